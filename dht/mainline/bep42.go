@@ -0,0 +1,135 @@
+package mainline
+
+import (
+	"hash/crc32"
+	"net"
+	"sync"
+)
+
+const (
+	// externalIPVotes is the minimum number of nodes that must report the same address before we
+	// trust it as our own.
+	externalIPVotes = 10
+	// externalIPRound is the number of distinct voters after which the votes are counted again
+	// from scratch, so that a change of address is eventually noticed.
+	externalIPRound = 100
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// isBEP42Exempt reports whether ip is a local address, to which BEP 42 does not apply.
+func isBEP42Exempt(ip net.IP) bool {
+	return ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+}
+
+// bep42Prefix returns the CRC32-C of the masked ip, combined with the 3 random bits r, whose
+// first 21 bits must match the ones of the node ID.
+func bep42Prefix(ip net.IP, r byte) uint32 {
+	var masked []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		mask := [4]byte{0x03, 0x0f, 0x3f, 0xff}
+		masked = make([]byte, 4)
+		for i := range masked {
+			masked[i] = ip4[i] & mask[i]
+		}
+	} else {
+		mask := [8]byte{0x01, 0x03, 0x07, 0x0f, 0x1f, 0x3f, 0x7f, 0xff}
+		masked = make([]byte, 8)
+		for i := range masked {
+			masked[i] = ip.To16()[i] & mask[i]
+		}
+	}
+	masked[0] |= (r & 0x07) << 5
+
+	return crc32.Checksum(masked, castagnoli)
+}
+
+// bep42NodeID returns a random node ID derived from ip as specified by BEP 42, or a fully random
+// one if ip is exempt.
+func bep42NodeID(ip net.IP) []byte {
+	id := randomNodeID()
+	if isBEP42Exempt(ip) {
+		return id
+	}
+
+	// The last byte is random, and its 3 lowest bits are the ones combined with the address.
+	r := id[19]
+	crc := bep42Prefix(ip, r)
+	id[0] = byte(crc >> 24)
+	id[1] = byte(crc >> 16)
+	id[2] = byte(crc>>8)&0xf8 | id[2]&0x07
+
+	return id
+}
+
+// isBEP42Compliant reports whether id has been derived from ip as specified by BEP 42. The IDs of
+// the nodes with an exempt address are always compliant.
+func isBEP42Compliant(id []byte, ip net.IP) bool {
+	if isBEP42Exempt(ip) {
+		return true
+	}
+	if len(id) != 20 {
+		return false
+	}
+
+	crc := bep42Prefix(ip, id[19])
+	return id[0] == byte(crc>>24) &&
+		id[1] == byte(crc>>16) &&
+		id[2]&0xf8 == byte(crc>>8)&0xf8
+}
+
+// parseCompactIP decodes the `ip` key of a message, i.e. our address as seen by the sender.
+func parseCompactIP(b []byte) net.IP {
+	var cp CompactPeer
+	if err := cp.UnmarshalBinary(b); err != nil {
+		return nil
+	}
+	return cp.IP
+}
+
+// externalIP elects our external address among the ones reported by the other nodes in the `ip`
+// key of their responses. Each node votes at most once per round.
+type externalIP struct {
+	sync.Mutex
+	votes   map[string]uint
+	voters  map[string]struct{}
+	current net.IP
+}
+
+func newExternalIP() *externalIP {
+	return &externalIP{
+		votes:  map[string]uint{},
+		voters: map[string]struct{}{},
+	}
+}
+
+// vote records that voter reported our address as reported. It returns the elected address, and
+// whether it has just changed: an address is elected once it gets at least externalIPVotes votes
+// and the absolute majority of the round.
+func (e *externalIP) vote(voter net.IP, reported net.IP) (net.IP, bool) {
+	e.Lock()
+	defer e.Unlock()
+
+	if reported == nil || isBEP42Exempt(reported) {
+		return e.current, false
+	}
+	if _, ok := e.voters[voter.String()]; ok {
+		return e.current, false
+	}
+	e.voters[voter.String()] = struct{}{}
+	key := reported.String()
+	e.votes[key]++
+
+	changed := false
+	if e.votes[key] >= externalIPVotes && 2*e.votes[key] > uint(len(e.voters)) && !reported.Equal(e.current) {
+		e.current = reported
+		changed = true
+	}
+
+	if len(e.voters) >= externalIPRound {
+		e.votes = map[string]uint{}
+		e.voters = map[string]struct{}{}
+	}
+
+	return e.current, changed
+}
@@ -0,0 +1,140 @@
+package mainline
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+)
+
+func TestIsBEP42Compliant(t *testing.T) {
+	t.Parallel()
+
+	// The examples of BEP 42.
+	tests := []struct {
+		ip string
+		id string
+	}{
+		{"124.31.75.21", "5fbfbff10c5d6a4ec8a88e4c6ab4c28b95eee401"},
+		{"21.75.31.124", "5a3ce9c14e7a08645677bbd1cfe7d8f956d53256"},
+		{"65.23.51.170", "a5d43220bc8f112a3d426c84764f8c2a1150e616"},
+		{"84.124.73.14", "1b0321dd1bb1fe518101ceef99462b947a01ff41"},
+		{"43.213.53.83", "e56f6cbf5b7c4be0237986d5243b87aa6d51305a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			t.Parallel()
+
+			id, _ := hex.DecodeString(tt.id)
+			if !isBEP42Compliant(id, net.ParseIP(tt.ip)) {
+				t.Errorf("expected %s to be compliant with %s", tt.id, tt.ip)
+			}
+			id[1] ^= 0x01
+			if isBEP42Compliant(id, net.ParseIP(tt.ip)) {
+				t.Errorf("expected a tampered ID not to be compliant with %s", tt.ip)
+			}
+		})
+	}
+}
+
+func TestBEP42NodeID(t *testing.T) {
+	t.Parallel()
+
+	for _, ip := range []string{"124.31.75.21", "2001:db8::1", "43.213.53.83"} {
+		id := bep42NodeID(net.ParseIP(ip))
+		if len(id) != 20 || !isBEP42Compliant(id, net.ParseIP(ip)) {
+			t.Errorf("expected %x to be compliant with %s", id, ip)
+		}
+		if isBEP42Compliant(id, net.ParseIP("1.2.3.4")) {
+			t.Errorf("expected %x not to be compliant with another address", id)
+		}
+	}
+
+	if !isBEP42Compliant(randomNodeID(), net.ParseIP("192.168.1.1")) {
+		t.Error("expected the nodes with a local address to be exempt")
+	}
+	if len(bep42NodeID(net.ParseIP("127.0.0.1"))) != 20 {
+		t.Error("expected a random ID for a local address")
+	}
+}
+
+func TestExternalIP_vote(t *testing.T) {
+	t.Parallel()
+
+	e := newExternalIP()
+	reported := net.ParseIP("1.2.3.4")
+
+	for i := range externalIPVotes - 1 {
+		if _, changed := e.vote(net.IPv4(5, 5, 5, byte(i)), reported); changed {
+			t.Fatalf("expected no election after %d votes", i+1)
+		}
+	}
+	if _, changed := e.vote(net.IPv4(5, 5, 5, 0), reported); changed {
+		t.Fatal("expected a node to vote only once")
+	}
+	if _, changed := e.vote(net.IPv4(6, 6, 6, 6), net.ParseIP("10.0.0.1")); changed {
+		t.Fatal("expected local addresses not to be elected")
+	}
+
+	ip, changed := e.vote(net.IPv4(5, 5, 5, 100), reported)
+	if !changed || !ip.Equal(reported) {
+		t.Fatalf("expected %s to be elected, got %s (%v)", reported, ip, changed)
+	}
+	if ip, changed := e.vote(net.IPv4(5, 5, 5, 101), reported); changed || !ip.Equal(reported) {
+		t.Errorf("expected %s to stay elected, got %s (%v)", reported, ip, changed)
+	}
+}
+
+func Test_routingTable_rekey(t *testing.T) {
+	t.Parallel()
+
+	rt := newRoutingTable(make([]byte, 20), 1, nil)
+	nodes := withBucketIDs([]net.UDPAddr{
+		{IP: net.IPv4(1, 1, 1, 1), Port: 1111},
+		{IP: net.IPv4(2, 2, 2, 2), Port: 2222},
+	})
+	rt.addNodes(nodes)
+
+	// The first node becomes our own ID and is dropped, the second one moves to bucket 0.
+	rt.rekey(nodes[0].ID)
+
+	rt.RLock()
+	defer rt.RUnlock()
+	if _, ok := rt.nodes[[20]byte(nodes[0].ID)]; ok {
+		t.Error("expected the node with our new ID to be dropped")
+	}
+	if len(rt.buckets[0].nodes) != 1 || rt.buckets[0].nodes[0].addr.Port != 2222 {
+		t.Errorf("expected the other node in bucket 0, got %v", rt.buckets[0].nodes)
+	}
+}
+
+func Test_routingTable_evictNonCompliant(t *testing.T) {
+	t.Parallel()
+
+	rt := newRoutingTable(make([]byte, 20), 1, nil)
+
+	// Fill bucket 0 with good nodes whose IDs are not derived from their addresses.
+	for i := range bucketSize {
+		id := make([]byte, 20)
+		id[0] = 0x80
+		id[19] = byte(i)
+		rt.markSeen(id, net.UDPAddr{IP: net.IPv4(1, 1, 1, byte(i+1)), Port: 1234})
+	}
+
+	addr := net.UDPAddr{IP: net.IPv4(2, 2, 2, 2), Port: 1234}
+	id := bep42NodeID(addr.IP)
+	for id[0]&0x80 == 0 {
+		id = bep42NodeID(addr.IP)
+	}
+	rt.markSeen(id, addr)
+
+	rt.RLock()
+	defer rt.RUnlock()
+	node, ok := rt.nodes[[20]byte(id)]
+	if !ok || !node.compliant {
+		t.Fatal("expected the compliant node to replace a non-compliant one")
+	}
+	if got := len(rt.buckets[0].nodes); got != bucketSize {
+		t.Errorf("expected %d nodes in the bucket, got %d", bucketSize, got)
+	}
+}
@@ -70,6 +70,17 @@ func (bf *BloomFilter) Estimate() float64 {
 	return size
 }
 
+// Merge ORs the bits of other into bf. BEP 33 specifies that the union of the filters returned by
+// several nodes estimates the size of the whole swarm.
+func (bf *BloomFilter) Merge(other *BloomFilter) {
+	if other == nil || len(other.bytes) != len(bf.bytes) {
+		return
+	}
+	for i := range bf.bytes {
+		bf.bytes[i] |= other.bytes[i]
+	}
+}
+
 func (bf *BloomFilter) RawBytes() []byte {
 	return bf.bytes
 }
@@ -51,3 +51,30 @@ func TestBloomFilter_InsertIP(t *testing.T) {
 		t.Errorf("Estimate mismatch. Expected %f, got %f", expectedEstimate, actualEstimate)
 	}
 }
+
+func TestBloomFilter_Merge(t *testing.T) {
+	t.Parallel()
+
+	seeds := NewBloomFilter()
+	peers := NewBloomFilter()
+	union := NewBloomFilter()
+	for i := 0; i < 100; i++ {
+		ip := net.IPv4(192, 0, 2, byte(i))
+		union.InsertIP(ip)
+		if i%2 == 0 {
+			seeds.InsertIP(ip)
+		} else {
+			peers.InsertIP(ip)
+		}
+	}
+
+	seeds.Merge(peers)
+	if hex.EncodeToString(seeds.RawBytes()) != hex.EncodeToString(union.RawBytes()) {
+		t.Error("Merge() should produce the union of the two filters")
+	}
+
+	seeds.Merge(nil)
+	if hex.EncodeToString(seeds.RawBytes()) != hex.EncodeToString(union.RawBytes()) {
+		t.Error("Merge(nil) should leave the filter untouched")
+	}
+}
@@ -0,0 +1,293 @@
+package mainline
+
+import (
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"tgragnato.it/magnetico/v2/stats"
+)
+
+const (
+	// dnsTTL is how long the addresses of a bootstrap host are cached. The resolver of the host does
+	// not expose the TTLs of the records, so they are all given the common TTL of the DNS load
+	// balancers of the well known bootstrap hosts.
+	dnsTTL = 30 * time.Minute
+	// minBootstrapBackoff and maxBootstrapBackoff bound the exponential backoff between the
+	// bootstrap rounds, between the lookups of a host that fails to resolve, and between the
+	// queries of a bootstrap node that does not answer.
+	minBootstrapBackoff = time.Second
+	maxBootstrapBackoff = 5 * time.Minute
+	// maxBootstrapPeers is the number of peers of the recently fetched torrents kept to bootstrap
+	// from: most clients run their DHT node on the port of their peer.
+	maxBootstrapPeers = 64
+)
+
+// The sources of the bootstrap nodes, which label the metrics.
+const (
+	bootstrapDNS   = "dns"
+	bootstrapSaved = "saved"
+	bootstrapPeers = "peers"
+)
+
+// bootstrapBackoff returns the delay after the given number of consecutive failures: none before
+// the first one, then doubling from minBootstrapBackoff up to maxBootstrapBackoff.
+func bootstrapBackoff(failures uint) time.Duration {
+	if failures == 0 {
+		return 0
+	}
+	backoff := minBootstrapBackoff
+	for range failures - 1 {
+		if backoff *= 2; backoff >= maxBootstrapBackoff {
+			return maxBootstrapBackoff
+		}
+	}
+	return backoff
+}
+
+// dnsEntry caches the addresses of a bootstrap host.
+type dnsEntry struct {
+	ips     []net.IP
+	expires time.Time
+	// failures counts the consecutive lookups that failed, which are retried with a backoff. The
+	// expired addresses are used in the meantime.
+	failures uint
+	retryAt  time.Time
+}
+
+// bootstrapNode is a node that the service bootstraps from, with the record of its answers.
+type bootstrapNode struct {
+	addr     net.UDPAddr
+	source   string
+	queried  uint
+	answered uint
+	// unanswered counts the consecutive queries that were not answered, which back off the next
+	// ones.
+	unanswered uint
+	retryAt    time.Time
+}
+
+// bootstrapper finds the nodes to bootstrap from when the routing tables are empty: the addresses
+// of the bootstrap hosts, the nodes saved in the state file and the peers of the torrents whose
+// metadata was fetched. The rounds of queries back off exponentially until the tables fill up.
+type bootstrapper struct {
+	sync.Mutex
+	indexer  string
+	hosts    []string
+	lookupIP func(host string) ([]net.IP, error)
+	// reaches reports whether the service has a routing table for the family of an address.
+	reaches func(ip net.IP) bool
+
+	dns   map[string]*dnsEntry
+	nodes map[string]*bootstrapNode
+	// saved and peers are the other sources of nodes, in the order they were added.
+	saved []net.UDPAddr
+	peers []net.UDPAddr
+
+	// rounds counts the consecutive rounds that did not fill the routing tables.
+	rounds uint
+	next   time.Time
+}
+
+func newBootstrapper(indexer string, hosts []string, lookupIP func(string) ([]net.IP, error), reaches func(net.IP) bool) *bootstrapper {
+	return &bootstrapper{
+		indexer:  indexer,
+		hosts:    hosts,
+		lookupIP: lookupIP,
+		reaches:  reaches,
+		dns:      make(map[string]*dnsEntry),
+		nodes:    make(map[string]*bootstrapNode),
+	}
+}
+
+// addSaved adds the nodes of the state file to the sources.
+func (b *bootstrapper) addSaved(addrs []net.UDPAddr) {
+	b.Lock()
+	defer b.Unlock()
+
+	for _, addr := range addrs {
+		if !slices.ContainsFunc(b.saved, func(saved net.UDPAddr) bool { return saved.String() == addr.String() }) {
+			b.saved = append(b.saved, addr)
+		}
+	}
+}
+
+// addPeers adds the peers of a torrent whose metadata was fetched to the sources, forgetting the
+// oldest ones beyond maxBootstrapPeers.
+func (b *bootstrapper) addPeers(addrs []net.UDPAddr) {
+	b.Lock()
+	defer b.Unlock()
+
+	for _, addr := range addrs {
+		if slices.ContainsFunc(b.peers, func(peer net.UDPAddr) bool { return peer.String() == addr.String() }) {
+			continue
+		}
+		b.peers = append(b.peers, addr)
+		if len(b.peers) > maxBootstrapPeers {
+			b.peers = slices.Delete(b.peers, 0, len(b.peers)-maxBootstrapPeers)
+		}
+	}
+}
+
+// round returns the nodes to query, if a bootstrap round is due, and schedules the next one.
+func (b *bootstrapper) round(now time.Time) []net.UDPAddr {
+	b.Lock()
+	if now.Before(b.next) {
+		b.Unlock()
+		return nil
+	}
+	b.rounds++
+	b.next = now.Add(bootstrapBackoff(b.rounds))
+	b.Unlock()
+
+	// The hosts are resolved without holding the lock, so that the answers are recorded meanwhile.
+	resolved := b.resolve(now)
+
+	b.Lock()
+	defer b.Unlock()
+
+	candidates := []*bootstrapNode{}
+	for _, source := range []struct {
+		name  string
+		addrs []net.UDPAddr
+	}{
+		{bootstrapDNS, resolved},
+		{bootstrapSaved, b.saved},
+		{bootstrapPeers, b.peers},
+	} {
+		for _, addr := range source.addrs {
+			if !b.reaches(addr.IP) {
+				continue
+			}
+			node, ok := b.nodes[addr.String()]
+			if !ok {
+				node = &bootstrapNode{addr: addr, source: source.name}
+				b.nodes[addr.String()] = node
+			}
+			if !slices.Contains(candidates, node) {
+				candidates = append(candidates, node)
+			}
+		}
+	}
+
+	addrs := []net.UDPAddr{}
+	for _, node := range candidates {
+		if now.Before(node.retryAt) {
+			continue
+		}
+		// Until it answers, the node backs off faster than the rounds, which skip it more and more.
+		node.queried++
+		node.unanswered++
+		node.retryAt = now.Add(bootstrapBackoff(node.unanswered + 1))
+		addrs = append(addrs, node.addr)
+		go stats.GetInstance().IncBootstrapQuery(b.indexer, node.source)
+	}
+	b.report()
+
+	return addrs
+}
+
+// resolve returns the addresses of the bootstrap hosts, looking up the ones whose cached addresses
+// have expired.
+func (b *bootstrapper) resolve(now time.Time) []net.UDPAddr {
+	addrs := []net.UDPAddr{}
+	for _, hostPort := range b.hosts {
+		host, portStr, err := net.SplitHostPort(hostPort)
+		if err != nil {
+			continue
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil || port == 0 {
+			continue
+		}
+
+		for _, ip := range b.lookup(host, now) {
+			addrs = append(addrs, net.UDPAddr{IP: ip, Port: port})
+		}
+	}
+	return addrs
+}
+
+// lookup returns the addresses of host, from the cache while they are fresh.
+func (b *bootstrapper) lookup(host string, now time.Time) []net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}
+	}
+
+	b.Lock()
+	entry, ok := b.dns[host]
+	if !ok {
+		entry = &dnsEntry{}
+		b.dns[host] = entry
+	}
+	fresh := now.Before(entry.expires) || now.Before(entry.retryAt)
+	cached := entry.ips
+	b.Unlock()
+	if fresh {
+		return cached
+	}
+
+	ips, err := b.lookupIP(host)
+
+	b.Lock()
+	defer b.Unlock()
+	if err != nil || len(ips) == 0 {
+		entry.failures++
+		entry.retryAt = now.Add(bootstrapBackoff(entry.failures))
+		return entry.ips
+	}
+	entry.ips = ips
+	entry.expires = now.Add(dnsTTL)
+	entry.failures = 0
+	return ips
+}
+
+// answered records the answer of a bootstrap node, which is queried again at once in the next
+// rounds.
+func (b *bootstrapper) answered(addr net.UDPAddr) {
+	b.Lock()
+	defer b.Unlock()
+
+	node, ok := b.nodes[addr.String()]
+	if !ok {
+		return
+	}
+	node.answered++
+	node.unanswered = 0
+	node.retryAt = time.Time{}
+	b.report()
+}
+
+// reset ends the backoff of the rounds, once the routing tables have filled up.
+func (b *bootstrapper) reset() {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.rounds == 0 {
+		return
+	}
+	b.rounds = 0
+	b.next = time.Time{}
+	b.report()
+}
+
+// report updates the metrics of the bootstrap nodes and of the backoff. The lock must be held.
+func (b *bootstrapper) report() {
+	var answered, silent int
+	for _, node := range b.nodes {
+		if node.answered > 0 {
+			answered++
+		} else {
+			silent++
+		}
+	}
+	backoff := bootstrapBackoff(b.rounds)
+
+	go func() {
+		stats.GetInstance().SetBootstrapNodes(b.indexer, "answered", answered)
+		stats.GetInstance().SetBootstrapNodes(b.indexer, "silent", silent)
+		stats.GetInstance().SetBootstrapBackoff(b.indexer, backoff.Seconds())
+	}()
+}
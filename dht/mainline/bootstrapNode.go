@@ -0,0 +1,60 @@
+package mainline
+
+import (
+	"net"
+	"time"
+)
+
+// refreshInterval is how long a bootstrap node waits before querying a node that it has not heard
+// from, a third of the time after which BEP 5 considers a node questionable.
+const refreshInterval = staleNodeAge / 3
+
+// NewBootstrapService returns an IndexingService that serves as a bootstrap node, typically for
+// the crawlers of a private network confined to filterNodes. It answers the ping, find_node,
+// get_peers and announce_peer queries like a regular DHT node, with the closest nodes of its
+// routing table, and keeps the table fresh with find_node queries: it neither samples the other
+// nodes nor produces any result. The table is saved to statePath, as in NewIndexingService.
+func NewBootstrapService(laddr string, maxNeighbors uint, bootstrapNodes []string, filterNodes []net.IPNet, statePath string, network Network) *IndexingService {
+	service := NewIndexingService(laddr, maxNeighbors, IndexingServiceEventHandlers{
+		OnResult:       func(IndexingResult) {},
+		OnScrapeResult: func(ScrapeResult) {},
+	}, bootstrapNodes, filterNodes, statePath, true, network)
+	service.bootstrapOnly = true
+	return service
+}
+
+// refresh sends a find_node query to the nodes of the routing tables that have been silent for
+// refreshInterval: the bad ones are evicted, while the answers bring in the neighbours of the
+// others.
+func (is *IndexingService) refresh() {
+	now := time.Now()
+	for _, rt := range is.tables() {
+		for _, addr := range rt.refreshNodes(now) {
+			is.sendQuery(NewFindNodeQuery(is.id(), randomNodeID()), queryFindNode, addr, [20]byte{})
+		}
+	}
+}
+
+// refreshNodes returns the nodes that have been neither heard from nor queried for
+// refreshInterval. It evicts all the bad nodes first, unlike getNodes() that evicts one per bucket,
+// and accounts every returned node as having a query pending.
+func (rt *routingTable) refreshNodes(now time.Time) []net.UDPAddr {
+	rt.Lock()
+	defer rt.Unlock()
+
+	for i := range rt.buckets {
+		for rt.evictOne(&rt.buckets[i], now) {
+		}
+	}
+
+	nodes := []net.UDPAddr{}
+	for _, node := range rt.nodes {
+		if now.Sub(node.lastSeen) < refreshInterval || now.Sub(node.lastQueried) < refreshInterval {
+			continue
+		}
+		node.lastQueried = now
+		node.failedQueries++
+		nodes = append(nodes, node.addr)
+	}
+	return nodes
+}
@@ -0,0 +1,55 @@
+package mainline
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewBootstrapService(t *testing.T) {
+	t.Parallel()
+
+	_, cidr, _ := net.ParseCIDR("10.0.0.0/8")
+	is := NewBootstrapService("127.0.0.1:0", 10, nil, []net.IPNet{*cidr}, "", Internet)
+	if !is.bootstrapOnly || !is.goodCitizen {
+		t.Error("expected a bootstrap service answering with the closest nodes")
+	}
+
+	// The announces are stored, without being handed to anyone.
+	is.eventHandlers.OnResult(IndexingResult{})
+	is.eventHandlers.OnScrapeResult(ScrapeResult{})
+}
+
+func TestRoutingTable_refreshNodes(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	rt := newRoutingTable(make([]byte, 20), 10, []net.IPNet{{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)}})
+	fresh := net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	silent := net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6881}
+	unseen := net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 6881}
+	// The three nodes share a bucket, from which both stale nodes are evicted in the same refresh.
+	rt.markSeen([]byte{0x80, 19: 1}, fresh)
+	rt.markSeen([]byte{0x80, 19: 2}, silent)
+	rt.addNodes([]CompactNodeInfo{{ID: []byte{0x80, 19: 3}, Addr: unseen}})
+	rt.nodes[rt.addrs[silent.String()]].lastSeen = now.Add(-refreshInterval)
+
+	nodes := rt.refreshNodes(now)
+	if len(nodes) != 2 {
+		t.Fatalf("expected the silent and the unseen nodes, got %v", nodes)
+	}
+	for _, addr := range nodes {
+		if addr.String() == fresh.String() {
+			t.Errorf("expected the node heard from recently not to be queried, got %v", nodes)
+		}
+	}
+
+	// The nodes are queried once per interval, until they answer or turn bad and are evicted.
+	if nodes := rt.refreshNodes(now.Add(time.Second)); len(nodes) != 0 {
+		t.Errorf("expected the queried nodes to wait, got %v", nodes)
+	}
+	rt.refreshNodes(now.Add(refreshInterval))
+	if nodes := rt.refreshNodes(now.Add(2 * refreshInterval)); len(nodes) != 1 || nodes[0].String() != fresh.String() {
+		t.Errorf("expected only the fresh node to be left, got %v", nodes)
+	}
+}
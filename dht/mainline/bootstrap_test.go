@@ -0,0 +1,152 @@
+package mainline
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBootstrapBackoff(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		failures uint
+		want     time.Duration
+	}{
+		{0, 0},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{9, 256 * time.Second},
+		{10, maxBootstrapBackoff},
+		{1000, maxBootstrapBackoff},
+	}
+	for _, tt := range tests {
+		if got := bootstrapBackoff(tt.failures); got != tt.want {
+			t.Errorf("bootstrapBackoff(%d) = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+// fakeResolver resolves router.example to 1.1.1.1 and 2.2.2.2, or fails when it is down.
+type fakeResolver struct {
+	lookups int
+	down    bool
+}
+
+func (r *fakeResolver) LookupIP(host string) ([]net.IP, error) {
+	r.lookups++
+	if r.down || host != "router.example" {
+		return nil, errors.New("no such host")
+	}
+	return []net.IP{net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 2)}, nil
+}
+
+func ipv4Only(ip net.IP) bool {
+	return ip.To4() != nil
+}
+
+func TestBootstrapper_round(t *testing.T) {
+	t.Parallel()
+
+	resolver := &fakeResolver{}
+	hosts := []string{"router.example:6881", "3.3.3.3:6881", "[::1]:6881", "unknown.example:6881", "invalid", "router.example:0"}
+	b := newBootstrapper("", hosts, resolver.LookupIP, ipv4Only)
+	now := time.Now()
+
+	addrs := b.round(now)
+	if len(addrs) != 3 {
+		t.Fatalf("expected the 3 IPv4 addresses of the hosts, got %v", addrs)
+	}
+	if resolver.lookups != 2 {
+		t.Errorf("expected the 2 host names to be looked up, got %d lookups", resolver.lookups)
+	}
+
+	// The next round waits for the backoff.
+	if addrs := b.round(now.Add(500 * time.Millisecond)); addrs != nil {
+		t.Errorf("expected the next round to wait, got %v", addrs)
+	}
+
+	// The node that answered is queried again at once, while the others back off.
+	b.answered(net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 6881})
+	addrs = b.round(now.Add(1500 * time.Millisecond))
+	if len(addrs) != 1 || addrs[0].String() != "1.1.1.1:6881" {
+		t.Errorf("expected only the node that answered, got %v", addrs)
+	}
+	if b.nodes["2.2.2.2:6881"].queried != 1 || b.nodes["1.1.1.1:6881"].answered != 1 {
+		t.Error("expected the queries and the answers of the nodes to be recorded")
+	}
+	// The addresses come from the cache until they expire, while the unknown host backs off.
+	if resolver.lookups != 3 {
+		t.Errorf("expected only the unknown host to be looked up again, got %d lookups", resolver.lookups)
+	}
+
+	// The rounds back off exponentially, until the routing table fills up.
+	if addrs := b.round(now.Add(2 * time.Second)); addrs != nil {
+		t.Errorf("expected the third round to wait 2s, got %v", addrs)
+	}
+	b.reset()
+	if addrs := b.round(now.Add(2 * time.Second)); addrs == nil {
+		t.Error("expected a round right after a reset")
+	}
+}
+
+func TestBootstrapper_lookup(t *testing.T) {
+	t.Parallel()
+
+	resolver := &fakeResolver{}
+	b := newBootstrapper("", nil, resolver.LookupIP, ipv4Only)
+	now := time.Now()
+
+	if ips := b.lookup("router.example", now); len(ips) != 2 {
+		t.Fatalf("expected 2 addresses, got %v", ips)
+	}
+	if ips := b.lookup("router.example", now.Add(dnsTTL-time.Second)); len(ips) != 2 || resolver.lookups != 1 {
+		t.Errorf("expected the cached addresses, got %v after %d lookups", ips, resolver.lookups)
+	}
+
+	// Once they expire, the stale addresses are used while the resolver fails.
+	resolver.down = true
+	expired := now.Add(dnsTTL)
+	if ips := b.lookup("router.example", expired); len(ips) != 2 || resolver.lookups != 2 {
+		t.Errorf("expected the stale addresses, got %v after %d lookups", ips, resolver.lookups)
+	}
+	if b.lookup("router.example", expired.Add(500*time.Millisecond)); resolver.lookups != 2 {
+		t.Errorf("expected the failed lookup to back off, got %d lookups", resolver.lookups)
+	}
+	if b.lookup("router.example", expired.Add(time.Second)); resolver.lookups != 3 {
+		t.Errorf("expected the lookup to be retried after the backoff, got %d lookups", resolver.lookups)
+	}
+
+	if ips := b.lookup("4.4.4.4", now); len(ips) != 1 || resolver.lookups != 3 {
+		t.Errorf("expected the IP addresses not to be looked up, got %v", ips)
+	}
+}
+
+func TestBootstrapper_sources(t *testing.T) {
+	t.Parallel()
+
+	b := newBootstrapper("", nil, (&fakeResolver{}).LookupIP, ipv4Only)
+	saved := net.UDPAddr{IP: net.IPv4(5, 5, 5, 5), Port: 5555}
+	b.addSaved([]net.UDPAddr{saved, saved})
+	for i := range maxBootstrapPeers + 1 {
+		b.addPeers([]net.UDPAddr{{IP: net.IPv4(6, 6, 6, byte(i)), Port: 6666}})
+	}
+	b.addPeers([]net.UDPAddr{{IP: net.ParseIP("2001:db8::1"), Port: 6666}})
+
+	if len(b.saved) != 1 {
+		t.Errorf("expected the saved node once, got %v", b.saved)
+	}
+	if len(b.peers) != maxBootstrapPeers || b.peers[0].IP.Equal(net.IPv4(6, 6, 6, 0)) {
+		t.Errorf("expected the oldest peers to be forgotten, got %d peers", len(b.peers))
+	}
+
+	sources := map[string]int{}
+	for _, addr := range b.round(time.Now()) {
+		sources[b.nodes[addr.String()].source]++
+	}
+	if sources[bootstrapSaved] != 1 || sources[bootstrapPeers] != maxBootstrapPeers-1 {
+		t.Errorf("expected the reachable nodes of every source, got %v", sources)
+	}
+}
@@ -0,0 +1,62 @@
+package mainline
+
+import "net"
+
+// seenNodesSize is the size of each of the two generations of the node IDs met recently, which are
+// counted once towards the client populations.
+const seenNodesSize = 1 << 16
+
+// clientNames maps the two characters that open the `v` key of a message to the client
+// implementation that sent it.
+var clientNames = map[string]string{
+	"AZ": "Vuze",
+	"BT": "BitTorrent",
+	"GR": "GetRight",
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"lt": "rTorrent",
+	"ML": "MLDonkey",
+	"MP": "MooPolice",
+	"TR": "Transmission",
+	"UM": "uTorrent Mac",
+	"UT": "uTorrent",
+}
+
+// clientName returns the client implementation identified by the `v` key of a message. Unknown
+// implementations are reported by their code, as long as it is made of letters.
+func clientName(v []byte) string {
+	if len(v) < 2 {
+		return "unknown"
+	}
+	code := string(v[:2])
+	if name, ok := clientNames[code]; ok {
+		return name
+	}
+	for _, c := range v[:2] {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') {
+			return "unknown"
+		}
+	}
+	return code
+}
+
+// setClient stores the `v` key sent by the node id, and the address that it reported for us.
+func (rt *routingTable) setClient(id []byte, version []byte, reported net.IP) {
+	if len(id) != 20 {
+		return
+	}
+
+	rt.Lock()
+	defer rt.Unlock()
+
+	node, ok := rt.nodes[[20]byte(id)]
+	if !ok {
+		return
+	}
+	if len(version) > 0 {
+		node.version = string(version)
+	}
+	if reported != nil {
+		node.reportedIP = reported
+	}
+}
@@ -0,0 +1,58 @@
+package mainline
+
+import (
+	"net"
+	"testing"
+
+	"tgragnato.it/magnetico/v2/stats"
+)
+
+func TestClientName(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		v    []byte
+		want string
+	}{
+		{nil, "unknown"},
+		{[]byte("L"), "unknown"},
+		{[]byte("LT\x01\x02"), "libtorrent"},
+		{[]byte("UT\x00\x01"), "uTorrent"},
+		{[]byte("XY\x00\x01"), "XY"},
+		{[]byte("\x00\x01\x02\x03"), "unknown"},
+	}
+
+	for _, tt := range tests {
+		if got := clientName(tt.v); got != tt.want {
+			t.Errorf("clientName(%q) = %q, want %q", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestRecordClient(t *testing.T) {
+	t.Parallel()
+
+	is := &IndexingService{
+		nodes4:    newRoutingTable(randomNodeID(), 10, nil),
+		seenNodes: newSeenHashes(seenNodesSize),
+	}
+	node := withBucketIDs([]net.UDPAddr{{IP: net.IPv4(1, 1, 1, 1), Port: 1111}})[0]
+	is.nodes4.markSeen(node.ID, node.Addr)
+
+	reported, _ := CompactPeers{{IP: net.ParseIP("2.2.2.2"), Port: 6881}}.MarshalBinary()
+	msg := &Message{V: []byte("Qz\x00\x01"), IP: reported}
+	before := stats.GetInstance().DHTSummary().Clients["Qz"]
+	is.recordClient(is.nodes4, node.ID, msg)
+	is.recordClient(is.nodes4, node.ID, msg)
+
+	if got := stats.GetInstance().DHTSummary().Clients["Qz"] - before; got != 1 {
+		t.Errorf("expected the node to be counted once, got %d", got)
+	}
+
+	is.nodes4.RLock()
+	defer is.nodes4.RUnlock()
+	n := is.nodes4.nodes[[20]byte(node.ID)]
+	if n.version != "Qz\x00\x01" || !n.reportedIP.Equal(net.ParseIP("2.2.2.2")) {
+		t.Errorf("unexpected client %q and reported address %s", n.version, n.reportedIP)
+	}
+}
@@ -28,6 +28,11 @@ type Message struct {
 	R ResponseValues `bencode:"r,omitempty"`
 	// ERROR type only
 	E Error `bencode:"e,omitempty"`
+	// Address of the recipient as seen by the sender, in compact form. Added by BEP 42.
+	IP []byte `bencode:"ip,omitempty"`
+	// Client version of the sender: two characters identifying the implementation, followed by
+	// two bytes of version number.
+	V []byte `bencode:"v,omitempty"`
 }
 
 type QueryArguments struct {
@@ -43,6 +48,9 @@ type QueryArguments struct {
 	Port int `bencode:"port,omitempty"`
 	// Use senders apparent DHT port
 	ImpliedPort int `bencode:"implied_port,omitempty"`
+	// Address families of the nodes sought: "n4" for IPv4 and "n6" for IPv6. Without it, the
+	// nodes of the family of the query are returned. Added by BEP 32.
+	Want []string `bencode:"want,omitempty"`
 
 	// Indicates whether the querying node is seeding the torrent it announces.
 	// Defined in BEP 33 "DHT Scrapes" for `announce_peer` queries.
@@ -50,6 +50,20 @@ var codecTest_validInstances = []struct {
 			},
 		},
 	},
+	// find_node Query asking for both address families (BEP 32):
+	{
+		data: []byte("d1:ad2:id20:abcdefghij01234567896:target20:mnopqrstuvwxyz1234564:wantl2:n42:n6ee1:q9:find_node1:t2:aa1:y1:qe"),
+		msg: Message{
+			T: []byte("aa"),
+			Y: "q",
+			Q: "find_node",
+			A: QueryArguments{
+				ID:     []byte("abcdefghij0123456789"),
+				Target: []byte("mnopqrstuvwxyz123456"),
+				Want:   []string{"n4", "n6"},
+			},
+		},
+	},
 	// find_node Response with no nodes (`nodes` key still exists):
 	{
 		data: []byte("d1:rd2:id20:0123456789abcdefghij5:nodes0:e1:t2:aa1:y1:re"),
@@ -198,6 +212,19 @@ var codecTest_validInstances = []struct {
 			E: Error{Code: 201, Message: []byte("A Generic Error Ocurred")},
 		},
 	},
+	// ping Response with the `ip` (BEP 42) and `v` keys:
+	{
+		data: []byte("d2:ip6:\x01\x02\x03\x04\x1a\xe11:rd2:id20:mnopqrstuvwxyz123456e1:t2:aa1:v4:LT\x01\x021:y1:re"),
+		msg: Message{
+			T:  []byte("aa"),
+			Y:  "r",
+			IP: []byte("\x01\x02\x03\x04\x1a\xe1"),
+			V:  []byte("LT\x01\x02"),
+			R: ResponseValues{
+				ID: []byte("mnopqrstuvwxyz123456"),
+			},
+		},
+	},
 	// TODO: Test Error where E.Message is an empty string, and E.Message contains invalid Unicode characters.
 	// TODO: Add announce_peer Query with optional `implied_port` argument.
 }
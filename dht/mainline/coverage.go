@@ -0,0 +1,166 @@
+package mainline
+
+import (
+	"encoding/binary"
+	"math/bits"
+	mrand "math/rand/v2"
+	"sync"
+	"time"
+)
+
+const (
+	// coveragePrefixBits is the length of the ID prefixes in which the keyspace is divided: fine
+	// enough for the samples of a window to cover a fraction of the regions, rather than all of
+	// them.
+	coveragePrefixBits = 16
+	coverageRegions    = 1 << coveragePrefixBits
+	// yieldPrefixBits is the length of the wider ID prefixes whose new info hashes are accounted.
+	yieldPrefixBits = 8
+	// coverageWindow is the time after which a sampled region is considered uncovered again.
+	coverageWindow = time.Hour
+	// targetChoices is the number of uncovered regions drawn for each target, of which the one in
+	// the most productive wider region is chosen.
+	targetChoices = 4
+	// maxDirectedSamples is the maximum number of nodes of uncovered regions that are sampled
+	// straight away from the nodes returned by a single response.
+	maxDirectedSamples = 4
+)
+
+// regionBitmap has a bit set for each region that has been sampled.
+type regionBitmap [coverageRegions / 64]uint64
+
+func (b *regionBitmap) set(region int) {
+	b[region/64] |= 1 << (region % 64)
+}
+
+// coverage is a map of the regions of the keyspace, identified by the first coveragePrefixBits of
+// the node IDs, that records which ones have been sampled recently, and how many new info hashes
+// the nodes of the wider regions produced. The regions sampled are kept in two bitmaps, for the
+// current half of coverageWindow and the one before, so that a region is covered from half a
+// window to a whole window after it was last sampled.
+type coverage struct {
+	sync.Mutex
+	current  regionBitmap
+	previous regionBitmap
+	// since is when the current half of the window started.
+	since  time.Time
+	yields [1 << yieldPrefixBits]uint
+}
+
+func regionOf(id []byte) int {
+	return int(binary.BigEndian.Uint16(id)) >> (16 - coveragePrefixBits)
+}
+
+// rotate starts a new half of the window once the current one is over, forgetting the regions
+// sampled in the one before.
+func (c *coverage) rotate(now time.Time) {
+	elapsed := now.Sub(c.since)
+	if elapsed < coverageWindow/2 {
+		return
+	}
+	if elapsed < coverageWindow {
+		c.previous = c.current
+	} else {
+		c.previous = regionBitmap{}
+	}
+	c.current = regionBitmap{}
+	c.since = now
+}
+
+// covered returns the bitmap word of the regions sampled in the current window.
+func (c *coverage) covered(word int) uint64 {
+	return c.current[word] | c.previous[word]
+}
+
+// uncoveredFrom returns the first uncovered region from start on, wrapping around, and false if
+// every region is covered.
+func (c *coverage) uncoveredFrom(start int) (int, bool) {
+	for i := range len(c.current) + 1 {
+		word := (start/64 + i) % len(c.current)
+		uncovered := ^c.covered(word)
+		if i == 0 {
+			uncovered &= ^uint64(0) << (start % 64)
+		}
+		if uncovered != 0 {
+			return word*64 + bits.TrailingZeros64(uncovered), true
+		}
+	}
+	return 0, false
+}
+
+// record accounts a sample_infohashes response of the node id, which returned newHashes new info
+// hashes.
+func (c *coverage) record(id []byte, newHashes uint, now time.Time) {
+	if len(id) != 20 {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.rotate(now)
+	c.current.set(regionOf(id))
+	c.yields[id[0]>>(8-yieldPrefixBits)] += newHashes
+}
+
+// isUncovered reports whether the region of id has not been sampled within coverageWindow.
+func (c *coverage) isUncovered(id []byte, now time.Time) bool {
+	if len(id) != 20 {
+		return false
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.rotate(now)
+	region := regionOf(id)
+	return c.covered(region/64)&(1<<(region%64)) == 0
+}
+
+// targets returns n random targets in the uncovered regions, preferring the ones whose wider
+// region has been the most productive, or anywhere in the keyspace once every region is covered.
+func (c *coverage) targets(n int, now time.Time) [][]byte {
+	c.Lock()
+	defer c.Unlock()
+
+	c.rotate(now)
+	targets := make([][]byte, 0, n)
+	for range n {
+		best, found := mrand.IntN(coverageRegions), false
+		for range targetChoices {
+			region, ok := c.uncoveredFrom(mrand.IntN(coverageRegions))
+			if !ok {
+				break
+			}
+			if !found || c.yieldOf(region) > c.yieldOf(best) {
+				best, found = region, true
+			}
+		}
+
+		target := randomNodeID()
+		suffix := binary.BigEndian.Uint16(target) & (0xFFFF >> coveragePrefixBits)
+		binary.BigEndian.PutUint16(target, uint16(best<<(16-coveragePrefixBits))|suffix)
+		targets = append(targets, target)
+	}
+
+	return targets
+}
+
+// yieldOf returns the new info hashes produced by the wider region of region.
+func (c *coverage) yieldOf(region int) uint {
+	return c.yields[region>>(coveragePrefixBits-yieldPrefixBits)]
+}
+
+// ratio returns the fraction of the regions that have been sampled within coverageWindow.
+func (c *coverage) ratio(now time.Time) float64 {
+	c.Lock()
+	defer c.Unlock()
+
+	c.rotate(now)
+	covered := 0
+	for word := range c.current {
+		covered += bits.OnesCount64(c.covered(word))
+	}
+
+	return float64(covered) / coverageRegions
+}
@@ -0,0 +1,150 @@
+package mainline
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCoverage_record(t *testing.T) {
+	t.Parallel()
+
+	c := new(coverage)
+	now := time.Now()
+
+	if !c.isUncovered([]byte{0x42, 0x01, 19: 0x01}, now) {
+		t.Error("expected a region never sampled to be uncovered")
+	}
+	if c.isUncovered([]byte{0x42}, now) {
+		t.Error("expected an invalid ID not to be uncovered")
+	}
+
+	c.record([]byte{0x42, 0x01, 19: 0x01}, 5, now)
+	c.record([]byte{0x42, 0x02, 19: 0x02}, 3, now)
+	c.record([]byte{0x42}, 3, now)
+
+	if c.isUncovered([]byte{0x42, 0x01, 19: 0x03}, now) {
+		t.Error("expected a region just sampled to be covered")
+	}
+	if !c.isUncovered([]byte{0x42, 0x03, 19: 0x01}, now) {
+		t.Error("expected the neighbouring region not sampled to be uncovered")
+	}
+	if c.isUncovered([]byte{0x42, 0x01, 19: 0x03}, now.Add(coverageWindow/2)) {
+		t.Error("expected a region sampled in the previous half of the window to be covered")
+	}
+	if !c.isUncovered([]byte{0x42, 0x01, 19: 0x03}, now.Add(2*coverageWindow)) {
+		t.Error("expected a region sampled long ago to be uncovered")
+	}
+	if c.yields[0x42>>(8-yieldPrefixBits)] != 8 {
+		t.Errorf("expected 8 new hashes in the wider region, got %d", c.yields[0x42>>(8-yieldPrefixBits)])
+	}
+}
+
+func TestCoverage_ratio(t *testing.T) {
+	t.Parallel()
+
+	c := new(coverage)
+	now := time.Now()
+	if got := c.ratio(now); got != 0 {
+		t.Errorf("ratio() = %f, want 0", got)
+	}
+
+	for i := range coverageRegions / 4 {
+		c.record([]byte{byte(i >> 8), byte(i), 19: 0x01}, 0, now)
+	}
+	if got := c.ratio(now); got != 0.25 {
+		t.Errorf("ratio() = %f, want 0.25", got)
+	}
+	if got := c.ratio(now.Add(3 * coverageWindow / 4)); got != 0.25 {
+		t.Errorf("ratio() = %f, want 0.25 within the window", got)
+	}
+	if got := c.ratio(now.Add(2 * coverageWindow)); got != 0 {
+		t.Errorf("ratio() = %f, want 0 once the window has passed", got)
+	}
+}
+
+func TestCoverage_targets(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		// uncovered are the regions left uncovered, and want the ones expected as targets.
+		uncovered []int
+		want      []int
+	}{
+		{
+			name:      "Uncovered regions",
+			uncovered: []int{0x1000, 0x9000},
+			want:      []int{0x1000, 0x9000},
+		},
+		{
+			name: "Every region covered",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := new(coverage)
+			now := time.Now()
+			for i := range coverageRegions {
+				c.current.set(i)
+			}
+			for _, region := range tt.uncovered {
+				c.current[region/64] &^= 1 << (region % 64)
+			}
+			c.since = now
+
+			targets := c.targets(100, now)
+			if len(targets) != 100 {
+				t.Fatalf("expected 100 targets, got %d", len(targets))
+			}
+			seen := map[int]bool{}
+			for _, target := range targets {
+				if len(target) != 20 {
+					t.Fatalf("invalid target %x", target)
+				}
+				seen[regionOf(target)] = true
+			}
+			if tt.want == nil {
+				if len(seen) < 2 {
+					t.Errorf("expected the targets to spread over the keyspace, got %v", seen)
+				}
+				return
+			}
+			for _, region := range tt.want {
+				if !seen[region] {
+					t.Errorf("expected a target in the uncovered region %x, got %v", region, seen)
+				}
+			}
+			if len(seen) != len(tt.want) {
+				t.Errorf("expected the targets in the uncovered regions only, got %v", seen)
+			}
+		})
+	}
+}
+
+func TestCoverage_targetsYield(t *testing.T) {
+	t.Parallel()
+
+	c := new(coverage)
+	now := time.Now()
+	for i := range coverageRegions {
+		c.current.set(i)
+	}
+	c.current[0x1000/64] &^= 1 << (0x1000 % 64)
+	c.current[0x9000/64] &^= 1 << (0x9000 % 64)
+	c.since = now
+	// The uncovered region of the productive wider region 0x90 is preferred to the other one.
+	c.yields[0x90>>(8-yieldPrefixBits)] = 10
+
+	productive := 0
+	for _, target := range c.targets(100, now) {
+		if regionOf(target) == 0x9000 {
+			productive++
+		}
+	}
+	if productive < 75 {
+		t.Errorf("expected most targets in the productive region, got %d out of 100", productive)
+	}
+}
@@ -0,0 +1,132 @@
+package mainline
+
+import (
+	"bytes"
+	"net"
+	"slices"
+)
+
+// wantBoth is the `want` key of the queries of a dual-stack service, which asks for the nodes of
+// both address families (BEP 32).
+var wantBoth = []string{"n4", "n6"}
+
+// families reports the address families reached by a socket bound to laddr. An unspecified IPv6
+// address, or no address at all, binds a dual-stack socket.
+func families(laddr string) (ipv4 bool, ipv6 bool) {
+	addr, err := net.ResolveUDPAddr("udp", laddr)
+	if err != nil || addr.IP == nil || addr.IP.Equal(net.IPv6unspecified) {
+		return true, true
+	}
+	if addr.IP.To4() != nil {
+		return true, false
+	}
+	return false, true
+}
+
+// table returns the routing table of the address family of ip, or nil if the service does not
+// reach that family.
+func (is *IndexingService) table(ip net.IP) *routingTable {
+	if ip.To4() != nil {
+		return is.nodes4
+	}
+	return is.nodes6
+}
+
+// tables returns the routing tables of the address families reached by the service.
+func (is *IndexingService) tables() []*routingTable {
+	tables := []*routingTable{}
+	for _, rt := range []*routingTable{is.nodes4, is.nodes6} {
+		if rt != nil {
+			tables = append(tables, rt)
+		}
+	}
+	return tables
+}
+
+func (is *IndexingService) dualStack() bool {
+	return is.nodes4 != nil && is.nodes6 != nil
+}
+
+// isAllowed reports whether the node belongs in one of our routing tables.
+func (is *IndexingService) isAllowed(addr net.UDPAddr) bool {
+	rt := is.table(addr.IP)
+	return rt != nil && rt.isAllowed(addr)
+}
+
+func (is *IndexingService) isEmpty() bool {
+	for _, rt := range is.tables() {
+		if !rt.isEmpty() {
+			return false
+		}
+	}
+	return true
+}
+
+// addNodes inserts the nodes of a response in the routing table of their address family. The
+// nodes of the families that the service does not reach are dropped.
+func (is *IndexingService) addNodes(nodes []CompactNodeInfo) {
+	nodes4, nodes6 := splitFamilies(nodes)
+	if len(nodes4) > 0 && is.nodes4 != nil {
+		is.nodes4.addNodes(nodes4)
+	}
+	if len(nodes6) > 0 && is.nodes6 != nil {
+		is.nodes6.addNodes(nodes6)
+	}
+}
+
+// recordTimeouts accounts the unanswered queries to the nodes of every routing table.
+func (is *IndexingService) recordTimeouts(addrs []net.UDPAddr) {
+	for _, rt := range is.tables() {
+		rt.recordTimeouts(addrs)
+	}
+}
+
+// closest returns up to n good nodes of any address family, sorted by their XOR distance from
+// target, closest first.
+func (is *IndexingService) closest(target [20]byte, n int) []CompactNodeInfo {
+	nodes := []CompactNodeInfo{}
+	for _, rt := range is.tables() {
+		nodes = append(nodes, rt.closest(target, n)...)
+	}
+	slices.SortFunc(nodes, func(a, b CompactNodeInfo) int {
+		da, db := distance([20]byte(a.ID), target), distance([20]byte(b.ID), target)
+		return bytes.Compare(da[:], db[:])
+	})
+	return nodes[:min(n, len(nodes))]
+}
+
+// responseNodes returns the nodes of a response to a find_node, get_peers or sample_infohashes
+// query, of the address families in its `want` key or of the family of the sender if there is
+// none. With closest, they are the nodes closest to target; otherwise they are random good nodes
+// under random IDs.
+func (is *IndexingService) responseNodes(msg *Message, addr *net.UDPAddr, target [20]byte, closest bool) []CompactNodeInfo {
+	want4, want6 := addr.IP.To4() != nil, addr.IP.To4() == nil
+	if len(msg.A.Want) > 0 {
+		want4, want6 = slices.Contains(msg.A.Want, "n4"), slices.Contains(msg.A.Want, "n6")
+	}
+
+	nodes := []CompactNodeInfo{}
+	for _, family := range []struct {
+		rt     *routingTable
+		ipv4   bool
+		wanted bool
+	}{
+		{is.nodes4, true, want4},
+		{is.nodes6, false, want6},
+	} {
+		if !family.wanted || family.rt == nil {
+			continue
+		}
+		if closest {
+			nodes = append(nodes, family.rt.closest(target, bucketSize)...)
+			continue
+		}
+		for _, node := range family.rt.dump(family.ipv4) {
+			nodes = append(nodes, CompactNodeInfo{
+				ID:   randomNodeID(),
+				Addr: node,
+			})
+		}
+	}
+	return nodes
+}
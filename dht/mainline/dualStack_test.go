@@ -0,0 +1,154 @@
+package mainline
+
+import (
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestFamilies(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		laddr string
+		ipv4  bool
+		ipv6  bool
+	}{
+		{"0.0.0.0:0", true, false},
+		{"1.2.3.4:6881", true, false},
+		{"[::]:0", true, true},
+		{":6881", true, true},
+		{"[2001:db8::1]:6881", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.laddr, func(t *testing.T) {
+			t.Parallel()
+
+			if ipv4, ipv6 := families(tt.laddr); ipv4 != tt.ipv4 || ipv6 != tt.ipv6 {
+				t.Errorf("families(%q) = %v, %v, want %v, %v", tt.laddr, ipv4, ipv6, tt.ipv4, tt.ipv6)
+			}
+		})
+	}
+}
+
+// dualStackService returns a service with a node of each address family in its routing tables.
+func dualStackService() (*IndexingService, []CompactNodeInfo) {
+	is := &IndexingService{
+		nodes4:       newRoutingTable(make([]byte, 20), 10, nil),
+		nodes6:       newRoutingTable(make([]byte, 20), 10, nil),
+		transactions: newTransactionManager(transactionTimeout),
+		protocol: &Protocol{
+			transport: &Transport{
+				started:      true,
+				maxNeighbors: 10,
+			},
+		},
+		nodeID: randomNodeID(),
+	}
+	nodes := withBucketIDs([]net.UDPAddr{
+		{IP: net.IPv4(1, 1, 1, 1), Port: 1111},
+		{IP: net.ParseIP("2001:db8::2"), Port: 2222},
+	})
+	is.addNodes(nodes)
+	return is, nodes
+}
+
+func TestIndexingService_addNodes(t *testing.T) {
+	t.Parallel()
+
+	is, nodes := dualStackService()
+	if !is.nodes4.contains(nodes[0].ID) || is.nodes4.contains(nodes[1].ID) {
+		t.Error("expected only the IPv4 node in the IPv4 table")
+	}
+	if !is.nodes6.contains(nodes[1].ID) || is.nodes6.contains(nodes[0].ID) {
+		t.Error("expected only the IPv6 node in the IPv6 table")
+	}
+
+	// Without an IPv6 table, the IPv6 nodes are dropped.
+	is.nodes6 = nil
+	is.addNodes(withBucketIDs([]net.UDPAddr{{IP: net.ParseIP("2001:db8::3"), Port: 3333}}))
+	if is.isAllowed(net.UDPAddr{IP: net.ParseIP("2001:db8::3"), Port: 3333}) {
+		t.Error("expected the IPv6 nodes not to be allowed")
+	}
+}
+
+func TestIndexingService_closest(t *testing.T) {
+	t.Parallel()
+
+	is, _ := dualStackService()
+
+	// Distances from 0x00: 0x80 for the IPv4 node and 0x40 for the IPv6 one.
+	got := is.closest([20]byte{}, 10)
+	if len(got) != 2 || got[0].Addr.Port != 2222 || got[1].Addr.Port != 1111 {
+		t.Errorf("unexpected nodes %v", got)
+	}
+	if got := is.closest([20]byte{}, 1); len(got) != 1 || got[0].Addr.Port != 2222 {
+		t.Errorf("unexpected nodes %v", got)
+	}
+}
+
+func TestIndexingService_responseNodes(t *testing.T) {
+	t.Parallel()
+
+	is, _ := dualStackService()
+	addr4 := &net.UDPAddr{IP: net.IPv4(5, 5, 5, 5), Port: 5555}
+	addr6 := &net.UDPAddr{IP: net.ParseIP("2001:db8::5"), Port: 5555}
+
+	tests := []struct {
+		name  string
+		want  []string
+		addr  *net.UDPAddr
+		ports []int
+	}{
+		{"IPv4 sender", nil, addr4, []int{1111}},
+		{"IPv6 sender", nil, addr6, []int{2222}},
+		{"Want n6", []string{"n6"}, addr4, []int{2222}},
+		{"Want both", []string{"n4", "n6"}, addr6, []int{1111, 2222}},
+		{"Want unknown", []string{"n5"}, addr4, []int{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			msg := &Message{A: QueryArguments{Want: tt.want}}
+			for _, closest := range []bool{true, false} {
+				ports := []int{}
+				for _, node := range is.responseNodes(msg, tt.addr, [20]byte{}, closest) {
+					ports = append(ports, node.Addr.Port)
+				}
+				slices.Sort(ports)
+				if !slices.Equal(ports, tt.ports) {
+					t.Errorf("responseNodes(closest=%v) returned the nodes at ports %v, want %v", closest, ports, tt.ports)
+				}
+			}
+		})
+	}
+}
+
+func TestSendQuery_Want(t *testing.T) {
+	t.Parallel()
+
+	is, _ := dualStackService()
+	addr := net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 1111}
+
+	msg := NewFindNodeQuery(is.id(), randomNodeID())
+	is.sendQuery(msg, queryFindNode, addr, [20]byte{})
+	if !slices.Equal(msg.A.Want, wantBoth) {
+		t.Errorf("expected a dual-stack service to want both families, got %v", msg.A.Want)
+	}
+
+	ping := NewPingQuery(is.id())
+	is.sendQuery(ping, queryPing, addr, [20]byte{})
+	if len(ping.A.Want) != 0 {
+		t.Errorf("expected no want key in a ping, got %v", ping.A.Want)
+	}
+
+	is.nodes6 = nil
+	msg = NewFindNodeQuery(is.id(), randomNodeID())
+	is.sendQuery(msg, queryFindNode, net.UDPAddr{IP: net.IPv4(2, 2, 2, 2), Port: 2222}, [20]byte{})
+	if len(msg.A.Want) != 0 {
+		t.Errorf("expected no want key from a single-stack service, got %v", msg.A.Want)
+	}
+}
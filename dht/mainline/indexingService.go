@@ -1,12 +1,16 @@
 package mainline
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"log"
 	mrand "math/rand/v2"
 	"net"
-	"reflect"
-	"strconv"
+	"os"
+	"sync"
 	"time"
 
 	"tgragnato.it/magnetico/v2/stats"
@@ -18,17 +22,41 @@ type IndexingService struct {
 	started       bool
 	eventHandlers IndexingServiceEventHandlers
 
-	nodeID []byte
-	nodes  *routingTable
-
-	counter          uint16
-	getPeersRequests map[[2]byte][20]byte // GetPeersQuery.`t` -> infohash
-
-	bootstrapNodes []string
+	laddr    string
+	nodeIDMu sync.RWMutex
+	nodeID   []byte
+	// fixedNodeID keeps the node ID set by SetNodeID, whatever our external address.
+	fixedNodeID bool
+	// The nodes of the two address families are kept in separate routing tables (BEP 32). The
+	// table of a family that the socket does not reach is nil.
+	nodes4 *routingTable
+	nodes6 *routingTable
+
+	externalIP *externalIP
+
+	transactions *transactionManager
+	scraper      *scraper
+	lookups      *lookups
+	seenHashes   *seenHashes
+	seenNodes    *seenHashes
+	peers        *peerStore
+	sources      *hashSources
+	coverage     *coverage
+
+	bootstrapper *bootstrapper
+	// goodCitizen makes find_node and get_peers queries be answered with the closest nodes of the
+	// routing table, rather than with random ones.
+	goodCitizen bool
+	// bootstrapOnly makes the service a bootstrap node, see NewBootstrapService.
+	bootstrapOnly bool
+
+	statePath  string
+	savedNodes []CompactNodeInfo
 }
 
 type IndexingServiceEventHandlers struct {
-	OnResult func(IndexingResult)
+	OnResult       func(IndexingResult)
+	OnScrapeResult func(ScrapeResult)
 }
 
 type IndexingResult struct {
@@ -44,7 +72,7 @@ func (ir IndexingResult) PeerAddrs() []net.TCPAddr {
 	return ir.peerAddrs
 }
 
-func NewIndexingService(laddr string, maxNeighbors uint, eventHandlers IndexingServiceEventHandlers, bootstrapNodes []string, filterNodes []net.IPNet) *IndexingService {
+func NewIndexingService(laddr string, maxNeighbors uint, eventHandlers IndexingServiceEventHandlers, bootstrapNodes []string, filterNodes []net.IPNet, statePath string, goodCitizen bool, network Network) *IndexingService {
 	service := new(IndexingService)
 	service.protocol = NewProtocol(
 		laddr,
@@ -58,19 +86,77 @@ func NewIndexingService(laddr string, maxNeighbors uint, eventHandlers IndexingS
 			OnPingORAnnouncePeerResponse: service.onPingORAnnouncePeerResponse,
 			OnSampleInfohashesQuery:      service.onSampleInfohashesQuery,
 			OnSampleInfohashesResponse:   service.onSampleInfohashesResponse,
+			OnError:                      service.onError,
+			OnInvalidResponse:            service.onInvalidResponse,
 		},
 		maxNeighbors,
+		network,
 	)
+	// BEP 42: the node ID is derived from our external address. Unless we listen on a public one,
+	// it is regenerated once the other nodes agree on it.
 	service.nodeID = randomNodeID()
-	service.nodes = newRoutingTable(maxNeighbors, filterNodes)
+	if host, _, err := net.SplitHostPort(laddr); err == nil {
+		service.nodeID = bep42NodeID(net.ParseIP(host))
+	}
+	service.statePath = statePath
+	if statePath != "" {
+		if state, err := loadState(statePath); err == nil {
+			service.nodeID = state.nodeID()
+			service.savedNodes = state.compactNodes()
+		} else if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Could not load the routing table from %s! %s\n", statePath, err.Error())
+		}
+	}
+	ipv4, ipv6 := families(laddr)
+	if ipv4 {
+		service.nodes4 = newRoutingTable(service.nodeID, maxNeighbors, filterNodes)
+	}
+	if ipv6 {
+		service.nodes6 = newRoutingTable(service.nodeID, maxNeighbors, filterNodes)
+	}
 	service.eventHandlers = eventHandlers
 
-	service.getPeersRequests = make(map[[2]byte][20]byte)
-	service.bootstrapNodes = bootstrapNodes
+	service.transactions = newTransactionManager(transactionTimeout)
+	service.scraper = newScraper()
+	service.lookups = newLookups()
+	service.seenHashes = newSeenHashes(seenHashesSize)
+	service.seenNodes = newSeenHashes(seenNodesSize)
+	service.peers = newPeerStore()
+	service.sources = newHashSources(seenHashesSize)
+	service.coverage = new(coverage)
+	service.externalIP = newExternalIP()
+	service.laddr = laddr
+	service.bootstrapper = newBootstrapper(laddr, bootstrapNodes, network.LookupIP, func(ip net.IP) bool {
+		return service.table(ip) != nil
+	})
+	service.goodCitizen = goodCitizen
 
 	return service
 }
 
+// SetRateLimits replaces the DefaultRateLimits of the service. It must be called before Start.
+func (is *IndexingService) SetRateLimits(limits RateLimits) {
+	is.protocol.transport.SetRateLimits(limits)
+}
+
+// SetConcurrency sets the number of sockets and workers of the transport of the service. It must be
+// called before Start.
+func (is *IndexingService) SetConcurrency(sockets int, workers int) {
+	is.protocol.transport.SetConcurrency(sockets, workers)
+}
+
+// SetNodeID fixes the node ID of the service, instead of the one saved in the state file or derived
+// from the external address (BEP 42). It must be called before Start.
+func (is *IndexingService) SetNodeID(nodeID []byte) {
+	is.nodeIDMu.Lock()
+	is.nodeID = nodeID
+	is.fixedNodeID = true
+	is.nodeIDMu.Unlock()
+	for _, rt := range is.tables() {
+		rt.rekey(nodeID)
+	}
+}
+
 func (is *IndexingService) Start() {
 	if is.started {
 		panic("Attempting to Start() a mainline/IndexingService that has been already started!")
@@ -82,80 +168,395 @@ func (is *IndexingService) Start() {
 }
 
 func (is *IndexingService) Terminate() {
+	is.saveState()
 	is.protocol.Terminate()
 }
 
 func (is *IndexingService) index() {
+	// The nodes saved before the last shutdown are given some time to answer, before resorting
+	// to the bootstrap nodes.
+	bootstrapAfter := time.Now()
+	if is.pingSavedNodes() {
+		bootstrapAfter = bootstrapAfter.Add(restoreGracePeriod)
+	}
+	lastSave := time.Now()
+	lastPeersExpiry := time.Now()
+
 	ticker := time.NewTicker(time.Second)
 	for ; true; <-ticker.C {
-		if is.nodes.isEmpty() {
-			is.bootstrap()
-		} else if !is.protocol.transport.Full() {
-			is.findNeighbors()
+		is.expireTransactions()
+		is.expireLookups()
+		go stats.GetInstance().SetCoverage(is.laddr, is.coverage.ratio(time.Now()))
+
+		if time.Since(lastPeersExpiry) >= time.Minute {
+			lastPeersExpiry = time.Now()
+			go is.peers.expire(lastPeersExpiry)
+		}
+
+		if time.Since(lastSave) >= stateSaveInterval {
+			lastSave = time.Now()
+			go is.saveState()
+		}
+
+		if is.isEmpty() {
+			if time.Now().After(bootstrapAfter) {
+				is.bootstrap()
+			}
+		} else {
+			is.bootstrapper.reset()
+			if is.bootstrapOnly {
+				is.refresh()
+			} else if !is.protocol.transport.Full() {
+				is.findNeighbors()
+			}
 		}
 	}
 }
 
+// bootstrap queries the nodes of the bootstrapper, when a round is due.
 func (is *IndexingService) bootstrap() {
-	for _, node := range is.bootstrapNodes {
-		dnsName, portStr, err := net.SplitHostPort(node)
-		if err != nil {
+	addrs := is.bootstrapper.round(time.Now())
+	if addrs == nil {
+		return
+	}
+	for _, addr := range addrs {
+		is.sendQuery(NewFindNodeQuery(is.id(), randomNodeID()), queryBootstrap, addr, [20]byte{})
+	}
+
+	go stats.GetInstance().IncBootstrap()
+}
+
+// pingSavedNodes pings the nodes loaded from the state file: the ones that answer are added back
+// to the routing table, and the bootstrapper falls back to the others. It returns false if there
+// were no nodes to ping.
+func (is *IndexingService) pingSavedNodes() bool {
+	addrs := []net.UDPAddr{}
+	for _, node := range is.savedNodes {
+		if !is.isAllowed(node.Addr) {
 			continue
 		}
-		port, err := strconv.Atoi(portStr)
-		if err != nil {
-			continue
+		is.sendQuery(NewPingQuery(is.id()), queryPing, node.Addr, [20]byte{})
+		addrs = append(addrs, node.Addr)
+	}
+	is.savedNodes = nil
+	is.bootstrapper.addSaved(addrs)
+
+	return len(addrs) > 0
+}
+
+// saveState writes the good nodes of the routing table to the state file, if there is one.
+func (is *IndexingService) saveState() {
+	if is.statePath == "" {
+		return
+	}
+
+	nodes := []nodeState{}
+	for _, rt := range is.tables() {
+		nodes = append(nodes, rt.snapshot(maxSavedNodes)...)
+	}
+	if len(nodes) == 0 {
+		// Do not replace a useful state file with an empty one, e.g. when terminating before the
+		// saved nodes had the time to answer.
+		return
+	}
+
+	state := &routingTableState{
+		ID:    hex.EncodeToString(is.id()),
+		Nodes: nodes,
+	}
+	if err := saveState(is.statePath, state); err != nil {
+		log.Printf("Could not save the routing table to %s! %s\n", is.statePath, err.Error())
+	}
+}
+
+func (is *IndexingService) findNeighbors() {
+	// The targets steer the nodes to return the neighbours that they know in the regions of the
+	// keyspace that we have not sampled recently.
+	addrs := []net.UDPAddr{}
+	for _, rt := range is.tables() {
+		addrs = append(addrs, rt.getNodes()...)
+	}
+	targets := is.coverage.targets(len(addrs), time.Now())
+	for i, addr := range addrs {
+		is.sendQuery(
+			NewSampleInfohashesQuery(is.id(), nil, targets[i]),
+			querySampleInfohashes,
+			addr,
+			[20]byte{},
+		)
+	}
+}
+
+// sampleUncovered samples straight away some of the unknown nodes that lie in the regions of the
+// keyspace that we have not sampled recently.
+func (is *IndexingService) sampleUncovered(nodes []CompactNodeInfo) {
+	now := time.Now()
+	directed := 0
+	for _, node := range nodes {
+		if directed >= maxDirectedSamples {
+			return
 		}
-		bootstrappingIPs := []net.IP{}
-		if ipAddrs, err := net.LookupIP(dnsName); err == nil {
-			bootstrappingIPs = append(bootstrappingIPs, ipAddrs...)
+		if !is.coverage.isUncovered(node.ID, now) || !is.isAllowed(node.Addr) || is.table(node.Addr.IP).contains(node.ID) {
+			continue
 		}
+		is.sendQuery(
+			NewSampleInfohashesQuery(is.id(), nil, node.ID),
+			querySampleInfohashes,
+			node.Addr,
+			[20]byte{},
+		)
+		directed++
+	}
+}
 
-		if len(bootstrappingIPs) == 0 || port == 0 {
-			continue
+// id returns our node ID, which changes when a new external address is elected.
+func (is *IndexingService) id() []byte {
+	is.nodeIDMu.RLock()
+	defer is.nodeIDMu.RUnlock()
+
+	return is.nodeID
+}
+
+// updateExternalIP counts the address reported in the `ip` key of a response towards the election
+// of our external address. A new one is reported to the stats, and when our node ID is not derived
+// from it, the ID is regenerated as specified by BEP 42.
+func (is *IndexingService) updateExternalIP(msg *Message, addr *net.UDPAddr) {
+	reported := parseCompactIP(msg.IP)
+	if reported == nil {
+		return
+	}
+	// A dual-stack service derives its ID from the IPv4 address, which the IPv6 votes would
+	// contend with.
+	if is.dualStack() && reported.To4() == nil {
+		return
+	}
+	ip, changed := is.externalIP.vote(addr.IP, reported)
+	if !changed {
+		return
+	}
+	stats.GetInstance().SetExternalAddr(is.laddr, ip.String())
+	if is.fixedNodeID || isBEP42Compliant(is.id(), ip) {
+		return
+	}
+
+	nodeID := bep42NodeID(ip)
+	is.nodeIDMu.Lock()
+	is.nodeID = nodeID
+	is.nodeIDMu.Unlock()
+	for _, rt := range is.tables() {
+		rt.rekey(nodeID)
+	}
+	log.Printf("External address of %s is %s, switched to node ID %x\n", is.laddr, ip, nodeID)
+}
+
+// markSeen records a query received from a node, together with the client that it runs.
+func (is *IndexingService) markSeen(msg *Message, addr net.UDPAddr) {
+	rt := is.table(addr.IP)
+	if rt == nil {
+		return
+	}
+	rt.markSeen(msg.A.ID, addr)
+	is.recordClient(rt, msg.A.ID, msg)
+}
+
+// markAnswered records a response to one of our queries, together with the client that sent it.
+func (is *IndexingService) markAnswered(msg *Message, addr net.UDPAddr, rtt time.Duration) {
+	rt := is.table(addr.IP)
+	if rt == nil {
+		return
+	}
+	rt.markAnswered(msg.R.ID, addr, rtt)
+	is.recordClient(rt, msg.R.ID, msg)
+}
+
+// recordClient stores the `v` and `ip` keys of a message with the node that sent it, and counts
+// the node towards the client populations the first time that it is met.
+func (is *IndexingService) recordClient(rt *routingTable, id []byte, msg *Message) {
+	if len(id) != 20 {
+		return
+	}
+	rt.setClient(id, msg.V, parseCompactIP(msg.IP))
+	if is.seenNodes.add([20]byte(id)) {
+		stats.GetInstance().IncDHTClient(clientName(msg.V))
+	}
+}
+
+// sendQuery sends a query, tagged with a transaction ID issued by the transactionManager.
+func (is *IndexingService) sendQuery(msg *Message, kind queryKind, addr net.UDPAddr, infoHash [20]byte) {
+	t := is.transactions.issue(kind, addr, infoHash)
+	if t == nil {
+		return
+	}
+	msg.T = t
+	if is.dualStack() && msg.Q != "ping" {
+		msg.A.Want = wantBoth
+	}
+	go func() {
+		// A query that is not sent, as the rate limits dropped it, fails at once without being
+		// accounted as a timeout of its node.
+		if !is.protocol.SendMessage(msg, &addr) {
+			if tx := is.transactions.cancel(t); tx != nil {
+				is.onQueryFailed(tx)
+			}
 		}
+	}()
+}
 
-		for _, ip := range bootstrappingIPs {
-			go is.protocol.SendMessage(
-				NewFindNodeQuery(is.nodeID, randomNodeID()),
-				&net.UDPAddr{IP: ip, Port: port},
-			)
+// expireTransactions accounts the queries that have not been answered in time to their nodes.
+func (is *IndexingService) expireTransactions() {
+	expired := is.transactions.expire(time.Now())
+	if len(expired) == 0 {
+		return
+	}
+	addrs := make([]net.UDPAddr, 0, len(expired))
+	for _, tx := range expired {
+		addrs = append(addrs, tx.addr)
+		is.onQueryFailed(tx)
+	}
+	go is.recordTimeouts(addrs)
+}
+
+// onQueryFailed moves on from a query that will not be answered properly.
+func (is *IndexingService) onQueryFailed(tx *transaction) {
+	if tx.kind == queryLookup {
+		is.lookups.onTimeout(tx.infoHash, tx.addr)
+		is.advanceLookup(tx.infoHash)
+	}
+}
+
+// OnMetadata credits the node that returned infoHash in its samples with the metadata fetched for
+// it, which raises the priority of the node in the sampling.
+func (is *IndexingService) OnMetadata(infoHash [20]byte) {
+	is.bootstrapFromPeers(infoHash)
+
+	addr, ok := is.sources.pop(infoHash)
+	if !ok {
+		return
+	}
+	if rt := is.table(addr.IP); rt != nil {
+		rt.recordMetadata(addr)
+	}
+}
+
+// bootstrapFromPeers hands the peers of a torrent whose metadata was fetched to the bootstrapper,
+// in case the routing tables empty out: the DHT nodes of most clients listen on their peer port.
+func (is *IndexingService) bootstrapFromPeers(infoHash [20]byte) {
+	addrs := []net.UDPAddr{}
+	for _, ipv4 := range []bool{true, false} {
+		for _, peer := range is.peers.peers(infoHash, ipv4, time.Now()) {
+			addr := net.UDPAddr{IP: peer.IP, Port: peer.Port}
+			if is.isAllowed(addr) {
+				addrs = append(addrs, addr)
+			}
 		}
 	}
+	is.bootstrapper.addPeers(addrs)
+}
 
-	go stats.GetInstance().IncBootstrap()
+// Lookup searches the DHT for the peers of infoHash, with an iterative get_peers lookup that
+// starts from the nodes of the routing table closest to it. The peers are handed to OnResult once
+// the lookup converges, or once lookupTimeout has elapsed.
+func (is *IndexingService) Lookup(infoHash [20]byte) {
+	nodes := is.closest(infoHash, lookupK)
+	if len(nodes) == 0 || !is.lookups.begin(infoHash, nodes, time.Now()) {
+		return
+	}
+	is.advanceLookup(infoHash)
 }
 
-func (is *IndexingService) findNeighbors() {
-	for _, addr := range is.nodes.getNodes() {
-		go is.protocol.SendMessage(
-			NewSampleInfohashesQuery(is.nodeID, []byte("aa"), randomNodeID()),
-			&addr,
-		)
+// advanceLookup sends the next queries of a lookup, or finishes it if it has converged.
+func (is *IndexingService) advanceLookup(infoHash [20]byte) {
+	addrs, converged := is.lookups.next(infoHash)
+	if converged {
+		is.finishLookup(infoHash)
+		return
 	}
+	for _, addr := range addrs {
+		is.sendQuery(NewGetPeersQuery(is.id(), infoHash[:]), queryLookup, addr, infoHash)
+	}
+}
+
+func (is *IndexingService) finishLookup(infoHash [20]byte) {
+	if result, ok := is.lookups.finish(infoHash); ok {
+		go is.eventHandlers.OnResult(result)
+	}
+}
+
+// expireLookups finishes the lookups that did not converge in time.
+func (is *IndexingService) expireLookups() {
+	for _, infoHash := range is.lookups.expire(time.Now()) {
+		is.finishLookup(infoHash)
+	}
+}
+
+// Scrape estimates the size of the swarm of infoHash by asking the nodes closest to it for their
+// BEP 33 Bloom filters. The result is handed to OnScrapeResult once scrapeTimeout has elapsed.
+func (is *IndexingService) Scrape(infoHash [20]byte) {
+	nodes := is.closest(infoHash, scrapeNodes)
+	if len(nodes) == 0 || !is.scraper.begin(infoHash) {
+		return
+	}
+
+	for _, node := range nodes {
+		if is.scraper.reserve(infoHash, node.Addr) {
+			is.sendQuery(NewGetPeersScrapeQuery(is.id(), infoHash[:]), queryScrape, node.Addr, infoHash)
+		}
+	}
+
+	time.AfterFunc(scrapeTimeout, func() {
+		result, ok := is.scraper.finish(infoHash)
+		if ok && is.eventHandlers.OnScrapeResult != nil {
+			is.eventHandlers.OnScrapeResult(result)
+		}
+	})
 }
 
 func (is *IndexingService) onFindNodeResponse(response *Message, addr *net.UDPAddr) {
-	neighbors := []net.UDPAddr{}
-	for _, node := range response.R.Nodes {
-		neighbors = append(neighbors, node.Addr)
+	// Nodes that do not support BEP 51 answer sample_infohashes queries as find_node ones.
+	tx, rtt, ok := is.transactions.resolve(response.T, addr)
+	if !ok {
+		return
 	}
-	for _, node := range response.R.Nodes6 {
-		neighbors = append(neighbors, node.Addr)
+	is.updateExternalIP(response, addr)
+	if tx.kind == queryBootstrap {
+		is.bootstrapper.answered(*addr)
 	}
+	go func() {
+		is.markAnswered(response, *addr, rtt)
+		if rt := is.table(addr.IP); rt != nil && tx.kind == querySampleInfohashes {
+			rt.recordNoSamples(*addr)
+		}
+	}()
+
+	neighbors := []CompactNodeInfo{}
+	neighbors = append(neighbors, response.R.Nodes...)
+	neighbors = append(neighbors, response.R.Nodes6...)
 
 	if len(neighbors) > 0 {
-		go is.nodes.addNodes(neighbors)
+		if !is.bootstrapOnly {
+			is.sampleUncovered(neighbors)
+		}
+		go is.addNodes(neighbors)
 	}
 }
 
 func (is *IndexingService) onGetPeersResponse(msg *Message, addr *net.UDPAddr) {
-	var t [2]byte
-	copy(t[:], msg.T)
+	tx, rtt, ok := is.transactions.resolve(msg.T, addr)
+	if !ok || tx.kind != queryGetPeers && tx.kind != queryScrape && tx.kind != queryLookup {
+		return
+	}
+	is.updateExternalIP(msg, addr)
+	go is.markAnswered(msg, *addr, rtt)
 
-	infoHash := is.getPeersRequests[t]
-	// We got a response, so free the key!
-	delete(is.getPeersRequests, t)
+	switch tx.kind {
+	case queryScrape:
+		is.onScrapeResponse(msg, tx.infoHash)
+		return
+	case queryLookup:
+		is.onLookupResponse(msg, tx.infoHash, *addr)
+		return
+	}
+	infoHash := tx.infoHash
 
 	// BEP 51 specifies that
 	//     The new sample_infohashes remote procedure call requests that a remote node return a string of multiple
@@ -177,6 +578,7 @@ func (is *IndexingService) onGetPeersResponse(msg *Message, addr *net.UDPAddr) {
 			Port: peer.Port,
 		})
 	}
+	go is.peers.add(infoHash, peerAddrs, false, time.Now())
 
 	go is.eventHandlers.OnResult(IndexingResult{
 		infoHash:  infoHash,
@@ -184,115 +586,269 @@ func (is *IndexingService) onGetPeersResponse(msg *Message, addr *net.UDPAddr) {
 	})
 }
 
+func (is *IndexingService) onScrapeResponse(msg *Message, infoHash [20]byte) {
+	if !is.scraper.onResponse(infoHash, msg) {
+		return
+	}
+
+	// The swarm is stored by the nodes closest to the info hash: follow the ones that are closer
+	// than the responder, as long as the scrape has queries left.
+	var responder [20]byte
+	copy(responder[:], msg.R.ID)
+	limit := distance(responder, infoHash)
+
+	neighbors := []CompactNodeInfo{}
+	neighbors = append(neighbors, msg.R.Nodes...)
+	neighbors = append(neighbors, msg.R.Nodes6...)
+	for _, node := range neighbors {
+		if len(node.ID) != 20 || !is.isAllowed(node.Addr) {
+			continue
+		}
+		var id [20]byte
+		copy(id[:], node.ID)
+		if d := distance(id, infoHash); bytes.Compare(d[:], limit[:]) >= 0 {
+			continue
+		}
+		if is.scraper.reserve(infoHash, node.Addr) {
+			is.sendQuery(NewGetPeersScrapeQuery(is.id(), infoHash[:]), queryScrape, node.Addr, infoHash)
+		}
+	}
+}
+
+func (is *IndexingService) onLookupResponse(msg *Message, infoHash [20]byte, addr net.UDPAddr) {
+	peers := []net.TCPAddr{}
+	for _, peer := range msg.R.Values {
+		if peer.Port == 0 {
+			continue
+		}
+		peers = append(peers, net.TCPAddr{IP: peer.IP, Port: peer.Port})
+	}
+
+	neighbors := []CompactNodeInfo{}
+	for _, nodes := range [][]CompactNodeInfo{msg.R.Nodes, msg.R.Nodes6} {
+		for _, node := range nodes {
+			if is.isAllowed(node.Addr) {
+				neighbors = append(neighbors, node)
+			}
+		}
+	}
+
+	go is.peers.add(infoHash, peers, false, time.Now())
+	if is.lookups.onResponse(infoHash, addr, peers, neighbors) {
+		is.advanceLookup(infoHash)
+	}
+}
+
 func (is *IndexingService) onSampleInfohashesResponse(msg *Message, addr *net.UDPAddr) {
+	_, rtt, ok := is.transactions.resolve(msg.T, addr)
+	if !ok {
+		return
+	}
+	is.updateExternalIP(msg, addr)
+
 	info_hashes := [][20]byte{}
+	var newHashes uint
 
-	// request samples
+	// request samples, skipping the ones that we have already asked for recently
 	for i := 0; i < len(msg.R.Samples)/20; i++ {
 		var infoHash [20]byte
-		copy(infoHash[:], msg.R.Samples[i:(i+1)*20])
+		copy(infoHash[:], msg.R.Samples[i*20:(i+1)*20])
 		info_hashes = append(info_hashes, infoHash)
 
-		msg := NewGetPeersQuery(is.nodeID, infoHash[:])
-		t := toBigEndianBytes(is.counter)
-		msg.T = t[:]
+		if !is.seenHashes.add(infoHash) {
+			continue
+		}
+		newHashes++
+		is.sources.add(infoHash, *addr)
+		is.sendQuery(NewGetPeersQuery(is.id(), infoHash[:]), queryGetPeers, *addr, infoHash)
+	}
 
-		is.protocol.SendMessage(msg, addr)
+	is.coverage.record(msg.R.ID, newHashes, time.Now())
 
-		is.getPeersRequests[t] = infoHash
-		is.counter++
+	neighbors := []CompactNodeInfo{}
+	neighbors = append(neighbors, msg.R.Nodes...)
+	neighbors = append(neighbors, msg.R.Nodes6...)
+	if len(neighbors) > 0 {
+		is.sampleUncovered(neighbors)
 	}
 
-	go is.nodes.addHashes(info_hashes)
+	// The neighbors go first: the responder may be among them, and its samples are recorded on the
+	// node of its address.
+	go func() {
+		if len(neighbors) > 0 {
+			is.addNodes(neighbors)
+		}
+		is.markAnswered(msg, *addr, rtt)
+		if rt := is.table(addr.IP); rt != nil {
+			rt.recordSamples(
+				*addr,
+				time.Duration(msg.R.Interval)*time.Second,
+				msg.R.Num,
+				uint(len(info_hashes)),
+				newHashes,
+			)
+		}
+	}()
+}
 
-	neighbors := []net.UDPAddr{}
-	if msg.R.Num > len(msg.R.Samples)/20 && time.Duration(msg.R.Interval) <= time.Minute {
-		neighbors = append(neighbors, *addr)
-	}
-	for _, node := range msg.R.Nodes {
-		neighbors = append(neighbors, node.Addr)
+func (is *IndexingService) onPingORAnnouncePeerResponse(msg *Message, addr *net.UDPAddr) {
+	// We never send announce_peer queries: the pings of the saved nodes and the empty answers to
+	// the other queries end up here.
+	tx, rtt, ok := is.transactions.resolve(msg.T, addr)
+	if !ok {
+		return
 	}
-	for _, node := range msg.R.Nodes6 {
-		neighbors = append(neighbors, node.Addr)
+	is.updateExternalIP(msg, addr)
+	go func() {
+		is.markAnswered(msg, *addr, rtt)
+		if rt := is.table(addr.IP); rt != nil && tx.kind == querySampleInfohashes {
+			rt.recordNoSamples(*addr)
+		}
+	}()
+}
+
+// onError accounts a KRPC error to the node that sent it in answer to one of our queries.
+func (is *IndexingService) onError(msg *Message, addr *net.UDPAddr) {
+	tx, _, ok := is.transactions.resolve(msg.T, addr)
+	if !ok {
+		return
 	}
-	if len(neighbors) > 0 {
-		go is.nodes.addNodes(neighbors)
+	go stats.GetInstance().IncKRPCError(msg.E.Code)
+	if rt := is.table(addr.IP); rt != nil {
+		go func() {
+			rt.recordError(*addr, msg.E.Code)
+			if tx.kind == querySampleInfohashes && msg.E.Code == methodUnknown {
+				rt.recordNoSamples(*addr)
+			}
+		}()
 	}
+	is.onQueryFailed(tx)
 }
 
-func (is *IndexingService) onPingORAnnouncePeerResponse(msg *Message, addr *net.UDPAddr) {
-	go is.nodes.addNodes([]net.UDPAddr{*addr})
+// onInvalidResponse accounts a malformed answer to one of our queries to the node that sent it.
+func (is *IndexingService) onInvalidResponse(msg *Message, addr *net.UDPAddr) {
+	tx, _, ok := is.transactions.resolve(msg.T, addr)
+	if !ok {
+		return
+	}
+	if rt := is.table(addr.IP); rt != nil {
+		go rt.recordInvalid(*addr)
+	}
+	is.onQueryFailed(tx)
 }
 
 func (is *IndexingService) onPingQuery(msg *Message, addr *net.UDPAddr) {
-	go is.nodes.addNodes([]net.UDPAddr{*addr})
+	go is.markSeen(msg, *addr)
 
 	go is.protocol.SendMessage(
-		NewPingResponse(msg.T, is.nodeID),
+		NewPingResponse(msg.T, is.id()),
 		addr,
 	)
 }
 
 func (is *IndexingService) onAnnouncePeerQuery(msg *Message, addr *net.UDPAddr) {
-	addresses := []net.UDPAddr{*addr}
-
-	if msg.A.Port > 0 &&
-		msg.A.Port <= 65535 &&
-		addr.Port != msg.A.Port {
-		addresses = append(addresses, net.UDPAddr{
-			IP:   addr.IP,
-			Port: msg.A.Port,
-		})
-	}
-
-	if msg.A.ImpliedPort > 0 &&
-		msg.A.ImpliedPort <= 65535 &&
-		addr.Port != msg.A.ImpliedPort &&
-		msg.A.Port != msg.A.ImpliedPort {
-		addresses = append(addresses, net.UDPAddr{
-			IP:   addr.IP,
-			Port: msg.A.ImpliedPort,
-		})
+	// The announced port is the BitTorrent port of the peer, not its DHT port: only the sender
+	// itself belongs in the routing table.
+	go is.markSeen(msg, *addr)
+
+	// BEP 5 requires the token to be one that we handed out to the same IP in a get_peers
+	// response, otherwise anyone could announce arbitrary addresses on behalf of others.
+	if !is.protocol.VerifyToken(addr.IP, msg.A.Token) {
+		go is.protocol.SendMessage(NewErrorMessage(msg.T, protocolError, "bad token"), addr)
+		return
 	}
 
-	go is.nodes.addNodes(addresses)
-
 	go is.protocol.SendMessage(
-		NewAnnouncePeerResponse(msg.T, is.nodeID),
+		NewAnnouncePeerResponse(msg.T, is.id()),
 		addr,
 	)
+
+	// When implied_port is set the peer is behind a NAT and the source port of the query is the
+	// one to be used, as in uTP.
+	port := msg.A.Port
+	if msg.A.ImpliedPort != 0 {
+		port = addr.Port
+	}
+	if port < 1 || port > 65535 {
+		return
+	}
+
+	var infoHash [20]byte
+	copy(infoHash[:], msg.A.InfoHash)
+	peer := net.TCPAddr{IP: addr.IP, Port: port}
+
+	go is.peers.add(infoHash, []net.TCPAddr{peer}, msg.A.Seed != 0, time.Now())
+	go is.eventHandlers.OnResult(IndexingResult{
+		infoHash:  infoHash,
+		peerAddrs: []net.TCPAddr{peer},
+	})
 }
 
 func (is *IndexingService) onFindNodeQuery(msg *Message, addr *net.UDPAddr) {
-	compactNodeInfos := []CompactNodeInfo{}
-	for _, node := range is.nodes.dump(addr.IP.To4() != nil) {
-		compactNodeInfos = append(compactNodeInfos, CompactNodeInfo{
-			ID:   randomNodeID(),
-			Addr: node,
-		})
-	}
+	var target [20]byte
+	copy(target[:], msg.A.Target)
 
 	go is.protocol.SendMessage(
-		NewFindNodeResponse(msg.T, is.nodeID, compactNodeInfos),
+		NewFindNodeResponse(msg.T, is.id(), is.responseNodes(msg, addr, target, is.goodCitizen)),
 		addr,
 	)
 
-	go is.nodes.addNodes([]net.UDPAddr{*addr})
+	go is.markSeen(msg, *addr)
 }
 
 func (is *IndexingService) onGetPeersQuery(msg *Message, addr *net.UDPAddr) {
+	// The peers that we hold are returned in any mode, with the Bloom filters of BEP 33 if asked.
+	infoHash := [20]byte(msg.A.InfoHash)
+	now := time.Now()
+	if peers := is.peers.peers(infoHash, addr.IP.To4() != nil, now); len(peers) > 0 {
+		var seeds, leechers *BloomFilter
+		if msg.A.Scrape == 1 {
+			seeds, leechers = is.peers.bloomFilters(infoHash, now)
+		}
+		go is.protocol.SendMessage(
+			NewGetPeersResponseWithValues(
+				msg.T,
+				is.id(),
+				is.protocol.CalculateToken(addr.IP),
+				peers,
+				seeds,
+				leechers,
+			),
+			addr,
+		)
+		go is.markSeen(msg, *addr)
+		return
+	}
+
+	if is.goodCitizen {
+		// We hold no peers: point the sender to the nodes closest to the info hash.
+		go is.protocol.SendMessage(
+			NewGetPeersResponseWithNodes(
+				msg.T,
+				is.id(),
+				is.protocol.CalculateToken(addr.IP),
+				is.responseNodes(msg, addr, infoHash, true),
+			),
+			addr,
+		)
+		go is.markSeen(msg, *addr)
+		return
+	}
+
 	compactPeers := []CompactPeer{}
-	for _, node := range is.nodes.dump(addr.IP.To4() != nil) {
-		compactPeers = append(compactPeers, CompactPeer{
-			IP:   node.IP,
-			Port: node.Port,
-		})
+	if rt := is.table(addr.IP); rt != nil {
+		for _, node := range rt.dump(addr.IP.To4() != nil) {
+			compactPeers = append(compactPeers, CompactPeer{
+				IP:   node.IP,
+				Port: node.Port,
+			})
+		}
 	}
 
 	go is.protocol.SendMessage(
 		NewGetPeersResponseWithValues(
 			msg.T,
-			is.nodeID,
+			is.id(),
 			is.protocol.CalculateToken(addr.IP),
 			compactPeers,
 			nil,
@@ -301,33 +857,25 @@ func (is *IndexingService) onGetPeersQuery(msg *Message, addr *net.UDPAddr) {
 		addr,
 	)
 
-	go is.nodes.addNodes([]net.UDPAddr{*addr})
+	go is.markSeen(msg, *addr)
 }
 
 func (is *IndexingService) onSampleInfohashesQuery(msg *Message, addr *net.UDPAddr) {
-	go is.nodes.addNodes([]net.UDPAddr{*addr})
+	go is.markSeen(msg, *addr)
 
 	// the remote is an indexer, send a find_node query to obtain some peers
-	go is.protocol.SendMessage(
-		NewFindNodeQuery(is.nodeID, randomNodeID()),
-		addr,
-	)
-
-	hash_stream := []byte{}
-	for _, info_hash := range is.nodes.getHashes() {
-		if !reflect.DeepEqual(info_hash, [20]byte{}) {
-			hash_stream = append(hash_stream, info_hash[:]...)
-		}
-	}
-	if len(hash_stream) == 0 {
-		return
-	}
+	is.sendQuery(NewFindNodeQuery(is.id(), randomNodeID()), queryFindNode, *addr, [20]byte{})
 
+	// A random subset of the info hashes for which we hold peers, as BEP 51 expects.
+	samples, num := is.peers.sample(maxSamples)
 	go is.protocol.SendMessage(
 		NewSampleInfohashesResponse(
 			msg.T,
-			is.nodeID,
-			hash_stream,
+			is.id(),
+			samples,
+			num,
+			sampleInterval,
+			is.responseNodes(msg, addr, [20]byte(msg.A.Target), true),
 		),
 		addr,
 	)
@@ -1,12 +1,17 @@
 package mainline
 
 import (
+	"bytes"
 	"math/rand/v2"
 	"net"
+	"reflect"
 	"sort"
 	"strconv"
 	"testing"
 	"time"
+
+	"tgragnato.it/magnetico/v2/bencode"
+	"tgragnato.it/magnetico/v2/stats"
 )
 
 func sortNodes(nodes []net.UDPAddr) {
@@ -69,7 +74,7 @@ func TestBasicIndexingService(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			is := NewIndexingService(tt.laddr, tt.maxNeighbors, tt.eventHandlers, []string{"dht.tgragnato.it"}, []net.IPNet{})
+			is := NewIndexingService(tt.laddr, tt.maxNeighbors, tt.eventHandlers, []string{"dht.tgragnato.it"}, []net.IPNet{}, "", false, Internet)
 			if is == nil {
 				t.Error("NewIndexingService() = nil, wanted != nil")
 			}
@@ -98,7 +103,7 @@ func TestOnFindNodeResponse(t *testing.T) {
 			response: &Message{
 				R: ResponseValues{
 					Nodes: []CompactNodeInfo{
-						{Addr: net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6881}},
+						{ID: randomNodeID(), Addr: net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6881}},
 					},
 				},
 			},
@@ -112,8 +117,8 @@ func TestOnFindNodeResponse(t *testing.T) {
 			response: &Message{
 				R: ResponseValues{
 					Nodes: []CompactNodeInfo{
-						{Addr: net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6881}},
-						{Addr: net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 6882}},
+						{ID: randomNodeID(), Addr: net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6881}},
+						{ID: randomNodeID(), Addr: net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 6882}},
 					},
 				},
 			},
@@ -138,15 +143,29 @@ func TestOnFindNodeResponse(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			is := &IndexingService{
-				nodes: newRoutingTable(
+				seenNodes: newSeenHashes(seenNodesSize),
+				peers:     newPeerStore(),
+				nodes4: newRoutingTable(
+					randomNodeID(),
 					10,
 					[]net.IPNet{*cidr},
 				),
+				protocol: &Protocol{
+					transport: &Transport{
+						started:      true,
+						onMessage:    func(*Message, *net.UDPAddr) {},
+						maxNeighbors: 10,
+					},
+				},
+				nodeID:       randomNodeID(),
+				transactions: newTransactionManager(transactionTimeout),
+				coverage:     new(coverage),
 			}
+			tt.response.T = is.transactions.issue(queryFindNode, *tt.addr, [20]byte{})
 			is.onFindNodeResponse(tt.response, tt.addr)
 			time.Sleep(time.Second)
 
-			gotNodes := is.nodes.getNodes()
+			gotNodes := is.nodes4.getNodes()
 			if len(gotNodes) != len(tt.wantNodes) {
 				t.Errorf("onFindNodeResponse() got %d nodes, want %d nodes", len(gotNodes), len(tt.wantNodes))
 			}
@@ -169,67 +188,83 @@ func TestOnAnnouncePeerQuery(t *testing.T) {
 
 	_, cidr, _ := net.ParseCIDR("127.0.0.0/8")
 	transport := &Transport{
-		conn:           &net.UDPConn{},
-		started:        true,
-		onMessage:      func(*Message, *net.UDPAddr) {},
-		throttlingRate: 0,
-		maxNeighbors:   10,
+		started:      true,
+		onMessage:    func(*Message, *net.UDPAddr) {},
+		maxNeighbors: 10,
 	}
+	protocol := &Protocol{
+		transport:   transport,
+		tokenSecret: []byte("secret"),
+	}
+	token := protocol.CalculateToken(net.ParseIP("127.0.0.1"))
 
 	tests := []struct {
 		name      string
 		msg       *Message
 		addr      *net.UDPAddr
 		wantNodes []net.UDPAddr
+		wantPeer  *net.TCPAddr
 	}{
 		{
 			name: "Announce with Port",
 			msg: &Message{
 				A: QueryArguments{
-					Port: 6881,
+					ID:       randomNodeID(),
+					InfoHash: []byte("xzlkjhgfdsapouytrewq"),
+					Port:     6881,
+					Token:    token,
 				},
 				T: []byte("aa"),
 			},
 			addr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6882},
 			wantNodes: []net.UDPAddr{
 				{IP: net.ParseIP("127.0.0.1"), Port: 6882},
-				{IP: net.ParseIP("127.0.0.1"), Port: 6881},
 			},
+			wantPeer: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6881},
 		},
 		{
 			name: "Announce with ImpliedPort",
 			msg: &Message{
 				A: QueryArguments{
-					ImpliedPort: 6883,
+					ID:          randomNodeID(),
+					InfoHash:    []byte("xzlkjhgfdsapouytrewq"),
+					ImpliedPort: 1,
+					Token:       token,
 				},
 				T: []byte("bb"),
 			},
 			addr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6882},
 			wantNodes: []net.UDPAddr{
 				{IP: net.ParseIP("127.0.0.1"), Port: 6882},
-				{IP: net.ParseIP("127.0.0.1"), Port: 6883},
 			},
+			wantPeer: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6882},
 		},
 		{
 			name: "Announce with Port and ImpliedPort",
 			msg: &Message{
 				A: QueryArguments{
+					ID:          randomNodeID(),
+					InfoHash:    []byte("xzlkjhgfdsapouytrewq"),
 					Port:        6881,
-					ImpliedPort: 6883,
+					ImpliedPort: 1,
+					Token:       token,
 				},
 				T: []byte("cc"),
 			},
 			addr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6882},
 			wantNodes: []net.UDPAddr{
 				{IP: net.ParseIP("127.0.0.1"), Port: 6882},
-				{IP: net.ParseIP("127.0.0.1"), Port: 6881},
-				{IP: net.ParseIP("127.0.0.1"), Port: 6883},
 			},
+			wantPeer: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6882},
 		},
 		{
 			name: "Announce with No Port",
 			msg: &Message{
-				A: QueryArguments{},
+				A: QueryArguments{
+					ID:       randomNodeID(),
+					InfoHash: []byte("xzlkjhgfdsapouytrewq"),
+					Token:    token,
+				},
 				T: []byte("dd"),
 			},
 			addr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6882},
@@ -237,24 +272,61 @@ func TestOnAnnouncePeerQuery(t *testing.T) {
 				{IP: net.ParseIP("127.0.0.1"), Port: 6882},
 			},
 		},
+		{
+			name: "Announce with Invalid Token",
+			msg: &Message{
+				A: QueryArguments{
+					ID:       randomNodeID(),
+					InfoHash: []byte("xzlkjhgfdsapouytrewq"),
+					Port:     6881,
+					Token:    []byte("invalid"),
+				},
+				T: []byte("ee"),
+			},
+			addr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6882},
+			wantNodes: []net.UDPAddr{
+				{IP: net.ParseIP("127.0.0.1"), Port: 6882},
+			},
+		},
+		{
+			name: "Announce from Another IP",
+			msg: &Message{
+				A: QueryArguments{
+					ID:       randomNodeID(),
+					InfoHash: []byte("xzlkjhgfdsapouytrewq"),
+					Port:     6881,
+					Token:    token,
+				},
+				T: []byte("ff"),
+			},
+			addr: &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 6882},
+			wantNodes: []net.UDPAddr{
+				{IP: net.ParseIP("127.0.0.2"), Port: 6882},
+			},
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			results := make(chan IndexingResult, 1)
 			is := &IndexingService{
-				nodes: newRoutingTable(
+				seenNodes: newSeenHashes(seenNodesSize),
+				peers:     newPeerStore(),
+				nodes4: newRoutingTable(
+					randomNodeID(),
 					10,
 					[]net.IPNet{*cidr},
 				),
-				protocol: &Protocol{
-					transport: transport,
+				protocol: protocol,
+				nodeID:   randomNodeID(),
+				eventHandlers: IndexingServiceEventHandlers{
+					OnResult: func(result IndexingResult) { results <- result },
 				},
-				nodeID: randomNodeID(),
 			}
 			is.onAnnouncePeerQuery(tt.msg, tt.addr)
 			time.Sleep(time.Second)
 
-			gotNodes := is.nodes.getNodes()
+			gotNodes := is.nodes4.getNodes()
 			if len(gotNodes) != len(tt.wantNodes) {
 				t.Errorf("onAnnouncePeerQuery() got %d nodes, want %d nodes", len(gotNodes), len(tt.wantNodes))
 			}
@@ -268,20 +340,61 @@ func TestOnAnnouncePeerQuery(t *testing.T) {
 					t.Errorf("onAnnouncePeerQuery() got node %v, want node %v", gotNode, tt.wantNodes[i])
 				}
 			}
+
+			select {
+			case result := <-results:
+				if tt.wantPeer == nil {
+					t.Fatalf("onAnnouncePeerQuery() got unexpected result %v", result)
+				}
+				if !bytes.Equal(result.infoHash[:], tt.msg.A.InfoHash) {
+					t.Errorf("onAnnouncePeerQuery() got info hash %x, want %x", result.infoHash, tt.msg.A.InfoHash)
+				}
+				if len(result.peerAddrs) != 1 || result.peerAddrs[0].String() != tt.wantPeer.String() {
+					t.Errorf("onAnnouncePeerQuery() got peers %v, want %v", result.peerAddrs, tt.wantPeer)
+				}
+				stored := is.peers.peers([20]byte(tt.msg.A.InfoHash), true, time.Now())
+				if len(stored) != 1 || stored[0].Port != tt.wantPeer.Port {
+					t.Errorf("onAnnouncePeerQuery() stored peers %v, want %v", stored, tt.wantPeer)
+				}
+			default:
+				if tt.wantPeer != nil {
+					t.Errorf("onAnnouncePeerQuery() got no result, want peer %v", tt.wantPeer)
+				}
+			}
 		})
 	}
 }
 
+func TestOnAnnouncePeerQuery_BadToken(t *testing.T) {
+	t.Parallel()
+
+	is, remote := goodCitizenService(t, nil)
+	is.onAnnouncePeerQuery(&Message{
+		Y: "q",
+		Q: "announce_peer",
+		T: []byte("aa"),
+		A: QueryArguments{
+			ID:       randomNodeID(),
+			InfoHash: []byte("xzlkjhgfdsapouytrewq"),
+			Port:     6881,
+			Token:    []byte("invalid"),
+		},
+	}, remote.LocalAddr().(*net.UDPAddr))
+
+	msg := readResponse(t, remote)
+	if msg.Y != "e" || string(msg.T) != "aa" || msg.E.Code != protocolError || string(msg.E.Message) != "bad token" {
+		t.Errorf("expected a bad token error, got %+v", msg)
+	}
+}
+
 func TestOnPingQuery(t *testing.T) {
 	t.Parallel()
 
 	_, cidr, _ := net.ParseCIDR("127.0.0.0/8")
 	transport := &Transport{
-		conn:           &net.UDPConn{},
-		started:        true,
-		onMessage:      func(*Message, *net.UDPAddr) {},
-		throttlingRate: 0,
-		maxNeighbors:   10,
+		started:      true,
+		onMessage:    func(*Message, *net.UDPAddr) {},
+		maxNeighbors: 10,
 	}
 
 	tests := []struct {
@@ -292,6 +405,9 @@ func TestOnPingQuery(t *testing.T) {
 		{
 			name: "Ping Query",
 			msg: &Message{
+				A: QueryArguments{
+					ID: randomNodeID(),
+				},
 				T: []byte("aa"),
 			},
 			addr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6881},
@@ -301,7 +417,10 @@ func TestOnPingQuery(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			is := &IndexingService{
-				nodes: newRoutingTable(
+				seenNodes: newSeenHashes(seenNodesSize),
+				peers:     newPeerStore(),
+				nodes4: newRoutingTable(
+					randomNodeID(),
 					10,
 					[]net.IPNet{*cidr},
 				),
@@ -313,7 +432,7 @@ func TestOnPingQuery(t *testing.T) {
 			is.onPingQuery(tt.msg, tt.addr)
 			time.Sleep(time.Second)
 
-			gotNodes := is.nodes.getNodes()
+			gotNodes := is.nodes4.getNodes()
 			if len(gotNodes) != 1 {
 				t.Errorf("onPingQuery() got %d nodes, want 1 node", len(gotNodes))
 			}
@@ -333,11 +452,9 @@ func TestOnPingORAnnouncePeerResponse(t *testing.T) {
 
 	_, cidr, _ := net.ParseCIDR("127.0.0.0/8")
 	transport := &Transport{
-		conn:           &net.UDPConn{},
-		started:        true,
-		onMessage:      func(*Message, *net.UDPAddr) {},
-		throttlingRate: 0,
-		maxNeighbors:   10,
+		started:      true,
+		onMessage:    func(*Message, *net.UDPAddr) {},
+		maxNeighbors: 10,
 	}
 
 	tests := []struct {
@@ -348,7 +465,9 @@ func TestOnPingORAnnouncePeerResponse(t *testing.T) {
 		{
 			name: "Ping OR Announce Peer Response",
 			msg: &Message{
-				T: []byte("aa"),
+				R: ResponseValues{
+					ID: randomNodeID(),
+				},
 			},
 			addr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6881},
 		},
@@ -357,19 +476,24 @@ func TestOnPingORAnnouncePeerResponse(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			is := &IndexingService{
-				nodes: newRoutingTable(
+				seenNodes: newSeenHashes(seenNodesSize),
+				peers:     newPeerStore(),
+				nodes4: newRoutingTable(
+					randomNodeID(),
 					10,
 					[]net.IPNet{*cidr},
 				),
 				protocol: &Protocol{
 					transport: transport,
 				},
-				nodeID: randomNodeID(),
+				nodeID:       randomNodeID(),
+				transactions: newTransactionManager(transactionTimeout),
 			}
+			tt.msg.T = is.transactions.issue(queryPing, *tt.addr, [20]byte{})
 			is.onPingORAnnouncePeerResponse(tt.msg, tt.addr)
 			time.Sleep(time.Second)
 
-			gotNodes := is.nodes.getNodes()
+			gotNodes := is.nodes4.getNodes()
 			if len(gotNodes) != 1 {
 				t.Errorf("onPingORAnnouncePeerResponse() got %d nodes, want 1 node", len(gotNodes))
 			}
@@ -389,11 +513,9 @@ func TestOnFindNodeQuery(t *testing.T) {
 
 	_, cidr, _ := net.ParseCIDR("127.0.0.0/8")
 	transport := &Transport{
-		conn:           &net.UDPConn{},
-		started:        true,
-		onMessage:      func(*Message, *net.UDPAddr) {},
-		throttlingRate: 0,
-		maxNeighbors:   10,
+		started:      true,
+		onMessage:    func(*Message, *net.UDPAddr) {},
+		maxNeighbors: 10,
 	}
 
 	tests := []struct {
@@ -404,6 +526,9 @@ func TestOnFindNodeQuery(t *testing.T) {
 		{
 			name: "Find Node Query",
 			msg: &Message{
+				A: QueryArguments{
+					ID: randomNodeID(),
+				},
 				T: []byte("aa"),
 			},
 			addr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6881},
@@ -413,7 +538,10 @@ func TestOnFindNodeQuery(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			is := &IndexingService{
-				nodes: newRoutingTable(
+				seenNodes: newSeenHashes(seenNodesSize),
+				peers:     newPeerStore(),
+				nodes4: newRoutingTable(
+					randomNodeID(),
 					10,
 					[]net.IPNet{*cidr},
 				),
@@ -425,7 +553,7 @@ func TestOnFindNodeQuery(t *testing.T) {
 			is.onFindNodeQuery(tt.msg, tt.addr)
 			time.Sleep(time.Second)
 
-			gotNodes := is.nodes.getNodes()
+			gotNodes := is.nodes4.getNodes()
 			if len(gotNodes) != 1 {
 				t.Errorf("onFindNodeQuery() got %d nodes, want 1 node", len(gotNodes))
 			}
@@ -445,25 +573,21 @@ func TestOnGetPeersResponse(t *testing.T) {
 
 	_, cidr, _ := net.ParseCIDR("127.0.0.0/8")
 	transport := &Transport{
-		conn:           &net.UDPConn{},
-		started:        true,
-		onMessage:      func(*Message, *net.UDPAddr) {},
-		throttlingRate: 0,
-		maxNeighbors:   10,
+		started:      true,
+		onMessage:    func(*Message, *net.UDPAddr) {},
+		maxNeighbors: 10,
 	}
 
 	tests := []struct {
 		name          string
 		msg           *Message
 		addr          *net.UDPAddr
-		getPeersReq   map[[2]byte][20]byte
 		wantPeerAddrs []net.TCPAddr
 		wantInfoHash  [20]byte
 	}{
 		{
 			name: "Single Peer",
 			msg: &Message{
-				T: []byte{0, 1},
 				R: ResponseValues{
 					Values: []CompactPeer{
 						{IP: net.ParseIP("127.0.0.1"), Port: 6881},
@@ -471,9 +595,6 @@ func TestOnGetPeersResponse(t *testing.T) {
 				},
 			},
 			addr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6881},
-			getPeersReq: map[[2]byte][20]byte{
-				{0, 1}: {1, 2, 3},
-			},
 			wantPeerAddrs: []net.TCPAddr{
 				{IP: net.ParseIP("127.0.0.1"), Port: 6881},
 			},
@@ -482,7 +603,6 @@ func TestOnGetPeersResponse(t *testing.T) {
 		{
 			name: "Multiple Peers",
 			msg: &Message{
-				T: []byte{0, 2},
 				R: ResponseValues{
 					Values: []CompactPeer{
 						{IP: net.ParseIP("127.0.0.1"), Port: 6881},
@@ -491,9 +611,6 @@ func TestOnGetPeersResponse(t *testing.T) {
 				},
 			},
 			addr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6881},
-			getPeersReq: map[[2]byte][20]byte{
-				{0, 2}: {4, 5, 6},
-			},
 			wantPeerAddrs: []net.TCPAddr{
 				{IP: net.ParseIP("127.0.0.1"), Port: 6881},
 				{IP: net.ParseIP("127.0.0.2"), Port: 6882},
@@ -503,15 +620,11 @@ func TestOnGetPeersResponse(t *testing.T) {
 		{
 			name: "No Peers",
 			msg: &Message{
-				T: []byte{0, 3},
 				R: ResponseValues{
 					Values: []CompactPeer{},
 				},
 			},
-			addr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6881},
-			getPeersReq: map[[2]byte][20]byte{
-				{0, 3}: {7, 8, 9},
-			},
+			addr:          &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6881},
 			wantPeerAddrs: []net.TCPAddr{},
 			wantInfoHash:  [20]byte{7, 8, 9},
 		},
@@ -521,21 +634,25 @@ func TestOnGetPeersResponse(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			resultChan := make(chan IndexingResult, 1)
 			is := &IndexingService{
-				nodes: newRoutingTable(
+				seenNodes: newSeenHashes(seenNodesSize),
+				peers:     newPeerStore(),
+				nodes4: newRoutingTable(
+					randomNodeID(),
 					10,
 					[]net.IPNet{*cidr},
 				),
 				protocol: &Protocol{
 					transport: transport,
 				},
-				nodeID:           randomNodeID(),
-				getPeersRequests: tt.getPeersReq,
+				nodeID:       randomNodeID(),
+				transactions: newTransactionManager(transactionTimeout),
 				eventHandlers: IndexingServiceEventHandlers{
 					OnResult: func(result IndexingResult) {
 						resultChan <- result
 					},
 				},
 			}
+			tt.msg.T = is.transactions.issue(queryGetPeers, *tt.addr, tt.wantInfoHash)
 			is.onGetPeersResponse(tt.msg, tt.addr)
 			time.Sleep(time.Second)
 
@@ -561,16 +678,96 @@ func TestOnGetPeersResponse(t *testing.T) {
 	}
 }
 
+func TestOnGetPeersResponse_Unsolicited(t *testing.T) {
+	t.Parallel()
+
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6881}
+	values := []CompactPeer{{IP: net.ParseIP("127.0.0.1"), Port: 6881}}
+
+	tests := []struct {
+		name string
+		t    func(tm *transactionManager) []byte
+	}{
+		{"unknown transaction", func(tm *transactionManager) []byte { return []byte{0, 1} }},
+		{"queried another node", func(tm *transactionManager) []byte {
+			return tm.issue(queryGetPeers, net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 6881}, [20]byte{1})
+		}},
+		{"answer to another query", func(tm *transactionManager) []byte {
+			return tm.issue(queryFindNode, *addr, [20]byte{})
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			called := make(chan IndexingResult, 1)
+			is := &IndexingService{
+				seenNodes:    newSeenHashes(seenNodesSize),
+				peers:        newPeerStore(),
+				nodes4:       newRoutingTable(randomNodeID(), 10, nil),
+				transactions: newTransactionManager(transactionTimeout),
+				eventHandlers: IndexingServiceEventHandlers{
+					OnResult: func(result IndexingResult) { called <- result },
+				},
+			}
+			msg := NewGetPeersResponseWithValues(tt.t(is.transactions), randomNodeID(), []byte("token"), values, nil, nil)
+			is.onGetPeersResponse(msg, addr)
+
+			select {
+			case result := <-called:
+				t.Errorf("onGetPeersResponse() called OnResult with %v", result)
+			case <-time.After(100 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestOnGetPeersResponse_Lookup(t *testing.T) {
+	t.Parallel()
+
+	infoHash := [20]byte{1, 2, 3}
+	addr := net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6881}
+	responder := CompactNodeInfo{ID: randomNodeID(), Addr: addr}
+
+	called := make(chan IndexingResult, 1)
+	is := &IndexingService{
+		seenNodes:    newSeenHashes(seenNodesSize),
+		peers:        newPeerStore(),
+		nodes4:       newRoutingTable(randomNodeID(), 10, nil),
+		transactions: newTransactionManager(transactionTimeout),
+		lookups:      newLookups(),
+		eventHandlers: IndexingServiceEventHandlers{
+			OnResult: func(result IndexingResult) { called <- result },
+		},
+	}
+	is.lookups.begin(infoHash, []CompactNodeInfo{responder}, time.Now())
+	is.lookups.next(infoHash)
+
+	values := []CompactPeer{{IP: net.ParseIP("1.2.3.4"), Port: 6881}, {IP: net.ParseIP("1.2.3.5"), Port: 0}}
+	msg := NewGetPeersResponseWithValues(
+		is.transactions.issue(queryLookup, addr, infoHash), responder.ID, []byte("token"), values, nil, nil,
+	)
+	is.onGetPeersResponse(msg, &addr)
+
+	select {
+	case result := <-called:
+		if result.InfoHash() != infoHash || len(result.PeerAddrs()) != 1 || result.PeerAddrs()[0].Port != 6881 {
+			t.Errorf("onGetPeersResponse() got result %v", result)
+		}
+	case <-time.After(time.Second):
+		t.Error("onGetPeersResponse() did not finish the lookup")
+	}
+}
+
 func TestOnSampleInfohashesResponse(t *testing.T) {
 	t.Parallel()
 
 	_, cidr, _ := net.ParseCIDR("127.0.0.0/8")
 	transport := &Transport{
-		conn:           &net.UDPConn{},
-		started:        true,
-		onMessage:      func(*Message, *net.UDPAddr) {},
-		throttlingRate: 0,
-		maxNeighbors:   10,
+		started:      true,
+		onMessage:    func(*Message, *net.UDPAddr) {},
+		maxNeighbors: 10,
 	}
 
 	tests := []struct {
@@ -578,7 +775,8 @@ func TestOnSampleInfohashesResponse(t *testing.T) {
 		msg            *Message
 		addr           *net.UDPAddr
 		wantInfoHashes [][20]byte
-		wantNodes      []net.UDPAddr
+		// The responder itself is not sampled again before the interval it returned.
+		wantNodes []net.UDPAddr
 	}{
 		{
 			name: "Single InfoHash",
@@ -588,7 +786,7 @@ func TestOnSampleInfohashesResponse(t *testing.T) {
 					Num:      1,
 					Interval: 30,
 					Nodes: []CompactNodeInfo{
-						{Addr: net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6881}},
+						{ID: randomNodeID(), Addr: net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6881}},
 					},
 				},
 			},
@@ -596,9 +794,7 @@ func TestOnSampleInfohashesResponse(t *testing.T) {
 			wantInfoHashes: [][20]byte{
 				{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
 			},
-			wantNodes: []net.UDPAddr{
-				{IP: net.ParseIP("127.0.0.1"), Port: 6881},
-			},
+			wantNodes: []net.UDPAddr{},
 		},
 		{
 			name: "Multiple InfoHashes",
@@ -611,8 +807,8 @@ func TestOnSampleInfohashesResponse(t *testing.T) {
 					Num:      2,
 					Interval: 30,
 					Nodes: []CompactNodeInfo{
-						{Addr: net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6881}},
-						{Addr: net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 6882}},
+						{ID: randomNodeID(), Addr: net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6881}},
+						{ID: randomNodeID(), Addr: net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 6882}},
 					},
 				},
 			},
@@ -622,7 +818,6 @@ func TestOnSampleInfohashesResponse(t *testing.T) {
 				{21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34, 35, 36, 37, 38, 39, 40},
 			},
 			wantNodes: []net.UDPAddr{
-				{IP: net.ParseIP("127.0.0.1"), Port: 6881},
 				{IP: net.ParseIP("127.0.0.2"), Port: 6882},
 			},
 		},
@@ -634,37 +829,42 @@ func TestOnSampleInfohashesResponse(t *testing.T) {
 					Num:      0,
 					Interval: 30,
 					Nodes: []CompactNodeInfo{
-						{Addr: net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6881}},
+						{ID: randomNodeID(), Addr: net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6881}},
 					},
 				},
 			},
 			addr:           &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6881},
 			wantInfoHashes: [][20]byte{},
-			wantNodes: []net.UDPAddr{
-				{IP: net.ParseIP("127.0.0.1"), Port: 6881},
-			},
+			wantNodes:      []net.UDPAddr{},
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			is := &IndexingService{
-				nodes: newRoutingTable(
+				seenNodes: newSeenHashes(seenNodesSize),
+				peers:     newPeerStore(),
+				nodes4: newRoutingTable(
+					randomNodeID(),
 					10,
 					[]net.IPNet{*cidr},
 				),
 				protocol: &Protocol{
 					transport: transport,
 				},
-				nodeID:           randomNodeID(),
-				getPeersRequests: make(map[[2]byte][20]byte),
+				nodeID:       randomNodeID(),
+				transactions: newTransactionManager(transactionTimeout),
+				seenHashes:   newSeenHashes(seenHashesSize),
+				sources:      newHashSources(seenHashesSize),
+				coverage:     new(coverage),
 			}
+			tt.msg.T = is.transactions.issue(querySampleInfohashes, *tt.addr, [20]byte{})
 			is.onSampleInfohashesResponse(tt.msg, tt.addr)
 			time.Sleep(time.Second)
 
-			gotNodes := is.nodes.getNodes()
+			gotNodes := is.nodes4.getNodes()
 			if len(gotNodes) != len(tt.wantNodes) {
-				t.Errorf("onSampleInfohashesResponse() got %d nodes, want %d nodes", len(gotNodes), len(tt.wantNodes))
+				t.Fatalf("onSampleInfohashesResponse() got %d nodes, want %d nodes", len(gotNodes), len(tt.wantNodes))
 			}
 
 			// Sort slices for a stable comparison
@@ -676,6 +876,12 @@ func TestOnSampleInfohashesResponse(t *testing.T) {
 					t.Errorf("onSampleInfohashesResponse() got node %v, want node %v", gotNode, tt.wantNodes[i])
 				}
 			}
+
+			for _, wantHash := range tt.wantInfoHashes {
+				if is.seenHashes.add(wantHash) {
+					t.Errorf("onSampleInfohashesResponse() did not record info hash %v", wantHash)
+				}
+			}
 		})
 	}
 }
@@ -685,18 +891,21 @@ func TestOnGetPeersQuery(t *testing.T) {
 
 	_, cidr, _ := net.ParseCIDR("127.0.0.0/8")
 	is := &IndexingService{
-		nodes: newRoutingTable(
+		seenNodes: newSeenHashes(seenNodesSize),
+		peers:     newPeerStore(),
+		nodes4: newRoutingTable(
+			randomNodeID(),
 			10,
 			[]net.IPNet{*cidr},
 		),
-		protocol: NewProtocol("0.0.0.0:0", ProtocolEventHandlers{}, 1000),
+		protocol: NewProtocol("0.0.0.0:0", ProtocolEventHandlers{}, 1000, Internet),
 	}
 	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6881}
 
 	is.onGetPeersQuery(NewGetPeersQuery(randomNodeID(), randomNodeID()), addr)
 	time.Sleep(time.Second)
 
-	gotNodes := is.nodes.getNodes()
+	gotNodes := is.nodes4.getNodes()
 	if len(gotNodes) != 1 {
 		t.Errorf("onGetPeersQuery() got %d nodes, want 1 node", len(gotNodes))
 	}
@@ -706,3 +915,312 @@ func TestOnGetPeersQuery(t *testing.T) {
 		}
 	}
 }
+
+func TestUpdateExternalIP(t *testing.T) {
+	t.Parallel()
+
+	is := &IndexingService{
+		seenNodes:  newSeenHashes(seenNodesSize),
+		peers:      newPeerStore(),
+		nodeID:     randomNodeID(),
+		nodes4:     newRoutingTable(randomNodeID(), 10, nil),
+		externalIP: newExternalIP(),
+	}
+	external := net.ParseIP("124.31.75.21")
+	reported, _ := CompactPeers{{IP: external, Port: 6881}}.MarshalBinary()
+
+	for i := range externalIPVotes {
+		is.updateExternalIP(&Message{IP: reported}, &net.UDPAddr{IP: net.IPv4(1, 1, 1, byte(i)), Port: 6881})
+	}
+
+	if !isBEP42Compliant(is.id(), external) {
+		t.Errorf("expected the node ID %x to be derived from %s", is.id(), external)
+	}
+	if !bytes.Equal(is.nodes4.self[:], is.id()) {
+		t.Error("expected the routing table to follow the new node ID")
+	}
+}
+
+func TestUpdateExternalIP_Compliant(t *testing.T) {
+	t.Parallel()
+
+	external := net.ParseIP("124.31.75.21")
+	nodeID := bep42NodeID(external)
+	is := &IndexingService{
+		laddr:      "127.0.0.1:64201",
+		nodeID:     nodeID,
+		nodes4:     newRoutingTable(nodeID, 10, nil),
+		externalIP: newExternalIP(),
+	}
+	reported, _ := CompactPeers{{IP: external, Port: 6881}}.MarshalBinary()
+
+	for i := range externalIPVotes {
+		is.updateExternalIP(&Message{IP: reported}, &net.UDPAddr{IP: net.IPv4(1, 1, 1, byte(i)), Port: 6881})
+	}
+
+	// The node ID already derived from the address is kept, but the address is reported.
+	if !bytes.Equal(is.id(), nodeID) {
+		t.Errorf("expected the node ID %x to be kept, got %x", nodeID, is.id())
+	}
+	if addr := stats.GetInstance().DHTSummary().ExternalAddresses[is.laddr]; addr != external.String() {
+		t.Errorf("expected the external address %s to be reported, got %q", external, addr)
+	}
+}
+
+func TestSetNodeID(t *testing.T) {
+	t.Parallel()
+
+	is := NewIndexingService("127.0.0.1:0", 10, IndexingServiceEventHandlers{}, nil, nil, "", false, Internet)
+	nodeID := randomNodeID()
+	is.SetNodeID(nodeID)
+	is.SetRateLimits(RateLimits{Queries: 10, Burst: time.Second})
+	if !bytes.Equal(is.id(), nodeID) || !bytes.Equal(is.nodes4.self[:], nodeID) {
+		t.Errorf("expected the node ID %x, got %x", nodeID, is.id())
+	}
+	if is.protocol.transport.limiter.limits.Queries != 10 || is.protocol.transport.limiter.indexer != "127.0.0.1:0" {
+		t.Errorf("expected the rate limits of the indexer, got %+v", is.protocol.transport.limiter)
+	}
+
+	// A fixed node ID is kept whatever our external address.
+	is.externalIP = newExternalIP()
+	reported, _ := CompactPeers{{IP: net.ParseIP("124.31.75.21"), Port: 6881}}.MarshalBinary()
+	for i := range externalIPVotes {
+		is.updateExternalIP(&Message{IP: reported}, &net.UDPAddr{IP: net.IPv4(1, 1, 1, byte(i)), Port: 6881})
+	}
+	if !bytes.Equal(is.id(), nodeID) {
+		t.Errorf("expected the fixed node ID %x, got %x", nodeID, is.id())
+	}
+}
+
+// goodCitizenService returns a service in good citizen mode whose routing table holds nodes, and
+// a socket to which the service answers.
+func goodCitizenService(t *testing.T, nodes []CompactNodeInfo) (*IndexingService, *net.UDPConn) {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &Transport{
+		started:      true,
+		onMessage:    func(*Message, *net.UDPAddr) {},
+		numWorkers:   1,
+		limiter:      newLimiter("", DefaultRateLimits, time.Now()),
+		maxNeighbors: 10,
+	}
+	transport.serve([]net.PacketConn{conn})
+	t.Cleanup(func() {
+		transport.Terminate()
+		_ = remote.Close()
+	})
+
+	_, cidr, _ := net.ParseCIDR("127.0.0.0/8")
+	is := &IndexingService{
+		nodes4:      newRoutingTable(make([]byte, 20), 10, []net.IPNet{*cidr}),
+		seenNodes:   newSeenHashes(seenNodesSize),
+		peers:       newPeerStore(),
+		nodeID:      randomNodeID(),
+		goodCitizen: true,
+		protocol: &Protocol{
+			transport:   transport,
+			tokenSecret: []byte("secret"),
+		},
+	}
+	is.nodes4.addNodes(nodes)
+
+	return is, remote
+}
+
+func readResponse(t *testing.T, conn *net.UDPConn) *Message {
+	t.Helper()
+
+	buf := make([]byte, 2048)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("no response: %v", err)
+	}
+	msg := new(Message)
+	if err := bencode.Unmarshal(buf[:n], msg); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	return msg
+}
+
+func TestOnFindNodeQuery_GoodCitizen(t *testing.T) {
+	t.Parallel()
+
+	nodes := withBucketIDs([]net.UDPAddr{
+		{IP: net.IPv4(127, 0, 0, 11), Port: 1111},
+		{IP: net.IPv4(127, 0, 0, 12), Port: 2222},
+		{IP: net.IPv4(127, 0, 0, 13), Port: 3333},
+	})
+	is, remote := goodCitizenService(t, nodes)
+
+	msg := &Message{T: []byte("aa"), A: QueryArguments{ID: randomNodeID(), Target: append([]byte{0x20}, make([]byte, 19)...)}}
+	is.onFindNodeQuery(msg, remote.LocalAddr().(*net.UDPAddr))
+
+	// Distances from 0x20: 0xa0, 0x60 and 0x00, with their real IDs.
+	response := readResponse(t, remote)
+	want := []CompactNodeInfo{nodes[2], nodes[1], nodes[0]}
+	if len(response.R.Nodes) != len(want) {
+		t.Fatalf("expected %d nodes, got %v", len(want), response.R.Nodes)
+	}
+	for i, node := range response.R.Nodes {
+		if !reflect.DeepEqual(node.ID, want[i].ID) || node.Addr.Port != want[i].Addr.Port {
+			t.Errorf("node %d: expected %v, got %v", i, want[i], node)
+		}
+	}
+}
+
+func TestOnGetPeersQuery_GoodCitizen(t *testing.T) {
+	t.Parallel()
+
+	nodes := withBucketIDs([]net.UDPAddr{{IP: net.IPv4(127, 0, 0, 11), Port: 1111}})
+	is, remote := goodCitizenService(t, nodes)
+
+	msg := &Message{T: []byte("aa"), A: QueryArguments{ID: randomNodeID(), InfoHash: randomNodeID()}}
+	is.onGetPeersQuery(msg, remote.LocalAddr().(*net.UDPAddr))
+
+	response := readResponse(t, remote)
+	if len(response.R.Values) != 0 {
+		t.Errorf("expected no values, got %v", response.R.Values)
+	}
+	if len(response.R.Nodes) != 1 || !reflect.DeepEqual(response.R.Nodes[0].ID, nodes[0].ID) {
+		t.Errorf("expected the node of the routing table, got %v", response.R.Nodes)
+	}
+	if !is.protocol.VerifyToken(remote.LocalAddr().(*net.UDPAddr).IP, response.R.Token) {
+		t.Error("expected a valid token")
+	}
+}
+
+func TestOnGetPeersQuery_StoredPeers(t *testing.T) {
+	t.Parallel()
+
+	is, remote := goodCitizenService(t, nil)
+	infoHash := [20]byte(randomNodeID())
+	is.peers.add(infoHash, []net.TCPAddr{{IP: net.IPv4(1, 2, 3, 4), Port: 6881}}, true, time.Now())
+	is.peers.add(infoHash, []net.TCPAddr{{IP: net.IPv4(5, 6, 7, 8), Port: 6882}}, false, time.Now())
+
+	msg := &Message{T: []byte("aa"), A: QueryArguments{ID: randomNodeID(), InfoHash: infoHash[:], Scrape: 1}}
+	is.onGetPeersQuery(msg, remote.LocalAddr().(*net.UDPAddr))
+
+	response := readResponse(t, remote)
+	if len(response.R.Values) != 2 {
+		t.Errorf("expected the 2 stored peers, got %v", response.R.Values)
+	}
+	if response.R.BFsd == nil || response.R.BFpe == nil {
+		t.Fatal("expected the Bloom filters of the seeds and of the peers")
+	}
+	if seeds := response.R.BFsd.Estimate(); seeds < 0.5 || seeds > 1.5 {
+		t.Errorf("expected about 1 seed, got %f", seeds)
+	}
+	if !is.protocol.VerifyToken(remote.LocalAddr().(*net.UDPAddr).IP, response.R.Token) {
+		t.Error("expected a valid token")
+	}
+}
+
+func TestOnSampleInfohashesQuery(t *testing.T) {
+	t.Parallel()
+
+	nodes := withBucketIDs([]net.UDPAddr{{IP: net.IPv4(127, 0, 0, 11), Port: 1111}})
+	is, remote := goodCitizenService(t, nodes)
+	is.transactions = newTransactionManager(transactionTimeout)
+	for i := range 3 {
+		is.peers.add([20]byte{byte(i)}, []net.TCPAddr{{IP: net.IPv4(1, 2, 3, 4), Port: 6881}}, false, time.Now())
+	}
+
+	msg := &Message{T: []byte("aa"), A: QueryArguments{ID: randomNodeID(), Target: randomNodeID()}}
+	is.onSampleInfohashesQuery(msg, remote.LocalAddr().(*net.UDPAddr))
+
+	// The sender is asked for its neighbours as well: skip that query.
+	response := readResponse(t, remote)
+	for response.Y != "r" {
+		response = readResponse(t, remote)
+	}
+	if response.R.Num != 3 || len(response.R.Samples) != 3*20 {
+		t.Errorf("expected 3 samples, got %d (%d bytes)", response.R.Num, len(response.R.Samples))
+	}
+	if response.R.Interval != sampleInterval {
+		t.Errorf("expected an interval of %d, got %d", sampleInterval, response.R.Interval)
+	}
+	if len(response.R.Nodes) != 1 || !reflect.DeepEqual(response.R.Nodes[0].ID, nodes[0].ID) {
+		t.Errorf("expected the node of the routing table, got %v", response.R.Nodes)
+	}
+}
+
+func TestOnError(t *testing.T) {
+	t.Parallel()
+
+	addr := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 1111}
+	id := []byte{0x80, 19: 0x01}
+	is := &IndexingService{
+		nodes4:       newRoutingTable(make([]byte, 20), 10, nil),
+		transactions: newTransactionManager(transactionTimeout),
+	}
+	is.nodes4.markSeen(id, *addr)
+
+	// A node that does not implement BEP 51 is left alone, without harming its reputation.
+	msg := &Message{
+		Y: "e",
+		T: is.transactions.issue(querySampleInfohashes, *addr, [20]byte{}),
+		E: Error{Code: methodUnknown, Message: []byte("Method Unknown")},
+	}
+	is.onError(msg, addr)
+	time.Sleep(100 * time.Millisecond)
+
+	is.nodes4.RLock()
+	node := is.nodes4.nodes[[20]byte(id)]
+	if node.krpcErrors[methodUnknown] != 1 || node.reputation() != 1 {
+		t.Errorf("unexpected errors %v and reputation %f", node.krpcErrors, node.reputation())
+	}
+	if time.Until(node.nextSample) < unsupportedSampleInterval-time.Minute {
+		t.Errorf("expected the sampling to be postponed, got %s", node.nextSample)
+	}
+	is.nodes4.RUnlock()
+
+	// An error that answers no query of ours is ignored.
+	is.onError(msg, addr)
+	time.Sleep(100 * time.Millisecond)
+
+	is.nodes4.RLock()
+	defer is.nodes4.RUnlock()
+	if node.krpcErrors[methodUnknown] != 1 {
+		t.Errorf("expected an unsolicited error to be ignored, got %v", node.krpcErrors)
+	}
+}
+
+func TestOnMetadata(t *testing.T) {
+	t.Parallel()
+
+	addr := net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 1111}
+	id := []byte{0x80, 19: 0x01}
+	is := &IndexingService{
+		nodes4:  newRoutingTable(make([]byte, 20), 10, nil),
+		sources: newHashSources(seenHashesSize),
+		peers:   newPeerStore(),
+	}
+	is.bootstrapper = newBootstrapper("", nil, nil, func(ip net.IP) bool { return is.table(ip) != nil })
+	is.nodes4.markSeen(id, addr)
+	is.sources.add([20]byte{1}, addr)
+	is.peers.add([20]byte{1}, []net.TCPAddr{{IP: net.IPv4(2, 2, 2, 2), Port: 2222}}, false, time.Now())
+
+	is.OnMetadata([20]byte{1})
+	is.OnMetadata([20]byte{1})
+	is.OnMetadata([20]byte{2})
+
+	is.nodes4.RLock()
+	defer is.nodes4.RUnlock()
+	if got := is.nodes4.nodes[[20]byte(id)].metadata; got != 1 {
+		t.Errorf("expected the node to be credited once, got %d", got)
+	}
+
+	// The peers of the torrent are kept to bootstrap from.
+	if len(is.bootstrapper.peers) != 1 || is.bootstrapper.peers[0].String() != "2.2.2.2:2222" {
+		t.Errorf("expected the peer to be kept to bootstrap from, got %v", is.bootstrapper.peers)
+	}
+}
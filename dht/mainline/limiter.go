@@ -0,0 +1,165 @@
+package mainline
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"tgragnato.it/magnetico/v2/stats"
+)
+
+// RateLimits are the budgets of the messages sent by an indexer, in messages per second. A budget
+// <= 0 is unlimited.
+type RateLimits struct {
+	// Queries is the budget of our own crawling. The get_peers and find_node queries, sent for
+	// every sampled infohash and every node learned, spend what the other queries leave and are
+	// dropped when it runs out; the other queries wait for it.
+	Queries float64
+	// Responses is the budget for answering the queries of the other nodes. The responses that
+	// exceed it are dropped.
+	Responses float64
+	// PerDestination caps the messages sent to each IP address, so that a single chatty node does
+	// not soak up the budget for responses.
+	PerDestination float64
+	// Burst is how long the unused budgets are saved up for.
+	Burst time.Duration
+}
+
+// Rate limits that transport will have at Start time.
+var DefaultRateLimits = RateLimits{Queries: -1, Responses: -1, PerDestination: -1, Burst: time.Second}
+
+// destinationSweep is how often the buckets of the destinations that are not sent any more
+// messages are forgotten.
+const destinationSweep = time.Minute
+
+// tokenBucket grants rate tokens per second, and saves up to burst of them.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst time.Duration, now time.Time) *tokenBucket {
+	size := max(rate*burst.Seconds(), 1)
+	return &tokenBucket{rate: rate, burst: size, tokens: size, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// take spends a token if there is one.
+func (b *tokenBucket) take(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// reserve spends a token, possibly in advance, and returns how long to wait before it is granted.
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.refill(now)
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// limiter enforces the RateLimits of the indexer, whose address labels the metrics.
+type limiter struct {
+	sync.Mutex
+	indexer      string
+	limits       RateLimits
+	queries      *tokenBucket
+	responses    *tokenBucket
+	destinations map[string]*tokenBucket
+	lastSweep    time.Time
+}
+
+func newLimiter(indexer string, limits RateLimits, now time.Time) *limiter {
+	l := &limiter{
+		indexer:      indexer,
+		limits:       limits,
+		destinations: make(map[string]*tokenBucket),
+		lastSweep:    now,
+	}
+	if limits.Queries > 0 {
+		l.queries = newTokenBucket(limits.Queries, limits.Burst, now)
+	}
+	if limits.Responses > 0 {
+		l.responses = newTokenBucket(limits.Responses, limits.Burst, now)
+	}
+	return l
+}
+
+// allow spends the tokens for sending msg to ip, and returns how long to wait before sending it.
+// Our get_peers and find_node queries and the responses are dropped when they exceed their
+// budgets, while our other queries are always sent, possibly later.
+func (l *limiter) allow(msg *Message, ip net.IP, now time.Time) (time.Duration, bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	destination := l.destination(ip, now)
+
+	if msg.Y == "q" {
+		crawl := msg.Q == "get_peers" || msg.Q == "find_node"
+		if crawl && l.queries != nil && !l.queries.take(now) {
+			go stats.GetInstance().IncRateDropped(l.indexer, "queries")
+			return 0, false
+		}
+		var wait time.Duration
+		if destination != nil {
+			wait = destination.reserve(now)
+		}
+		if !crawl && l.queries != nil {
+			wait = max(wait, l.queries.reserve(now))
+		}
+		go stats.GetInstance().IncRateToken(l.indexer, "queries")
+		return wait, true
+	}
+
+	if destination != nil && !destination.take(now) {
+		go stats.GetInstance().IncRateDropped(l.indexer, "destination")
+		return 0, false
+	}
+	if l.responses != nil && !l.responses.take(now) {
+		if destination != nil {
+			destination.tokens++
+		}
+		go stats.GetInstance().IncRateDropped(l.indexer, "responses")
+		return 0, false
+	}
+	go stats.GetInstance().IncRateToken(l.indexer, "responses")
+	return 0, true
+}
+
+// destination returns the bucket of ip, or nil if the messages to each destination are unlimited.
+func (l *limiter) destination(ip net.IP, now time.Time) *tokenBucket {
+	if l.limits.PerDestination <= 0 {
+		return nil
+	}
+
+	if now.Sub(l.lastSweep) >= destinationSweep {
+		for key, bucket := range l.destinations {
+			if bucket.refill(now); bucket.tokens >= bucket.burst {
+				delete(l.destinations, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	key := ip.String()
+	bucket, ok := l.destinations[key]
+	if !ok {
+		bucket = newTokenBucket(l.limits.PerDestination, l.limits.Burst, now)
+		l.destinations[key] = bucket
+	}
+	return bucket
+}
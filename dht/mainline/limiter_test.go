@@ -0,0 +1,148 @@
+package mainline
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	b := newTokenBucket(10, 500*time.Millisecond, now)
+
+	// A full bucket grants its burst at once.
+	for i := range 5 {
+		if !b.take(now) {
+			t.Fatalf("expected the token %d of the burst", i)
+		}
+	}
+	if b.take(now) {
+		t.Fatal("expected the bucket to be empty after its burst")
+	}
+
+	// At 10 tokens per second, a token is granted every 100ms.
+	if !b.take(now.Add(100 * time.Millisecond)) {
+		t.Error("expected a token after 100ms")
+	}
+	if wait := b.reserve(now.Add(100 * time.Millisecond)); wait != 100*time.Millisecond {
+		t.Errorf("expected to wait 100ms for a reserved token, got %s", wait)
+	}
+	if wait := b.reserve(now.Add(100 * time.Millisecond)); wait != 200*time.Millisecond {
+		t.Errorf("expected to wait 200ms for the next reserved token, got %s", wait)
+	}
+
+	// The unused tokens are saved up to the burst.
+	b.refill(now.Add(time.Hour))
+	if b.tokens != 5 {
+		t.Errorf("expected a full bucket of 5 tokens, got %f", b.tokens)
+	}
+
+	// A bucket holds at least a token.
+	if b := newTokenBucket(1, 0, now); b.burst != 1 {
+		t.Errorf("expected a burst of 1, got %f", b.burst)
+	}
+}
+
+func TestLimiter_allow(t *testing.T) {
+	t.Parallel()
+
+	ip := net.IPv4(1, 1, 1, 1)
+	response := &Message{Y: "r"}
+	ping := &Message{Y: "q", Q: "ping"}
+	findNode := &Message{Y: "q", Q: "find_node"}
+
+	t.Run("unlimited", func(t *testing.T) {
+		t.Parallel()
+
+		now := time.Now()
+		l := newLimiter("", RateLimits{}, now)
+		for _, msg := range []*Message{response, ping, findNode} {
+			if wait, ok := l.allow(msg, ip, now); !ok || wait != 0 {
+				t.Errorf("expected %q to be sent at once, got %s and %v", msg.Q, wait, ok)
+			}
+		}
+	})
+
+	t.Run("responses", func(t *testing.T) {
+		t.Parallel()
+
+		now := time.Now()
+		l := newLimiter("", RateLimits{Queries: 1, Responses: 2, Burst: time.Second}, now)
+		for range 2 {
+			if _, ok := l.allow(response, ip, now); !ok {
+				t.Fatal("expected the responses within the budget to be sent")
+			}
+		}
+		if _, ok := l.allow(response, ip, now); ok {
+			t.Error("expected the responses beyond the budget to be dropped")
+		}
+
+		// Our own crawling has a separate budget.
+		if wait, ok := l.allow(ping, ip, now); !ok || wait != 0 {
+			t.Errorf("expected the query to be sent at once, got %s and %v", wait, ok)
+		}
+	})
+
+	t.Run("queries", func(t *testing.T) {
+		t.Parallel()
+
+		now := time.Now()
+		l := newLimiter("", RateLimits{Queries: 1, Burst: time.Second}, now)
+
+		// find_node takes the only token without waiting, and the next one is dropped.
+		if wait, ok := l.allow(findNode, ip, now); !ok || wait != 0 {
+			t.Errorf("expected find_node to be sent at once, got %s and %v", wait, ok)
+		}
+		if _, ok := l.allow(findNode, ip, now); ok {
+			t.Error("expected find_node to be dropped without a token")
+		}
+
+		// ping waits for the next token, which find_node cannot take in the meantime.
+		if wait, ok := l.allow(ping, ip, now); !ok || wait != time.Second {
+			t.Errorf("expected ping to wait 1s, got %s and %v", wait, ok)
+		}
+		if _, ok := l.allow(findNode, ip, now.Add(time.Second)); ok {
+			t.Error("expected find_node to be dropped while ping waits for the token")
+		}
+		if wait, ok := l.allow(findNode, ip, now.Add(2*time.Second)); !ok || wait != 0 {
+			t.Errorf("expected find_node to be sent once the budget is back, got %s and %v", wait, ok)
+		}
+	})
+
+	t.Run("per destination", func(t *testing.T) {
+		t.Parallel()
+
+		now := time.Now()
+		l := newLimiter("", RateLimits{Responses: 2, PerDestination: 1, Burst: time.Second}, now)
+		if _, ok := l.allow(response, ip, now); !ok {
+			t.Fatal("expected the first response to the node to be sent")
+		}
+		if _, ok := l.allow(response, ip, now); ok {
+			t.Error("expected the second response to the node to be dropped")
+		}
+		if _, ok := l.allow(response, net.IPv4(2, 2, 2, 2), now); !ok {
+			t.Error("expected a response to another node to be sent")
+		}
+
+		// The response dropped for the whole budget gives back the token of its destination.
+		if _, ok := l.allow(response, net.IPv4(3, 3, 3, 3), now); ok {
+			t.Error("expected the response beyond the budget to be dropped")
+		}
+		if l.destinations["3.3.3.3"].tokens != 1 {
+			t.Errorf("expected the token of the destination to be given back, got %f", l.destinations["3.3.3.3"].tokens)
+		}
+
+		// Our queries wait for their destination instead of being dropped.
+		if wait, ok := l.allow(ping, ip, now); !ok || wait != time.Second {
+			t.Errorf("expected the query to wait 1s, got %s and %v", wait, ok)
+		}
+
+		// The buckets of the idle destinations are forgotten.
+		l.allow(response, net.IPv4(4, 4, 4, 4), now.Add(destinationSweep))
+		if len(l.destinations) != 1 {
+			t.Errorf("expected only the last destination, got %d", len(l.destinations))
+		}
+	})
+}
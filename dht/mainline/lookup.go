@@ -0,0 +1,214 @@
+package mainline
+
+import (
+	"bytes"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// lookupAlpha is the number of get_peers queries of a lookup that are in flight at once.
+	lookupAlpha = 3
+	// lookupK is the number of nodes, the closest to the info hash, that must have answered for a
+	// lookup to converge.
+	lookupK = 8
+	// lookupMaxCandidates bounds the nodes remembered by a lookup: the farthest ones are dropped.
+	lookupMaxCandidates = 4 * lookupK
+	// lookupMaxQueries bounds the number of queries of a single lookup.
+	lookupMaxQueries = 64
+	// lookupTimeout is the time after which a lookup that has not converged yet is finished
+	// anyway, with the peers gathered so far.
+	lookupTimeout = 30 * time.Second
+)
+
+type lookupNode struct {
+	addr     net.UDPAddr
+	distance [20]byte
+	queried  bool
+	failed   bool
+}
+
+type lookup struct {
+	started time.Time
+	nodes   []*lookupNode // sorted by distance from the info hash
+	known   map[string]struct{}
+	pending map[string]struct{} // queries in flight, by address
+	queries int
+	peers   []net.TCPAddr
+	seen    map[string]struct{}
+}
+
+// lookups keeps the state of the iterative get_peers lookups in progress. Each of them walks
+// towards its info hash through the `nodes` and `nodes6` of the responses, and gathers the
+// `values` returned along the way.
+type lookups struct {
+	sync.Mutex
+	lookups map[[20]byte]*lookup
+}
+
+func newLookups() *lookups {
+	return &lookups{
+		lookups: map[[20]byte]*lookup{},
+	}
+}
+
+// begin registers a new lookup, seeded with the nodes of the routing table closest to the info
+// hash. It returns false if the info hash is already being looked up.
+func (ls *lookups) begin(infoHash [20]byte, seeds []CompactNodeInfo, now time.Time) bool {
+	ls.Lock()
+	defer ls.Unlock()
+
+	if _, ok := ls.lookups[infoHash]; ok {
+		return false
+	}
+	l := &lookup{
+		started: now,
+		known:   map[string]struct{}{},
+		pending: map[string]struct{}{},
+		seen:    map[string]struct{}{},
+	}
+	l.add(infoHash, seeds)
+	ls.lookups[infoHash] = l
+	return true
+}
+
+// add merges nodes into the candidates of the lookup, keeping them sorted by distance.
+func (l *lookup) add(infoHash [20]byte, nodes []CompactNodeInfo) {
+	for _, node := range nodes {
+		if len(node.ID) != 20 {
+			continue
+		}
+		key := node.Addr.String()
+		if _, ok := l.known[key]; ok {
+			continue
+		}
+		l.known[key] = struct{}{}
+
+		var id [20]byte
+		copy(id[:], node.ID)
+		l.nodes = append(l.nodes, &lookupNode{addr: node.Addr, distance: distance(id, infoHash)})
+	}
+
+	slices.SortStableFunc(l.nodes, func(a, b *lookupNode) int {
+		return bytes.Compare(a.distance[:], b.distance[:])
+	})
+	if len(l.nodes) > lookupMaxCandidates {
+		l.nodes = l.nodes[:lookupMaxCandidates]
+	}
+}
+
+// next returns the nodes to be queried, that is the closest ones that have not been queried yet,
+// within the lookupAlpha queries in flight. It reports whether the lookup has converged: the
+// lookupK closest nodes that did not fail have all answered.
+func (ls *lookups) next(infoHash [20]byte) ([]net.UDPAddr, bool) {
+	ls.Lock()
+	defer ls.Unlock()
+
+	l, ok := ls.lookups[infoHash]
+	if !ok {
+		return nil, false
+	}
+
+	addrs := []net.UDPAddr{}
+	considered := 0
+	for _, node := range l.nodes {
+		if considered >= lookupK || len(l.pending) >= lookupAlpha || l.queries >= lookupMaxQueries {
+			break
+		}
+		if node.failed {
+			continue
+		}
+		considered++
+		if node.queried {
+			continue
+		}
+		node.queried = true
+		l.pending[node.addr.String()] = struct{}{}
+		l.queries++
+		addrs = append(addrs, node.addr)
+	}
+
+	return addrs, len(addrs) == 0 && len(l.pending) == 0
+}
+
+// onResponse records the answer of the node at addr: its peers are gathered, and the nodes it
+// returned become candidates. It returns false if the lookup is unknown or already finished.
+func (ls *lookups) onResponse(infoHash [20]byte, addr net.UDPAddr, peers []net.TCPAddr, nodes []CompactNodeInfo) bool {
+	ls.Lock()
+	defer ls.Unlock()
+
+	l, ok := ls.lookups[infoHash]
+	if !ok {
+		return false
+	}
+	delete(l.pending, addr.String())
+
+	for _, peer := range peers {
+		key := peer.String()
+		if _, ok := l.seen[key]; ok {
+			continue
+		}
+		l.seen[key] = struct{}{}
+		l.peers = append(l.peers, peer)
+	}
+	l.add(infoHash, nodes)
+
+	return true
+}
+
+// onTimeout records that the node at addr did not answer, so that it no longer counts among the
+// closest nodes.
+func (ls *lookups) onTimeout(infoHash [20]byte, addr net.UDPAddr) {
+	ls.Lock()
+	defer ls.Unlock()
+
+	l, ok := ls.lookups[infoHash]
+	if !ok {
+		return
+	}
+	key := addr.String()
+	delete(l.pending, key)
+	for _, node := range l.nodes {
+		if node.addr.String() == key {
+			node.failed = true
+		}
+	}
+}
+
+// finish forgets a lookup and returns the peers that it gathered. It returns false if the lookup
+// is unknown or found no peers.
+func (ls *lookups) finish(infoHash [20]byte) (IndexingResult, bool) {
+	ls.Lock()
+	defer ls.Unlock()
+
+	l, ok := ls.lookups[infoHash]
+	if !ok {
+		return IndexingResult{}, false
+	}
+	delete(ls.lookups, infoHash)
+
+	if len(l.peers) == 0 {
+		return IndexingResult{}, false
+	}
+	return IndexingResult{
+		infoHash:  infoHash,
+		peerAddrs: l.peers,
+	}, true
+}
+
+// expire returns the info hashes of the lookups that have been running for longer than
+// lookupTimeout.
+func (ls *lookups) expire(now time.Time) [][20]byte {
+	ls.Lock()
+	defer ls.Unlock()
+
+	expired := [][20]byte{}
+	for infoHash, l := range ls.lookups {
+		if now.Sub(l.started) > lookupTimeout {
+			expired = append(expired, infoHash)
+		}
+	}
+	return expired
+}
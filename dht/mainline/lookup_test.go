@@ -0,0 +1,130 @@
+package mainline
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func lookupTestNode(id byte, port int) CompactNodeInfo {
+	nodeID := make([]byte, 20)
+	nodeID[0] = id
+	return CompactNodeInfo{ID: nodeID, Addr: net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: port}}
+}
+
+func TestLookups_begin(t *testing.T) {
+	t.Parallel()
+
+	ls := newLookups()
+	if !ls.begin([20]byte{1}, nil, time.Now()) {
+		t.Error("expected the first lookup to begin")
+	}
+	if ls.begin([20]byte{1}, nil, time.Now()) {
+		t.Error("expected a lookup in progress not to begin again")
+	}
+}
+
+func TestLookups_next(t *testing.T) {
+	t.Parallel()
+
+	ls := newLookups()
+	if addrs, converged := ls.next([20]byte{1}); len(addrs) != 0 || converged {
+		t.Error("expected nothing from an unknown lookup")
+	}
+
+	// The nodes are queried from the closest to the info hash, lookupAlpha at a time.
+	ls.begin([20]byte{}, []CompactNodeInfo{
+		lookupTestNode(0x40, 4), lookupTestNode(0x10, 1), lookupTestNode(0x30, 3), lookupTestNode(0x20, 2),
+	}, time.Now())
+
+	addrs, converged := ls.next([20]byte{})
+	if converged || len(addrs) != lookupAlpha {
+		t.Fatalf("expected %d queries, got %v (converged %v)", lookupAlpha, addrs, converged)
+	}
+	for i, addr := range addrs {
+		if addr.Port != i+1 {
+			t.Errorf("expected query %d to go to port %d, got %d", i, i+1, addr.Port)
+		}
+	}
+	if addrs, _ := ls.next([20]byte{}); len(addrs) != 0 {
+		t.Errorf("expected no more queries in flight, got %v", addrs)
+	}
+
+	// A closer node learned from a response is queried before the farther ones.
+	ls.onResponse([20]byte{}, addrs[0], nil, []CompactNodeInfo{lookupTestNode(0x01, 5)})
+	if addrs, _ := ls.next([20]byte{}); len(addrs) != 1 || addrs[0].Port != 5 {
+		t.Errorf("expected the closer node to be queried, got %v", addrs)
+	}
+}
+
+func TestLookups_converge(t *testing.T) {
+	t.Parallel()
+
+	ls := newLookups()
+	infoHash := [20]byte{}
+	ls.begin(infoHash, []CompactNodeInfo{lookupTestNode(0x10, 1), lookupTestNode(0x20, 2)}, time.Now())
+	addrs, _ := ls.next(infoHash)
+
+	peer := net.TCPAddr{IP: net.IPv4(2, 2, 2, 2), Port: 6881}
+	ls.onResponse(infoHash, addrs[0], []net.TCPAddr{peer, peer}, nil)
+	if _, converged := ls.next(infoHash); converged {
+		t.Error("expected the lookup not to converge with a query in flight")
+	}
+
+	// A node that does not answer no longer holds the lookup back.
+	ls.onTimeout(infoHash, addrs[1])
+	if _, converged := ls.next(infoHash); !converged {
+		t.Error("expected the lookup to converge")
+	}
+
+	result, ok := ls.finish(infoHash)
+	if !ok || result.InfoHash() != infoHash || len(result.PeerAddrs()) != 1 || !result.PeerAddrs()[0].IP.Equal(peer.IP) {
+		t.Errorf("unexpected result %v (%v)", result, ok)
+	}
+	if _, ok := ls.finish(infoHash); ok {
+		t.Error("expected a finished lookup to be forgotten")
+	}
+}
+
+func TestLookups_finishWithoutPeers(t *testing.T) {
+	t.Parallel()
+
+	ls := newLookups()
+	ls.begin([20]byte{1}, nil, time.Now())
+	if _, ok := ls.finish([20]byte{1}); ok {
+		t.Error("expected no result without peers")
+	}
+}
+
+func TestLookups_expire(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	ls := newLookups()
+	ls.begin([20]byte{1}, nil, now.Add(-2*lookupTimeout))
+	ls.begin([20]byte{2}, nil, now)
+
+	expired := ls.expire(now)
+	if len(expired) != 1 || expired[0] != [20]byte{1} {
+		t.Errorf("unexpected expired lookups %v", expired)
+	}
+}
+
+func TestLookups_maxCandidates(t *testing.T) {
+	t.Parallel()
+
+	ls := newLookups()
+	nodes := []CompactNodeInfo{}
+	for i := range 2 * lookupMaxCandidates {
+		nodes = append(nodes, lookupTestNode(byte(i+1), i+1))
+	}
+	ls.begin([20]byte{}, nodes, time.Now())
+
+	l := ls.lookups[[20]byte{}]
+	if len(l.nodes) != lookupMaxCandidates {
+		t.Fatalf("expected %d candidates, got %d", lookupMaxCandidates, len(l.nodes))
+	}
+	if last := l.nodes[len(l.nodes)-1]; last.addr.Port != lookupMaxCandidates {
+		t.Errorf("expected the farthest nodes to be dropped, last candidate is %v", last.addr)
+	}
+}
@@ -0,0 +1,72 @@
+package mainline
+
+import (
+	"context"
+	"net"
+
+	"golang.org/x/net/ipv4"
+)
+
+// Network is where the transports bind their sockets and the bootstrap nodes are resolved: the
+// Internet, or a simulated network in the tests and benchmarks.
+type Network interface {
+	// ListenPacket binds n sockets to address, sharing its port.
+	ListenPacket(network string, address string, n int) ([]net.PacketConn, error)
+	// LookupIP returns the addresses of host.
+	LookupIP(host string) ([]net.IP, error)
+}
+
+// Internet is the Network of the UDP sockets and of the resolver of the host.
+var Internet Network = internet{}
+
+type internet struct{}
+
+// ListenPacket binds n UDP sockets to address. When there are several, they share the port with
+// SO_REUSEPORT.
+func (internet) ListenPacket(network string, address string, n int) ([]net.PacketConn, error) {
+	lc := net.ListenConfig{}
+	if n > 1 {
+		lc.Control = reusePort
+	}
+
+	conns := []net.PacketConn{}
+	for range max(n, 1) {
+		conn, err := lc.ListenPacket(context.Background(), network, address)
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, conn)
+		// The other sockets bind the port that has been assigned to the first one.
+		address = conn.LocalAddr().String()
+	}
+	return conns, nil
+}
+
+func (internet) LookupIP(host string) ([]net.IP, error) {
+	return net.LookupIP(host)
+}
+
+// packetBatch reads and writes the datagrams of the packet conns other than the UDP sockets, one
+// at a time.
+type packetBatch struct {
+	net.PacketConn
+}
+
+func (c packetBatch) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	n, addr, err := c.ReadFrom(ms[0].Buffers[0])
+	if err != nil {
+		return 0, err
+	}
+	ms[0].N, ms[0].Addr = n, addr
+	return 1, nil
+}
+
+func (c packetBatch) WriteBatch(ms []ipv4.Message, flags int) (int, error) {
+	if _, err := c.WriteTo(ms[0].Buffers[0], ms[0].Addr); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
@@ -0,0 +1,167 @@
+package mainline
+
+import (
+	mrand "math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// maxStoredHashes bounds the info hashes held by the peerStore: when it is full, a random
+	// swarm makes room for the new one.
+	maxStoredHashes = 1 << 14
+	// maxStoredPeers bounds the peers held for every info hash.
+	maxStoredPeers = 100
+	// storedPeerTTL is how long a peer is held after it was last announced or learned. BEP 5
+	// clients re-announce every 30 minutes or so.
+	storedPeerTTL = 30 * time.Minute
+	// maxReturnedPeers is the maximum number of `values` of a get_peers response, which must fit
+	// in a single UDP packet.
+	maxReturnedPeers = 50
+	// maxSamples is the maximum number of info hashes of a sample_infohashes response.
+	maxSamples = 20
+	// sampleInterval is the `interval` of our sample_infohashes responses, in seconds.
+	sampleInterval = 300
+)
+
+type storedPeer struct {
+	addr    net.TCPAddr
+	seed    bool
+	expires time.Time
+}
+
+// peerStore holds the peers announced to us and the ones found by our get_peers queries, so that
+// the indexer can answer get_peers and sample_infohashes queries like any other node.
+type peerStore struct {
+	sync.Mutex
+	swarms map[[20]byte]map[string]*storedPeer
+}
+
+func newPeerStore() *peerStore {
+	return &peerStore{
+		swarms: map[[20]byte]map[string]*storedPeer{},
+	}
+}
+
+// add stores peers of infoHash, or extends their lifetime if they are already known.
+func (ps *peerStore) add(infoHash [20]byte, peers []net.TCPAddr, seed bool, now time.Time) {
+	if len(peers) == 0 {
+		return
+	}
+
+	ps.Lock()
+	defer ps.Unlock()
+
+	swarm, ok := ps.swarms[infoHash]
+	if !ok {
+		if len(ps.swarms) >= maxStoredHashes {
+			for evicted := range ps.swarms {
+				delete(ps.swarms, evicted)
+				break
+			}
+		}
+		swarm = map[string]*storedPeer{}
+		ps.swarms[infoHash] = swarm
+	}
+
+	for _, addr := range peers {
+		key := addr.String()
+		if peer, ok := swarm[key]; ok {
+			peer.seed = seed
+			peer.expires = now.Add(storedPeerTTL)
+			continue
+		}
+		if len(swarm) >= maxStoredPeers {
+			// The peer that would expire first makes room for the new one.
+			var oldest string
+			for k, peer := range swarm {
+				if oldest == "" || peer.expires.Before(swarm[oldest].expires) {
+					oldest = k
+				}
+			}
+			delete(swarm, oldest)
+		}
+		swarm[key] = &storedPeer{addr: addr, seed: seed, expires: now.Add(storedPeerTTL)}
+	}
+}
+
+// peers returns up to maxReturnedPeers live peers of infoHash, of the IPv4 or of the IPv6 family.
+func (ps *peerStore) peers(infoHash [20]byte, ipv4 bool, now time.Time) []CompactPeer {
+	ps.Lock()
+	defer ps.Unlock()
+
+	peers := []CompactPeer{}
+	for _, peer := range ps.swarms[infoHash] {
+		if len(peers) >= maxReturnedPeers {
+			break
+		}
+		if now.After(peer.expires) || (peer.addr.IP.To4() != nil) != ipv4 {
+			continue
+		}
+		peers = append(peers, CompactPeer{IP: peer.addr.IP, Port: peer.addr.Port})
+	}
+	return peers
+}
+
+// bloomFilters returns the BEP 33 Bloom filters of the seeds and of the other peers of infoHash.
+func (ps *peerStore) bloomFilters(infoHash [20]byte, now time.Time) (*BloomFilter, *BloomFilter) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	seeds, peers := NewBloomFilter(), NewBloomFilter()
+	for _, peer := range ps.swarms[infoHash] {
+		if now.After(peer.expires) {
+			continue
+		}
+		if peer.seed {
+			seeds.InsertIP(peer.addr.IP)
+		} else {
+			peers.InsertIP(peer.addr.IP)
+		}
+	}
+	return seeds, peers
+}
+
+// sample returns up to n random info hashes for which we hold peers, concatenated, together with
+// the number of info hashes held.
+func (ps *peerStore) sample(n int) ([]byte, int) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	// Reservoir sampling over the whole store.
+	samples := make([][20]byte, 0, n)
+	i := 0
+	for infoHash := range ps.swarms {
+		if len(samples) < n {
+			samples = append(samples, infoHash)
+		} else if j := mrand.IntN(i + 1); j < n {
+			samples[j] = infoHash
+		}
+		i++
+	}
+
+	concatenated := make([]byte, 0, len(samples)*20)
+	for _, infoHash := range samples {
+		concatenated = append(concatenated, infoHash[:]...)
+	}
+	return concatenated, len(ps.swarms)
+}
+
+// expire forgets the peers that have not been announced again within storedPeerTTL, and the info
+// hashes left without peers.
+func (ps *peerStore) expire(now time.Time) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	for infoHash, swarm := range ps.swarms {
+		for key, peer := range swarm {
+			if now.After(peer.expires) {
+				delete(swarm, key)
+			}
+		}
+		if len(swarm) == 0 {
+			delete(ps.swarms, infoHash)
+		}
+	}
+}
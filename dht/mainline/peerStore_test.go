@@ -0,0 +1,129 @@
+package mainline
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPeerStore_add(t *testing.T) {
+	t.Parallel()
+
+	ps := newPeerStore()
+	now := time.Now()
+	infoHash := [20]byte{1}
+
+	ps.add(infoHash, nil, false, now)
+	if len(ps.swarms) != 0 {
+		t.Fatal("expected no swarm without peers")
+	}
+
+	ps.add(infoHash, []net.TCPAddr{{IP: net.IPv4(1, 1, 1, 1), Port: 1111}}, false, now)
+	ps.add(infoHash, []net.TCPAddr{{IP: net.IPv4(1, 1, 1, 1), Port: 1111}}, true, now.Add(time.Minute))
+	if len(ps.swarms[infoHash]) != 1 {
+		t.Fatalf("expected a known peer to be stored once, got %d", len(ps.swarms[infoHash]))
+	}
+	peer := ps.swarms[infoHash]["1.1.1.1:1111"]
+	if !peer.seed || !peer.expires.Equal(now.Add(time.Minute+storedPeerTTL)) {
+		t.Errorf("expected a known peer to be refreshed, got %+v", peer)
+	}
+
+	// The peer that would expire first makes room for the new ones.
+	for i := range maxStoredPeers {
+		ps.add(infoHash, []net.TCPAddr{{IP: net.IPv4(2, 2, byte(i/256), byte(i)), Port: 2222}}, false, now.Add(time.Hour))
+	}
+	if len(ps.swarms[infoHash]) != maxStoredPeers {
+		t.Errorf("expected %d peers, got %d", maxStoredPeers, len(ps.swarms[infoHash]))
+	}
+	if _, ok := ps.swarms[infoHash]["1.1.1.1:1111"]; ok {
+		t.Error("expected the oldest peer to be evicted")
+	}
+}
+
+func TestPeerStore_peers(t *testing.T) {
+	t.Parallel()
+
+	ps := newPeerStore()
+	now := time.Now()
+	infoHash := [20]byte{1}
+	ps.add(infoHash, []net.TCPAddr{
+		{IP: net.IPv4(1, 1, 1, 1), Port: 1111},
+		{IP: net.ParseIP("2001:db8::1"), Port: 2222},
+	}, false, now)
+	ps.add(infoHash, []net.TCPAddr{{IP: net.IPv4(3, 3, 3, 3), Port: 3333}}, false, now.Add(-storedPeerTTL-time.Second))
+
+	peers := ps.peers(infoHash, true, now)
+	if len(peers) != 1 || peers[0].Port != 1111 {
+		t.Errorf("expected the live IPv4 peer, got %v", peers)
+	}
+	peers = ps.peers(infoHash, false, now)
+	if len(peers) != 1 || peers[0].Port != 2222 {
+		t.Errorf("expected the IPv6 peer, got %v", peers)
+	}
+	if peers := ps.peers([20]byte{2}, true, now); len(peers) != 0 {
+		t.Errorf("expected no peers for an unknown info hash, got %v", peers)
+	}
+}
+
+func TestPeerStore_bloomFilters(t *testing.T) {
+	t.Parallel()
+
+	ps := newPeerStore()
+	now := time.Now()
+	infoHash := [20]byte{1}
+	ps.add(infoHash, []net.TCPAddr{{IP: net.IPv4(1, 1, 1, 1), Port: 1111}}, true, now)
+	ps.add(infoHash, []net.TCPAddr{
+		{IP: net.IPv4(2, 2, 2, 2), Port: 2222},
+		{IP: net.IPv4(3, 3, 3, 3), Port: 3333},
+	}, false, now)
+
+	seeds, peers := ps.bloomFilters(infoHash, now)
+	if estimate := seeds.Estimate(); estimate < 0.5 || estimate > 1.5 {
+		t.Errorf("expected about 1 seed, got %f", estimate)
+	}
+	if estimate := peers.Estimate(); estimate < 1.5 || estimate > 2.5 {
+		t.Errorf("expected about 2 peers, got %f", estimate)
+	}
+}
+
+func TestPeerStore_sample(t *testing.T) {
+	t.Parallel()
+
+	ps := newPeerStore()
+	if samples, num := ps.sample(maxSamples); len(samples) != 0 || num != 0 {
+		t.Errorf("expected no samples, got %d (%d bytes)", num, len(samples))
+	}
+
+	for i := range 2 * maxSamples {
+		ps.add([20]byte{byte(i)}, []net.TCPAddr{{IP: net.IPv4(1, 1, 1, 1), Port: 1111}}, false, time.Now())
+	}
+	samples, num := ps.sample(maxSamples)
+	if num != 2*maxSamples || len(samples) != maxSamples*20 {
+		t.Fatalf("expected %d samples out of %d, got %d bytes out of %d", maxSamples, 2*maxSamples, len(samples), num)
+	}
+	seen := map[[20]byte]bool{}
+	for i := 0; i < len(samples); i += 20 {
+		infoHash := [20]byte(samples[i : i+20])
+		if _, ok := ps.swarms[infoHash]; !ok || seen[infoHash] {
+			t.Errorf("unexpected sample %x", infoHash)
+		}
+		seen[infoHash] = true
+	}
+}
+
+func TestPeerStore_expire(t *testing.T) {
+	t.Parallel()
+
+	ps := newPeerStore()
+	now := time.Now()
+	ps.add([20]byte{1}, []net.TCPAddr{{IP: net.IPv4(1, 1, 1, 1), Port: 1111}}, false, now)
+	ps.add([20]byte{2}, []net.TCPAddr{{IP: net.IPv4(2, 2, 2, 2), Port: 2222}}, false, now.Add(time.Hour))
+
+	ps.expire(now.Add(storedPeerTTL + time.Second))
+	if _, ok := ps.swarms[[20]byte{1}]; ok {
+		t.Error("expected the expired swarm to be forgotten")
+	}
+	if _, ok := ps.swarms[[20]byte{2}]; !ok {
+		t.Error("expected the live swarm to be kept")
+	}
+}
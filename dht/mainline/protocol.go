@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/sha1"
+	"errors"
 	mrand "math/rand/v2"
 	"net"
+	"slices"
 	"sync"
 	"time"
 
@@ -13,11 +15,12 @@ import (
 )
 
 type Protocol struct {
-	tokenSecret   []byte
-	tokenLock     sync.Mutex
-	transport     *Transport
-	eventHandlers ProtocolEventHandlers
-	started       bool
+	tokenSecret         []byte
+	previousTokenSecret []byte
+	tokenLock           sync.Mutex
+	transport           *Transport
+	eventHandlers       ProtocolEventHandlers
+	started             bool
 }
 
 type ProtocolEventHandlers struct {
@@ -32,12 +35,17 @@ type ProtocolEventHandlers struct {
 	// Added by BEP 51
 	OnSampleInfohashesQuery    func(*Message, *net.UDPAddr)
 	OnSampleInfohashesResponse func(*Message, *net.UDPAddr)
+
+	// OnError receives the KRPC error messages, and OnInvalidResponse the responses that do not
+	// carry the keys required by their kind.
+	OnError           func(*Message, *net.UDPAddr)
+	OnInvalidResponse func(*Message, *net.UDPAddr)
 }
 
-func NewProtocol(laddr string, eventHandlers ProtocolEventHandlers, maxNeighbors uint) (p *Protocol) {
+func NewProtocol(laddr string, eventHandlers ProtocolEventHandlers, maxNeighbors uint, network Network) (p *Protocol) {
 	p = new(Protocol)
 	p.eventHandlers = eventHandlers
-	p.transport = NewTransport(laddr, p.onMessage, maxNeighbors)
+	p.transport = NewTransport(laddr, p.onMessage, maxNeighbors, network)
 	return
 }
 
@@ -130,6 +138,7 @@ func (p *Protocol) onMessage(msg *Message, addr *net.UDPAddr) {
 		// sample_infohashes > get_peers > find_node > ping / announce_peer
 		if len(msg.R.Samples) != 0 { // The message should be a sample_infohashes response.
 			if !validateSampleInfohashesResponseMessage(msg) {
+				p.onInvalidResponse(msg, addr)
 				return
 			}
 			if p.eventHandlers.OnSampleInfohashesResponse != nil {
@@ -137,6 +146,7 @@ func (p *Protocol) onMessage(msg *Message, addr *net.UDPAddr) {
 			}
 		} else if len(msg.R.Token) != 0 { // The message should be a get_peers response.
 			if !validateGetPeersResponseMessage(msg) {
+				p.onInvalidResponse(msg, addr)
 				return
 			}
 			if p.eventHandlers.OnGetPeersResponse != nil {
@@ -144,6 +154,7 @@ func (p *Protocol) onMessage(msg *Message, addr *net.UDPAddr) {
 			}
 		} else if len(msg.R.Nodes) != 0 || len(msg.R.Nodes6) != 0 { // The message should be a find_node response.
 			if !validateFindNodeResponseMessage(msg) {
+				p.onInvalidResponse(msg, addr)
 				return
 			}
 			if p.eventHandlers.OnFindNodeResponse != nil {
@@ -151,24 +162,42 @@ func (p *Protocol) onMessage(msg *Message, addr *net.UDPAddr) {
 			}
 		} else { // The message should be a ping or an announce_peer response.
 			if !validatePingORannouncePeerResponseMessage(msg) {
+				p.onInvalidResponse(msg, addr)
 				return
 			}
 			if p.eventHandlers.OnPingORAnnouncePeerResponse != nil {
 				p.eventHandlers.OnPingORAnnouncePeerResponse(msg, addr)
 			}
 		}
+	case "e":
+		if !validateErrorMessage(msg) {
+			return
+		}
+		if p.eventHandlers.OnError != nil {
+			p.eventHandlers.OnError(msg, addr)
+		}
 	default:
 	}
 }
 
-func (p *Protocol) SendMessage(msg *Message, addr *net.UDPAddr) {
+func (p *Protocol) onInvalidResponse(msg *Message, addr *net.UDPAddr) {
+	if p.eventHandlers.OnInvalidResponse != nil {
+		p.eventHandlers.OnInvalidResponse(msg, addr)
+	}
+}
+
+// SendMessage sends msg to addr, and reports whether it was sent.
+func (p *Protocol) SendMessage(msg *Message, addr *net.UDPAddr) bool {
 	if addr.Port < 1 || addr.Port > 65535 {
-		return
+		return false
 	}
 
-	if err := p.transport.WriteMessages(msg, addr); err != nil {
+	// The messages dropped by the limiter are counted by it.
+	err := p.transport.WriteMessages(msg, addr)
+	if err != nil && !errors.Is(err, errRateLimited) {
 		go stats.GetInstance().IncUDPError(true)
 	}
+	return err == nil
 }
 
 func NewPingQuery(id []byte) *Message {
@@ -206,6 +235,13 @@ func NewGetPeersQuery(id []byte, infoHash []byte) *Message {
 	}
 }
 
+// NewGetPeersScrapeQuery builds a get_peers query asking for the BFsd/BFpe Bloom filters of BEP 33.
+func NewGetPeersScrapeQuery(id []byte, infoHash []byte) *Message {
+	msg := NewGetPeersQuery(id, infoHash)
+	msg.A.Scrape = 1
+	return msg
+}
+
 func NewAnnouncePeerQuery(id []byte, implied_port bool, info_hash []byte, port uint16, token []byte) *Message {
 	if implied_port {
 		return &Message{
@@ -258,24 +294,14 @@ func NewPingResponse(t []byte, id []byte) *Message {
 }
 
 func NewFindNodeResponse(t []byte, id []byte, nodes []CompactNodeInfo) *Message {
-	// Assumes that all nodes are IPv4 or all are IPv6.
-	if len(nodes) > 0 && nodes[0].Addr.IP.To4() != nil {
-		return &Message{
-			Y: "r",
-			T: t,
-			R: ResponseValues{
-				ID:    id,
-				Nodes: nodes,
-			},
-		}
-	}
-
+	nodes4, nodes6 := splitFamilies(nodes)
 	return &Message{
 		Y: "r",
 		T: t,
 		R: ResponseValues{
 			ID:     id,
-			Nodes6: nodes,
+			Nodes:  nodes4,
+			Nodes6: nodes6,
 		},
 	}
 }
@@ -295,30 +321,62 @@ func NewGetPeersResponseWithValues(t []byte, id []byte, token []byte, values []C
 }
 
 func NewGetPeersResponseWithNodes(t []byte, id []byte, token []byte, nodes []CompactNodeInfo) *Message {
+	nodes4, nodes6 := splitFamilies(nodes)
 	return &Message{
 		Y: "r",
 		T: t,
 		R: ResponseValues{
-			ID:    id,
-			Token: token,
-			Nodes: nodes,
+			ID:     id,
+			Token:  token,
+			Nodes:  nodes4,
+			Nodes6: nodes6,
 		},
 	}
 }
 
-func NewSampleInfohashesResponse(t []byte, id []byte, info_hashes []byte) *Message {
+func NewSampleInfohashesResponse(t []byte, id []byte, info_hashes []byte, num int, interval int, nodes []CompactNodeInfo) *Message {
+	nodes4, nodes6 := splitFamilies(nodes)
 	return &Message{
 		Y: "r",
 		T: t,
 		R: ResponseValues{
 			ID:       id,
-			Interval: 30,
-			Num:      len(info_hashes) / 20,
+			Nodes:    nodes4,
+			Nodes6:   nodes6,
+			Interval: interval,
+			Num:      num,
 			Samples:  info_hashes,
 		},
 	}
 }
 
+// NewErrorMessage builds the KRPC error of code, answering the query of the transaction t.
+func NewErrorMessage(t []byte, code int, message string) *Message {
+	return &Message{
+		Y: "e",
+		T: t,
+		E: Error{
+			Code:    code,
+			Message: []byte(message),
+		},
+	}
+}
+
+// splitFamilies separates the IPv4 nodes, which go in the `nodes` key of a response, from the
+// IPv6 ones, which go in the `nodes6` key (BEP 32). The `nodes` key is present even when empty, as
+// BEP 5 requires it.
+func splitFamilies(nodes []CompactNodeInfo) (nodes4 []CompactNodeInfo, nodes6 []CompactNodeInfo) {
+	nodes4 = []CompactNodeInfo{}
+	for _, node := range nodes {
+		if node.Addr.IP.To4() != nil {
+			nodes4 = append(nodes4, node)
+		} else {
+			nodes6 = append(nodes6, node)
+		}
+	}
+	return
+}
+
 func NewAnnouncePeerResponse(t []byte, id []byte) *Message {
 	// Because they are indistinguishable.
 	return NewPingResponse(t, id)
@@ -327,26 +385,35 @@ func NewAnnouncePeerResponse(t []byte, id []byte) *Message {
 func (p *Protocol) CalculateToken(address net.IP) []byte {
 	p.tokenLock.Lock()
 	defer p.tokenLock.Unlock()
-	sum := sha1.Sum(append(p.tokenSecret, address...))
+	sum := sha1.Sum(append(slices.Clip(p.tokenSecret), address...))
 	return sum[:]
 }
 
+// VerifyToken accepts the tokens calculated with either the current or the previous secret, so
+// that a token stays valid for at least 10 minutes as recommended by BEP 5.
 func (p *Protocol) VerifyToken(address net.IP, token []byte) bool {
 	p.tokenLock.Lock()
 	defer p.tokenLock.Unlock()
 	// Compare the provided token with the calculated token
-	calculatedToken := sha1.Sum(append(p.tokenSecret, address...))
-	return bytes.Equal(calculatedToken[:], token)
+	calculatedToken := sha1.Sum(append(slices.Clip(p.tokenSecret), address...))
+	if bytes.Equal(calculatedToken[:], token) {
+		return true
+	}
+	if p.previousTokenSecret == nil {
+		return false
+	}
+	previousToken := sha1.Sum(append(slices.Clip(p.previousTokenSecret), address...))
+	return bytes.Equal(previousToken[:], token)
 }
 
 func (p *Protocol) updateTokenSecret() {
 	p.tokenLock.Lock()
 	defer p.tokenLock.Unlock()
+	p.previousTokenSecret = p.tokenSecret
+	p.tokenSecret = make([]byte, 20)
 	_, err := rand.Read(p.tokenSecret)
 	if err != nil {
-		len := mrand.IntN(256)
-		p.tokenSecret = make([]byte, len)
-		for i := range len {
+		for i := range p.tokenSecret {
 			p.tokenSecret[i] = byte(mrand.IntN(256))
 		}
 	}
@@ -369,7 +436,7 @@ func validateGetPeersQueryMessage(msg *Message) bool {
 func validateAnnouncePeerQueryMessage(msg *Message) bool {
 	return len(msg.A.ID) == 20 &&
 		len(msg.A.InfoHash) == 20 &&
-		msg.A.Port > 0 &&
+		(msg.A.Port > 0 || msg.A.ImpliedPort != 0) &&
 		len(msg.A.Token) > 0
 }
 
@@ -378,6 +445,11 @@ func validateSampleInfohashesQueryMessage(msg *Message) bool {
 		len(msg.A.Target) == 20
 }
 
+func validateErrorMessage(msg *Message) bool {
+	return len(msg.T) > 0 &&
+		msg.E.Code > 0
+}
+
 func validatePingORannouncePeerResponseMessage(msg *Message) bool {
 	return len(msg.R.ID) == 20
 }
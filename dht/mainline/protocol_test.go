@@ -1,8 +1,11 @@
 package mainline
 
 import (
+	"bytes"
 	"net"
 	"testing"
+
+	"tgragnato.it/magnetico/v2/bencode"
 )
 
 var protocolTest_validInstances = []struct {
@@ -202,6 +205,21 @@ var protocolTest_validInstances = []struct {
 			},
 		},
 	},
+	// announce_peer Query with `implied_port` and without `port`:
+	{
+		validator: validateAnnouncePeerQueryMessage,
+		msg: Message{
+			T: []byte("aa"),
+			Y: "q",
+			Q: "announce_peer",
+			A: QueryArguments{
+				ID:          []byte("abcdefghij0123456789"),
+				InfoHash:    []byte("mnopqrstuvwxyz123456"),
+				ImpliedPort: 1,
+				Token:       []byte("aoeusnth"),
+			},
+		},
+	},
 	// sample_infohashes Query
 	{
 		validator: validateSampleInfohashesQueryMessage,
@@ -236,9 +254,21 @@ func TestNewFindNodeQuery(t *testing.T) {
 
 func TestNewFindNodeResponse(t *testing.T) {
 	t.Parallel()
-	if !validateFindNodeResponseMessage(NewFindNodeResponse([]byte("tt"), []byte("qwertyuopasdfghjklzx"), []CompactNodeInfo{})) {
+	empty := NewFindNodeResponse([]byte("tt"), []byte("qwertyuopasdfghjklzx"), []CompactNodeInfo{})
+	if !validateFindNodeResponseMessage(empty) {
 		t.Errorf("NewFindNodeResponse returned an invalid message!")
 	}
+	if data, err := bencode.Marshal(empty); err != nil || !bytes.Contains(data, []byte("5:nodes0:")) {
+		t.Errorf("NewFindNodeResponse returned no nodes key: %q %v", data, err)
+	}
+
+	msg := NewFindNodeResponse([]byte("tt"), []byte("qwertyuopasdfghjklzx"), []CompactNodeInfo{
+		{ID: randomNodeID(), Addr: net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6881}},
+		{ID: randomNodeID(), Addr: net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 6882}},
+	})
+	if len(msg.R.Nodes) != 1 || msg.R.Nodes[0].Addr.Port != 6882 || len(msg.R.Nodes6) != 1 || msg.R.Nodes6[0].Addr.Port != 6881 {
+		t.Errorf("NewFindNodeResponse did not split the address families: %v %v", msg.R.Nodes, msg.R.Nodes6)
+	}
 }
 
 func TestNewPingQuery(t *testing.T) {
@@ -262,11 +292,27 @@ func TestNewGetPeersQuery(t *testing.T) {
 	}
 }
 
+func TestNewGetPeersScrapeQuery(t *testing.T) {
+	t.Parallel()
+	msg := NewGetPeersScrapeQuery([]byte("qwertyuopasdfghjklzx"), []byte("xzlkjhgfdsapouytrewq"))
+	if !validateGetPeersQueryMessage(msg) {
+		t.Errorf("NewGetPeersScrapeQuery returned an invalid message!")
+	}
+	if msg.A.Scrape != 1 {
+		t.Errorf("NewGetPeersScrapeQuery did not set the scrape flag!")
+	}
+}
+
 func TestNewGetPeersResponseWithNodes(t *testing.T) {
 	t.Parallel()
 	if !validateGetPeersResponseMessage(NewGetPeersResponseWithNodes([]byte("tt"), []byte("qwertyuopasdfghjklzx"), []byte("token"), []CompactNodeInfo{})) {
 		t.Errorf("NewGetPeersResponseWithNodes returned an invalid message!")
 	}
+
+	nodes6 := []CompactNodeInfo{{ID: randomNodeID(), Addr: net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6881}}}
+	if msg := NewGetPeersResponseWithNodes([]byte("tt"), randomNodeID(), []byte("token"), nodes6); len(msg.R.Nodes) != 0 || len(msg.R.Nodes6) != 1 {
+		t.Errorf("NewGetPeersResponseWithNodes did not return the IPv6 nodes in nodes6!")
+	}
 }
 
 func TestNewGetPeersResponseWithValues(t *testing.T) {
@@ -278,10 +324,18 @@ func TestNewGetPeersResponseWithValues(t *testing.T) {
 
 func TestNewSampleInfohashesResponse(t *testing.T) {
 	t.Parallel()
-	msg := NewSampleInfohashesResponse([]byte("bb"), []byte("abcdefghij0123456789"), []byte("mnopqrstuvwxyz123456mnopqrstuvwxyz123456"))
+	msg := NewSampleInfohashesResponse([]byte("bb"), []byte("abcdefghij0123456789"), []byte("mnopqrstuvwxyz123456mnopqrstuvwxyz123456"), 2, 60, nil)
 	if !validateSampleInfohashesResponseMessage(msg) {
 		t.Error("validateSampleInfohashesResponseMessage() returned an invalid message!")
 	}
+	if msg.R.Num != 2 || msg.R.Interval != 60 {
+		t.Errorf("unexpected num %d and interval %d", msg.R.Num, msg.R.Interval)
+	}
+
+	nodes6 := []CompactNodeInfo{{ID: randomNodeID(), Addr: net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6881}}}
+	if msg := NewSampleInfohashesResponse([]byte("bb"), randomNodeID(), nil, 0, 60, nodes6); len(msg.R.Nodes6) != 1 {
+		t.Error("NewSampleInfohashesResponse did not return the IPv6 nodes in nodes6!")
+	}
 }
 
 func TestNewAnnouncePeerQuery(t *testing.T) {
@@ -320,7 +374,7 @@ func TestNewProtocol(t *testing.T) {
 		OnPingORAnnouncePeerResponse: service.onPingORAnnouncePeerResponse,
 		OnSampleInfohashesQuery:      service.onSampleInfohashesQuery,
 		OnSampleInfohashesResponse:   service.onSampleInfohashesResponse,
-	}, 1000)
+	}, 1000, Internet)
 	protocol.Start()
 	protocol.Terminate()
 }
@@ -344,7 +398,7 @@ func TestProtocol_Start(t *testing.T) {
 		OnPingORAnnouncePeerResponse: service.onPingORAnnouncePeerResponse,
 		OnSampleInfohashesQuery:      service.onSampleInfohashesQuery,
 		OnSampleInfohashesResponse:   service.onSampleInfohashesResponse,
-	}, 1000)
+	}, 1000, Internet)
 	protocol.Start()
 	protocol.Start()
 }
@@ -368,7 +422,7 @@ func TestProtocol_Terminate(t *testing.T) {
 		OnPingORAnnouncePeerResponse: service.onPingORAnnouncePeerResponse,
 		OnSampleInfohashesQuery:      service.onSampleInfohashesQuery,
 		OnSampleInfohashesResponse:   service.onSampleInfohashesResponse,
-	}, 1000)
+	}, 1000, Internet)
 	protocol.Terminate()
 	protocol.Terminate()
 }
@@ -403,6 +457,26 @@ func TestVerifyToken_InvalidToken(t *testing.T) {
 	}
 }
 
+func TestVerifyToken_PreviousSecret(t *testing.T) {
+	t.Parallel()
+
+	p := &Protocol{}
+	p.updateTokenSecret()
+
+	address := net.IPv4(192, 168, 0, 1)
+	token := p.CalculateToken(address)
+
+	p.updateTokenSecret()
+	if !p.VerifyToken(address, token) {
+		t.Error("VerifyToken returned false for a token of the previous secret")
+	}
+
+	p.updateTokenSecret()
+	if p.VerifyToken(address, token) {
+		t.Error("VerifyToken returned true for an expired token")
+	}
+}
+
 func TestOnMessage_PingQuery(t *testing.T) {
 	t.Parallel()
 
@@ -411,7 +485,7 @@ func TestOnMessage_PingQuery(t *testing.T) {
 		OnPingQuery: func(m *Message, a *net.UDPAddr) {
 			called = true
 		},
-	}, 1000)
+	}, 1000, Internet)
 
 	protocol.onMessage(
 		NewPingQuery([]byte("abcdefghij0123456789")),
@@ -431,7 +505,7 @@ func TestOnMessage_FindNodeQuery(t *testing.T) {
 		OnFindNodeQuery: func(m *Message, a *net.UDPAddr) {
 			called = true
 		},
-	}, 1000)
+	}, 1000, Internet)
 
 	protocol.onMessage(
 		NewFindNodeQuery([]byte("abcdefghij0123456789"), []byte("mnopqrstuvwxyz123456")),
@@ -451,7 +525,7 @@ func TestOnMessage_GetPeersQuery(t *testing.T) {
 		OnGetPeersQuery: func(m *Message, a *net.UDPAddr) {
 			called = true
 		},
-	}, 1000)
+	}, 1000, Internet)
 
 	protocol.onMessage(
 		NewGetPeersQuery([]byte("abcdefghij0123456789"), []byte("mnopqrstuvwxyz123456")),
@@ -471,7 +545,7 @@ func TestOnMessage_AnnouncePeerQuery(t *testing.T) {
 		OnAnnouncePeerQuery: func(m *Message, a *net.UDPAddr) {
 			called = true
 		},
-	}, 1000)
+	}, 1000, Internet)
 
 	protocol.onMessage(
 		NewAnnouncePeerQuery(
@@ -497,7 +571,7 @@ func TestOnMessage_SampleInfohashesQuery(t *testing.T) {
 		OnSampleInfohashesQuery: func(m *Message, a *net.UDPAddr) {
 			called = true
 		},
-	}, 1000)
+	}, 1000, Internet)
 
 	protocol.onMessage(
 		NewSampleInfohashesQuery(
@@ -521,7 +595,7 @@ func TestOnMessage_GetPeersResponse(t *testing.T) {
 		OnGetPeersResponse: func(m *Message, a *net.UDPAddr) {
 			called = true
 		},
-	}, 1000)
+	}, 1000, Internet)
 
 	protocol.onMessage(
 		NewGetPeersResponseWithValues(
@@ -548,7 +622,7 @@ func TestOnMessage_FindNodeResponse(t *testing.T) {
 		OnFindNodeResponse: func(m *Message, a *net.UDPAddr) {
 			called = true
 		},
-	}, 1000)
+	}, 1000, Internet)
 
 	protocol.onMessage(
 		NewFindNodeResponse(
@@ -577,7 +651,7 @@ func TestOnMessage_PingORAnnouncePeerResponse(t *testing.T) {
 		OnPingORAnnouncePeerResponse: func(m *Message, a *net.UDPAddr) {
 			called = true
 		},
-	}, 1000)
+	}, 1000, Internet)
 
 	protocol.onMessage(
 		NewPingResponse([]byte("aa"), []byte("abcdefghij0123456789")),
@@ -597,7 +671,7 @@ func TestOnMessage_SampleInfohashesResponse(t *testing.T) {
 		OnSampleInfohashesResponse: func(m *Message, a *net.UDPAddr) {
 			called = true
 		},
-	}, 1000)
+	}, 1000, Internet)
 
 	protocol.onMessage(
 		&Message{
@@ -623,3 +697,50 @@ func TestOnMessage_SampleInfohashesResponse(t *testing.T) {
 		t.Error("Expected OnSampleInfohashesResponse to be called")
 	}
 }
+
+func TestOnMessage_Error(t *testing.T) {
+	t.Parallel()
+
+	called := false
+	protocol := NewProtocol("0.0.0.0:0", ProtocolEventHandlers{
+		OnError: func(m *Message, a *net.UDPAddr) {
+			called = true
+		},
+	}, 1000, Internet)
+
+	protocol.onMessage(
+		&Message{
+			Y: "e",
+			T: []byte("aa"),
+			E: Error{Code: 202, Message: []byte("Server Error")},
+		},
+		&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881},
+	)
+
+	if !called {
+		t.Error("Expected OnError to be called")
+	}
+}
+
+func TestOnMessage_InvalidResponse(t *testing.T) {
+	t.Parallel()
+
+	invalid, answered := false, false
+	protocol := NewProtocol("0.0.0.0:0", ProtocolEventHandlers{
+		OnInvalidResponse: func(m *Message, a *net.UDPAddr) {
+			invalid = true
+		},
+		OnPingORAnnouncePeerResponse: func(m *Message, a *net.UDPAddr) {
+			answered = true
+		},
+	}, 1000, Internet)
+
+	protocol.onMessage(
+		NewPingResponse([]byte("aa"), []byte("too short")),
+		&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881},
+	)
+
+	if !invalid || answered {
+		t.Error("Expected OnInvalidResponse to be called instead of OnPingORAnnouncePeerResponse")
+	}
+}
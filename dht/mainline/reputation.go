@@ -0,0 +1,186 @@
+package mainline
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"tgragnato.it/magnetico/v2/stats"
+)
+
+const (
+	// quarantineDuration is how long the address of a quarantined node is kept out of the routing
+	// table. The address is the IP and port of the node only, as other nodes may share its IP
+	// address behind a NAT, and the quarantine short, as the address may be reassigned.
+	quarantineDuration = time.Hour
+	// minReputationQueries is the number of queries that a node must have been sent before its
+	// reputation is judged.
+	minReputationQueries = 10
+	// minReputation is the reputation below which a node is quarantined.
+	minReputation = 0.2
+	// honeypotMetadata is the metadata that a node is expected to have produced, at the yield of
+	// the whole table, before it is quarantined for producing none. Nodes that return made up info
+	// hashes, like the honeypots of some monitoring services, end up here.
+	honeypotMetadata = 5
+	// protocolError is the KRPC error code of the malformed queries, among which the announces
+	// with a bad token.
+	protocolError = 203
+	// methodUnknown is the KRPC error code of the nodes that do not implement a query, which says
+	// nothing about their reliability.
+	methodUnknown = 204
+	// otherError stands for the KRPC error codes other than the ones of BEP 5 (201 to 204), which
+	// the remote nodes choose.
+	otherError = 0
+)
+
+// failures counts the queries that the node did not answer properly: the timeouts, the KRPC
+// errors and the invalid responses, which weigh double.
+func (n *rtNode) failures() uint {
+	failures := n.timeouts + 2*n.invalid
+	for code, count := range n.krpcErrors {
+		if code != methodUnknown {
+			failures += count
+		}
+	}
+	return failures
+}
+
+// reputation estimates the reliability of a node between 0 and 1, as the share of our queries
+// that it answered properly. A node that has never been queried has a reputation of 1.
+func (n *rtNode) reputation() float64 {
+	return float64(n.responses+1) / float64(n.responses+n.failures()+1)
+}
+
+// yield compares the share of the new info hashes returned by the node that produced metadata
+// with the share over the whole table, average: above 1 the node returns more useful hashes than
+// the average one.
+func (n *rtNode) yield(average float64) float64 {
+	return (float64(n.metadata) + 1) / (float64(n.newHashes)*average + 1)
+}
+
+// rank orders the nodes that have already been sampled: the ones expected to return the most new
+// info hashes that produce metadata, and to answer, come first.
+func (n *rtNode) rank(average float64) float64 {
+	return n.sampleScore() * n.reputation() * n.yield(average)
+}
+
+// averageYield returns the share of the new info hashes returned by the nodes of the table that
+// produced metadata.
+func (rt *routingTable) averageYield() float64 {
+	if rt.newHashes == 0 {
+		return 0
+	}
+	return float64(rt.metadata) / float64(rt.newHashes)
+}
+
+// recordError accounts a KRPC error with the given code sent by the node at addr.
+func (rt *routingTable) recordError(addr net.UDPAddr, code int) {
+	rt.Lock()
+	defer rt.Unlock()
+
+	node := rt.nodeAt(addr)
+	if node == nil {
+		return
+	}
+	if node.krpcErrors == nil {
+		node.krpcErrors = map[int]uint{}
+	}
+	if code < 201 || code > methodUnknown {
+		code = otherError
+	}
+	node.krpcErrors[code]++
+	rt.judge(node, time.Now())
+}
+
+// recordInvalid accounts a response of the node at addr that lacked the keys required by its kind.
+func (rt *routingTable) recordInvalid(addr net.UDPAddr) {
+	rt.Lock()
+	defer rt.Unlock()
+
+	node := rt.nodeAt(addr)
+	if node == nil {
+		return
+	}
+	node.invalid++
+	rt.judge(node, time.Now())
+}
+
+// recordMetadata credits the node at addr with an info hash that it returned in its samples, and
+// whose metadata has been fetched.
+func (rt *routingTable) recordMetadata(addr net.UDPAddr) {
+	rt.Lock()
+	defer rt.Unlock()
+
+	rt.metadata++
+	if node := rt.nodeAt(addr); node != nil {
+		node.metadata++
+	}
+}
+
+// judge quarantines the node if it answers too few of our queries properly, or if none of the
+// many new info hashes that it returned produced metadata.
+func (rt *routingTable) judge(node *rtNode, now time.Time) {
+	unreliable := node.responses+node.failures() >= minReputationQueries && node.reputation() < minReputation
+	honeypot := node.metadata == 0 && float64(node.newHashes)*rt.averageYield() >= honeypotMetadata
+	if !unreliable && !honeypot {
+		return
+	}
+
+	rt.remove(node.id)
+	rt.quarantined[node.addr.String()] = now.Add(quarantineDuration)
+	go stats.GetInstance().IncRtQuarantine()
+}
+
+// isQuarantined reports whether addr belongs to a node that has been quarantined recently.
+func (rt *routingTable) isQuarantined(addr net.UDPAddr, now time.Time) bool {
+	key := addr.String()
+	until, ok := rt.quarantined[key]
+	if ok && now.After(until) {
+		delete(rt.quarantined, key)
+		return false
+	}
+	return ok
+}
+
+// hashSources remembers the node that returned each info hash sampled recently, so that the
+// metadata fetched for it can be credited to the node. Like seenHashes, it keeps two generations
+// of at most size entries each.
+type hashSources struct {
+	sync.Mutex
+	current  map[[20]byte]net.UDPAddr
+	previous map[[20]byte]net.UDPAddr
+	size     int
+}
+
+func newHashSources(size int) *hashSources {
+	return &hashSources{
+		current:  make(map[[20]byte]net.UDPAddr),
+		previous: make(map[[20]byte]net.UDPAddr),
+		size:     size,
+	}
+}
+
+func (hs *hashSources) add(infoHash [20]byte, addr net.UDPAddr) {
+	hs.Lock()
+	defer hs.Unlock()
+
+	if len(hs.current) >= hs.size {
+		hs.previous = hs.current
+		hs.current = make(map[[20]byte]net.UDPAddr)
+	}
+	hs.current[infoHash] = addr
+}
+
+// pop returns the node that returned infoHash, and forgets it so that it is credited only once.
+func (hs *hashSources) pop(infoHash [20]byte) (net.UDPAddr, bool) {
+	hs.Lock()
+	defer hs.Unlock()
+
+	for _, generation := range []map[[20]byte]net.UDPAddr{hs.current, hs.previous} {
+		if addr, ok := generation[infoHash]; ok {
+			delete(generation, infoHash)
+			return addr, true
+		}
+	}
+	return net.UDPAddr{}, false
+}
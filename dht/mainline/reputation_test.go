@@ -0,0 +1,197 @@
+package mainline
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRtNode_reputation(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		node rtNode
+		want float64
+	}{
+		{"never queried", rtNode{}, 1},
+		{"always answers", rtNode{responses: 9}, 1},
+		{"times out", rtNode{responses: 4, timeouts: 5}, 0.5},
+		{"sends errors", rtNode{responses: 4, krpcErrors: map[int]uint{202: 3, 203: 2}}, 0.5},
+		{"lacks a method", rtNode{responses: 4, krpcErrors: map[int]uint{methodUnknown: 5}}, 1},
+		{"sends invalid responses", rtNode{responses: 4, invalid: 5}, 5.0 / 15},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := tt.node.reputation(); got != tt.want {
+				t.Errorf("reputation() = %f, want %f", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRtNode_yield(t *testing.T) {
+	t.Parallel()
+
+	// At an average yield of 1 in 100, a node that returned 100 new hashes is expected to have
+	// produced 1 metadata.
+	average := 0.01
+	if got := (&rtNode{newHashes: 100, metadata: 1}).yield(average); got != 1 {
+		t.Errorf("expected an average node to yield 1, got %f", got)
+	}
+	if got := (&rtNode{newHashes: 100, metadata: 3}).yield(average); got != 2 {
+		t.Errorf("expected a productive node to yield 2, got %f", got)
+	}
+	if got := (&rtNode{newHashes: 100}).yield(average); got != 0.5 {
+		t.Errorf("expected an unproductive node to yield 0.5, got %f", got)
+	}
+}
+
+func Test_routingTable_judge(t *testing.T) {
+	t.Parallel()
+
+	t.Run("unreliable", func(t *testing.T) {
+		t.Parallel()
+
+		rt := newRoutingTable(make([]byte, 20), 10, nil)
+		addr := net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 1111}
+		rt.markSeen([]byte{0x80, 19: 0x01}, addr)
+
+		for range minReputationQueries - 1 {
+			rt.recordError(addr, 202)
+		}
+		if !rt.contains([]byte{0x80, 19: 0x01}) {
+			t.Fatal("expected the node to be judged only after enough queries")
+		}
+		rt.recordInvalid(addr)
+		if rt.contains([]byte{0x80, 19: 0x01}) {
+			t.Fatal("expected the unreliable node to be quarantined")
+		}
+
+		// The address is kept out of the table, even under another ID, but not the other nodes
+		// sharing its IP address.
+		rt.markSeen([]byte{0x40, 19: 0x01}, addr)
+		if rt.contains([]byte{0x40, 19: 0x01}) {
+			t.Error("expected the quarantined address not to be added back")
+		}
+		rt.markSeen([]byte{0x20, 19: 0x01}, net.UDPAddr{IP: addr.IP, Port: 2222})
+		if !rt.contains([]byte{0x20, 19: 0x01}) {
+			t.Error("expected another port of the IP address to be allowed")
+		}
+
+		rt.Lock()
+		rt.quarantined[addr.String()] = time.Now().Add(-time.Second)
+		rt.Unlock()
+		rt.markSeen([]byte{0x40, 19: 0x01}, addr)
+		if !rt.contains([]byte{0x40, 19: 0x01}) {
+			t.Error("expected the address to be allowed back after the quarantine")
+		}
+	})
+
+	t.Run("honeypot", func(t *testing.T) {
+		t.Parallel()
+
+		rt := newRoutingTable(make([]byte, 20), 10, nil)
+		honest := net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 1111}
+		honeypot := net.UDPAddr{IP: net.IPv4(2, 2, 2, 2), Port: 2222}
+		rt.markSeen([]byte{0x80, 19: 0x01}, honest)
+		rt.markSeen([]byte{0x40, 19: 0x01}, honeypot)
+
+		// Without any metadata, the yield of the nodes is unknown and nobody is quarantined.
+		rt.recordSamples(honeypot, time.Minute, 1000, 500, 500)
+		if !rt.contains([]byte{0x40, 19: 0x01}) {
+			t.Fatal("expected no quarantine before any metadata is fetched")
+		}
+
+		// The honest node produces metadata for 6 of its 100 new hashes: at the resulting yield of
+		// the table, more than 5 are expected out of the 1000 new hashes of the other one.
+		rt.recordSamples(honest, time.Minute, 1000, 100, 100)
+		for range 6 {
+			rt.recordMetadata(honest)
+		}
+		rt.recordSamples(honeypot, time.Minute, 1000, 500, 500)
+		if rt.contains([]byte{0x40, 19: 0x01}) {
+			t.Error("expected the node without metadata to be quarantined")
+		}
+		if !rt.contains([]byte{0x80, 19: 0x01}) {
+			t.Error("expected the honest node to stay")
+		}
+	})
+}
+
+func Test_routingTable_getNodesYield(t *testing.T) {
+	t.Parallel()
+
+	rt := newRoutingTable(make([]byte, 20), 1, nil)
+	productive := net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 1111}
+	unproductive := net.UDPAddr{IP: net.IPv4(2, 2, 2, 2), Port: 2222}
+	rt.markSeen([]byte{0x80, 19: 0x01}, productive)
+	rt.markSeen([]byte{0x40, 19: 0x01}, unproductive)
+
+	// Both nodes store as many hashes and returned as many new ones, but only the hashes of the
+	// first one produced metadata.
+	for _, addr := range []net.UDPAddr{productive, unproductive} {
+		rt.recordSamples(addr, 0, 100, 20, 20)
+	}
+	rt.recordMetadata(productive)
+	rt.recordMetadata(productive)
+
+	rt.Lock()
+	for _, node := range rt.nodes {
+		node.nextSample = time.Time{}
+	}
+	rt.Unlock()
+
+	// With a budget of 1, the quarter reserved to the unsampled nodes is empty.
+	if got := rt.getNodes(); len(got) != 1 || got[0].Port != productive.Port {
+		t.Errorf("expected the productive node first, got %v", got)
+	}
+}
+
+func TestHashSources(t *testing.T) {
+	t.Parallel()
+
+	hs := newHashSources(2)
+	addr := net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 1111}
+	hs.add([20]byte{1}, addr)
+	hs.add([20]byte{2}, addr)
+	// Rotates the generations: {1} and {2} survive in the previous one.
+	hs.add([20]byte{3}, addr)
+
+	if got, ok := hs.pop([20]byte{1}); !ok || got.Port != addr.Port {
+		t.Errorf("expected the source of a hash of the previous generation, got %v", got)
+	}
+	if _, ok := hs.pop([20]byte{1}); ok {
+		t.Error("expected a hash to be credited only once")
+	}
+	if _, ok := hs.pop([20]byte{4}); ok {
+		t.Error("expected no source for an unknown hash")
+	}
+}
+
+func Test_routingTable_recordError(t *testing.T) {
+	t.Parallel()
+
+	rt := newRoutingTable(make([]byte, 20), 10, nil)
+	addr := net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 1111}
+	rt.markSeen([]byte{0x80, 19: 0x01}, addr)
+
+	// The codes chosen by the node are counted together, whatever their number.
+	for code := range minReputationQueries / 2 {
+		rt.recordError(addr, 1000+code)
+	}
+	rt.recordError(addr, 202)
+
+	rt.Lock()
+	defer rt.Unlock()
+	node := rt.nodeAt(addr)
+	if node == nil {
+		t.Fatal("expected the node to be in the table")
+	}
+	if len(node.krpcErrors) != 2 || node.krpcErrors[otherError] != minReputationQueries/2 || node.krpcErrors[202] != 1 {
+		t.Errorf("unexpected KRPC errors %v", node.krpcErrors)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package mainline
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePort fails, as SO_REUSEPORT is not available: a single socket has to be bound instead.
+func reusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is not supported on this platform")
+}
@@ -1,28 +1,108 @@
 package mainline
 
 import (
+	"bytes"
+	"cmp"
 	"net"
-	"strconv"
+	"slices"
 	"sync"
+	"time"
 
 	"tgragnato.it/magnetico/v2/stats"
 )
 
+const (
+	// bucketSize is the K of Kademlia, the minimum capacity of every k-bucket.
+	bucketSize = 8
+	// maxFailedQueries is the number of consecutive unanswered queries after which a node is
+	// considered bad and becomes a candidate for eviction.
+	maxFailedQueries = 2
+	// staleNodeAge is the time after which a node that has not been heard from, and that has at
+	// least one query pending, is considered stale (BEP 5 uses 15 minutes for "good" nodes).
+	staleNodeAge = 15 * time.Minute
+	// maxDumpedNodes is the maximum number of nodes returned by dump().
+	maxDumpedNodes = 100
+)
+
+type rtNode struct {
+	id            [20]byte
+	addr          net.UDPAddr
+	lastSeen      time.Time
+	lastQueried   time.Time
+	failedQueries uint
+	// compliant reports whether the ID is derived from the address as specified by BEP 42.
+	compliant bool
+	// version is the `v` key of the messages of the node, and reportedIP our address as seen by it.
+	version    string
+	reportedIP net.IP
+
+	// Statistics of the queries tracked by the transactionManager.
+	rtt       time.Duration
+	responses uint
+	timeouts  uint
+
+	// BEP 51 sampling schedule and productivity, see sampling.go.
+	nextSample    time.Time
+	num           int
+	samples       uint
+	sampledHashes uint
+	newHashes     uint
+
+	// Reputation, see reputation.go: the KRPC errors by code, the invalid responses, and the new
+	// info hashes returned by the node whose metadata has been fetched.
+	krpcErrors map[int]uint
+	invalid    uint
+	metadata   uint
+}
+
+// isBad reports whether the node failed to answer too many queries in a row, or whether it has
+// been silent for too long while we are waiting for an answer.
+func (n *rtNode) isBad(now time.Time) bool {
+	if n.failedQueries >= maxFailedQueries {
+		return true
+	}
+	return n.failedQueries > 0 && !n.lastSeen.IsZero() && now.Sub(n.lastSeen) > staleNodeAge
+}
+
+type kBucket struct {
+	nodes        []*rtNode
+	replacements []*rtNode
+}
+
+// routingTable is a Kademlia routing table made of 160 k-buckets, indexed by the length of the
+// prefix shared between the XOR distance of a node and our own ID.
+//
+// A crawler needs a much wider view of the DHT than a regular client, so every bucket holds up to
+// maxNeighbors nodes (and never less than bucketSize). Nodes that do not fit are kept in a
+// per-bucket replacement cache, and are promoted as soon as a stale node is evicted.
 type routingTable struct {
 	sync.RWMutex
-	nodes        map[string]uint
+	self         [20]byte
+	buckets      [160]kBucket
+	nodes        map[[20]byte]*rtNode
+	addrs        map[string][20]byte
+	bucketCap    int
 	maxNeighbors uint
 	filterNodes  []net.IPNet
-	info_hashes  [10][20]byte
+
+	// quarantined holds the addresses of the nodes of poor reputation until they are allowed back,
+	// while newHashes and metadata are the totals of the nodes, see reputation.go.
+	quarantined map[string]time.Time
+	newHashes   uint
+	metadata    uint
 }
 
-func newRoutingTable(maxNeighbors uint, filterNodes []net.IPNet) *routingTable {
-	return &routingTable{
-		nodes:        map[string]uint{},
+func newRoutingTable(self []byte, maxNeighbors uint, filterNodes []net.IPNet) *routingTable {
+	rt := &routingTable{
+		nodes:        map[[20]byte]*rtNode{},
+		addrs:        map[string][20]byte{},
+		bucketCap:    max(bucketSize, int(maxNeighbors)),
 		maxNeighbors: maxNeighbors,
 		filterNodes:  filterNodes,
-		info_hashes:  [10][20]byte{},
+		quarantined:  map[string]time.Time{},
 	}
+	copy(rt.self[:], self)
+	return rt
 }
 
 func (rt *routingTable) isAllowed(node net.UDPAddr) bool {
@@ -48,60 +128,342 @@ func (rt *routingTable) isAllowed(node net.UDPAddr) bool {
 	return true
 }
 
-func (rt *routingTable) addNodes(nodes []net.UDPAddr) {
-	filteredNodes := []net.UDPAddr{}
+// bucketIndex returns the index of the k-bucket responsible for id, or -1 if id is our own.
+func (rt *routingTable) bucketIndex(id [20]byte) int {
+	for i := range id {
+		if x := id[i] ^ rt.self[i]; x != 0 {
+			for j := 0; j < 8; j++ {
+				if x&(0x80>>j) != 0 {
+					return i*8 + j
+				}
+			}
+		}
+	}
+	return -1
+}
+
+// addNodes inserts nodes learned from the `nodes` and `nodes6` fields of a response. They have not
+// been contacted yet, so they do not refresh an entry that is already known.
+func (rt *routingTable) addNodes(nodes []CompactNodeInfo) {
+	rt.Lock()
+	defer rt.Unlock()
+
 	for _, node := range nodes {
-		if !rt.isAllowed(node) {
-			continue
+		rt.insert(node.ID, node.Addr, false)
+	}
+}
+
+// markSeen records that a node has contacted us directly, either by answering one of our queries
+// or by querying us. The node is added to the table if there is room for it.
+func (rt *routingTable) markSeen(id []byte, addr net.UDPAddr) {
+	rt.Lock()
+	defer rt.Unlock()
+
+	rt.insert(id, addr, true)
+}
+
+// markAnswered is markSeen for a node that answered one of our queries after rtt.
+func (rt *routingTable) markAnswered(id []byte, addr net.UDPAddr, rtt time.Duration) {
+	rt.Lock()
+	defer rt.Unlock()
+
+	rt.insert(id, addr, true)
+	if node := rt.nodeAt(addr); node != nil {
+		// Smoothed like the SRTT of TCP (RFC 6298).
+		if node.responses == 0 {
+			node.rtt = rtt
+		} else {
+			node.rtt += (rtt - node.rtt) / 8
 		}
-		filteredNodes = append(filteredNodes, node)
+		node.responses++
 	}
-	if len(filteredNodes) == 0 {
+}
+
+// recordTimeouts accounts a query that has not been answered to each of the nodes at addrs.
+func (rt *routingTable) recordTimeouts(addrs []net.UDPAddr) {
+	rt.Lock()
+	defer rt.Unlock()
+
+	now := time.Now()
+	for _, addr := range addrs {
+		if node := rt.nodeAt(addr); node != nil {
+			node.timeouts++
+			rt.judge(node, now)
+		}
+	}
+}
+
+func (rt *routingTable) nodeAt(addr net.UDPAddr) *rtNode {
+	if id, ok := rt.addrs[addr.String()]; ok {
+		return rt.nodes[id]
+	}
+	return nil
+}
+
+func (rt *routingTable) insert(rawID []byte, addr net.UDPAddr, seen bool) {
+	if len(rawID) != 20 || !rt.isAllowed(addr) {
 		return
 	}
+	var id [20]byte
+	copy(id[:], rawID)
+	index := rt.bucketIndex(id)
+	if index < 0 {
+		return
+	}
+	now := time.Now()
+	key := addr.String()
+	if rt.isQuarantined(addr, now) {
+		return
+	}
+
+	if node, ok := rt.nodes[id]; ok {
+		if seen {
+			if node.addr.String() != key {
+				delete(rt.addrs, node.addr.String())
+				rt.removeAddr(key)
+				node.addr = addr
+				node.compliant = isBEP42Compliant(id[:], addr.IP)
+				rt.addrs[key] = id
+			}
+			node.lastSeen = now
+			node.failedQueries = 0
+		}
+		return
+	}
+
+	if otherID, ok := rt.addrs[key]; ok {
+		// The same address is advertising a different ID: trust it only if it told us directly.
+		if !seen {
+			return
+		}
+		rt.remove(otherID)
+	}
 
+	node := &rtNode{
+		id:        id,
+		addr:      addr,
+		compliant: isBEP42Compliant(id[:], addr.IP),
+	}
+	if seen {
+		node.lastSeen = now
+	}
+
+	bucket := &rt.buckets[index]
+	if len(bucket.nodes) >= rt.bucketCap {
+		// evictOne may fill the bucket again by promoting a replacement.
+		evicted := rt.evictOne(bucket, now) || node.compliant && rt.evictNonCompliant(bucket)
+		if !evicted || len(bucket.nodes) >= rt.bucketCap {
+			bucket.addReplacement(node, rt.bucketCap)
+			return
+		}
+	}
+
+	bucket.nodes = append(bucket.nodes, node)
+	rt.nodes[id] = node
+	rt.addrs[key] = id
+}
+
+// evictOne removes the worst stale node from the bucket, promoting a replacement if there is one.
+// It returns false if all the nodes in the bucket are good.
+func (rt *routingTable) evictOne(bucket *kBucket, now time.Time) bool {
+	worst := -1
+	for i, node := range bucket.nodes {
+		if !node.isBad(now) {
+			continue
+		}
+		if worst < 0 || node.failedQueries > bucket.nodes[worst].failedQueries {
+			worst = i
+		}
+	}
+	if worst < 0 {
+		return false
+	}
+
+	evicted := bucket.nodes[worst]
+	bucket.nodes = slices.Delete(bucket.nodes, worst, worst+1)
+	delete(rt.nodes, evicted.id)
+	delete(rt.addrs, evicted.addr.String())
+	go stats.GetInstance().IncRtEviction()
+
+	for len(bucket.replacements) > 0 {
+		last := len(bucket.replacements) - 1
+		replacement := bucket.replacements[last]
+		bucket.replacements = bucket.replacements[:last]
+		if _, ok := rt.addrs[replacement.addr.String()]; ok {
+			continue
+		}
+		bucket.nodes = append(bucket.nodes, replacement)
+		rt.nodes[replacement.id] = replacement
+		rt.addrs[replacement.addr.String()] = replacement.id
+		break
+	}
+
+	return true
+}
+
+// evictNonCompliant makes room for a BEP 42 compliant node in a full bucket of good nodes, by
+// removing the least recently seen node whose ID is not derived from its address. It returns false
+// if all the nodes in the bucket are compliant.
+func (rt *routingTable) evictNonCompliant(bucket *kBucket) bool {
+	worst := -1
+	for i, node := range bucket.nodes {
+		if node.compliant {
+			continue
+		}
+		if worst < 0 || node.lastSeen.Before(bucket.nodes[worst].lastSeen) {
+			worst = i
+		}
+	}
+	if worst < 0 {
+		return false
+	}
+
+	evicted := bucket.nodes[worst]
+	bucket.nodes = slices.Delete(bucket.nodes, worst, worst+1)
+	delete(rt.nodes, evicted.id)
+	delete(rt.addrs, evicted.addr.String())
+	go stats.GetInstance().IncRtEviction()
+
+	return true
+}
+
+// rekey changes our own ID, and moves every node to the bucket it belongs to under the new one.
+func (rt *routingTable) rekey(self []byte) {
 	rt.Lock()
 	defer rt.Unlock()
 
-	if len(rt.nodes)+len(filteredNodes) > int(rt.maxNeighbors*rt.maxNeighbors) {
-		for node := range rt.nodes {
-			delete(rt.nodes, node)
+	nodes := []*rtNode{}
+	replacements := []*rtNode{}
+	for i := range rt.buckets {
+		nodes = append(nodes, rt.buckets[i].nodes...)
+		replacements = append(replacements, rt.buckets[i].replacements...)
+	}
+	copy(rt.self[:], self)
+	rt.buckets = [160]kBucket{}
+
+	for _, node := range nodes {
+		index := rt.bucketIndex(node.id)
+		if index < 0 || len(rt.buckets[index].nodes) >= rt.bucketCap {
+			delete(rt.nodes, node.id)
+			delete(rt.addrs, node.addr.String())
+			if index >= 0 {
+				rt.buckets[index].addReplacement(node, rt.bucketCap)
+			}
+			continue
+		}
+		rt.buckets[index].nodes = append(rt.buckets[index].nodes, node)
+	}
+	for _, node := range replacements {
+		if index := rt.bucketIndex(node.id); index >= 0 {
+			rt.buckets[index].addReplacement(node, rt.bucketCap)
+		}
+	}
+}
+
+// addReplacement keeps the most recently learned nodes at the end of the cache.
+func (b *kBucket) addReplacement(node *rtNode, capacity int) {
+	for i, replacement := range b.replacements {
+		if replacement.id == node.id {
+			b.replacements = slices.Delete(b.replacements, i, i+1)
+			break
 		}
-		go stats.GetInstance().IncRtClearing()
 	}
+	if len(b.replacements) >= capacity {
+		b.replacements = b.replacements[1:]
+	}
+	b.replacements = append(b.replacements, node)
+}
 
-	for _, node := range filteredNodes {
-		rt.nodes[node.String()]++
+func (rt *routingTable) remove(id [20]byte) {
+	node, ok := rt.nodes[id]
+	if !ok {
+		return
 	}
+	bucket := &rt.buckets[rt.bucketIndex(id)]
+	bucket.nodes = slices.DeleteFunc(bucket.nodes, func(n *rtNode) bool { return n == node })
+	delete(rt.nodes, id)
+	delete(rt.addrs, node.addr.String())
 }
 
+func (rt *routingTable) removeAddr(addr string) {
+	if id, ok := rt.addrs[addr]; ok {
+		rt.remove(id)
+	}
+}
+
+// getNodes returns up to maxNeighbors nodes to be sampled, among the ones whose sample set has been
+// refreshed since they were last sampled. The nodes storing the most info hashes that we have not
+// seen yet come first, weighted by their reputation and by the share of their hashes that produced
+// metadata, but a quarter of the budget is kept for the nodes that have never returned samples, so
+// that new productive nodes can be found. Every returned node is accounted as having a
+// query pending, which is cleared by markSeen() once the node answers.
 func (rt *routingTable) getNodes() []net.UDPAddr {
 	rt.Lock()
 	defer rt.Unlock()
 
-	counter := uint(0)
-	nodes := []net.UDPAddr{}
-	for node := range rt.nodes {
-		if counter >= rt.maxNeighbors {
-			break
+	now := time.Now()
+	for i := range rt.buckets {
+		rt.evictOne(&rt.buckets[i], now)
+	}
+	for addr, until := range rt.quarantined {
+		if now.After(until) {
+			delete(rt.quarantined, addr)
 		}
-		addr, err := addrFromStr(node)
-		if err != nil {
+	}
+
+	sampled := []*rtNode{}
+	unsampled := []*rtNode{}
+	for _, node := range rt.nodes {
+		if node.isBad(now) || now.Before(node.nextSample) {
 			continue
 		}
-
-		nodes = append(nodes, addr)
-		if rt.nodes[node] > 1 {
-			rt.nodes[node]--
+		if node.samples == 0 {
+			unsampled = append(unsampled, node)
 		} else {
-			delete(rt.nodes, node)
+			sampled = append(sampled, node)
+		}
+	}
+	average := rt.averageYield()
+	slices.SortFunc(sampled, func(a, b *rtNode) int {
+		if c := cmp.Compare(b.rank(average), a.rank(average)); c != 0 {
+			return c
+		}
+		return a.lastQueried.Compare(b.lastQueried)
+	})
+	slices.SortFunc(unsampled, func(a, b *rtNode) int {
+		return a.lastQueried.Compare(b.lastQueried)
+	})
+
+	budget := int(rt.maxNeighbors)
+	explore := min(len(unsampled), max(1, budget/4))
+	candidates := append(unsampled[:explore:explore], sampled...)
+	candidates = append(candidates, unsampled[explore:]...)
+
+	nodes := []net.UDPAddr{}
+	for _, node := range candidates {
+		if len(nodes) >= budget {
+			break
 		}
-		counter++
+		node.lastQueried = now
+		node.failedQueries++
+		nodes = append(nodes, node.addr)
 	}
 
 	return nodes
 }
 
+func (rt *routingTable) contains(id []byte) bool {
+	if len(id) != 20 {
+		return false
+	}
+
+	rt.RLock()
+	defer rt.RUnlock()
+
+	_, ok := rt.nodes[[20]byte(id)]
+	return ok
+}
+
 func (rt *routingTable) isEmpty() bool {
 	rt.RLock()
 	defer rt.RUnlock()
@@ -109,56 +471,72 @@ func (rt *routingTable) isEmpty() bool {
 	return len(rt.nodes) == 0
 }
 
+// dump returns up to maxDumpedNodes good nodes of the given address family, preferring the ones
+// heard from most recently.
 func (rt *routingTable) dump(ipv4 bool) []net.UDPAddr {
 	rt.RLock()
 	defer rt.RUnlock()
 
-	counter := uint(0)
-	nodes := []net.UDPAddr{}
-	for node := range rt.nodes {
-		if counter >= 100 {
-			break
-		}
-
-		addr, err := addrFromStr(node)
-		if err != nil {
+	now := time.Now()
+	candidates := []*rtNode{}
+	for _, node := range rt.nodes {
+		if node.isBad(now) {
 			continue
 		}
-		if ipv4 && addr.IP.To4() != nil || !ipv4 && addr.IP.To4() == nil {
-			nodes = append(nodes, addr)
+		if ipv4 && node.addr.IP.To4() != nil || !ipv4 && node.addr.IP.To4() == nil {
+			candidates = append(candidates, node)
+		}
+	}
+	slices.SortFunc(candidates, func(a, b *rtNode) int {
+		return b.lastSeen.Compare(a.lastSeen)
+	})
+
+	nodes := []net.UDPAddr{}
+	for _, node := range candidates {
+		if len(nodes) >= maxDumpedNodes {
+			break
 		}
+		nodes = append(nodes, node.addr)
 	}
 
 	return nodes
 }
 
-func (rt *routingTable) addHashes(info_hashes [][20]byte) {
-	rt.Lock()
-	defer rt.Unlock()
+// closest returns up to n good nodes sorted by their XOR distance from target, closest first.
+func (rt *routingTable) closest(target [20]byte, n int) []CompactNodeInfo {
+	rt.RLock()
+	defer rt.RUnlock()
 
-	for i := 0; i < len(info_hashes) && i < 10; i++ {
-		rt.info_hashes[i] = info_hashes[i]
+	now := time.Now()
+	candidates := make([]*rtNode, 0, len(rt.nodes))
+	for _, node := range rt.nodes {
+		if !node.isBad(now) {
+			candidates = append(candidates, node)
+		}
 	}
-}
+	slices.SortFunc(candidates, func(a, b *rtNode) int {
+		da, db := distance(a.id, target), distance(b.id, target)
+		return bytes.Compare(da[:], db[:])
+	})
 
-func (rt *routingTable) getHashes() [10][20]byte {
-	rt.RLock()
-	defer rt.RUnlock()
+	nodes := []CompactNodeInfo{}
+	for _, node := range candidates {
+		if len(nodes) >= n {
+			break
+		}
+		nodes = append(nodes, CompactNodeInfo{
+			ID:   append([]byte(nil), node.id[:]...),
+			Addr: node.addr,
+		})
+	}
 
-	return rt.info_hashes
+	return nodes
 }
 
-func addrFromStr(addr string) (net.UDPAddr, error) {
-	host, port, err := net.SplitHostPort(addr)
-	if err != nil {
-		return net.UDPAddr{}, err
-	}
-	portNum, err := strconv.Atoi(port)
-	if err != nil {
-		return net.UDPAddr{}, err
+// distance returns the XOR metric of Kademlia between two IDs.
+func distance(a, b [20]byte) (d [20]byte) {
+	for i := range d {
+		d[i] = a[i] ^ b[i]
 	}
-	return net.UDPAddr{
-		IP:   net.ParseIP(host),
-		Port: portNum,
-	}, nil
+	return
 }
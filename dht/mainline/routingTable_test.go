@@ -3,69 +3,70 @@ package mainline
 import (
 	"net"
 	"testing"
+	"time"
 )
 
 func Test_routingTable_isEmpty(t *testing.T) {
 	t.Parallel()
 
 	t.Run("empty", func(t *testing.T) {
-		rt := newRoutingTable(0, nil)
+		rt := newRoutingTable(make([]byte, 20), 0, nil)
 		if !rt.isEmpty() {
 			t.Error("expected empty routing table")
 		}
 	})
 
 	t.Run("empty adding port 0", func(t *testing.T) {
-		rt := newRoutingTable(1, nil)
-		rt.addNodes([]net.UDPAddr{{IP: net.IPv4(1, 1, 1, 1), Port: 0}})
+		rt := newRoutingTable(make([]byte, 20), 1, nil)
+		rt.addNodes(withBucketIDs([]net.UDPAddr{{IP: net.IPv4(1, 1, 1, 1), Port: 0}}))
 		if !rt.isEmpty() {
 			t.Error("expected empty routing table")
 		}
 	})
 
 	t.Run("empty with loopback", func(t *testing.T) {
-		rt := newRoutingTable(1, nil)
-		rt.addNodes([]net.UDPAddr{{IP: net.IPv4(127, 0, 0, 1), Port: 1234}})
+		rt := newRoutingTable(make([]byte, 20), 1, nil)
+		rt.addNodes(withBucketIDs([]net.UDPAddr{{IP: net.IPv4(127, 0, 0, 1), Port: 1234}}))
 		if !rt.isEmpty() {
 			t.Error("expected empty routing table")
 		}
 	})
 
 	t.Run("empty with private address", func(t *testing.T) {
-		rt := newRoutingTable(1, nil)
-		rt.addNodes([]net.UDPAddr{{IP: net.IPv4(192, 168, 0, 1), Port: 1234}})
+		rt := newRoutingTable(make([]byte, 20), 1, nil)
+		rt.addNodes(withBucketIDs([]net.UDPAddr{{IP: net.IPv4(192, 168, 0, 1), Port: 1234}}))
 		if !rt.isEmpty() {
 			t.Error("expected empty routing table")
 		}
 	})
 
 	t.Run("not empty 80", func(t *testing.T) {
-		rt := newRoutingTable(1, nil)
-		rt.addNodes([]net.UDPAddr{{IP: net.IPv4(1, 1, 1, 1), Port: 80}})
+		rt := newRoutingTable(make([]byte, 20), 1, nil)
+		rt.addNodes(withBucketIDs([]net.UDPAddr{{IP: net.IPv4(1, 1, 1, 1), Port: 80}}))
 		if rt.isEmpty() {
 			t.Error("expected non-empty routing table")
 		}
 	})
 
 	t.Run("empty 123", func(t *testing.T) {
-		rt := newRoutingTable(1, nil)
-		rt.addNodes([]net.UDPAddr{{IP: net.IPv4(1, 1, 1, 1), Port: 123}})
+		rt := newRoutingTable(make([]byte, 20), 1, nil)
+		rt.addNodes(withBucketIDs([]net.UDPAddr{{IP: net.IPv4(1, 1, 1, 1), Port: 123}}))
 		if !rt.isEmpty() {
 			t.Error("expected empty routing table")
 		}
 	})
 
 	t.Run("not empty 443", func(t *testing.T) {
-		rt := newRoutingTable(1, nil)
-		rt.addNodes([]net.UDPAddr{{IP: net.IPv4(1, 1, 1, 1), Port: 443}})
+		rt := newRoutingTable(make([]byte, 20), 1, nil)
+		rt.addNodes(withBucketIDs([]net.UDPAddr{{IP: net.IPv4(1, 1, 1, 1), Port: 443}}))
 		if rt.isEmpty() {
 			t.Error("expected non-empty routing table")
 		}
 	})
 
 	t.Run("not empty 1234", func(t *testing.T) {
-		rt := newRoutingTable(1, nil)
-		rt.addNodes([]net.UDPAddr{{IP: net.IPv4(1, 1, 1, 1), Port: 1234}})
+		rt := newRoutingTable(make([]byte, 20), 1, nil)
+		rt.addNodes(withBucketIDs([]net.UDPAddr{{IP: net.IPv4(1, 1, 1, 1), Port: 1234}}))
 		if rt.isEmpty() {
 			t.Error("expected non-empty routing table")
 		}
@@ -76,7 +77,7 @@ func Test_routingTable_dump(t *testing.T) {
 	t.Parallel()
 
 	t.Run("empty", func(t *testing.T) {
-		rt := newRoutingTable(1, nil)
+		rt := newRoutingTable(make([]byte, 20), 1, nil)
 		nodes := rt.dump(true)
 		if len(nodes) != 0 {
 			t.Error("expected empty node list")
@@ -84,11 +85,11 @@ func Test_routingTable_dump(t *testing.T) {
 	})
 
 	t.Run("less than 10 nodes", func(t *testing.T) {
-		rt := newRoutingTable(1, nil)
-		rt.addNodes([]net.UDPAddr{
+		rt := newRoutingTable(make([]byte, 20), 1, nil)
+		rt.addNodes(withBucketIDs([]net.UDPAddr{
 			{IP: net.IPv4(1, 1, 1, 1), Port: 1234},
 			{IP: net.IPv4(2, 2, 2, 2), Port: 5678},
-		})
+		}))
 		nodes := rt.dump(true)
 		if len(nodes) != 2 {
 			t.Error("expected 2 nodes")
@@ -96,8 +97,8 @@ func Test_routingTable_dump(t *testing.T) {
 	})
 
 	t.Run("more than 10 nodes", func(t *testing.T) {
-		rt := newRoutingTable(1, nil)
-		rt.addNodes([]net.UDPAddr{
+		rt := newRoutingTable(make([]byte, 20), 1, nil)
+		rt.addNodes(withBucketIDs([]net.UDPAddr{
 			{IP: net.IPv4(1, 1, 1, 1), Port: 1234},
 			{IP: net.IPv4(2, 2, 2, 2), Port: 5678},
 			{IP: net.IPv4(3, 3, 3, 3), Port: 9012},
@@ -109,7 +110,7 @@ func Test_routingTable_dump(t *testing.T) {
 			{IP: net.IPv4(9, 9, 9, 9), Port: 3456},
 			{IP: net.IPv4(10, 10, 10, 10), Port: 7890},
 			{IP: net.IPv4(11, 11, 11, 11), Port: 1234},
-		})
+		}))
 		nodes := rt.dump(true)
 		if len(nodes) != 10 {
 			t.Error("expected 10 nodes")
@@ -120,7 +121,7 @@ func Test_routingTable_isAllowed(t *testing.T) {
 	t.Parallel()
 
 	t.Run("allowed global unicast port 80", func(t *testing.T) {
-		rt := newRoutingTable(1, nil)
+		rt := newRoutingTable(make([]byte, 20), 1, nil)
 		node := net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 80}
 		if !rt.isAllowed(node) {
 			t.Error("expected node to be allowed")
@@ -128,7 +129,7 @@ func Test_routingTable_isAllowed(t *testing.T) {
 	})
 
 	t.Run("allowed global unicast port 443", func(t *testing.T) {
-		rt := newRoutingTable(1, nil)
+		rt := newRoutingTable(make([]byte, 20), 1, nil)
 		node := net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 443}
 		if !rt.isAllowed(node) {
 			t.Error("expected node to be allowed")
@@ -136,7 +137,7 @@ func Test_routingTable_isAllowed(t *testing.T) {
 	})
 
 	t.Run("not allowed private IP", func(t *testing.T) {
-		rt := newRoutingTable(1, nil)
+		rt := newRoutingTable(make([]byte, 20), 1, nil)
 		node := net.UDPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 1234}
 		if rt.isAllowed(node) {
 			t.Error("expected node to be not allowed")
@@ -144,7 +145,7 @@ func Test_routingTable_isAllowed(t *testing.T) {
 	})
 
 	t.Run("not allowed loopback IP", func(t *testing.T) {
-		rt := newRoutingTable(1, nil)
+		rt := newRoutingTable(make([]byte, 20), 1, nil)
 		node := net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
 		if rt.isAllowed(node) {
 			t.Error("expected node to be not allowed")
@@ -152,7 +153,7 @@ func Test_routingTable_isAllowed(t *testing.T) {
 	})
 
 	t.Run("not allowed port 0", func(t *testing.T) {
-		rt := newRoutingTable(1, nil)
+		rt := newRoutingTable(make([]byte, 20), 1, nil)
 		node := net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 0}
 		if rt.isAllowed(node) {
 			t.Error("expected node to be not allowed")
@@ -160,7 +161,7 @@ func Test_routingTable_isAllowed(t *testing.T) {
 	})
 
 	t.Run("not allowed port 1023", func(t *testing.T) {
-		rt := newRoutingTable(1, nil)
+		rt := newRoutingTable(make([]byte, 20), 1, nil)
 		node := net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 1023}
 		if rt.isAllowed(node) {
 			t.Error("expected node to be not allowed")
@@ -168,7 +169,7 @@ func Test_routingTable_isAllowed(t *testing.T) {
 	})
 
 	t.Run("allowed port 1024", func(t *testing.T) {
-		rt := newRoutingTable(1, nil)
+		rt := newRoutingTable(make([]byte, 20), 1, nil)
 		node := net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 1024}
 		if !rt.isAllowed(node) {
 			t.Error("expected node to be allowed")
@@ -176,7 +177,7 @@ func Test_routingTable_isAllowed(t *testing.T) {
 	})
 
 	t.Run("not allowed port 65536", func(t *testing.T) {
-		rt := newRoutingTable(1, nil)
+		rt := newRoutingTable(make([]byte, 20), 1, nil)
 		node := net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 65536}
 		if rt.isAllowed(node) {
 			t.Error("expected node to be not allowed")
@@ -185,7 +186,7 @@ func Test_routingTable_isAllowed(t *testing.T) {
 
 	t.Run("allowed with filter", func(t *testing.T) {
 		_, ipNet, _ := net.ParseCIDR("8.8.8.0/24")
-		rt := newRoutingTable(1, []net.IPNet{*ipNet})
+		rt := newRoutingTable(make([]byte, 20), 1, []net.IPNet{*ipNet})
 		node := net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 1234}
 		if !rt.isAllowed(node) {
 			t.Error("expected node to be allowed")
@@ -194,7 +195,7 @@ func Test_routingTable_isAllowed(t *testing.T) {
 
 	t.Run("not allowed with filter", func(t *testing.T) {
 		_, ipNet, _ := net.ParseCIDR("8.8.8.0/24")
-		rt := newRoutingTable(1, []net.IPNet{*ipNet})
+		rt := newRoutingTable(make([]byte, 20), 1, []net.IPNet{*ipNet})
 		node := net.UDPAddr{IP: net.IPv4(9, 9, 9, 9), Port: 1234}
 		if rt.isAllowed(node) {
 			t.Error("expected node to be not allowed")
@@ -202,122 +203,263 @@ func Test_routingTable_isAllowed(t *testing.T) {
 	})
 }
 
-func Test_routingTable_addHashes(t *testing.T) {
+// withBucketIDs assigns each address an ID that falls in a different bucket of a table whose own
+// ID is all zeroes.
+func withBucketIDs(addrs []net.UDPAddr) []CompactNodeInfo {
+	nodes := []CompactNodeInfo{}
+	for i, addr := range addrs {
+		id := make([]byte, 20)
+		id[i/8] = 0x80 >> (i % 8)
+		nodes = append(nodes, CompactNodeInfo{ID: id, Addr: addr})
+	}
+	return nodes
+}
+
+func Test_routingTable_bucketIndex(t *testing.T) {
 	t.Parallel()
 
-	t.Run("add less than 10 hashes", func(t *testing.T) {
-		rt := newRoutingTable(1, nil)
-		hashes := [][20]byte{
-			{0x01}, {0x02}, {0x03},
-		}
-		rt.addHashes(hashes)
-		storedHashes := rt.getHashes()
-		for i, hash := range hashes {
-			if storedHashes[i] != hash {
-				t.Errorf("expected hash %v, got %v", hash, storedHashes[i])
+	rt := newRoutingTable(make([]byte, 20), 1, nil)
+
+	tests := []struct {
+		name string
+		id   [20]byte
+		want int
+	}{
+		{"self", [20]byte{}, -1},
+		{"farthest", [20]byte{0x80}, 0},
+		{"second bit", [20]byte{0x40}, 1},
+		{"second byte", [20]byte{0x00, 0x01}, 15},
+		{"closest", [20]byte{19: 0x01}, 159},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rt.bucketIndex(tt.id); got != tt.want {
+				t.Errorf("bucketIndex() = %d, want %d", got, tt.want)
 			}
+		})
+	}
+}
+
+func Test_routingTable_getNodes(t *testing.T) {
+	t.Parallel()
+
+	t.Run("does not remove the nodes", func(t *testing.T) {
+		rt := newRoutingTable(make([]byte, 20), 10, nil)
+		rt.addNodes(withBucketIDs([]net.UDPAddr{
+			{IP: net.IPv4(1, 1, 1, 1), Port: 1234},
+			{IP: net.IPv4(2, 2, 2, 2), Port: 5678},
+		}))
+		if nodes := rt.getNodes(); len(nodes) != 2 {
+			t.Errorf("expected 2 nodes, got %d", len(nodes))
+		}
+		if rt.isEmpty() {
+			t.Error("expected non-empty routing table")
 		}
 	})
 
-	t.Run("add exactly 10 hashes", func(t *testing.T) {
-		rt := newRoutingTable(1, nil)
-		hashes := [][20]byte{
-			{0x01}, {0x02}, {0x03}, {0x04}, {0x05},
-			{0x06}, {0x07}, {0x08}, {0x09}, {0x0A},
-		}
-		rt.addHashes(hashes)
-		storedHashes := rt.getHashes()
-		for i, hash := range hashes {
-			if storedHashes[i] != hash {
-				t.Errorf("expected hash %v, got %v", hash, storedHashes[i])
-			}
+	t.Run("limited to maxNeighbors", func(t *testing.T) {
+		rt := newRoutingTable(make([]byte, 20), 1, nil)
+		rt.addNodes(withBucketIDs([]net.UDPAddr{
+			{IP: net.IPv4(1, 1, 1, 1), Port: 1234},
+			{IP: net.IPv4(2, 2, 2, 2), Port: 5678},
+		}))
+		first := rt.getNodes()
+		second := rt.getNodes()
+		if len(first) != 1 || len(second) != 1 {
+			t.Fatalf("expected 1 node per call, got %d and %d", len(first), len(second))
+		}
+		if first[0].String() == second[0].String() {
+			t.Error("expected the least recently queried node to be picked")
 		}
 	})
 
-	t.Run("add more than 10 hashes", func(t *testing.T) {
-		rt := newRoutingTable(1, nil)
-		hashes := [][20]byte{
-			{0x01}, {0x02}, {0x03}, {0x04}, {0x05},
-			{0x06}, {0x07}, {0x08}, {0x09}, {0x0A},
-			{0x0B}, {0x0C},
-		}
-		rt.addHashes(hashes)
-		storedHashes := rt.getHashes()
-		for i := range 10 {
-			if storedHashes[i] != hashes[i] {
-				t.Errorf("expected hash %v, got %v", hashes[i], storedHashes[i])
-			}
+	t.Run("unresponsive nodes are evicted", func(t *testing.T) {
+		rt := newRoutingTable(make([]byte, 20), 10, nil)
+		rt.addNodes(withBucketIDs([]net.UDPAddr{{IP: net.IPv4(1, 1, 1, 1), Port: 1234}}))
+		for range maxFailedQueries {
+			rt.getNodes()
+		}
+		if nodes := rt.getNodes(); len(nodes) != 0 {
+			t.Errorf("expected no nodes, got %d", len(nodes))
+		}
+		if !rt.isEmpty() {
+			t.Error("expected empty routing table")
 		}
 	})
 
-	t.Run("add empty hashes", func(t *testing.T) {
-		rt := newRoutingTable(1, nil)
-		hashes := [][20]byte{}
-		rt.addHashes(hashes)
-		storedHashes := rt.getHashes()
-		for _, hash := range storedHashes {
-			if hash != [20]byte{} {
-				t.Errorf("expected empty hash, got %v", hash)
-			}
+	t.Run("responsive nodes are kept", func(t *testing.T) {
+		rt := newRoutingTable(make([]byte, 20), 10, nil)
+		nodes := withBucketIDs([]net.UDPAddr{{IP: net.IPv4(1, 1, 1, 1), Port: 1234}})
+		rt.addNodes(nodes)
+		for range maxFailedQueries + 1 {
+			rt.getNodes()
+			rt.markSeen(nodes[0].ID, nodes[0].Addr)
+		}
+		if rt.isEmpty() {
+			t.Error("expected non-empty routing table")
 		}
 	})
 }
 
-func Test_routingTable_getHashes(t *testing.T) {
+func Test_routingTable_replacements(t *testing.T) {
 	t.Parallel()
 
-	t.Run("get empty hashes", func(t *testing.T) {
-		rt := newRoutingTable(1, nil)
-		hashes := rt.getHashes()
-		for _, hash := range hashes {
-			if hash != [20]byte{} {
-				t.Errorf("expected empty hash, got %v", hash)
-			}
-		}
-	})
+	self := make([]byte, 20)
+	rt := newRoutingTable(self, 1, nil)
+
+	// All of these nodes belong to bucket 0, which can hold bucketSize of them.
+	nodes := []CompactNodeInfo{}
+	for i := range bucketSize + 1 {
+		id := make([]byte, 20)
+		id[0] = 0x80
+		id[19] = byte(i)
+		nodes = append(nodes, CompactNodeInfo{
+			ID:   id,
+			Addr: net.UDPAddr{IP: net.IPv4(1, 1, 1, byte(i+1)), Port: 1234},
+		})
+	}
+	rt.addNodes(nodes)
+
+	if got := len(rt.buckets[0].nodes); got != bucketSize {
+		t.Fatalf("expected %d nodes in the bucket, got %d", bucketSize, got)
+	}
+	if got := len(rt.buckets[0].replacements); got != 1 {
+		t.Fatalf("expected 1 replacement, got %d", got)
+	}
+
+	// Make the first node go bad and check that the replacement takes its place.
+	rt.Lock()
+	rt.nodes[[20]byte(nodes[0].ID)].failedQueries = maxFailedQueries
+	rt.Unlock()
+	rt.getNodes()
+
+	rt.RLock()
+	defer rt.RUnlock()
+	if _, ok := rt.nodes[[20]byte(nodes[0].ID)]; ok {
+		t.Error("expected the bad node to be evicted")
+	}
+	if _, ok := rt.nodes[[20]byte(nodes[bucketSize].ID)]; !ok {
+		t.Error("expected the replacement to be promoted")
+	}
+	if got := len(rt.buckets[0].nodes); got != bucketSize {
+		t.Errorf("expected %d nodes in the bucket, got %d", bucketSize, got)
+	}
+}
 
-	t.Run("get added hashes", func(t *testing.T) {
-		rt := newRoutingTable(1, nil)
-		expectedHashes := [][20]byte{
-			{0x01}, {0x02}, {0x03},
-		}
-		rt.addHashes(expectedHashes)
-		hashes := rt.getHashes()
-		for i, hash := range expectedHashes {
-			if hashes[i] != hash {
-				t.Errorf("expected hash %v, got %v", hash, hashes[i])
-			}
+func Test_routingTable_insertIntoFullBucket(t *testing.T) {
+	t.Parallel()
+
+	rt := newRoutingTable(make([]byte, 20), 1, nil)
+	nodes := []CompactNodeInfo{}
+	for i := range bucketSize + 2 {
+		id := make([]byte, 20)
+		id[0] = 0x80
+		id[19] = byte(i)
+		nodes = append(nodes, CompactNodeInfo{
+			ID:   id,
+			Addr: net.UDPAddr{IP: net.IPv4(1, 1, 1, byte(i+1)), Port: 1234},
+		})
+	}
+	rt.addNodes(nodes[:bucketSize+1])
+
+	// The eviction of the bad node promotes the replacement, which leaves no room for the new node.
+	rt.Lock()
+	defer rt.Unlock()
+	rt.nodes[[20]byte(nodes[0].ID)].failedQueries = maxFailedQueries
+	rt.insert(nodes[bucketSize+1].ID, nodes[bucketSize+1].Addr, true)
+
+	if got := len(rt.buckets[0].nodes); got != bucketSize {
+		t.Errorf("expected %d nodes in the bucket, got %d", bucketSize, got)
+	}
+	if _, ok := rt.nodes[[20]byte(nodes[bucketSize].ID)]; !ok {
+		t.Error("expected the replacement to be promoted")
+	}
+	if _, ok := rt.nodes[[20]byte(nodes[bucketSize+1].ID)]; ok {
+		t.Error("expected the new node to wait among the replacements")
+	}
+}
+
+func Test_routingTable_markSeen(t *testing.T) {
+	t.Parallel()
+
+	t.Run("invalid ID", func(t *testing.T) {
+		rt := newRoutingTable(make([]byte, 20), 1, nil)
+		rt.markSeen([]byte{1, 2, 3}, net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 1234})
+		if !rt.isEmpty() {
+			t.Error("expected empty routing table")
 		}
 	})
 
-	t.Run("get exactly 10 hashes", func(t *testing.T) {
-		rt := newRoutingTable(1, nil)
-		expectedHashes := [][20]byte{
-			{0x01}, {0x02}, {0x03}, {0x04}, {0x05},
-			{0x06}, {0x07}, {0x08}, {0x09}, {0x0A},
-		}
-		rt.addHashes(expectedHashes)
-		hashes := rt.getHashes()
-		for i, hash := range expectedHashes {
-			if hashes[i] != hash {
-				t.Errorf("expected hash %v, got %v", hash, hashes[i])
-			}
+	t.Run("own ID", func(t *testing.T) {
+		rt := newRoutingTable(make([]byte, 20), 1, nil)
+		rt.markSeen(make([]byte, 20), net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 1234})
+		if !rt.isEmpty() {
+			t.Error("expected empty routing table")
 		}
 	})
 
-	t.Run("get more than 10 hashes", func(t *testing.T) {
-		rt := newRoutingTable(1, nil)
-		expectedHashes := [][20]byte{
-			{0x01}, {0x02}, {0x03}, {0x04}, {0x05},
-			{0x06}, {0x07}, {0x08}, {0x09}, {0x0A},
-			{0x0B}, {0x0C},
-		}
-		rt.addHashes(expectedHashes)
-		hashes := rt.getHashes()
-		for i := range 10 {
-			if hashes[i] != expectedHashes[i] {
-				t.Errorf("expected hash %v, got %v", expectedHashes[i], hashes[i])
-			}
+	t.Run("address takes a new ID", func(t *testing.T) {
+		rt := newRoutingTable(make([]byte, 20), 1, nil)
+		addr := net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 1234}
+		rt.markSeen([]byte{0x80, 19: 0x01}, addr)
+		rt.markSeen([]byte{0x40, 19: 0x01}, addr)
+
+		rt.RLock()
+		defer rt.RUnlock()
+		if len(rt.nodes) != 1 {
+			t.Fatalf("expected 1 node, got %d", len(rt.nodes))
+		}
+		if _, ok := rt.nodes[[20]byte{0x40, 19: 0x01}]; !ok {
+			t.Error("expected the newest ID to be kept")
 		}
 	})
 }
+
+func Test_routingTable_closest(t *testing.T) {
+	t.Parallel()
+
+	rt := newRoutingTable(make([]byte, 20), 10, nil)
+	rt.addNodes(withBucketIDs([]net.UDPAddr{
+		{IP: net.IPv4(1, 1, 1, 1), Port: 1111},
+		{IP: net.IPv4(2, 2, 2, 2), Port: 2222},
+		{IP: net.IPv4(3, 3, 3, 3), Port: 3333},
+		{IP: net.IPv4(4, 4, 4, 4), Port: 4444},
+	}))
+
+	// Distances from 0xc0: 0x40, 0x80, 0xe0 and 0xd0.
+	got := rt.closest([20]byte{0xc0}, 3)
+	want := []int{1111, 2222, 4444}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d nodes, got %d", len(want), len(got))
+	}
+	for i, node := range got {
+		if node.Addr.Port != want[i] {
+			t.Errorf("node %d: expected port %d, got %d", i, want[i], node.Addr.Port)
+		}
+	}
+}
+
+func Test_routingTable_queryStatistics(t *testing.T) {
+	t.Parallel()
+
+	rt := newRoutingTable(make([]byte, 20), 10, nil)
+	addr := net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 1111}
+	id := []byte{0x80, 19: 0x01}
+
+	rt.markAnswered(id, addr, 800*time.Millisecond)
+	rt.markAnswered(id, addr, 0)
+	rt.recordTimeouts([]net.UDPAddr{addr, {IP: net.IPv4(2, 2, 2, 2), Port: 2222}})
+
+	rt.RLock()
+	defer rt.RUnlock()
+	node, ok := rt.nodes[[20]byte{0x80, 19: 0x01}]
+	if !ok {
+		t.Fatal("expected the node to be added")
+	}
+	if node.responses != 2 || node.timeouts != 1 {
+		t.Errorf("expected 2 responses and 1 timeout, got %d and %d", node.responses, node.timeouts)
+	}
+	if node.rtt != 700*time.Millisecond {
+		t.Errorf("expected a smoothed rtt of 700ms, got %s", node.rtt)
+	}
+}
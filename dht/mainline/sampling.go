@@ -0,0 +1,93 @@
+package mainline
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// minSampleInterval and maxSampleInterval bound the `interval` returned by the nodes; BEP 51
+	// caps it at 6 hours.
+	minSampleInterval = 10 * time.Second
+	maxSampleInterval = 6 * time.Hour
+	// unsupportedSampleInterval is how long a node that does not implement BEP 51 is left alone.
+	// It is still queried from time to time, since its answers carry other nodes.
+	unsupportedSampleInterval = 30 * time.Minute
+	// seenHashesSize is the size of each of the two generations of seenHashes.
+	seenHashesSize = 1 << 17
+)
+
+// sampleScore estimates how many new info hashes a node will return: the size of its storage,
+// discounted by the fraction of the hashes it returned so far that we had already seen.
+func (n *rtNode) sampleScore() float64 {
+	return float64(n.num) * float64(n.newHashes+1) / float64(n.sampledHashes+1)
+}
+
+// recordSamples updates the sampling schedule and the productivity of the node at addr, after a
+// sample_infohashes response carrying `interval` and `num`, in which sampled hashes were returned
+// and newHashes of them had not been seen before.
+func (rt *routingTable) recordSamples(addr net.UDPAddr, interval time.Duration, num int, sampled, newHashes uint) {
+	rt.Lock()
+	defer rt.Unlock()
+
+	node := rt.nodeAt(addr)
+	if node == nil {
+		return
+	}
+	node.nextSample = time.Now().Add(min(max(interval, minSampleInterval), maxSampleInterval))
+	node.num = max(num, 0)
+	node.samples++
+	node.sampledHashes += sampled
+	node.newHashes += newHashes
+	rt.newHashes += newHashes
+	rt.judge(node, time.Now())
+}
+
+// recordNoSamples postpones the next sampling of a node that answered a sample_infohashes query
+// without samples, because it does not implement BEP 51.
+func (rt *routingTable) recordNoSamples(addr net.UDPAddr) {
+	rt.Lock()
+	defer rt.Unlock()
+
+	if node := rt.nodeAt(addr); node != nil {
+		node.nextSample = time.Now().Add(unsupportedSampleInterval)
+	}
+}
+
+// seenHashes remembers the info hashes sampled recently, to tell the new ones apart. It keeps two
+// generations of at most seenHashesSize entries each, and drops the older one when the current one
+// is full.
+type seenHashes struct {
+	sync.Mutex
+	current  map[[20]byte]struct{}
+	previous map[[20]byte]struct{}
+	size     int
+}
+
+func newSeenHashes(size int) *seenHashes {
+	return &seenHashes{
+		current:  make(map[[20]byte]struct{}),
+		previous: make(map[[20]byte]struct{}),
+		size:     size,
+	}
+}
+
+// add records infoHash, and reports whether it was not seen recently.
+func (sh *seenHashes) add(infoHash [20]byte) bool {
+	sh.Lock()
+	defer sh.Unlock()
+
+	if _, ok := sh.current[infoHash]; ok {
+		return false
+	}
+	_, seen := sh.previous[infoHash]
+
+	if len(sh.current) >= sh.size {
+		sh.previous = sh.current
+		sh.current = make(map[[20]byte]struct{})
+	}
+	sh.current[infoHash] = struct{}{}
+
+	return !seen
+}
@@ -0,0 +1,127 @@
+package mainline
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSeenHashes_add(t *testing.T) {
+	t.Parallel()
+
+	sh := newSeenHashes(2)
+	if !sh.add([20]byte{1}) {
+		t.Error("expected the first hash to be new")
+	}
+	if sh.add([20]byte{1}) {
+		t.Error("expected a repeated hash not to be new")
+	}
+
+	// Rotate the generations: {1} survives in the previous one.
+	sh.add([20]byte{2})
+	if !sh.add([20]byte{3}) {
+		t.Error("expected the third hash to be new")
+	}
+	if sh.add([20]byte{1}) {
+		t.Error("expected a hash of the previous generation not to be new")
+	}
+
+	// {1} has been promoted, while {2} and {3} are forgotten after two more rotations.
+	sh.add([20]byte{4})
+	sh.add([20]byte{5})
+	sh.add([20]byte{6})
+	if !sh.add([20]byte{2}) {
+		t.Error("expected an old hash to be new again")
+	}
+}
+
+func Test_routingTable_recordSamples(t *testing.T) {
+	t.Parallel()
+
+	rt := newRoutingTable(make([]byte, 20), 10, nil)
+	addr := net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 1111}
+	rt.markSeen([]byte{0x80, 19: 0x01}, addr)
+
+	tests := []struct {
+		name     string
+		interval time.Duration
+		want     time.Duration
+	}{
+		{"too short", 0, minSampleInterval},
+		{"in range", time.Hour, time.Hour},
+		{"too long", 24 * time.Hour, maxSampleInterval},
+	}
+
+	for _, tt := range tests {
+		rt.recordSamples(addr, tt.interval, 100, 20, 5)
+
+		rt.RLock()
+		node := rt.nodes[[20]byte{0x80, 19: 0x01}]
+		got := time.Until(node.nextSample)
+		rt.RUnlock()
+
+		if got > tt.want || got < tt.want-time.Second {
+			t.Errorf("%s: expected the next sample in %s, got %s", tt.name, tt.want, got)
+		}
+	}
+
+	rt.RLock()
+	defer rt.RUnlock()
+	node := rt.nodes[[20]byte{0x80, 19: 0x01}]
+	if node.num != 100 || node.samples != 3 || node.sampledHashes != 60 || node.newHashes != 15 {
+		t.Errorf("unexpected statistics %+v", node)
+	}
+}
+
+func Test_routingTable_getNodesSchedule(t *testing.T) {
+	t.Parallel()
+
+	rt := newRoutingTable(make([]byte, 20), 4, nil)
+	nodes := withBucketIDs([]net.UDPAddr{
+		{IP: net.IPv4(1, 1, 1, 1), Port: 1111},
+		{IP: net.IPv4(2, 2, 2, 2), Port: 2222},
+		{IP: net.IPv4(3, 3, 3, 3), Port: 3333},
+		{IP: net.IPv4(4, 4, 4, 4), Port: 4444},
+		{IP: net.IPv4(5, 5, 5, 5), Port: 5555},
+		{IP: net.IPv4(6, 6, 6, 6), Port: 6666},
+	})
+	for _, node := range nodes {
+		rt.markSeen(node.ID, node.Addr)
+	}
+
+	rt.Lock()
+	for i, node := range []struct {
+		num       int
+		sampled   uint
+		newHashes uint
+		ready     bool
+	}{
+		{num: 1000, sampled: 100, newHashes: 100, ready: false}, // productive, but not refreshed yet
+		{num: 1000, sampled: 100, newHashes: 0, ready: true},    // returns the same samples
+		{num: 500, sampled: 100, newHashes: 90, ready: true},
+		{num: 100, sampled: 100, newHashes: 100, ready: true},
+	} {
+		n := rt.nodes[[20]byte(nodes[i].ID)]
+		n.num, n.samples, n.sampledHashes, n.newHashes = node.num, 1, node.sampled, node.newHashes
+		if !node.ready {
+			n.nextSample = time.Now().Add(time.Hour)
+		}
+	}
+	// Of the two unsampled nodes, the one queried the least recently comes first.
+	rt.nodes[[20]byte(nodes[5].ID)].lastQueried = time.Now()
+	rt.Unlock()
+
+	got := rt.getNodes()
+	want := map[int]bool{5555: true, 3333: true, 4444: true, 2222: true}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d nodes, got %v", len(want), got)
+	}
+	for _, addr := range got {
+		if !want[addr.Port] {
+			t.Errorf("unexpected node %v in %v", addr, got)
+		}
+	}
+	if got[1].Port != 3333 || got[2].Port != 4444 {
+		t.Errorf("expected the most productive nodes first, got %v", got)
+	}
+}
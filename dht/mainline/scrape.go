@@ -0,0 +1,139 @@
+package mainline
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// scrapeNodes is the number of nodes, the closest to the info hash, that are queried first.
+	scrapeNodes = 8
+	// scrapeMaxQueries bounds the number of queries of a single scrape, including the ones sent to
+	// the closer nodes learned from the responses.
+	scrapeMaxQueries = 16
+	// scrapeTimeout is the time given to the nodes to answer before the result is emitted.
+	scrapeTimeout = 10 * time.Second
+)
+
+// ScrapeResult is the outcome of a BEP 33 scrape: the size of a swarm, estimated from the union of
+// the Bloom filters returned by the nodes that store its peers.
+type ScrapeResult struct {
+	infoHash [20]byte
+	seeders  uint
+	leechers uint
+}
+
+func (sr ScrapeResult) InfoHash() [20]byte {
+	return sr.infoHash
+}
+
+func (sr ScrapeResult) Seeders() uint {
+	return sr.seeders
+}
+
+func (sr ScrapeResult) Leechers() uint {
+	return sr.leechers
+}
+
+type scrape struct {
+	seeds     *BloomFilter
+	peers     *BloomFilter
+	responses uint
+	queried   map[string]struct{}
+}
+
+// scraper keeps the state of the scrapes in progress, while their queries are tracked by the
+// transactionManager like any other.
+type scraper struct {
+	sync.Mutex
+	scrapes map[[20]byte]*scrape
+}
+
+func newScraper() *scraper {
+	return &scraper{
+		scrapes: map[[20]byte]*scrape{},
+	}
+}
+
+// begin registers a new scrape, and returns false if the info hash is already being scraped.
+func (s *scraper) begin(infoHash [20]byte) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.scrapes[infoHash]; ok {
+		return false
+	}
+	s.scrapes[infoHash] = &scrape{
+		seeds:   NewBloomFilter(),
+		peers:   NewBloomFilter(),
+		queried: map[string]struct{}{},
+	}
+	return true
+}
+
+// reserve reports whether addr should be queried, that is if the node has not been queried yet
+// and the scrape has queries left.
+func (s *scraper) reserve(infoHash [20]byte, addr net.UDPAddr) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	sc, ok := s.scrapes[infoHash]
+	if !ok || len(sc.queried) >= scrapeMaxQueries {
+		return false
+	}
+	key := addr.String()
+	if _, ok := sc.queried[key]; ok {
+		return false
+	}
+	sc.queried[key] = struct{}{}
+	return true
+}
+
+// onResponse merges the Bloom filters of a response into its scrape. It returns false if the
+// scrape is unknown or already finished.
+func (s *scraper) onResponse(infoHash [20]byte, msg *Message) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	sc, ok := s.scrapes[infoHash]
+	if !ok {
+		return false
+	}
+	sc.responses++
+	sc.seeds.Merge(msg.R.BFsd)
+	sc.peers.Merge(msg.R.BFpe)
+
+	return true
+}
+
+// finish forgets a scrape and returns its result. It returns false if no node answered.
+func (s *scraper) finish(infoHash [20]byte) (ScrapeResult, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	sc, ok := s.scrapes[infoHash]
+	if !ok {
+		return ScrapeResult{}, false
+	}
+	delete(s.scrapes, infoHash)
+
+	if sc.responses == 0 {
+		return ScrapeResult{}, false
+	}
+	return ScrapeResult{
+		infoHash: infoHash,
+		seeders:  estimate(sc.seeds),
+		leechers: estimate(sc.peers),
+	}, true
+}
+
+func estimate(bf *BloomFilter) uint {
+	for _, b := range bf.RawBytes() {
+		if b != 0 {
+			return uint(math.Round(bf.Estimate()))
+		}
+	}
+	return 0
+}
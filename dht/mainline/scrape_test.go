@@ -0,0 +1,120 @@
+package mainline
+
+import (
+	"net"
+	"testing"
+)
+
+func TestScraper_begin(t *testing.T) {
+	t.Parallel()
+
+	s := newScraper()
+	if !s.begin([20]byte{1}) {
+		t.Error("expected the first scrape to begin")
+	}
+	if s.begin([20]byte{1}) {
+		t.Error("expected a scrape in progress not to begin again")
+	}
+	if !s.begin([20]byte{2}) {
+		t.Error("expected a scrape of another info hash to begin")
+	}
+}
+
+func TestScraper_reserve(t *testing.T) {
+	t.Parallel()
+
+	s := newScraper()
+	addr := net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 6881}
+
+	if s.reserve([20]byte{1}, addr) {
+		t.Error("expected no query for an unknown scrape")
+	}
+
+	s.begin([20]byte{1})
+	if !s.reserve([20]byte{1}, addr) {
+		t.Fatal("expected a query")
+	}
+	if s.reserve([20]byte{1}, addr) {
+		t.Error("expected no second query to the same node")
+	}
+
+	for i := 1; i < scrapeMaxQueries; i++ {
+		if !s.reserve([20]byte{1}, net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 6881 + i}) {
+			t.Fatalf("expected query %d to be allowed", i)
+		}
+	}
+	if s.reserve([20]byte{1}, net.UDPAddr{IP: net.IPv4(2, 2, 2, 2), Port: 6881}) {
+		t.Error("expected the number of queries to be capped")
+	}
+}
+
+func TestScraper_finish(t *testing.T) {
+	t.Parallel()
+
+	t.Run("no responses", func(t *testing.T) {
+		t.Parallel()
+		s := newScraper()
+		s.begin([20]byte{1})
+		s.reserve([20]byte{1}, net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 6881})
+		if _, ok := s.finish([20]byte{1}); ok {
+			t.Error("expected no result without responses")
+		}
+		if len(s.scrapes) != 0 {
+			t.Error("expected the scrape to be forgotten")
+		}
+	})
+
+	t.Run("merged filters", func(t *testing.T) {
+		t.Parallel()
+		s := newScraper()
+		s.begin([20]byte{1})
+
+		for i := 0; i < 4; i++ {
+			seeds := NewBloomFilter()
+			peers := NewBloomFilter()
+			for j := 0; j < 10; j++ {
+				// Every node stores the same swarm: the union must not count peers twice.
+				seeds.InsertIP(net.IPv4(192, 0, 2, byte(j)))
+				peers.InsertIP(net.IPv4(198, 51, 100, byte(j)))
+				peers.InsertIP(net.IPv4(203, 0, 113, byte(i*10+j)))
+			}
+
+			response := NewGetPeersResponseWithValues([]byte("tt"), randomNodeID(), []byte("token"), nil, seeds, peers)
+			if !s.onResponse([20]byte{1}, response) {
+				t.Fatalf("expected the response to be accepted")
+			}
+		}
+		if s.onResponse([20]byte{2}, NewGetPeersResponseWithNodes([]byte("tt"), randomNodeID(), []byte("token"), nil)) {
+			t.Error("expected the response of an unknown scrape to be rejected")
+		}
+
+		result, ok := s.finish([20]byte{1})
+		if !ok {
+			t.Fatal("expected a result")
+		}
+		if result.InfoHash() != [20]byte{1} {
+			t.Errorf("unexpected info hash %v", result.InfoHash())
+		}
+		if result.Seeders() < 9 || result.Seeders() > 11 {
+			t.Errorf("expected about 10 seeders, got %d", result.Seeders())
+		}
+		if result.Leechers() < 45 || result.Leechers() > 55 {
+			t.Errorf("expected about 50 leechers, got %d", result.Leechers())
+		}
+	})
+
+	t.Run("empty filters", func(t *testing.T) {
+		t.Parallel()
+		s := newScraper()
+		s.begin([20]byte{1})
+		s.onResponse([20]byte{1}, NewGetPeersResponseWithNodes([]byte("tt"), randomNodeID(), []byte("token"), nil))
+
+		result, ok := s.finish([20]byte{1})
+		if !ok {
+			t.Fatal("expected a result")
+		}
+		if result.Seeders() != 0 || result.Leechers() != 0 {
+			t.Errorf("expected an empty swarm, got %d/%d", result.Seeders(), result.Leechers())
+		}
+	})
+}
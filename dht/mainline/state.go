@@ -0,0 +1,132 @@
+package mainline
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+const (
+	// maxSavedNodes is the maximum number of nodes written to the state file. They are more than
+	// enough to rebuild the routing table, and they are all pinged at startup.
+	maxSavedNodes = 1000
+	// stateSaveInterval is the interval between two saves of the state file.
+	stateSaveInterval = 5 * time.Minute
+	// restoreGracePeriod is the time given to the saved nodes to answer our pings before falling
+	// back to the bootstrap nodes.
+	restoreGracePeriod = 5 * time.Second
+)
+
+// routingTableState is what is saved to the state file: our own node ID, so that the other nodes
+// recognise us after a restart, and the good nodes that we knew.
+type routingTableState struct {
+	ID    string      `json:"id"`
+	Nodes []nodeState `json:"nodes"`
+}
+
+type nodeState struct {
+	ID       string    `json:"id"`
+	Addr     string    `json:"addr"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+func loadState(path string) (*routingTableState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	state := new(routingTableState)
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	if id, err := hex.DecodeString(state.ID); err != nil || len(id) != 20 {
+		return nil, errors.New("invalid node ID in the state file")
+	}
+
+	return state, nil
+}
+
+// saveState writes the state to a temporary file first, so that a crash never leaves a truncated
+// state file behind.
+func saveState(path string, state *routingTableState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// nodeID returns the saved node ID, which loadState has already validated.
+func (s *routingTableState) nodeID() []byte {
+	id, _ := hex.DecodeString(s.ID)
+	return id
+}
+
+// compactNodes returns the saved nodes that can still be parsed.
+func (s *routingTableState) compactNodes() []CompactNodeInfo {
+	nodes := []CompactNodeInfo{}
+	for _, node := range s.Nodes {
+		id, err := hex.DecodeString(node.ID)
+		if err != nil || len(id) != 20 {
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", node.Addr)
+		if err != nil {
+			continue
+		}
+		nodes = append(nodes, CompactNodeInfo{ID: id, Addr: *addr})
+	}
+	return nodes
+}
+
+// snapshot returns up to n good nodes that have contacted us, the most recently seen first.
+func (rt *routingTable) snapshot(n int) []nodeState {
+	rt.RLock()
+	defer rt.RUnlock()
+
+	now := time.Now()
+	candidates := []*rtNode{}
+	for _, node := range rt.nodes {
+		if !node.lastSeen.IsZero() && !node.isBad(now) {
+			candidates = append(candidates, node)
+		}
+	}
+	slices.SortFunc(candidates, func(a, b *rtNode) int {
+		return b.lastSeen.Compare(a.lastSeen)
+	})
+
+	nodes := []nodeState{}
+	for _, node := range candidates {
+		if len(nodes) >= n {
+			break
+		}
+		nodes = append(nodes, nodeState{
+			ID:       hex.EncodeToString(node.id[:]),
+			Addr:     node.addr.String(),
+			LastSeen: node.lastSeen,
+		})
+	}
+
+	return nodes
+}
@@ -0,0 +1,132 @@
+package mainline
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSaveLoadState(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "state.json")
+	id := randomNodeID()
+	nodeID := randomNodeID()
+	lastSeen := time.Now().Truncate(time.Second)
+
+	state := &routingTableState{
+		ID: hex.EncodeToString(id),
+		Nodes: []nodeState{
+			{ID: hex.EncodeToString(nodeID), Addr: "1.1.1.1:6881", LastSeen: lastSeen},
+			{ID: "invalid", Addr: "2.2.2.2:6881", LastSeen: lastSeen},
+			{ID: hex.EncodeToString(randomNodeID()), Addr: "invalid", LastSeen: lastSeen},
+		},
+	}
+	if err := saveState(path, state); err != nil {
+		t.Fatalf("saveState() error = %v", err)
+	}
+
+	loaded, err := loadState(path)
+	if err != nil {
+		t.Fatalf("loadState() error = %v", err)
+	}
+	if !bytes.Equal(loaded.nodeID(), id) {
+		t.Errorf("loadState() got node ID %x, want %x", loaded.nodeID(), id)
+	}
+
+	nodes := loaded.compactNodes()
+	if len(nodes) != 1 {
+		t.Fatalf("compactNodes() got %d nodes, want 1", len(nodes))
+	}
+	if !bytes.Equal(nodes[0].ID, nodeID) || nodes[0].Addr.String() != "1.1.1.1:6881" {
+		t.Errorf("compactNodes() got %v", nodes[0])
+	}
+
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("expected no temporary files to be left behind, got %d entries", len(entries))
+	}
+}
+
+func TestLoadState_Invalid(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"not json", "not json"},
+		{"invalid ID", `{"id": "abcd", "nodes": []}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := loadState(path); err == nil {
+				t.Error("loadState() expected an error")
+			}
+		})
+	}
+
+	if _, err := loadState(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("loadState() expected a not exist error, got %v", err)
+	}
+}
+
+func Test_routingTable_snapshot(t *testing.T) {
+	t.Parallel()
+
+	rt := newRoutingTable(make([]byte, 20), 10, nil)
+	// Learned nodes have never contacted us, and are not saved.
+	rt.addNodes(withBucketIDs([]net.UDPAddr{{IP: net.IPv4(1, 1, 1, 1), Port: 1111}}))
+	rt.markSeen([]byte{0x40, 19: 0x01}, net.UDPAddr{IP: net.IPv4(2, 2, 2, 2), Port: 2222})
+	time.Sleep(10 * time.Millisecond)
+	rt.markSeen([]byte{0x20, 19: 0x01}, net.UDPAddr{IP: net.IPv4(3, 3, 3, 3), Port: 3333})
+
+	nodes := rt.snapshot(10)
+	if len(nodes) != 2 {
+		t.Fatalf("snapshot() got %d nodes, want 2", len(nodes))
+	}
+	if nodes[0].Addr != "3.3.3.3:3333" || nodes[1].Addr != "2.2.2.2:2222" {
+		t.Errorf("snapshot() got %v, want the most recently seen node first", nodes)
+	}
+
+	if nodes := rt.snapshot(1); len(nodes) != 1 {
+		t.Errorf("snapshot() got %d nodes, want 1", len(nodes))
+	}
+}
+
+func TestIndexingService_saveState(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "state.json")
+	is := &IndexingService{
+		nodeID:    randomNodeID(),
+		nodes4:    newRoutingTable(make([]byte, 20), 10, nil),
+		statePath: path,
+	}
+
+	is.saveState()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("expected an empty routing table not to be saved")
+	}
+
+	is.nodes4.markSeen([]byte{0x40, 19: 0x01}, net.UDPAddr{IP: net.IPv4(2, 2, 2, 2), Port: 2222})
+	is.saveState()
+
+	restored := NewIndexingService("127.0.0.1:0", 10, IndexingServiceEventHandlers{}, nil, nil, path, false, Internet)
+	if !bytes.Equal(restored.nodeID, is.nodeID) {
+		t.Errorf("expected the node ID %x to be restored, got %x", is.nodeID, restored.nodeID)
+	}
+	if len(restored.savedNodes) != 1 || restored.savedNodes[0].Addr.String() != "2.2.2.2:2222" {
+		t.Errorf("unexpected saved nodes %v", restored.savedNodes)
+	}
+}
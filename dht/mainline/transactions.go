@@ -0,0 +1,129 @@
+package mainline
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// transactionTimeout is the time after which an unanswered query is considered lost.
+const transactionTimeout = 10 * time.Second
+
+// queryKind identifies the query of a transaction. It is the first byte of the transaction ID, so
+// that every kind of query has its own space of 65536 IDs.
+type queryKind byte
+
+const (
+	queryPing             queryKind = 'p'
+	queryFindNode         queryKind = 'f'
+	queryBootstrap        queryKind = 'b'
+	queryGetPeers         queryKind = 'g'
+	queryLookup           queryKind = 'l'
+	queryScrape           queryKind = 's'
+	querySampleInfohashes queryKind = 'i'
+)
+
+type transaction struct {
+	kind     queryKind
+	infoHash [20]byte
+	addr     net.UDPAddr
+	sent     time.Time
+}
+
+// transactionManager issues the transaction IDs of the outgoing queries, and matches every
+// response to the query it answers. Queries that are not answered in time are forgotten, so that
+// their IDs can be issued again.
+type transactionManager struct {
+	sync.Mutex
+	timeout  time.Duration
+	counters map[queryKind]uint16
+	pending  map[[3]byte]*transaction
+}
+
+func newTransactionManager(timeout time.Duration) *transactionManager {
+	return &transactionManager{
+		timeout:  timeout,
+		counters: map[queryKind]uint16{},
+		pending:  map[[3]byte]*transaction{},
+	}
+}
+
+// issue registers a query sent to addr and returns its transaction ID, skipping the IDs that are
+// still waiting for an answer. It returns nil if all the IDs of the kind are in use.
+func (tm *transactionManager) issue(kind queryKind, addr net.UDPAddr, infoHash [20]byte) []byte {
+	tm.Lock()
+	defer tm.Unlock()
+
+	counter := tm.counters[kind]
+	defer func() { tm.counters[kind] = counter }()
+
+	for range 1 << 16 {
+		b := toBigEndianBytes(counter)
+		counter++
+		id := [3]byte{byte(kind), b[0], b[1]}
+		if _, ok := tm.pending[id]; ok {
+			continue
+		}
+		tm.pending[id] = &transaction{
+			kind:     kind,
+			infoHash: infoHash,
+			addr:     addr,
+			sent:     time.Now(),
+		}
+		return id[:]
+	}
+
+	return nil
+}
+
+// resolve returns the query answered by a response together with its round-trip time. Responses
+// that carry an unknown transaction ID, or that come from an address other than the queried one,
+// are rejected.
+func (tm *transactionManager) resolve(t []byte, addr *net.UDPAddr) (*transaction, time.Duration, bool) {
+	if len(t) != 3 {
+		return nil, 0, false
+	}
+	var id [3]byte
+	copy(id[:], t)
+
+	tm.Lock()
+	defer tm.Unlock()
+
+	tx, ok := tm.pending[id]
+	if !ok || !tx.addr.IP.Equal(addr.IP) || tx.addr.Port != addr.Port {
+		return nil, 0, false
+	}
+	delete(tm.pending, id)
+
+	return tx, time.Since(tx.sent), true
+}
+
+// cancel forgets a query that was not sent, and returns it unless it has already expired.
+func (tm *transactionManager) cancel(t []byte) *transaction {
+	tm.Lock()
+	defer tm.Unlock()
+
+	id := [3]byte(t)
+	tx, ok := tm.pending[id]
+	if !ok {
+		return nil
+	}
+	delete(tm.pending, id)
+	return tx
+}
+
+// expire forgets the queries that have not been answered within the timeout, and returns them.
+func (tm *transactionManager) expire(now time.Time) []*transaction {
+	tm.Lock()
+	defer tm.Unlock()
+
+	expired := []*transaction{}
+	for id, tx := range tm.pending {
+		if now.Sub(tx.sent) > tm.timeout {
+			expired = append(expired, tx)
+			delete(tm.pending, id)
+		}
+	}
+
+	return expired
+}
@@ -0,0 +1,141 @@
+package mainline
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTransactionManager_issue(t *testing.T) {
+	t.Parallel()
+
+	tm := newTransactionManager(transactionTimeout)
+	addr := net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 6881}
+
+	first := tm.issue(queryGetPeers, addr, [20]byte{1})
+	second := tm.issue(queryGetPeers, addr, [20]byte{2})
+	other := tm.issue(queryFindNode, addr, [20]byte{})
+
+	if len(first) != 3 || first[0] != byte(queryGetPeers) {
+		t.Fatalf("unexpected transaction ID %v", first)
+	}
+	if string(first) == string(second) {
+		t.Error("expected unique transaction IDs")
+	}
+	if other[0] != byte(queryFindNode) || other[1] != 0 || other[2] != 0 {
+		t.Errorf("expected every kind of query to have its own counter, got %v", other)
+	}
+}
+
+func TestTransactionManager_issueSkipsLiveIDs(t *testing.T) {
+	t.Parallel()
+
+	tm := newTransactionManager(transactionTimeout)
+	addr := net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 6881}
+
+	live := tm.issue(queryGetPeers, addr, [20]byte{1})
+	// Wrap the counter around, back onto the ID that is still waiting for an answer.
+	tm.counters[queryGetPeers] = 0
+
+	if got := tm.issue(queryGetPeers, addr, [20]byte{2}); string(got) == string(live) {
+		t.Errorf("expected %v not to be issued twice", live)
+	}
+}
+
+func TestTransactionManager_resolve(t *testing.T) {
+	t.Parallel()
+
+	addr := net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 6881}
+
+	tests := []struct {
+		name string
+		t    func(tm *transactionManager) []byte
+		addr *net.UDPAddr
+		want bool
+	}{
+		{
+			name: "matching response",
+			t:    func(tm *transactionManager) []byte { return tm.issue(queryGetPeers, addr, [20]byte{1}) },
+			addr: &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 6881},
+			want: true,
+		},
+		{
+			name: "different address",
+			t:    func(tm *transactionManager) []byte { return tm.issue(queryGetPeers, addr, [20]byte{1}) },
+			addr: &net.UDPAddr{IP: net.IPv4(2, 2, 2, 2), Port: 6881},
+			want: false,
+		},
+		{
+			name: "different port",
+			t:    func(tm *transactionManager) []byte { return tm.issue(queryGetPeers, addr, [20]byte{1}) },
+			addr: &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 6882},
+			want: false,
+		},
+		{
+			name: "unknown transaction",
+			t:    func(tm *transactionManager) []byte { return []byte("aa") },
+			addr: &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 6881},
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			tm := newTransactionManager(transactionTimeout)
+			id := tt.t(tm)
+			tx, _, ok := tm.resolve(id, tt.addr)
+			if ok != tt.want {
+				t.Fatalf("resolve() = %v, want %v", ok, tt.want)
+			}
+			if !ok {
+				return
+			}
+			if tx.kind != queryGetPeers || tx.infoHash != [20]byte{1} {
+				t.Errorf("unexpected transaction %+v", tx)
+			}
+			if _, _, ok := tm.resolve(id, tt.addr); ok {
+				t.Error("expected a transaction to be resolved only once")
+			}
+		})
+	}
+}
+
+func TestTransactionManager_expire(t *testing.T) {
+	t.Parallel()
+
+	tm := newTransactionManager(time.Minute)
+	addr := net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 6881}
+	id := tm.issue(querySampleInfohashes, addr, [20]byte{})
+
+	if expired := tm.expire(time.Now()); len(expired) != 0 {
+		t.Errorf("expected no expired transactions, got %d", len(expired))
+	}
+
+	expired := tm.expire(time.Now().Add(2 * time.Minute))
+	if len(expired) != 1 || expired[0].addr.String() != addr.String() {
+		t.Fatalf("unexpected expired transactions %v", expired)
+	}
+	if _, _, ok := tm.resolve(id, &addr); ok {
+		t.Error("expected an expired transaction not to be resolved")
+	}
+}
+
+func TestTransactionManager_cancel(t *testing.T) {
+	t.Parallel()
+
+	tm := newTransactionManager(time.Minute)
+	addr := net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 6881}
+	id := tm.issue(queryLookup, addr, [20]byte{1})
+
+	if tx := tm.cancel(id); tx == nil || tx.infoHash != [20]byte{1} {
+		t.Fatalf("unexpected cancelled transaction %v", tx)
+	}
+	if tx := tm.cancel(id); tx != nil {
+		t.Errorf("expected a cancelled transaction to be forgotten, got %v", tx)
+	}
+	if expired := tm.expire(time.Now().Add(2 * time.Minute)); len(expired) != 0 {
+		t.Errorf("expected a cancelled transaction not to expire, got %v", expired)
+	}
+}
@@ -1,54 +1,114 @@
 package mainline
 
 import (
+	"bytes"
+	"errors"
+	"io"
 	"log"
 	"net"
+	"runtime"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
 	"tgragnato.it/magnetico/v2/bencode"
 	"tgragnato.it/magnetico/v2/stats"
 )
 
+const (
+	/*   The field size sets a theoretical limit of 65,535 bytes (8 byte header + 65,527 bytes of
+	 * data) for a UDP datagram. However the actual limit for the data length, which is imposed by
+	 * the underlying IPv4 protocol, is 65,507 bytes (65,535 − 8 byte UDP header − 20 byte IP
+	 * header).
+	 *
+	 *   In IPv6 jumbograms it is possible to have UDP packets of size greater than 65,535 bytes.
+	 * RFC 2675 specifies that the length field is set to zero if the length of the UDP header plus
+	 * UDP data is greater than 65,535.
+	 *
+	 * https://en.wikipedia.org/wiki/User_Datagram_Protocol
+	 */
+	maxDatagramSize = 65507
+	// batchSize is the maximum number of datagrams read or written with a single syscall
+	// (recvmmsg and sendmmsg on Linux, while the other platforms handle one at a time).
+	batchSize = 32
+)
+
 var (
-	//Throttle rate that transport will have at Start time. Set <= 0 for unlimited requests
-	DefaultThrottleRate = -1
+	errNoSocket    = errors.New("the transport has no socket")
+	errRateLimited = errors.New("the message exceeds the rate limits")
 )
 
 type Transport struct {
-	conn    *net.UDPConn
+	network Network
+	sockets []*socket
 	laddr   *net.UDPAddr
 	started bool
-	buffer  []byte
+	closed  chan struct{}
+	// closeOnce makes Terminate idempotent.
+	closeOnce sync.Once
+
+	// packets are the datagrams read from the sockets, waiting for a worker to decode them.
+	packets chan packet
+	// next is the counter that spreads the outgoing messages among the sockets.
+	next uint64
 
 	// OnMessage is the function that will be called when Transport receives a packet that is
 	// successfully unmarshalled as a syntactically correct Message (but -of course- the checking
-	// the semantic correctness of the Message is left to Protocol).
+	// the semantic correctness of the Message is left to Protocol). It is called concurrently by
+	// the workers.
 	onMessage func(*Message, *net.UDPAddr)
 
-	throttlingRate         int           //available messages per second. If <=0, it is considered disabled
-	throttleTicketsChannel chan struct{} //channel giving tickets (allowance) to make send a message
-	maxNeighbors           uint
-	queuedCommunications   uint64
+	// numSockets is the number of sockets bound to the address at Start time, sharing the port
+	// with SO_REUSEPORT so that the kernel spreads the incoming datagrams among them, and
+	// numWorkers the number of goroutines that decode and handle the incoming messages, one per
+	// CPU when <= 0.
+	numSockets int
+	numWorkers int
+
+	limiter              *limiter
+	maxNeighbors         uint
+	queuedCommunications uint64
+}
+
+// batchConn reads and writes batches of datagrams. Both ipv4.PacketConn and ipv6.PacketConn
+// implement it, as their messages are the same type.
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// socket is one of the sockets bound to the address of the transport, with the queue of the
+// datagrams to be written on it.
+type socket struct {
+	conn     net.PacketConn
+	batch    batchConn
+	ipv6     bool
+	outgoing chan *datagram
+}
+
+// datagram is a marshalled message waiting to be written, with the channel on which the result of
+// the write is reported.
+type datagram struct {
+	data []byte
+	addr *net.UDPAddr
+	err  chan error
 }
 
-func NewTransport(laddr string, onMessage func(*Message, *net.UDPAddr), maxNeighbors uint) *Transport {
+// packet is a datagram read from a socket.
+type packet struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+func NewTransport(laddr string, onMessage func(*Message, *net.UDPAddr), maxNeighbors uint, network Network) *Transport {
 	t := new(Transport)
-	/*   The field size sets a theoretical limit of 65,535 bytes (8 byte header + 65,527 bytes of
-	 * data) for a UDP datagram. However the actual limit for the data length, which is imposed by
-	 * the underlying IPv4 protocol, is 65,507 bytes (65,535 − 8 byte UDP header − 20 byte IP
-	 * header).
-	 *
-	 *   In IPv6 jumbograms it is possible to have UDP packets of size greater than 65,535 bytes.
-	 * RFC 2675 specifies that the length field is set to zero if the length of the UDP header plus
-	 * UDP data is greater than 65,535.
-	 *
-	 * https://en.wikipedia.org/wiki/User_Datagram_Protocol
-	 */
-	t.buffer = make([]byte, 65507)
+	t.network = network
 	t.onMessage = onMessage
-	t.throttleTicketsChannel = make(chan struct{})
-	t.throttlingRate = DefaultThrottleRate
+	t.numSockets = 1
+	t.numWorkers = 0
 	t.maxNeighbors = maxNeighbors
 	t.queuedCommunications = 0
 
@@ -57,10 +117,23 @@ func NewTransport(laddr string, onMessage func(*Message, *net.UDPAddr), maxNeigh
 	if err != nil {
 		panic("Could not resolve the UDP address for the trawler! " + err.Error())
 	}
+	t.limiter = newLimiter(laddr, DefaultRateLimits, time.Now())
 
 	return t
 }
 
+// SetRateLimits replaces the DefaultRateLimits of the transport. It must be called before Start.
+func (t *Transport) SetRateLimits(limits RateLimits) {
+	t.limiter = newLimiter(t.limiter.indexer, limits, time.Now())
+}
+
+// SetConcurrency replaces the single socket of the transport with sockets sharing its port, and
+// its workers, one per CPU by default, with workers. It must be called before Start.
+func (t *Transport) SetConcurrency(sockets int, workers int) {
+	t.numSockets = sockets
+	t.numWorkers = workers
+}
+
 func (t *Transport) Start() {
 	// Why check whether the Transport `t` started or not, here and not -for instance- in
 	// t.Terminate()?
@@ -75,90 +148,182 @@ func (t *Transport) Start() {
 	}
 	t.started = true
 
-	var err error
-	t.conn, err = net.ListenUDP("udp", t.laddr)
+	conns, err := t.network.ListenPacket(t.udpNetwork(), t.laddr.String(), t.numSockets)
 	if err != nil {
 		log.Fatalf("Could NOT bind the socket! %s\n", err.Error())
 	}
 
-	go t.readMessages()
-	go t.Throttle()
+	t.serve(conns)
 }
 
 func (t *Transport) Terminate() {
-	t.conn.Close()
+	t.closeOnce.Do(func() {
+		if t.closed != nil {
+			close(t.closed)
+		}
+		for _, s := range t.sockets {
+			s.conn.Close()
+		}
+	})
 }
 
-// readMessages is a goroutine!
-func (t *Transport) readMessages() {
+// udpNetwork returns the network of the sockets: the ones bound to an IPv4 address do not reach
+// the IPv6 nodes, and their batches can address the IPv4 ones.
+func (t *Transport) udpNetwork() string {
+	switch ipv4, ipv6 := families(t.laddr.String()); {
+	case !ipv6:
+		return "udp4"
+	case !ipv4:
+		return "udp6"
+	default:
+		return "udp"
+	}
+}
+
+// serve starts reading from and writing to conns, and the workers that handle the messages.
+func (t *Transport) serve(conns []net.PacketConn) {
+	workers := t.numWorkers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	t.closed = make(chan struct{})
+	t.packets = make(chan packet, workers*batchSize)
+	for range workers {
+		go t.handleMessages()
+	}
+
+	var readers sync.WaitGroup
+	for _, conn := range conns {
+		s := newSocket(conn)
+		t.sockets = append(t.sockets, s)
+		readers.Go(func() { t.readMessages(s) })
+		go s.writeMessages(t.closed)
+	}
+	go func() {
+		readers.Wait()
+		close(t.packets)
+	}()
+}
+
+func newSocket(conn net.PacketConn) *socket {
+	s := &socket{conn: conn, outgoing: make(chan *datagram, batchSize)}
+	udpConn, ok := conn.(*net.UDPConn)
+	switch {
+	case !ok:
+		s.batch = packetBatch{conn}
+	case udpConn.LocalAddr().(*net.UDPAddr).IP.To4() != nil:
+		s.batch = ipv4.NewPacketConn(udpConn)
+	default:
+		s.batch = ipv6.NewPacketConn(udpConn)
+		s.ipv6 = true
+	}
+	return s
+}
+
+// readMessages is a goroutine! It reads the datagrams of the socket in batches, and hands them over
+// to the workers.
+func (t *Transport) readMessages(s *socket) {
+	msgs := make([]ipv4.Message, batchSize)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, maxDatagramSize)}
+	}
+
 	for {
-		n, from, err := t.conn.ReadFromUDP(t.buffer)
+		n, err := s.batch.ReadBatch(msgs, 0)
 		if err != nil {
 			go stats.GetInstance().IncUDPError(false)
 			break
 		}
 
-		if n == 0 {
-			/* Datagram sockets in various domains  (e.g., the UNIX and Internet domains) permit
-			 * zero-length datagrams. When such a datagram is received, the return value (n) is 0.
-			 */
-			continue
+		for _, msg := range msgs[:n] {
+			if msg.N == 0 {
+				/* Datagram sockets in various domains  (e.g., the UNIX and Internet domains) permit
+				 * zero-length datagrams. When such a datagram is received, the return value (n) is 0.
+				 */
+				continue
+			}
+			from, ok := msg.Addr.(*net.UDPAddr)
+			if !ok {
+				continue
+			}
+			t.packets <- packet{data: bytes.Clone(msg.Buffers[0][:msg.N]), from: from}
 		}
+	}
+}
 
+// handleMessages is a goroutine! It decodes the datagrams read from the sockets and dispatches the
+// messages, until the sockets are closed.
+func (t *Transport) handleMessages() {
+	for p := range t.packets {
 		var msg Message
-		err = bencode.Unmarshal(t.buffer[:n], &msg)
-		if err != nil {
+		if err := bencode.Unmarshal(p.data, &msg); err != nil {
 			// couldn't unmarshal packet data
 			continue
 		}
 
-		t.onMessage(&msg, from)
-	}
-}
-
-// Manages throttling for transport. To be called as a routine at Start time. Should never return.
-func (t *Transport) Throttle() {
-	if t.throttlingRate > 0 {
-		resetChannel := make(chan struct{})
-
-		dealer := func(resetRequest chan struct{}) {
-			ticketGiven := 0
-			tooManyTicketGiven := false
-			for {
-				select {
-				case <-t.throttleTicketsChannel:
-					{
-						ticketGiven++
-						if ticketGiven >= t.throttlingRate {
-							tooManyTicketGiven = true
-							break
-						}
-					}
-				case <-resetRequest:
-					{
-						return
-					}
-				}
-
-				if tooManyTicketGiven {
-					break
-				}
-			}
+		t.onMessage(&msg, p.from)
+	}
+}
+
+// writeMessages is a goroutine! It writes the datagrams queued on the socket, in batches of the
+// ones that are already waiting, until closed is closed.
+func (s *socket) writeMessages(closed <-chan struct{}) {
+	batch := make([]*datagram, 0, batchSize)
+	msgs := make([]ipv4.Message, batchSize)
 
-			<-resetRequest
+	for {
+		select {
+		case d := <-s.outgoing:
+			batch = append(batch[:0], d)
+		case <-closed:
+			return
 		}
 
-		go dealer(resetChannel)
-		for range time.Tick(1 * time.Second) {
-			resetChannel <- struct{}{}
+	fill:
+		for len(batch) < batchSize {
+			select {
+			case d := <-s.outgoing:
+				batch = append(batch, d)
+			default:
+				break fill
+			}
+		}
 
-			go dealer(resetChannel)
+		s.write(batch, msgs)
+	}
+}
+
+// write writes batch, using msgs as scratch space, and reports the result of each datagram.
+func (s *socket) write(batch []*datagram, msgs []ipv4.Message) {
+	n := 0
+	for _, d := range batch {
+		// The batches address the IPv4 nodes with IPv4 socket addresses, which a dual-stack socket
+		// rejects: the standard library maps them to IPv6 instead.
+		if s.ipv6 && d.addr.IP.To4() != nil {
+			_, err := s.conn.WriteTo(d.data, d.addr)
+			d.err <- err
+			continue
 		}
+		msgs[n] = ipv4.Message{Buffers: [][]byte{d.data}, Addr: d.addr}
+		batch[n] = d
+		n++
+	}
 
-	} else {
-		// no limit, keep giving tickets to whoever requests it
-		for {
-			<-t.throttleTicketsChannel
+	for sent := 0; sent < n; {
+		written, err := s.batch.WriteBatch(msgs[sent:n], 0)
+		written = max(written, 0)
+		for _, d := range batch[sent : sent+written] {
+			d.err <- nil
+		}
+		sent += written
+
+		if err == nil && written == 0 {
+			err = io.ErrShortWrite
+		}
+		if err != nil && sent < n {
+			// Skip the datagram that failed, and carry on with the rest of the batch.
+			batch[sent].err <- err
+			sent++
 		}
 	}
 }
@@ -173,15 +338,41 @@ func (t *Transport) WriteMessages(msg *Message, addr *net.UDPAddr) error {
 		return err
 	}
 
-	// get ticket but prioritize get_peers and find_node
-	if msg.Q != "get_peers" && msg.Q != "find_node" {
+	if len(t.sockets) == 0 {
+		return errNoSocket
+	}
+
+	wait, ok := t.limiter.allow(msg, addr.IP, time.Now())
+	if !ok {
+		return errRateLimited
+	}
+	if wait > 0 {
 		atomic.AddUint64(&t.queuedCommunications, 1)
-		defer atomic.AddUint64(&t.queuedCommunications, ^uint64(0))
-		t.throttleTicketsChannel <- struct{}{}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-t.closed:
+			timer.Stop()
+			atomic.AddUint64(&t.queuedCommunications, ^uint64(0))
+			return net.ErrClosed
+		}
+		atomic.AddUint64(&t.queuedCommunications, ^uint64(0))
+	}
+
+	s := t.sockets[atomic.AddUint64(&t.next, 1)%uint64(len(t.sockets))]
+	d := &datagram{data: data, addr: addr, err: make(chan error, 1)}
+	select {
+	case s.outgoing <- d:
+	case <-t.closed:
+		return net.ErrClosed
 	}
 
-	_, err = t.conn.WriteToUDP(data, addr)
-	return err
+	select {
+	case err = <-d.err:
+		return err
+	case <-t.closed:
+		return net.ErrClosed
+	}
 }
 
 // Transport is full if the queued communications are more than the maximum neighbors.
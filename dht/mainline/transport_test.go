@@ -1,11 +1,16 @@
 package mainline
 
 import (
+	"errors"
 	"math/rand/v2"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"tgragnato.it/magnetico/v2/bencode"
 )
 
 const (
@@ -67,39 +72,39 @@ func TestTransport_WriteMessages(t *testing.T) {
 	t.Parallel()
 
 	tests := []struct {
-		name           string
-		throttlingRate int
-		msg            *Message
-		addr           *net.UDPAddr
-		wantErr        bool
+		name    string
+		queries float64
+		msg     *Message
+		addr    *net.UDPAddr
+		wantErr bool
 	}{
 		{
-			name:           "Nil message",
-			throttlingRate: 10,
-			msg:            nil,
-			addr:           &net.UDPAddr{IP: net.ParseIP("::1"), Port: 8080},
-			wantErr:        false,
+			name:    "Nil message",
+			queries: 10,
+			msg:     nil,
+			addr:    &net.UDPAddr{IP: net.ParseIP("::1"), Port: 8080},
+			wantErr: false,
 		},
 		{
-			name:           "Nil address",
-			throttlingRate: 10,
-			msg:            &Message{Q: "ping"},
-			addr:           nil,
-			wantErr:        false,
+			name:    "Nil address",
+			queries: 10,
+			msg:     &Message{Q: "ping"},
+			addr:    nil,
+			wantErr: false,
 		},
 		{
-			name:           "Valid message and address",
-			throttlingRate: 10,
-			msg:            &Message{Q: "ping"},
-			addr:           &net.UDPAddr{IP: net.ParseIP("::1"), Port: 8080},
-			wantErr:        false,
+			name:    "Valid message and address",
+			queries: 10,
+			msg:     &Message{Q: "ping"},
+			addr:    &net.UDPAddr{IP: net.ParseIP("::1"), Port: 8080},
+			wantErr: false,
 		},
 		{
-			name:           "Throttle limit reached",
-			throttlingRate: 0,
-			msg:            &Message{Q: "ping"},
-			addr:           &net.UDPAddr{IP: net.ParseIP("::1"), Port: 8080},
-			wantErr:        false,
+			name:    "Throttle limit reached",
+			queries: 0,
+			msg:     &Message{Q: "ping"},
+			addr:    &net.UDPAddr{IP: net.ParseIP("::1"), Port: 8080},
+			wantErr: false,
 		},
 	}
 	for _, tt := range tests {
@@ -108,8 +113,9 @@ func TestTransport_WriteMessages(t *testing.T) {
 				net.JoinHostPort("::1", strconv.Itoa(rand.IntN(64511)+1024)),
 				func(m *Message, u *net.UDPAddr) {},
 				1000,
+				Internet,
 			)
-			transport.throttlingRate = tt.throttlingRate
+			transport.limiter = newLimiter("", RateLimits{Queries: tt.queries, Burst: time.Second}, time.Now())
 			transport.Start()
 			defer transport.Terminate()
 
@@ -161,3 +167,152 @@ func TestTransportFull(t *testing.T) {
 		})
 	}
 }
+
+func TestTransport_Sockets(t *testing.T) {
+	t.Parallel()
+
+	received := make(chan *net.UDPAddr, 64)
+	transport := NewTransport("127.0.0.1:0", func(m *Message, u *net.UDPAddr) {
+		received <- u
+	}, 1000, Internet)
+	transport.SetConcurrency(4, 2)
+	transport.Start()
+	defer transport.Terminate()
+
+	if len(transport.sockets) != 4 {
+		t.Fatalf("expected 4 sockets, got %d", len(transport.sockets))
+	}
+	laddr := transport.sockets[0].conn.LocalAddr().(*net.UDPAddr)
+	for _, s := range transport.sockets[1:] {
+		if s.conn.LocalAddr().(*net.UDPAddr).Port != laddr.Port {
+			t.Fatalf("expected the sockets to share port %d, got %s", laddr.Port, s.conn.LocalAddr())
+		}
+	}
+
+	// Several clients, so that the kernel spreads them among the sockets.
+	data, _ := bencode.Marshal(NewPingQuery(randomNodeID()))
+	for range 16 {
+		client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		if _, err := client.WriteToUDP(data, laddr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.WriteToUDP([]byte("not bencode"), laddr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for range 16 {
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			t.Fatal("expected every valid message to be dispatched")
+		}
+	}
+	select {
+	case from := <-received:
+		t.Errorf("unexpected message from %s", from)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestTransport_WriteBatches(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		laddr  string
+		remote string
+	}{
+		{"IPv4", "127.0.0.1:0", "127.0.0.1"},
+		{"IPv4 from a dual-stack socket", "[::]:0", "127.0.0.1"},
+		{"IPv6 from a dual-stack socket", "[::]:0", "::1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			remote, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(tt.remote)})
+			if err != nil {
+				t.Skip(MSG_SKIP_ERR)
+			}
+			defer remote.Close()
+
+			transport := NewTransport(tt.laddr, func(m *Message, u *net.UDPAddr) {}, 1000, Internet)
+			transport.Start()
+			defer transport.Terminate()
+
+			// Concurrent writers fill the batches.
+			var wg sync.WaitGroup
+			for range 2 * batchSize {
+				wg.Go(func() {
+					addr := remote.LocalAddr().(*net.UDPAddr)
+					if err := transport.WriteMessages(NewFindNodeQuery(randomNodeID(), randomNodeID()), addr); err != nil {
+						t.Errorf("Transport.WriteMessages() error = %v", err)
+					}
+				})
+			}
+			wg.Wait()
+
+			buf := make([]byte, 2048)
+			for i := range 2 * batchSize {
+				_ = remote.SetReadDeadline(time.Now().Add(time.Second))
+				n, err := remote.Read(buf)
+				if err != nil {
+					t.Fatalf("received only %d datagrams: %v", i, err)
+				}
+				var msg Message
+				if err := bencode.Unmarshal(buf[:n], &msg); err != nil || msg.Q != "find_node" {
+					t.Fatalf("unexpected datagram %q", buf[:n])
+				}
+			}
+		})
+	}
+}
+
+func TestTransport_WriteMessagesAfterTerminate(t *testing.T) {
+	t.Parallel()
+
+	transport := NewTransport("127.0.0.1:0", func(m *Message, u *net.UDPAddr) {}, 1000, Internet)
+	transport.Start()
+	transport.Terminate()
+	// Terminating twice is harmless.
+	transport.Terminate()
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881}
+	if err := transport.WriteMessages(NewFindNodeQuery(randomNodeID(), randomNodeID()), addr); err == nil {
+		t.Error("expected an error from a terminated transport")
+	}
+	if err := (&Transport{}).WriteMessages(&Message{Q: "find_node"}, addr); err != errNoSocket {
+		t.Errorf("expected %v from a transport without sockets, got %v", errNoSocket, err)
+	}
+}
+
+func TestTransport_WriteMessagesWaitingOnTerminate(t *testing.T) {
+	t.Parallel()
+
+	transport := NewTransport("127.0.0.1:0", func(m *Message, u *net.UDPAddr) {}, 1000, Internet)
+	transport.limiter = newLimiter("", RateLimits{Queries: 0.1, Burst: time.Second}, time.Now())
+	transport.Start()
+
+	// The first ping spends the only token, and the second one waits 10s for the next one.
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881}
+	if err := transport.WriteMessages(NewPingQuery(randomNodeID()), addr); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		transport.Terminate()
+	}()
+	start := time.Now()
+	if err := transport.WriteMessages(NewPingQuery(randomNodeID()), addr); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("expected %v, got %v", net.ErrClosed, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the wait to end with the transport, took %s", elapsed)
+	}
+}
@@ -2,14 +2,23 @@ package dht
 
 import (
 	"net"
+	"strconv"
 	"sync"
+	"time"
 
 	"tgragnato.it/magnetico/v2/dht/mainline"
 )
 
+// lookupWindow is the time during which the peers found by the lookups of a torrent are delivered
+// once, however many indexing services find them: longer than a lookup takes to finish.
+const lookupWindow = time.Minute
+
 type Service interface {
 	Start()
 	Terminate()
+	Scrape(infoHash [20]byte)
+	Lookup(infoHash [20]byte)
+	OnMetadata(infoHash [20]byte)
 }
 
 type Result interface {
@@ -17,27 +26,112 @@ type Result interface {
 	PeerAddrs() []net.TCPAddr
 }
 
+type ScrapeResult interface {
+	InfoHash() [20]byte
+	Seeders() uint
+	Leechers() uint
+}
+
+// IndexerConfig is the configuration of an indexing service of a Manager.
+type IndexerConfig struct {
+	Addr           string
+	MaxNeighbors   uint
+	BootstrapNodes []string
+	FilterNodes    []net.IPNet
+	RateLimits     mainline.RateLimits
+	// Sockets is the number of sockets bound to Addr with SO_REUSEPORT, zero meaning one, and
+	// Workers the number of goroutines handling the messages, zero meaning one per CPU.
+	Sockets int
+	Workers int
+	// NodeID is the fixed node ID of the indexer, or nil to let it pick one.
+	NodeID []byte
+}
+
 type Manager struct {
 	mu               sync.RWMutex
 	output           chan Result
+	scrapeOutput     chan ScrapeResult
 	indexingServices []Service
+
+	// lookups are the addresses of the peers delivered for the torrents looked up in the current
+	// lookupWindow, and previousLookups in the one before, which are forgotten together.
+	lookupsMu       sync.Mutex
+	lookups         map[[20]byte]map[string]struct{}
+	previousLookups map[[20]byte]map[string]struct{}
+	lookupsRotated  time.Time
+}
+
+// lookupResult is a result of a torrent looked up, without the peers already delivered.
+type lookupResult struct {
+	infoHash  [20]byte
+	peerAddrs []net.TCPAddr
+}
+
+func (lr lookupResult) InfoHash() [20]byte {
+	return lr.infoHash
+}
+
+func (lr lookupResult) PeerAddrs() []net.TCPAddr {
+	return lr.peerAddrs
 }
 
-func NewManager(addrs []string, maxNeighbors uint, bootstrappingNodes []string, filterNodes []net.IPNet) *Manager {
+// NewManager starts an indexing service for every indexer, each with its own settings. When
+// statePath is not empty, their routing tables are saved to it (suffixed by the index of the
+// indexer if there are more than one) and restored at the next start. With goodCitizen, the
+// queries of the other nodes are answered with the closest nodes of the routing tables.
+func NewManager(indexers []IndexerConfig, statePath string, goodCitizen bool, network mainline.Network) *Manager {
 	manager := new(Manager)
 	manager.output = make(chan Result, 20)
+	manager.scrapeOutput = make(chan ScrapeResult, 100)
+
+	for i, indexer := range indexers {
+		service := mainline.NewIndexingService(indexer.Addr, indexer.MaxNeighbors, mainline.IndexingServiceEventHandlers{
+			OnResult:       manager.onIndexingResult,
+			OnScrapeResult: manager.onScrapeResult,
+		}, indexer.BootstrapNodes, indexer.FilterNodes, servicePath(statePath, i, len(indexers)), goodCitizen, network)
+		manager.start(service, indexer)
+	}
+
+	return manager
+}
+
+// NewBootstrapManager starts a bootstrap node for every indexer, for the crawlers of the private
+// networks confined to their filters. The nodes produce no results, and their routing tables are
+// saved to statePath like in NewManager.
+func NewBootstrapManager(indexers []IndexerConfig, statePath string, network mainline.Network) *Manager {
+	manager := new(Manager)
+	manager.output = make(chan Result)
+	manager.scrapeOutput = make(chan ScrapeResult)
 
-	for _, addr := range addrs {
-		service := mainline.NewIndexingService(addr, maxNeighbors, mainline.IndexingServiceEventHandlers{
-			OnResult: manager.onIndexingResult,
-		}, bootstrappingNodes, filterNodes)
-		manager.indexingServices = append(manager.indexingServices, service)
-		service.Start()
+	for i, indexer := range indexers {
+		service := mainline.NewBootstrapService(indexer.Addr, indexer.MaxNeighbors, indexer.BootstrapNodes, indexer.FilterNodes, servicePath(statePath, i, len(indexers)), network)
+		manager.start(service, indexer)
 	}
 
 	return manager
 }
 
+// start applies the rate limits, the concurrency and the node ID of indexer to service, and starts
+// it.
+func (m *Manager) start(service *mainline.IndexingService, indexer IndexerConfig) {
+	service.SetRateLimits(indexer.RateLimits)
+	service.SetConcurrency(indexer.Sockets, indexer.Workers)
+	if indexer.NodeID != nil {
+		service.SetNodeID(indexer.NodeID)
+	}
+	m.indexingServices = append(m.indexingServices, service)
+	service.Start()
+}
+
+// servicePath returns the state file of the i-th of n services: statePath suffixed by i if there
+// are more than one.
+func servicePath(statePath string, i int, n int) string {
+	if statePath != "" && n > 1 {
+		return statePath + "." + strconv.Itoa(i)
+	}
+	return statePath
+}
+
 func (m *Manager) Output() <-chan Result {
 	m.mu.Lock()
 	ch := m.output
@@ -45,7 +139,12 @@ func (m *Manager) Output() <-chan Result {
 	return ch
 }
 
-func (m *Manager) onIndexingResult(res mainline.IndexingResult) {
+func (m *Manager) onIndexingResult(indexingResult mainline.IndexingResult) {
+	res, ok := m.dedupe(indexingResult, time.Now())
+	if !ok {
+		return
+	}
+
 	select {
 	case m.output <- res:
 		return
@@ -67,6 +166,90 @@ func (m *Manager) onIndexingResult(res mainline.IndexingResult) {
 	}
 }
 
+// Scrape starts a DHT scrape of infoHash on one of the indexing services. The estimated swarm
+// size is delivered on ScrapeOutput().
+func (m *Manager) Scrape(infoHash [20]byte) {
+	if len(m.indexingServices) == 0 {
+		return
+	}
+	m.indexingServices[int(infoHash[0])%len(m.indexingServices)].Scrape(infoHash)
+}
+
+// Lookup searches the DHT for the peers of infoHash on every indexing service. The peers found are
+// delivered on Output(), like the ones harvested by the indexing, once however many services find
+// them.
+func (m *Manager) Lookup(infoHash [20]byte) {
+	m.lookupsMu.Lock()
+	m.rotateLookups(time.Now())
+	m.lookups[infoHash] = map[string]struct{}{}
+	m.lookupsMu.Unlock()
+
+	for _, service := range m.indexingServices {
+		service.Lookup(infoHash)
+	}
+}
+
+// dedupe removes from a result of a torrent looked up recently the peers already delivered, and
+// reports false if none is left. The other results are left alone.
+func (m *Manager) dedupe(res Result, now time.Time) (Result, bool) {
+	m.lookupsMu.Lock()
+	defer m.lookupsMu.Unlock()
+
+	m.rotateLookups(now)
+	delivered, ok := m.lookups[res.InfoHash()]
+	if !ok {
+		if delivered, ok = m.previousLookups[res.InfoHash()]; !ok {
+			return res, true
+		}
+	}
+
+	peers := []net.TCPAddr{}
+	for _, peer := range res.PeerAddrs() {
+		if _, ok := delivered[peer.String()]; !ok {
+			delivered[peer.String()] = struct{}{}
+			peers = append(peers, peer)
+		}
+	}
+	if len(peers) == 0 {
+		return nil, false
+	}
+	return lookupResult{infoHash: res.InfoHash(), peerAddrs: peers}, true
+}
+
+// rotateLookups forgets the lookups of the previous lookupWindow once the current one is over, and
+// all of them once both are.
+func (m *Manager) rotateLookups(now time.Time) {
+	if m.lookups != nil && now.Sub(m.lookupsRotated) < lookupWindow {
+		return
+	}
+	m.previousLookups = nil
+	if now.Sub(m.lookupsRotated) < 2*lookupWindow {
+		m.previousLookups = m.lookups
+	}
+	m.lookups = make(map[[20]byte]map[string]struct{})
+	m.lookupsRotated = now
+}
+
+// OnMetadata tells the indexing services that the metadata of infoHash has been fetched, so that
+// they can credit the node that returned it in its samples.
+func (m *Manager) OnMetadata(infoHash [20]byte) {
+	for _, service := range m.indexingServices {
+		service.OnMetadata(infoHash)
+	}
+}
+
+func (m *Manager) ScrapeOutput() <-chan ScrapeResult {
+	return m.scrapeOutput
+}
+
+func (m *Manager) onScrapeResult(res mainline.ScrapeResult) {
+	// Scrapes are repeated periodically, so a result can be dropped when the consumer lags behind.
+	select {
+	case m.scrapeOutput <- res:
+	default:
+	}
+}
+
 func (m *Manager) Terminate() {
 	for _, service := range m.indexingServices {
 		service.Terminate()
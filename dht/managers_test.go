@@ -36,7 +36,7 @@ func TestChannelOutput(t *testing.T) {
 	t.Parallel()
 
 	address := ManagerAddress + ":" + strconv.Itoa(rand.IntN(64511)+1024)
-	manager := NewManager([]string{address}, MaxNeighbours, []string{"dht.tgragnato.it"}, []net.IPNet{})
+	manager := NewManager([]IndexerConfig{{Addr: address, MaxNeighbors: MaxNeighbours, BootstrapNodes: []string{"dht.tgragnato.it"}}}, "", false, mainline.Internet)
 	peerPort := rand.IntN(64511) + 1024
 
 	result := &TestResult{
@@ -64,7 +64,7 @@ func TestOnIndexingResult(t *testing.T) {
 	t.Parallel()
 
 	address := ManagerAddress + ":" + strconv.Itoa(rand.IntN(64511)+1024)
-	manager := NewManager([]string{address}, MaxNeighbours, []string{"dht.tgragnato.it"}, []net.IPNet{})
+	manager := NewManager([]IndexerConfig{{Addr: address, MaxNeighbors: MaxNeighbours, BootstrapNodes: []string{"dht.tgragnato.it"}}}, "", false, mainline.Internet)
 
 	result := mainline.IndexingResult{}
 	outputChan := make(chan Result, ChanSize)
@@ -88,3 +88,142 @@ func TestOnIndexingResult(t *testing.T) {
 
 	manager.Terminate()
 }
+
+type TestService struct {
+	scraped  [][20]byte
+	lookedUp [][20]byte
+	fetched  [][20]byte
+}
+
+func (ts *TestService) Start()     {}
+func (ts *TestService) Terminate() {}
+
+func (ts *TestService) Scrape(infoHash [20]byte) {
+	ts.scraped = append(ts.scraped, infoHash)
+}
+
+func (ts *TestService) Lookup(infoHash [20]byte) {
+	ts.lookedUp = append(ts.lookedUp, infoHash)
+}
+
+func (ts *TestService) OnMetadata(infoHash [20]byte) {
+	ts.fetched = append(ts.fetched, infoHash)
+}
+
+func TestOnMetadata(t *testing.T) {
+	t.Parallel()
+
+	first, second := &TestService{}, &TestService{}
+	manager := &Manager{indexingServices: []Service{first, second}}
+
+	manager.OnMetadata([20]byte{3})
+
+	if !reflect.DeepEqual(first.fetched, [][20]byte{{3}}) || !reflect.DeepEqual(second.fetched, [][20]byte{{3}}) {
+		t.Errorf("expected every service to be told, got %v and %v", first.fetched, second.fetched)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	t.Parallel()
+
+	first, second := &TestService{}, &TestService{}
+	manager := &Manager{indexingServices: []Service{first, second}}
+
+	manager.Lookup([20]byte{2})
+
+	if !reflect.DeepEqual(first.lookedUp, [][20]byte{{2}}) || !reflect.DeepEqual(second.lookedUp, [][20]byte{{2}}) {
+		t.Errorf("expected the lookup on every service, got %v and %v", first.lookedUp, second.lookedUp)
+	}
+}
+
+func TestLookup_Dedupe(t *testing.T) {
+	t.Parallel()
+
+	manager := &Manager{indexingServices: []Service{&TestService{}}}
+	first := net.TCPAddr{IP: net.ParseIP(PeerIP), Port: 6881}
+	second := net.TCPAddr{IP: net.ParseIP(PeerIP), Port: 6882}
+	now := time.Now()
+	manager.Lookup([20]byte{2})
+
+	// The peers found by several indexing services are delivered once.
+	tests := []struct {
+		name   string
+		result Result
+		want   []net.TCPAddr
+	}{
+		{"First", &TestResult{[20]byte{2}, []net.TCPAddr{first}}, []net.TCPAddr{first}},
+		{"Duplicate", &TestResult{[20]byte{2}, []net.TCPAddr{first}}, nil},
+		{"Merged", &TestResult{[20]byte{2}, []net.TCPAddr{first, second}}, []net.TCPAddr{second}},
+		{"Not looked up", &TestResult{[20]byte{3}, []net.TCPAddr{first}}, []net.TCPAddr{first}},
+	}
+	for _, tt := range tests {
+		res, ok := manager.dedupe(tt.result, now)
+		if ok != (tt.want != nil) || ok && !reflect.DeepEqual(res.PeerAddrs(), tt.want) {
+			t.Errorf("%s: dedupe() = %v, want %v", tt.name, res, tt.want)
+		}
+	}
+
+	// The peers are forgotten once the lookup is over.
+	if _, ok := manager.dedupe(&TestResult{[20]byte{2}, []net.TCPAddr{first}}, now.Add(3*lookupWindow)); !ok {
+		t.Error("expected the peers of an old lookup to be delivered again")
+	}
+}
+
+func TestScrape(t *testing.T) {
+	t.Parallel()
+
+	first, second := &TestService{}, &TestService{}
+	manager := &Manager{indexingServices: []Service{first, second}}
+
+	manager.Scrape([20]byte{2})
+	manager.Scrape([20]byte{3})
+	manager.Scrape([20]byte{4})
+
+	if !reflect.DeepEqual(first.scraped, [][20]byte{{2}, {4}}) {
+		t.Errorf("unexpected scrapes on the first service %v", first.scraped)
+	}
+	if !reflect.DeepEqual(second.scraped, [][20]byte{{3}}) {
+		t.Errorf("unexpected scrapes on the second service %v", second.scraped)
+	}
+
+	(&Manager{}).Scrape([20]byte{1})
+}
+
+func TestOnScrapeResult(t *testing.T) {
+	t.Parallel()
+
+	manager := &Manager{scrapeOutput: make(chan ScrapeResult, 1)}
+	result := mainline.ScrapeResult{}
+
+	// The second result does not fit and must be dropped without blocking.
+	manager.onScrapeResult(result)
+	manager.onScrapeResult(result)
+
+	if received := <-manager.ScrapeOutput(); !reflect.DeepEqual(received, result) {
+		t.Errorf("\nReceived result %v, \nExpected result %v", received, result)
+	}
+	select {
+	case <-manager.ScrapeOutput():
+		t.Error("Unexpected result received")
+	default:
+	}
+}
+
+func TestServicePath(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		statePath string
+		i, n      int
+		want      string
+	}{
+		{"", 1, 2, ""},
+		{"state.json", 0, 1, "state.json"},
+		{"state.json", 1, 2, "state.json.1"},
+	}
+	for _, tt := range tests {
+		if got := servicePath(tt.statePath, tt.i, tt.n); got != tt.want {
+			t.Errorf("servicePath(%q, %d, %d) = %q, want %q", tt.statePath, tt.i, tt.n, got, tt.want)
+		}
+	}
+}
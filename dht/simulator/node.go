@@ -0,0 +1,135 @@
+package simulator
+
+import (
+	"net"
+	"slices"
+
+	"tgragnato.it/magnetico/v2/dht/mainline"
+)
+
+const (
+	// sampleSize is the maximum number of info hashes in a sample.
+	sampleSize = 20
+	// sampleInterval is the interval between the samples that the nodes ask for, in seconds. It is
+	// short, so that the indexers keep walking the few nodes of the network.
+	sampleInterval = 1
+	// honeypotNum is the number of info hashes that the honeypots claim to store.
+	honeypotNum = 1000
+	// clientVersion identifies the virtual nodes in their responses.
+	clientVersion = "SM\x00\x01"
+)
+
+// token is the announce token given by every node, which accepts any.
+var token = []byte("simulator")
+
+// node is a virtual DHT node. It is not a goroutine: the network makes it answer the queries as
+// they are delivered.
+type node struct {
+	id        [20]byte
+	addr      net.UDPAddr
+	behaviour Behaviour
+	// hashes are the torrents whose peers the node stores. They are never modified after New.
+	hashes map[[20]byte]*torrent
+}
+
+// answer returns the response of node to query, or nil if the node does not answer.
+func (n *Network) answer(node *node, query *mainline.Message, from net.UDPAddr) *mainline.Message {
+	if query.Y != "q" {
+		return nil
+	}
+
+	switch node.behaviour {
+	case Silent:
+		return nil
+	case Erroring:
+		return &mainline.Message{
+			Y: "e",
+			T: query.T,
+			E: mainline.Error{Code: 202, Message: []byte("Server Error")},
+		}
+	case Malformed:
+		// A node ID must be 20 bytes long.
+		return &mainline.Message{Y: "r", T: query.T, R: mainline.ResponseValues{ID: node.id[:10]}}
+	}
+
+	var target [20]byte
+	copy(target[:], query.A.Target)
+	var infoHash [20]byte
+	copy(infoHash[:], query.A.InfoHash)
+
+	var response *mainline.Message
+	switch query.Q {
+	case "ping", "announce_peer":
+		response = mainline.NewPingResponse(query.T, node.id[:])
+	case "find_node":
+		response = mainline.NewFindNodeResponse(query.T, node.id[:], n.closestNodes(target))
+	case "get_peers":
+		if torrent, ok := node.hashes[infoHash]; ok {
+			response = mainline.NewGetPeersResponseWithValues(query.T, node.id[:], token, torrent.compactPeers(), nil, nil)
+		} else {
+			response = mainline.NewGetPeersResponseWithNodes(query.T, node.id[:], token, n.closestNodes(infoHash))
+		}
+	case "sample_infohashes":
+		samples, num := n.sample(node)
+		response = mainline.NewSampleInfohashesResponse(query.T, node.id[:], samples, num, sampleInterval, n.closestNodes(target))
+	default:
+		return &mainline.Message{
+			Y: "e",
+			T: query.T,
+			E: mainline.Error{Code: 204, Message: []byte("Method Unknown")},
+		}
+	}
+
+	// BEP 42: the responses tell the querying node its external address.
+	response.IP, _ = mainline.CompactPeers{{IP: from.IP, Port: from.Port}}.MarshalBinary()
+	response.V = []byte(clientVersion)
+	return response
+}
+
+// sample returns a random sample of the info hashes stored by node, and their number. Honeypots
+// make them up.
+func (n *Network) sample(node *node) ([]byte, int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if node.behaviour == Honeypot {
+		samples := make([]byte, 20*sampleSize)
+		n.fill(samples)
+		return samples, honeypotNum
+	}
+
+	hashes := make([][20]byte, 0, len(node.hashes))
+	for infoHash := range node.hashes {
+		hashes = append(hashes, infoHash)
+	}
+	n.rand.Shuffle(len(hashes), func(i, j int) { hashes[i], hashes[j] = hashes[j], hashes[i] })
+
+	samples := []byte{}
+	for _, infoHash := range hashes[:min(len(hashes), sampleSize)] {
+		samples = append(samples, infoHash[:]...)
+	}
+	return samples, len(hashes)
+}
+
+// closestNodes returns the nodes of the network closest to target.
+func (n *Network) closestNodes(target [20]byte) []mainline.CompactNodeInfo {
+	nodes := []mainline.CompactNodeInfo{}
+	for _, node := range closest(n.nodes, target, k) {
+		nodes = append(nodes, mainline.CompactNodeInfo{ID: node.id[:], Addr: node.addr})
+	}
+	return nodes
+}
+
+// closest returns the count nodes closest to target, in the XOR metric.
+func closest(nodes []*node, target [20]byte, count int) []*node {
+	sorted := slices.Clone(nodes)
+	slices.SortFunc(sorted, func(a, b *node) int {
+		for i := range target {
+			if da, db := a.id[i]^target[i], b.id[i]^target[i]; da != db {
+				return int(da) - int(db)
+			}
+		}
+		return 0
+	})
+	return sorted[:min(len(sorted), count)]
+}
@@ -0,0 +1,121 @@
+package simulator
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// packetConn is a socket bound by an indexer to the simulated network.
+type packetConn struct {
+	network  *Network
+	laddr    net.UDPAddr
+	incoming chan datagram
+
+	mu           sync.Mutex
+	readDeadline time.Time
+	// deadlineSet wakes up the pending reads when the read deadline changes.
+	deadlineSet chan struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+type datagram struct {
+	data []byte
+	from net.UDPAddr
+}
+
+func newPacketConn(network *Network, laddr net.UDPAddr) *packetConn {
+	return &packetConn{
+		network:     network,
+		laddr:       laddr,
+		incoming:    make(chan datagram, queueSize),
+		deadlineSet: make(chan struct{}),
+		closed:      make(chan struct{}),
+	}
+}
+
+// receive queues a datagram for reading. Like a full socket buffer, a full queue drops it.
+func (c *packetConn) receive(data []byte, from net.UDPAddr) {
+	select {
+	case <-c.closed:
+	case c.incoming <- datagram{data: data, from: from}:
+	default:
+	}
+}
+
+func (c *packetConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		deadline, deadlineSet := c.readDeadline, c.deadlineSet
+		c.mu.Unlock()
+
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			expired = timer.C
+			defer timer.Stop()
+		}
+
+		select {
+		case d := <-c.incoming:
+			from := d.from
+			return copy(p, d.data), &from, nil
+		case <-c.closed:
+			return 0, nil, net.ErrClosed
+		case <-expired:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-deadlineSet:
+			// Wait again, with the new deadline.
+		}
+	}
+}
+
+func (c *packetConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok || !prefix.Contains(udpAddr.IP) {
+		return 0, &net.OpError{Op: "write", Net: "udp", Addr: addr, Err: errUnreachable}
+	}
+	c.network.send(append([]byte(nil), p...), c.laddr, *udpAddr)
+	return len(p), nil
+}
+
+func (c *packetConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.network.unbind(c)
+	})
+	return nil
+}
+
+func (c *packetConn) LocalAddr() net.Addr {
+	laddr := c.laddr
+	return &laddr
+}
+
+func (c *packetConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *packetConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+	close(c.deadlineSet)
+	c.deadlineSet = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline does nothing, as the writes never block.
+func (c *packetConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
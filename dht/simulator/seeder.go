@@ -0,0 +1,299 @@
+package simulator
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"tgragnato.it/magnetico/v2/bencode"
+	"tgragnato.it/magnetico/v2/dht/mainline"
+	"tgragnato.it/magnetico/v2/metadata/btconn"
+)
+
+const (
+	// pieceLength is the piece length of the synthetic torrents.
+	pieceLength = 1 << 18
+	// maxPieces is the maximum number of pieces of a synthetic torrent. At 20 bytes per piece
+	// hash, the largest metadata takes a few pieces of metadata.
+	maxPieces = 2048
+	// metadataPieceSize is the size of the pieces of metadata (BEP 9).
+	metadataPieceSize = 16 * 1024
+	// maxMessageSize is the length of the longest message that the peers accept.
+	maxMessageSize = 1 << 20
+	// handshakeTimeout is how long the peers wait for the leeches.
+	handshakeTimeout = 10 * time.Second
+	// utMetadata is the ID of the ut_metadata extension for the peers.
+	utMetadata = 1
+)
+
+var (
+	errRefused = errors.New("connection refused")
+	// peerID is the peer ID of every peer.
+	peerID = [20]byte([]byte("-SM0001-simulator000"))
+	// peerExtensions advertise the extension protocol (BEP 10).
+	peerExtensions = [8]byte{0, 0, 0, 0, 0, 0x10, 0, 0}
+)
+
+// torrent is a synthetic torrent, whose metadata is a valid single-file info dictionary.
+type torrent struct {
+	infoHash [20]byte
+	name     string
+	size     int64
+	// metadata is the bencoded info dictionary.
+	metadata []byte
+	peers    []*peer
+}
+
+// peer is a peer of a torrent. A dead one refuses the connections.
+type peer struct {
+	addr net.TCPAddr
+	dead bool
+}
+
+// info is the info dictionary of a synthetic torrent.
+type info struct {
+	Name        string `bencode:"name"`
+	Length      int64  `bencode:"length"`
+	PieceLength int64  `bencode:"piece length"`
+	Pieces      []byte `bencode:"pieces"`
+}
+
+// extHandshake is the payload of the extension handshake (BEP 10).
+type extHandshake struct {
+	M            map[string]int `bencode:"m"`
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+}
+
+// extMessage is the dictionary of the ut_metadata messages (BEP 9).
+type extMessage struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// Torrent is a synthetic torrent of the network, as the sink should find it.
+type Torrent struct {
+	InfoHash  [20]byte
+	Name      string
+	TotalSize uint64
+	// Peers are the peers of the torrent, including the dead ones.
+	Peers []net.TCPAddr
+}
+
+func (n *Network) newTorrent(i int) *torrent {
+	numPieces := 1 + n.rand.IntN(maxPieces)
+	pieces := make([]byte, 20*numPieces)
+	n.fill(pieces)
+	info := info{
+		Name:        fmt.Sprintf("torrent-%d", i),
+		Length:      int64(numPieces-1)*pieceLength + 1 + n.rand.Int64N(pieceLength),
+		PieceLength: pieceLength,
+		Pieces:      pieces,
+	}
+	metadata, err := bencode.Marshal(info)
+	if err != nil {
+		panic("Could not marshal the info dictionary of a synthetic torrent! " + err.Error())
+	}
+
+	t := &torrent{
+		infoHash: sha1.Sum(metadata),
+		name:     info.Name,
+		size:     info.Length,
+		metadata: metadata,
+	}
+	for range n.config.PeersPerTorrent {
+		peer := &peer{
+			addr: net.TCPAddr{IP: offset(peersBlock, len(n.peers)), Port: nodePort},
+			dead: n.rand.Float64() < n.config.DeadPeers,
+		}
+		n.peers[peer.addr.String()] = peer
+		t.peers = append(t.peers, peer)
+	}
+	n.byInfoHash[t.infoHash] = t
+	n.bySKey[btconn.HashSKey(t.infoHash[:])] = t
+	return t
+}
+
+// compactPeers returns the peers of the torrent, as the nodes return them.
+func (t *torrent) compactPeers() []mainline.CompactPeer {
+	peers := []mainline.CompactPeer{}
+	for _, peer := range t.peers {
+		peers = append(peers, mainline.CompactPeer{IP: peer.addr.IP, Port: peer.addr.Port})
+	}
+	return peers
+}
+
+// Torrents returns the synthetic torrents of the network.
+func (n *Network) Torrents() []Torrent {
+	torrents := []Torrent{}
+	for _, t := range n.torrents {
+		torrent := Torrent{InfoHash: t.infoHash, Name: t.name, TotalSize: uint64(t.size)}
+		for _, peer := range t.peers {
+			torrent.Peers = append(torrent.Peers, peer.addr)
+		}
+		torrents = append(torrents, torrent)
+	}
+	return torrents
+}
+
+// DialContext connects to a peer of a torrent, after the latency. All the peers that are alive are
+// served by a seeder listening on the loopback interface, which sends the metadata of any torrent
+// of the network.
+func (n *Network) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	peer, ok := n.peers[address]
+	if !ok {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errUnreachable}
+	}
+	if peer.dead {
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: &peer.addr, Err: errRefused}
+	}
+
+	select {
+	case <-time.After(n.delay()):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	seeder, err := n.listen()
+	if err != nil {
+		return nil, err
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", seeder.Addr().String())
+}
+
+// listen starts the seeder, the first time that a peer is dialled.
+func (n *Network) listen() (net.Listener, error) {
+	n.seederOnce.Do(func() {
+		n.seeder, n.seederErr = net.Listen("tcp", "127.0.0.1:0")
+		if n.seederErr == nil {
+			go n.seed(n.seeder)
+		}
+	})
+	return n.seeder, n.seederErr
+}
+
+// seed is a goroutine! It serves the connections of the leeches, until the seeder is closed.
+func (n *Network) seed(seeder net.Listener) {
+	for {
+		conn, err := seeder.Accept()
+		if err != nil {
+			return
+		}
+		go n.serve(conn)
+	}
+}
+
+// serve sends the metadata that the leech asks for over conn (BEP 9).
+func (n *Network) serve(conn net.Conn) {
+	defer conn.Close()
+
+	conn, _, _, _, infoHash, err := btconn.Accept(
+		conn,
+		handshakeTimeout,
+		func(sKeyHash [20]byte) []byte {
+			if t, ok := n.bySKey[sKeyHash]; ok {
+				return t.infoHash[:]
+			}
+			return nil
+		},
+		func(infoHash [20]byte) bool {
+			_, ok := n.byInfoHash[infoHash]
+			return ok
+		},
+		peerExtensions,
+		peerID,
+	)
+	if err != nil {
+		return
+	}
+	t := n.byInfoHash[infoHash]
+
+	handshake, err := bencode.Marshal(extHandshake{
+		M:            map[string]int{"ut_metadata": utMetadata},
+		MetadataSize: len(t.metadata),
+	})
+	if err != nil || writeExtMessage(conn, 0, handshake) != nil {
+		return
+	}
+
+	leechUTMetadata := 0
+	for {
+		message, err := readMessage(conn)
+		if err != nil {
+			return
+		}
+		// Only the extension messages matter.
+		if len(message) < 2 || message[0] != 20 {
+			continue
+		}
+
+		switch message[1] {
+		case 0:
+			var handshake extHandshake
+			if bencode.Unmarshal(message[2:], &handshake) == nil {
+				leechUTMetadata = handshake.M["ut_metadata"]
+			}
+		case utMetadata:
+			var request extMessage
+			if err := bencode.NewDecoder(bytes.NewReader(message[2:])).Decode(&request); err != nil {
+				return
+			}
+			if request.MsgType != 0 || leechUTMetadata <= 0 || leechUTMetadata > 255 {
+				continue
+			}
+			if err := t.sendPiece(conn, byte(leechUTMetadata), request.Piece); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// sendPiece sends a piece of metadata, or rejects the request of a piece that does not exist.
+func (t *torrent) sendPiece(w io.Writer, id byte, piece int) error {
+	start := piece * metadataPieceSize
+	if piece < 0 || start >= len(t.metadata) {
+		reject, err := bencode.Marshal(extMessage{MsgType: 2, Piece: piece})
+		if err != nil {
+			return err
+		}
+		return writeExtMessage(w, id, reject)
+	}
+
+	data, err := bencode.Marshal(extMessage{MsgType: 1, Piece: piece, TotalSize: len(t.metadata)})
+	if err != nil {
+		return err
+	}
+	return writeExtMessage(w, id, append(data, t.metadata[start:min(start+metadataPieceSize, len(t.metadata))]...))
+}
+
+// writeExtMessage writes an extension message with the given extension ID.
+func writeExtMessage(w io.Writer, id byte, payload []byte) error {
+	message := binary.BigEndian.AppendUint32(nil, uint32(2+len(payload)))
+	message = append(message, 20, id)
+	_, err := w.Write(append(message, payload...))
+	return err
+}
+
+// readMessage reads a message, sans the 4 bytes of its length.
+func readMessage(r io.Reader) ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size > maxMessageSize {
+		return nil, errors.New("message too long")
+	}
+	message := make([]byte, size)
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
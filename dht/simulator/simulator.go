@@ -0,0 +1,328 @@
+// Package simulator runs a DHT in memory: hundreds of virtual nodes that hold synthetic torrents
+// and their peers, behind a network with configurable latency, loss and misbehaviour. It stands in
+// for the Internet in the tests and benchmarks of the indexing services and of the metadata sink.
+package simulator
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"tgragnato.it/magnetico/v2/bencode"
+	"tgragnato.it/magnetico/v2/dht/mainline"
+)
+
+const (
+	// nodePort is the port of the DHT nodes, and of the peers of the torrents.
+	nodePort = 6881
+	// firstPort is the first port given to the sockets bound to port 0.
+	firstPort = 32768
+	// queueSize is the number of datagrams buffered by each socket, beyond which they are dropped.
+	queueSize = 1024
+	// bootstrapHost resolves to some of the honest nodes.
+	bootstrapHost = "router.simulator"
+	// bootstrapSize is the number of nodes that bootstrapHost resolves to.
+	bootstrapSize = 4
+	// k is the number of nodes that store each torrent, and that are returned by the lookups.
+	k = 8
+)
+
+var (
+	// prefix holds every address of the simulated network. It is private, so the indexers must be
+	// told to accept it.
+	prefix = net.IPNet{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)}
+	// The nodes, the peers of the torrents and the sockets of the indexers get their addresses
+	// from separate blocks of the prefix.
+	nodesBlock = net.IPv4(10, 0, 0, 1).To4()
+	peersBlock = net.IPv4(10, 64, 0, 1).To4()
+	hostIP     = net.IPv4(10, 128, 0, 1).To4()
+)
+
+var errUnreachable = errors.New("the address is unreachable in the simulated network")
+
+// Behaviour is how a virtual node answers the queries.
+type Behaviour int
+
+const (
+	// Honest nodes answer every query properly.
+	Honest Behaviour = iota
+	// Silent nodes never answer.
+	Silent
+	// Erroring nodes answer every query with a KRPC server error.
+	Erroring
+	// Malformed nodes answer with responses that are syntactically correct, but invalid.
+	Malformed
+	// Honeypots answer properly, but sample made up info hashes that no one has the metadata of.
+	Honeypot
+)
+
+// Config describes the simulated network. The same Seed builds the same nodes, torrents and
+// peers.
+type Config struct {
+	Seed uint64
+	// Nodes is the number of virtual nodes.
+	Nodes int
+	// Torrents is the number of synthetic torrents, each stored by the nodes closest to its info
+	// hash.
+	Torrents int
+	// PeersPerTorrent is the number of peers of each torrent.
+	PeersPerTorrent int
+	// DeadPeers is the share of the peers that refuse the connections.
+	DeadPeers float64
+
+	// Latency is the delay of every datagram and connection, to which up to Jitter is added.
+	Latency time.Duration
+	Jitter  time.Duration
+	// Loss is the share of the datagrams that are dropped.
+	Loss float64
+
+	// The shares of the nodes that misbehave, in each way. The rest of them are Honest.
+	Silent    float64
+	Erroring  float64
+	Malformed float64
+	Honeypots float64
+}
+
+// Network is the simulated network: it is both a mainline.Network, where the indexers bind their
+// sockets and resolve the bootstrap nodes, and a btconn.Dialer, through which the sink connects to
+// the peers of the torrents.
+type Network struct {
+	config Config
+
+	mu   sync.Mutex
+	rand *rand.Rand
+
+	// The nodes, the torrents and the peers are never modified after New.
+	nodes      []*node
+	byIP       map[string]*node
+	torrents   []*torrent
+	byInfoHash map[[20]byte]*torrent
+	// bySKey maps the hash of the MSE shared secret, which is the info hash, to its torrent.
+	bySKey map[[20]byte]*torrent
+	peers  map[string]*peer
+
+	// sockets are the packet conns bound by the indexers, by address.
+	sockets  map[string][]*packetConn
+	nextPort int
+
+	seederOnce sync.Once
+	seeder     net.Listener
+	seederErr  error
+}
+
+// New builds the network described by config.
+func New(config Config) *Network {
+	n := &Network{
+		config:     config,
+		rand:       rand.New(rand.NewPCG(config.Seed, config.Seed)),
+		byIP:       make(map[string]*node),
+		byInfoHash: make(map[[20]byte]*torrent),
+		bySKey:     make(map[[20]byte]*torrent),
+		peers:      make(map[string]*peer),
+		sockets:    make(map[string][]*packetConn),
+		nextPort:   firstPort,
+	}
+
+	for i := range config.Nodes {
+		node := &node{
+			addr:      net.UDPAddr{IP: offset(nodesBlock, i), Port: nodePort},
+			behaviour: n.drawBehaviour(),
+			hashes:    make(map[[20]byte]*torrent),
+		}
+		n.fill(node.id[:])
+		n.nodes = append(n.nodes, node)
+		n.byIP[node.addr.IP.String()] = node
+	}
+
+	honest := slices.DeleteFunc(slices.Clone(n.nodes), func(node *node) bool {
+		return node.behaviour != Honest && node.behaviour != Honeypot
+	})
+	for i := range config.Torrents {
+		torrent := n.newTorrent(i)
+		n.torrents = append(n.torrents, torrent)
+		for _, node := range closest(honest, torrent.infoHash, k) {
+			node.hashes[torrent.infoHash] = torrent
+		}
+	}
+
+	return n
+}
+
+// drawBehaviour picks the behaviour of a node, with the shares of the config.
+func (n *Network) drawBehaviour() Behaviour {
+	draw := n.rand.Float64()
+	for _, share := range []struct {
+		share     float64
+		behaviour Behaviour
+	}{
+		{n.config.Silent, Silent},
+		{n.config.Erroring, Erroring},
+		{n.config.Malformed, Malformed},
+		{n.config.Honeypots, Honeypot},
+	} {
+		if draw < share.share {
+			return share.behaviour
+		}
+		draw -= share.share
+	}
+	return Honest
+}
+
+// fill fills b with random bytes.
+func (n *Network) fill(b []byte) {
+	for i := range b {
+		b[i] = byte(n.rand.Uint32())
+	}
+}
+
+// offset returns the IPv4 address i after ip.
+func offset(ip net.IP, i int) net.IP {
+	next := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(next, binary.BigEndian.Uint32(ip.To4())+uint32(i))
+	return next
+}
+
+// Prefix returns the addresses of the network, which the indexers and the sink must be told to
+// accept, as they are private.
+func (n *Network) Prefix() net.IPNet {
+	return prefix
+}
+
+// BootstrapNodes returns the bootstrap nodes of the network, to be resolved with LookupIP.
+func (n *Network) BootstrapNodes() []string {
+	return []string{net.JoinHostPort(bootstrapHost, strconv.Itoa(nodePort))}
+}
+
+// ListenPacket binds count sockets to address: the unspecified IP addresses become the address of
+// the host, and port 0 a free port. Like with SO_REUSEPORT, the incoming datagrams are spread among
+// the sockets.
+func (n *Network) ListenPacket(network string, address string, count int) ([]net.PacketConn, error) {
+	laddr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	addr := net.UDPAddr{IP: laddr.IP, Port: laddr.Port}
+	if addr.IP == nil || addr.IP.IsUnspecified() {
+		addr.IP = hostIP
+	}
+	if addr.Port == 0 {
+		addr.Port = n.nextPort
+		n.nextPort++
+	}
+	if _, ok := n.sockets[addr.String()]; ok {
+		return nil, &net.OpError{Op: "listen", Net: network, Addr: &addr, Err: errors.New("address already in use")}
+	}
+
+	conns := []net.PacketConn{}
+	for range max(count, 1) {
+		conn := newPacketConn(n, addr)
+		n.sockets[addr.String()] = append(n.sockets[addr.String()], conn)
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+// unbind removes conn from the sockets bound to its address.
+func (n *Network) unbind(conn *packetConn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	key := conn.laddr.String()
+	if conns := slices.DeleteFunc(n.sockets[key], func(c *packetConn) bool { return c == conn }); len(conns) > 0 {
+		n.sockets[key] = conns
+	} else {
+		delete(n.sockets, key)
+	}
+}
+
+// LookupIP resolves the bootstrap host to some of the honest nodes.
+func (n *Network) LookupIP(host string) ([]net.IP, error) {
+	if host != bootstrapHost {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	ips := []net.IP{}
+	for _, node := range n.nodes {
+		if len(ips) == bootstrapSize {
+			break
+		}
+		if node.behaviour == Honest {
+			ips = append(ips, node.addr.IP)
+		}
+	}
+	return ips, nil
+}
+
+// delay draws the latency of a datagram or a connection.
+func (n *Network) delay() time.Duration {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delay := n.config.Latency
+	if n.config.Jitter > 0 {
+		delay += time.Duration(n.rand.Int64N(int64(n.config.Jitter)))
+	}
+	return delay
+}
+
+// send carries a datagram to addr, unless it is lost, after the latency.
+func (n *Network) send(data []byte, from net.UDPAddr, to net.UDPAddr) {
+	n.mu.Lock()
+	lost := n.config.Loss > 0 && n.rand.Float64() < n.config.Loss
+	n.mu.Unlock()
+	if lost {
+		return
+	}
+
+	if delay := n.delay(); delay > 0 {
+		time.AfterFunc(delay, func() { n.deliver(data, from, to) })
+	} else {
+		n.deliver(data, from, to)
+	}
+}
+
+// deliver hands a datagram to the socket or to the node bound to its destination, which answers
+// straight away.
+func (n *Network) deliver(data []byte, from net.UDPAddr, to net.UDPAddr) {
+	n.mu.Lock()
+	conns := n.sockets[to.String()]
+	var conn *packetConn
+	if len(conns) > 0 {
+		conn = conns[n.rand.IntN(len(conns))]
+	}
+	node := n.byIP[to.IP.String()]
+	n.mu.Unlock()
+
+	switch {
+	case conn != nil:
+		conn.receive(data, from)
+	case node != nil && to.Port == nodePort:
+		var query mainline.Message
+		if err := bencode.Unmarshal(data, &query); err != nil {
+			return
+		}
+		if response := n.answer(node, &query, from); response != nil {
+			if data, err := bencode.Marshal(response); err == nil {
+				n.send(data, node.addr, from)
+			}
+		}
+	}
+}
+
+// Close stops the peers of the torrents.
+func (n *Network) Close() error {
+	n.seederOnce.Do(func() { n.seederErr = net.ErrClosed })
+	if n.seeder != nil {
+		return n.seeder.Close()
+	}
+	return nil
+}
@@ -0,0 +1,346 @@
+package simulator
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"tgragnato.it/magnetico/v2/bencode"
+	"tgragnato.it/magnetico/v2/dht"
+	"tgragnato.it/magnetico/v2/dht/mainline"
+	"tgragnato.it/magnetico/v2/metadata"
+)
+
+// hostile is a network where some of the nodes and of the peers misbehave. The datagrams are not
+// lost, so that the indexers find every torrent.
+var hostile = Config{
+	Seed:            42,
+	Nodes:           300,
+	Torrents:        30,
+	PeersPerTorrent: 3,
+	DeadPeers:       0.2,
+	Latency:         2 * time.Millisecond,
+	Jitter:          3 * time.Millisecond,
+	Silent:          0.1,
+	Erroring:        0.1,
+	Malformed:       0.05,
+	Honeypots:       0.05,
+}
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	a, b := New(hostile), New(hostile)
+	if !reflect.DeepEqual(a.Torrents(), b.Torrents()) {
+		t.Error("expected the same seed to build the same torrents")
+	}
+	for i := range a.nodes {
+		if a.nodes[i].id != b.nodes[i].id || a.nodes[i].behaviour != b.nodes[i].behaviour {
+			t.Fatalf("expected the same seed to build the same node %d", i)
+		}
+	}
+
+	if torrents := a.Torrents(); len(torrents) != hostile.Torrents {
+		t.Errorf("expected %d torrents, got %d", hostile.Torrents, len(torrents))
+	}
+	for _, torrent := range a.torrents {
+		if len(torrent.peers) != hostile.PeersPerTorrent {
+			t.Errorf("expected %d peers, got %d", hostile.PeersPerTorrent, len(torrent.peers))
+		}
+		stored := 0
+		for _, node := range a.nodes {
+			if _, ok := node.hashes[torrent.infoHash]; ok {
+				stored++
+				if node.behaviour != Honest && node.behaviour != Honeypot {
+					t.Errorf("expected only the answering nodes to store the torrents, got %d", node.behaviour)
+				}
+			}
+		}
+		if stored != k {
+			t.Errorf("expected the torrent to be stored by %d nodes, got %d", k, stored)
+		}
+	}
+
+	ips, err := a.LookupIP(bootstrapHost)
+	if err != nil || len(ips) != bootstrapSize {
+		t.Errorf("expected %d bootstrap nodes, got %v and %v", bootstrapSize, ips, err)
+	}
+	if _, err := a.LookupIP("router.bittorrent.com"); err == nil {
+		t.Error("expected the hosts of the Internet not to be resolved")
+	}
+}
+
+func TestNetwork_ListenPacket(t *testing.T) {
+	t.Parallel()
+
+	n := New(Config{})
+	conns, err := n.ListenPacket("udp4", "0.0.0.0:0", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conns) != 2 || conns[0].LocalAddr().String() != conns[1].LocalAddr().String() {
+		t.Fatalf("expected two sockets bound to the same address, got %v", conns)
+	}
+	if !prefix.Contains(conns[0].LocalAddr().(*net.UDPAddr).IP) {
+		t.Errorf("expected an address of the network, got %s", conns[0].LocalAddr())
+	}
+
+	if _, err := n.ListenPacket("udp4", conns[0].LocalAddr().String(), 1); err == nil {
+		t.Error("expected the address to be in use")
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	if _, _, err := conns[0].ReadFrom(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("expected the read of a closed socket to fail, got %v", err)
+	}
+
+	conns, err = n.ListenPacket("udp4", conns[0].LocalAddr().String(), 1)
+	if err != nil {
+		t.Fatalf("expected the address to be free after closing its sockets, got %v", err)
+	}
+	defer conns[0].Close()
+
+	// The reads time out at the deadline.
+	if err := conns[0].SetReadDeadline(time.Now().Add(10 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := conns[0].ReadFrom(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected the read to time out, got %v", err)
+	}
+}
+
+func TestNetwork_answer(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		config Config
+		// check validates the response, which is nil if none arrived.
+		check func(*mainline.Message) bool
+	}{
+		{"honest", Config{Nodes: 10}, func(m *mainline.Message) bool { return m != nil && m.Y == "r" && len(m.R.ID) == 20 }},
+		{"silent", Config{Nodes: 10, Silent: 1}, func(m *mainline.Message) bool { return m == nil }},
+		{"erroring", Config{Nodes: 10, Erroring: 1}, func(m *mainline.Message) bool { return m != nil && m.Y == "e" && m.E.Code == 202 }},
+		{"malformed", Config{Nodes: 10, Malformed: 1}, func(m *mainline.Message) bool { return m != nil && m.Y == "r" && len(m.R.ID) != 20 }},
+		{"lost", Config{Nodes: 10, Loss: 1}, func(m *mainline.Message) bool { return m == nil }},
+		{"late", Config{Nodes: 10, Latency: time.Second}, func(m *mainline.Message) bool { return m == nil }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			n := New(tt.config)
+			conns, err := n.ListenPacket("udp4", "0.0.0.0:0", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn := conns[0]
+			defer conn.Close()
+
+			data, err := bencode.Marshal(mainline.NewPingQuery(make([]byte, 20)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := conn.WriteTo(data, &n.nodes[0].addr); err != nil {
+				t.Fatal(err)
+			}
+
+			var response *mainline.Message
+			buf := make([]byte, 1500)
+			conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+			if size, _, err := conn.ReadFrom(buf); err == nil {
+				response = new(mainline.Message)
+				if err := bencode.Unmarshal(buf[:size], response); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !tt.check(response) {
+				t.Errorf("unexpected response %+v", response)
+			}
+		})
+	}
+}
+
+func TestNetwork_sample(t *testing.T) {
+	t.Parallel()
+
+	n := New(Config{Nodes: 20, Torrents: 100, Honeypots: 0.5})
+	for _, node := range n.nodes {
+		samples, num := n.sample(node)
+		if len(samples)%20 != 0 || len(samples) > 20*sampleSize {
+			t.Errorf("expected at most %d samples, got %d bytes", sampleSize, len(samples))
+		}
+		if node.behaviour == Honeypot {
+			if num != honeypotNum {
+				t.Errorf("expected a honeypot to claim %d info hashes, got %d", honeypotNum, num)
+			}
+			continue
+		}
+		if num != len(node.hashes) {
+			t.Errorf("expected %d info hashes, got %d", len(node.hashes), num)
+		}
+		for i := 0; i < len(samples); i += 20 {
+			if _, ok := node.hashes[[20]byte(samples[i:i+20])]; !ok {
+				t.Errorf("expected the sample %x to be stored by the node", samples[i:i+20])
+			}
+		}
+	}
+}
+
+// index runs an indexing service on n, bootstrapping from bootstrapNodes, until it finds the peers
+// of every torrent, or the timeout expires. It returns the peers found for each torrent.
+func index(n *Network, bootstrapNodes []string, timeout time.Duration) map[[20]byte][]net.TCPAddr {
+	var mu sync.Mutex
+	found := make(map[[20]byte][]net.TCPAddr)
+	done := make(chan struct{})
+	service := mainline.NewIndexingService("0.0.0.0:0", 1000, mainline.IndexingServiceEventHandlers{
+		OnResult: func(result mainline.IndexingResult) {
+			mu.Lock()
+			defer mu.Unlock()
+			if _, ok := n.byInfoHash[result.InfoHash()]; !ok || len(found) == len(n.torrents) {
+				return
+			}
+			found[result.InfoHash()] = result.PeerAddrs()
+			if len(found) == len(n.torrents) {
+				close(done)
+			}
+		},
+		OnScrapeResult: func(mainline.ScrapeResult) {},
+	}, bootstrapNodes, []net.IPNet{n.Prefix()}, "", false, n)
+	service.Start()
+	defer service.Terminate()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	return found
+}
+
+func TestIndexingService(t *testing.T) {
+	t.Parallel()
+
+	n := New(hostile)
+	defer n.Close()
+
+	found := index(n, n.BootstrapNodes(), 30*time.Second)
+	if len(found) != len(n.torrents) {
+		t.Fatalf("expected the peers of all the %d torrents, got %d", len(n.torrents), len(found))
+	}
+	for _, torrent := range n.Torrents() {
+		if peers := found[torrent.InfoHash]; !reflect.DeepEqual(peers, torrent.Peers) {
+			t.Errorf("expected the peers %v of %s, got %v", torrent.Peers, torrent.Name, peers)
+		}
+	}
+}
+
+func TestBootstrapManager(t *testing.T) {
+	t.Parallel()
+
+	n := New(hostile)
+	defer n.Close()
+
+	// The bootstrap node joins the network, and the indexer joins it through the bootstrap node
+	// alone.
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	manager := dht.NewBootstrapManager([]dht.IndexerConfig{{
+		Addr:           "10.128.0.1:6881",
+		MaxNeighbors:   1000,
+		BootstrapNodes: n.BootstrapNodes(),
+		FilterNodes:    []net.IPNet{n.Prefix()},
+	}}, statePath, n)
+	found := index(n, []string{"10.128.0.1:6881"}, 30*time.Second)
+	if len(found) != len(n.torrents) {
+		t.Errorf("expected the peers of all the %d torrents, got %d", len(n.torrents), len(found))
+	}
+
+	manager.Terminate()
+	if _, err := os.Stat(statePath); err != nil {
+		t.Errorf("expected the routing table to be saved, got %v", err)
+	}
+}
+
+func TestManagerAndSink(t *testing.T) {
+	t.Parallel()
+
+	n := New(hostile)
+	defer n.Close()
+
+	manager := dht.NewManager([]dht.IndexerConfig{{
+		Addr:           "0.0.0.0:0",
+		MaxNeighbors:   1000,
+		BootstrapNodes: n.BootstrapNodes(),
+		FilterNodes:    []net.IPNet{n.Prefix()},
+	}}, "", false, n)
+	defer manager.Terminate()
+	sink := metadata.NewSink(5*time.Second, 10, 0, 0, []net.IPNet{n.Prefix()}, manager.Lookup, n)
+	defer sink.Terminate()
+
+	// Like the event loop, the output of the manager is fetched again for every result, as it is
+	// replaced when full.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case result, ok := <-manager.Output():
+				if ok {
+					sink.Sink(result)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	// A torrent whose peers are all dead never produces its metadata.
+	expected := make(map[[20]byte]*torrent)
+	for _, torrent := range n.torrents {
+		for _, peer := range torrent.peers {
+			if !peer.dead {
+				expected[torrent.infoHash] = torrent
+			}
+		}
+	}
+
+	timeout := time.After(30 * time.Second)
+	for len(expected) > 0 {
+		select {
+		case md := <-sink.Drain():
+			torrent, ok := expected[[20]byte(md.InfoHash)]
+			if !ok {
+				continue
+			}
+			if md.Name != torrent.name || md.TotalSize != uint64(torrent.size) || len(md.Files) != 1 {
+				t.Errorf("expected the metadata of %s, got %+v", torrent.name, md)
+			}
+			delete(expected, torrent.infoHash)
+		case <-timeout:
+			t.Fatalf("expected the metadata of %d more torrents", len(expected))
+		}
+	}
+}
+
+func BenchmarkIndexingService(b *testing.B) {
+	config := hostile
+	config.Nodes = 1000
+	config.Torrents = 100
+
+	for b.Loop() {
+		n := New(config)
+		if found := index(n, n.BootstrapNodes(), time.Minute); len(found) != len(n.torrents) {
+			b.Fatalf("expected the peers of all the %d torrents, got %d", len(n.torrents), len(found))
+		}
+		n.Close()
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"tgragnato.it/magnetico/v2/dht"
 	"tgragnato.it/magnetico/v2/dht/mainline"
 	"tgragnato.it/magnetico/v2/metadata"
+	"tgragnato.it/magnetico/v2/metadata/btconn"
 	"tgragnato.it/magnetico/v2/opflags"
 	"tgragnato.it/magnetico/v2/persistence"
 	"tgragnato.it/magnetico/v2/stats"
@@ -27,6 +28,14 @@ func main() {
 	interruptChan := make(chan os.Signal, 1)
 	signal.Notify(interruptChan, os.Interrupt)
 
+	// Run the bootstrap nodes of a private network, which need no database.
+	if opFlags.RunBootstrap {
+		bootstrapManager := dht.NewBootstrapManager(indexerConfigs(opFlags), opFlags.StatePath, mainline.Internet)
+		<-interruptChan
+		bootstrapManager.Terminate()
+		return
+	}
+
 	database, err := persistence.MakeDatabase(opFlags.DatabaseURL)
 	if err != nil {
 		log.Fatalf("Could not open the database %s. %s\n", opFlags.DatabaseURL, err.Error())
@@ -93,19 +102,37 @@ func main() {
 		return
 	}
 
-	mainline.DefaultThrottleRate = int(opFlags.MaxRPS)
 	trawlingManager := dht.NewManager(
-		opFlags.IndexerAddrs,
-		opFlags.IndexerMaxNeighbors,
-		opFlags.BootstrappingNodes,
-		opFlags.FilterNodesIpNets,
+		indexerConfigs(opFlags),
+		opFlags.StatePath,
+		opFlags.IndexerGoodCitizen,
+		mainline.Internet,
 	)
+	dialPolicy, err := btconn.ParseDialPolicy(opFlags.LeechTransport)
+	if err != nil {
+		log.Fatalf("Could not parse the leech transport %s\n", err.Error())
+	}
 	metadataSink := metadata.NewSink(
 		time.Duration(opFlags.LeechDeadline)*time.Second,
 		int(opFlags.LeechMaxN),
+		int(opFlags.LeechMaxActive),
+		int(opFlags.LeechMaxPerIP),
 		opFlags.FilterNodesIpNets,
+		trawlingManager.Lookup,
+		btconn.NewDialer(dialPolicy),
 	)
 
+	// Periodically scrape the stored torrents through the DHT, walking the whole database from the
+	// torrents that were never scraped to the ones that were scraped the longest time ago.
+	var scrapeTicker <-chan time.Time
+	var scrapeLastValue *float64
+	var scrapeLastID *uint64
+	if opFlags.ScrapeInterval > 0 && (database.Engine() == persistence.Sqlite3 || database.Engine() == persistence.Postgres) {
+		ticker := time.NewTicker(time.Duration(opFlags.ScrapeInterval) * time.Second)
+		defer ticker.Stop()
+		scrapeTicker = ticker.C
+	}
+
 	// The Event Loop
 	for stopped := false; !stopped; {
 		select {
@@ -120,10 +147,45 @@ func main() {
 				go stats.GetInstance().IncDBError(false)
 			} else if !exists {
 				metadataSink.Sink(result)
+			} else {
+				// A torrent that we already have is as real as a new one: credit the node that
+				// returned it.
+				trawlingManager.OnMetadata(infoHash)
 			}
 
 		case md := <-metadataSink.Drain():
-			if err := database.AddNewTorrent(md.InfoHash, md.Name, md.Files); err != nil {
+			if err := database.AddNewTorrent(md.InfoHash, md.InfoHashV2, md.Name, md.Files); err != nil {
+				go stats.GetInstance().IncDBError(true)
+			}
+			for _, infoHash := range md.DHTInfoHashes() {
+				trawlingManager.OnMetadata(infoHash)
+			}
+
+		case <-scrapeTicker:
+			torrents, err := database.QueryTorrents(
+				"", time.Now().Unix(), persistence.ByUpdatedOn, true,
+				uint64(opFlags.ScrapeN), scrapeLastValue, scrapeLastID,
+			)
+			if err != nil {
+				go stats.GetInstance().IncDBError(false)
+				continue
+			}
+			for _, torrent := range torrents {
+				var infoHash [20]byte
+				copy(infoHash[:], torrent.InfoHash)
+				trawlingManager.Scrape(infoHash)
+			}
+			if uint(len(torrents)) < opFlags.ScrapeN {
+				scrapeLastValue, scrapeLastID = nil, nil
+			} else {
+				last := torrents[len(torrents)-1]
+				updatedOn := float64(last.UpdatedOn)
+				scrapeLastValue, scrapeLastID = &updatedOn, &last.ID
+			}
+
+		case result := <-trawlingManager.ScrapeOutput():
+			infoHash := result.InfoHash()
+			if err := database.UpdateSwarm(infoHash[:], result.Seeders(), result.Leechers()); err != nil {
 				go stats.GetInstance().IncDBError(true)
 			}
 
@@ -133,3 +195,27 @@ func main() {
 		}
 	}
 }
+
+// indexerConfigs returns the configurations of the indexing services of the indexers of opFlags,
+// whose settings opflags have completed, with the sockets and workers of every indexer.
+func indexerConfigs(opFlags opflags.OpFlags) []dht.IndexerConfig {
+	configs := []dht.IndexerConfig{}
+	for _, indexer := range opFlags.Indexers {
+		configs = append(configs, dht.IndexerConfig{
+			Addr:           indexer.Addr,
+			MaxNeighbors:   *indexer.MaxNeighbors,
+			BootstrapNodes: indexer.BootstrappingNodes,
+			FilterNodes:    indexer.FilterNodesIpNets,
+			RateLimits: mainline.RateLimits{
+				Queries:        float64(*indexer.MaxRPS),
+				Responses:      float64(*indexer.MaxResponseRPS),
+				PerDestination: float64(*indexer.MaxNodeRPS),
+				Burst:          time.Duration(*indexer.RateBurst) * time.Second,
+			},
+			Sockets: int(opFlags.IndexerSockets),
+			Workers: int(opFlags.IndexerWorkers),
+			NodeID:  indexer.NodeIDBytes,
+		})
+	}
+	return configs
+}
@@ -29,7 +29,7 @@ func TestUnencrypted(t *testing.T) {
 	var gerr error
 	go func() {
 		defer close(done)
-		_, _, _, _, err2 := Dial(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, time.Now().Add(10*time.Second), ext1, infoHash, id1)
+		_, _, _, _, err2 := Dial(NewDialer(TCPFirst), &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, time.Now().Add(10*time.Second), ext1, infoHash, id1)
 		if err2 != nil {
 			gerr = err2
 		}
@@ -62,7 +62,7 @@ func TestEncrypted(t *testing.T) {
 	var gerr error
 	go func() {
 		defer close(done)
-		conn, cipher, ext, id, err2 := Dial(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, time.Now().Add(10*time.Second), ext1, infoHash, id1)
+		conn, cipher, ext, id, err2 := Dial(NewDialer(TCPFirst), &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, time.Now().Add(10*time.Second), ext1, infoHash, id1)
 		if err2 != nil {
 			gerr = err2
 			return
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"net"
 	"time"
 )
@@ -11,10 +12,150 @@ import (
 // The MIT License (MIT)
 // Copyright (c) 2013 Cenk Alti
 
+// Dialer opens the connections to the peers: the TCP dialer of NewDialer, or a simulated network
+// in the tests and benchmarks.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// DialPolicy is the transport, or the order of the transports, through which NewDialer connects
+// to the peers.
+type DialPolicy int
+
+const (
+	// TCPFirst tries uTP when the TCP connection fails.
+	TCPFirst DialPolicy = iota
+	// UTPFirst tries TCP when the uTP connection fails.
+	UTPFirst
+	// Race tries both at once, and keeps the first connection established.
+	Race
+)
+
+// ParseDialPolicy parses a DialPolicy: "tcp-first", "utp-first" or "race".
+func ParseDialPolicy(policy string) (DialPolicy, error) {
+	switch policy {
+	case "tcp-first":
+		return TCPFirst, nil
+	case "utp-first":
+		return UTPFirst, nil
+	case "race":
+		return Race, nil
+	}
+	return 0, fmt.Errorf("unknown dial policy %q", policy)
+}
+
+// DialSockets returns the number of sockets that a connection dialled by dialer may hold at once
+// while connecting: both the TCP and the uTP one with the Race policy, while the other policies
+// close the socket of the transport that failed before trying the other one.
+func DialSockets(dialer Dialer) int {
+	if d, ok := dialer.(*policyDialer); ok && d.policy == Race {
+		return 2
+	}
+	return 1
+}
+
+// policyDialer connects to the peers over TCP, which tries to use MPTCP - https://www.mptcp.dev/ -
+// and over uTP (BEP 29), as its policy says.
+type policyDialer struct {
+	tcp    *net.Dialer
+	policy DialPolicy
+	// dialTCP and dialUTP are replaced in the tests.
+	dialTCP, dialUTP func(ctx context.Context, address string) (net.Conn, error)
+}
+
+// NewDialer returns a Dialer of TCP and uTP connections, with the policy.
+func NewDialer(policy DialPolicy) Dialer {
+	d := &policyDialer{tcp: &net.Dialer{}, policy: policy, dialUTP: dialUTP}
+	d.tcp.SetMultipathTCP(true)
+	d.dialTCP = func(ctx context.Context, address string) (net.Conn, error) {
+		return d.tcp.DialContext(ctx, "tcp", address)
+	}
+	return d
+}
+
+// DialContext connects to the address of a peer. The networks other than TCP are dialled as is.
+func (d *policyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return d.tcp.DialContext(ctx, network, address)
+	}
+
+	switch d.policy {
+	case UTPFirst:
+		return d.fallback(ctx, address, d.dialUTP, d.dialTCP)
+	case Race:
+		return d.race(ctx, address)
+	default:
+		return d.fallback(ctx, address, d.dialTCP, d.dialUTP)
+	}
+}
+
+// fallback dials the address with first, and then with second if first fails. When the context
+// has a deadline, first gets half of the time, as the peers that do not answer would take it all.
+func (d *policyDialer) fallback(ctx context.Context, address string, first, second func(context.Context, string) (net.Conn, error)) (net.Conn, error) {
+	firstCtx := ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		firstCtx, cancel = context.WithDeadline(ctx, time.Now().Add(time.Until(deadline)/2))
+		defer cancel()
+	}
+
+	conn, err := first(firstCtx, address)
+	if err == nil {
+		return conn, nil
+	}
+	if ctx.Err() != nil {
+		return nil, err
+	}
+	conn, secondErr := second(ctx, address)
+	if secondErr != nil {
+		return nil, errors.Join(err, secondErr)
+	}
+	return conn, nil
+}
+
+// race dials the address over TCP and uTP at once, and returns the first connection established,
+// closing the other.
+func (d *policyDialer) race(ctx context.Context, address string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, 2)
+	for _, dial := range []func(context.Context, string) (net.Conn, error){d.dialTCP, d.dialUTP} {
+		go func() {
+			conn, err := dial(ctx, address)
+			results <- result{conn, err}
+		}()
+	}
+
+	var errs []error
+	for i := range 2 {
+		r := <-results
+		if r.err != nil {
+			errs = append(errs, r.err)
+			continue
+		}
+		if i == 0 {
+			// The connection that loses the race is closed once established.
+			go func() {
+				if r := <-results; r.err == nil {
+					r.conn.Close()
+				}
+			}()
+		}
+		return r.conn, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
 // Dial new connection to the address. Does the BitTorrent protocol handshake.
 // Handles encryption. May try to connect again if encryption does not match with given setting.
 // Returns a net.Conn that is ready for sending/receiving BitTorrent peer protocol messages.
 func Dial(
+	dialer Dialer,
 	addr net.Addr,
 	deadline time.Time,
 	ourExtensions [8]byte,
@@ -22,8 +163,9 @@ func Dial(
 	ourID [20]byte) (
 	conn net.Conn, cipher CryptoMethod, peerExtensions [8]byte, peerID [20]byte, err error) {
 	// First connection - Connecting to peer
-	dialer := net.Dialer{Deadline: deadline}
-	conn, err = dialer.DialContext(context.Background(), addr.Network(), addr.String())
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	conn, err = dialer.DialContext(ctx, addr.Network(), addr.String())
 	if err != nil {
 		return
 	}
@@ -33,9 +175,6 @@ func Dial(
 		}
 	}(conn)
 
-	// Try to use MPTCP - https://www.mptcp.dev/
-	dialer.SetMultipathTCP(true)
-
 	// Write first part of BitTorrent handshake to a buffer because we will use it in both encrypted and unencrypted handshake.
 	out := bytes.NewBuffer(make([]byte, 0, 68))
 	err = writeHandshake(out, ih, ourID, ourExtensions)
@@ -0,0 +1,518 @@
+package btconn
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// uTP (BEP 29) is the BitTorrent transport over UDP, which many peers accept besides TCP, or
+// instead of it when only their UDP port is reachable through a NAT. This implementation is enough
+// to fetch metadata: it sends and receives the packets in order with retransmissions, but skips the
+// LEDBAT congestion control and the selective acks, as only a few KiB are ever in flight.
+
+// The types of the uTP packets.
+const (
+	utpData  = 0
+	utpFin   = 1
+	utpState = 2
+	utpReset = 3
+	utpSyn   = 4
+)
+
+const (
+	utpVersion    = 1
+	utpHeaderSize = 20
+	// utpMaxPayload keeps the packets within the MTU of most paths, tunnels included.
+	utpMaxPayload = 1200
+	// utpMaxInFlight is the number of packets sent and not acked yet, after which Write blocks.
+	utpMaxInFlight = 64
+	// utpRecvWindow is the receive window advertised to the peer, in bytes.
+	utpRecvWindow = 1 << 20
+	// utpMaxOutOfOrder is the number of packets received ahead of a missing one that are kept.
+	utpMaxOutOfOrder = 1024
+	// utpTick is the interval at which the packets not acked in time are sent again.
+	utpTick = 50 * time.Millisecond
+	// utpRTO is the first retransmission timeout, doubled at every retransmission of a packet,
+	// and utpMaxRetries the number of retransmissions after which the connection fails.
+	utpRTO        = 500 * time.Millisecond
+	utpMaxRetries = 5
+)
+
+var (
+	errUTPReset   = errors.New("utp: connection reset by peer")
+	errUTPTimeout = errors.New("utp: retransmission timeout")
+	errUTPClosed  = errors.New("utp: use of closed connection")
+)
+
+// utpHeader is the header of a uTP packet, without the extensions.
+type utpHeader struct {
+	typ           uint8
+	connID        uint16
+	timestamp     uint32
+	timestampDiff uint32
+	wndSize       uint32
+	seqNr         uint16
+	ackNr         uint16
+}
+
+// marshal returns the packet made of the header and the payload.
+func (h *utpHeader) marshal(payload []byte) []byte {
+	b := make([]byte, utpHeaderSize+len(payload))
+	b[0] = h.typ<<4 | utpVersion
+	binary.BigEndian.PutUint16(b[2:], h.connID)
+	binary.BigEndian.PutUint32(b[4:], h.timestamp)
+	binary.BigEndian.PutUint32(b[8:], h.timestampDiff)
+	binary.BigEndian.PutUint32(b[12:], h.wndSize)
+	binary.BigEndian.PutUint16(b[16:], h.seqNr)
+	binary.BigEndian.PutUint16(b[18:], h.ackNr)
+	copy(b[utpHeaderSize:], payload)
+	return b
+}
+
+// parseUTPPacket returns the header and the payload of a packet, skipping its extensions.
+func parseUTPPacket(b []byte) (h utpHeader, payload []byte, err error) {
+	if len(b) < utpHeaderSize || b[0]&0x0f != utpVersion || b[0]>>4 > utpSyn {
+		return h, nil, errors.New("utp: malformed packet")
+	}
+	h.typ = b[0] >> 4
+	h.connID = binary.BigEndian.Uint16(b[2:])
+	h.timestamp = binary.BigEndian.Uint32(b[4:])
+	h.timestampDiff = binary.BigEndian.Uint32(b[8:])
+	h.wndSize = binary.BigEndian.Uint32(b[12:])
+	h.seqNr = binary.BigEndian.Uint16(b[16:])
+	h.ackNr = binary.BigEndian.Uint16(b[18:])
+
+	// Every extension starts with the type of the next one, zero after the last, and its length.
+	extension, payload := b[1], b[utpHeaderSize:]
+	for extension != 0 {
+		if len(payload) < 2 || len(payload) < 2+int(payload[1]) {
+			return h, nil, errors.New("utp: malformed extension")
+		}
+		extension, payload = payload[0], payload[2+int(payload[1]):]
+	}
+	return h, payload, nil
+}
+
+// seqLess compares two sequence numbers, which wrap around.
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+func utpTimestamp(now time.Time) uint32 {
+	return uint32(now.UnixMicro())
+}
+
+// utpPacket is a packet sent and not acked yet.
+type utpPacket struct {
+	typ     uint8
+	seqNr   uint16
+	payload []byte
+	sentAt  time.Time
+	rto     time.Duration
+	retries int
+}
+
+// utpConn is a uTP connection, on a UDP socket of its own.
+type utpConn struct {
+	pc    net.PacketConn
+	raddr net.Addr
+
+	mu sync.Mutex
+	// changed is closed, and replaced, whenever the state of the connection changes, to wake up
+	// the blocked Read, Write and dial.
+	changed chan struct{}
+
+	recvID, sendID uint16
+	// seqNr is the sequence number of the next packet, and ackNr the one of the last packet
+	// received in order.
+	seqNr, ackNr uint16
+	connected    bool
+	// replyMicro is the difference between our clock and the one of the peer, echoed to it.
+	replyMicro uint32
+	peerWnd    uint32
+
+	unacked    []*utpPacket
+	inbuf      []byte
+	outOfOrder map[uint16][]byte
+	finSeqNr   uint16
+	gotFin     bool
+	eof        bool
+
+	readDeadline, writeDeadline time.Time
+	closed                      bool
+	err                         error
+}
+
+// newUTPConn returns a connection on pc to the peer at raddr, whose packets are received with
+// recvID and sent with sendID.
+func newUTPConn(pc net.PacketConn, raddr net.Addr, recvID, sendID uint16) *utpConn {
+	return &utpConn{
+		pc:         pc,
+		raddr:      raddr,
+		changed:    make(chan struct{}),
+		recvID:     recvID,
+		sendID:     sendID,
+		peerWnd:    utpRecvWindow,
+		outOfOrder: make(map[uint16][]byte),
+	}
+}
+
+// dialUTP opens a uTP connection to the address, sending the SYN until the peer acks it.
+func dialUTP(ctx context.Context, address string) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		pc.Close()
+		return nil, err
+	}
+	recvID := binary.BigEndian.Uint16(id[:])
+	c := newUTPConn(pc, raddr, recvID, recvID+1)
+
+	c.mu.Lock()
+	c.seqNr = 1
+	// The SYN is sent with the ID of the packets that we receive, unlike the others.
+	c.sendPacket(&utpPacket{typ: utpSyn}, time.Now())
+	c.mu.Unlock()
+	go c.loop()
+
+	for {
+		c.mu.Lock()
+		connected, err, changed := c.connected, c.err, c.changed
+		c.mu.Unlock()
+		if connected {
+			return c, nil
+		}
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			c.Close()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// accept makes the connection the responder of a SYN.
+func (c *utpConn) accept(syn utpHeader, seqNr uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seqNr = seqNr
+	c.ackNr = syn.seqNr
+	c.replyMicro = utpTimestamp(time.Now()) - syn.timestamp
+	c.connected = true
+	c.sendState(time.Now())
+}
+
+// loop receives the packets of the peer, and sends again the ones that it has not acked in time,
+// until the connection is closed.
+func (c *utpConn) loop() {
+	b := make([]byte, 64*1024)
+	for {
+		if err := c.pc.SetReadDeadline(time.Now().Add(utpTick)); err != nil {
+			c.fail(err)
+			return
+		}
+		n, addr, err := c.pc.ReadFrom(b)
+		if ne, ok := err.(net.Error); err != nil && (!ok || !ne.Timeout()) {
+			c.fail(err)
+			return
+		}
+		if err == nil && addr.String() == c.raddr.String() {
+			if h, payload, err := parseUTPPacket(b[:n]); err == nil {
+				c.handle(h, payload, time.Now())
+			}
+		}
+		c.retransmit(time.Now())
+	}
+}
+
+// handle processes a packet of the peer.
+func (c *utpConn) handle(h utpHeader, payload []byte, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return
+	}
+	if h.typ == utpSyn {
+		// The SYN carries the ID that we send with: the peer has not received our STATE.
+		if h.connID == c.sendID && c.connected {
+			c.sendState(now)
+		}
+		return
+	}
+	if h.connID != c.recvID {
+		return
+	}
+	c.replyMicro = utpTimestamp(now) - h.timestamp
+	c.peerWnd = h.wndSize
+
+	if h.typ == utpReset {
+		c.setErr(errUTPReset)
+		return
+	}
+
+	if !c.connected {
+		if h.typ != utpState {
+			return
+		}
+		// The peer sends its first packet with the sequence number of its STATE.
+		c.connected = true
+		c.ackNr = h.seqNr - 1
+	}
+
+	// Every packet acks the ones sent up to ackNr.
+	acked := 0
+	for _, p := range c.unacked {
+		if seqLess(h.ackNr, p.seqNr) {
+			break
+		}
+		acked++
+	}
+	c.unacked = c.unacked[acked:]
+
+	switch h.typ {
+	case utpData:
+		c.receive(h.seqNr, append([]byte(nil), payload...))
+	case utpFin:
+		c.gotFin, c.finSeqNr = true, h.seqNr
+		c.receive(h.seqNr, nil)
+	}
+	c.broadcast()
+}
+
+// receive buffers the payload of a data or FIN packet, and acks it.
+func (c *utpConn) receive(seqNr uint16, payload []byte) {
+	if seqLess(c.ackNr, seqNr) && seqNr-c.ackNr <= utpMaxOutOfOrder && !c.eof {
+		c.outOfOrder[seqNr] = payload
+		for {
+			next, ok := c.outOfOrder[c.ackNr+1]
+			if !ok {
+				break
+			}
+			delete(c.outOfOrder, c.ackNr+1)
+			c.ackNr++
+			c.inbuf = append(c.inbuf, next...)
+			if c.gotFin && c.ackNr == c.finSeqNr {
+				c.eof = true
+				break
+			}
+		}
+	}
+	c.sendState(time.Now())
+}
+
+// retransmit sends again the packets not acked within their timeout.
+func (c *utpConn) retransmit(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, p := range c.unacked {
+		if now.Sub(p.sentAt) < p.rto {
+			continue
+		}
+		if p.retries >= utpMaxRetries {
+			c.setErr(errUTPTimeout)
+			return
+		}
+		p.retries++
+		p.rto *= 2
+		c.writePacket(p, now)
+	}
+}
+
+// sendPacket sends a packet with the next sequence number, and keeps it until it is acked.
+func (c *utpConn) sendPacket(p *utpPacket, now time.Time) {
+	p.seqNr = c.seqNr
+	p.rto = utpRTO
+	c.seqNr++
+	c.unacked = append(c.unacked, p)
+	c.writePacket(p, now)
+}
+
+// sendState acks the packets received up to ackNr.
+func (c *utpConn) sendState(now time.Time) {
+	c.writePacket(&utpPacket{typ: utpState, seqNr: c.seqNr}, now)
+}
+
+func (c *utpConn) writePacket(p *utpPacket, now time.Time) {
+	h := utpHeader{
+		typ:           p.typ,
+		connID:        c.sendID,
+		timestamp:     utpTimestamp(now),
+		timestampDiff: c.replyMicro,
+		wndSize:       uint32(max(utpRecvWindow-len(c.inbuf), 0)),
+		seqNr:         p.seqNr,
+		ackNr:         c.ackNr,
+	}
+	if p.typ == utpSyn {
+		h.connID = c.recvID
+	}
+	p.sentAt = now
+	// The lost packets are sent again, hence the errors are left to the retransmissions.
+	_, _ = c.pc.WriteTo(h.marshal(p.payload), c.raddr)
+}
+
+// broadcast wakes up the blocked Read, Write and dial.
+func (c *utpConn) broadcast() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *utpConn) setErr(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.broadcast()
+}
+
+func (c *utpConn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		err = errUTPClosed
+	}
+	c.setErr(err)
+}
+
+// wait blocks until the state of the connection changes, or the deadline expires.
+func wait(changed chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-changed
+		return nil
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-changed:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func (c *utpConn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if len(c.inbuf) > 0 {
+			n := copy(b, c.inbuf)
+			c.inbuf = c.inbuf[n:]
+			c.mu.Unlock()
+			return n, nil
+		}
+		if c.eof {
+			c.mu.Unlock()
+			return 0, io.EOF
+		}
+		err, changed, deadline := c.err, c.changed, c.readDeadline
+		c.mu.Unlock()
+
+		if err != nil {
+			return 0, err
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		if err := wait(changed, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *utpConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		c.mu.Lock()
+		if c.err == nil && !c.closed && len(c.unacked) < utpMaxInFlight &&
+			uint32(len(c.unacked)*utpMaxPayload) < c.peerWnd {
+			chunk := b[written:min(written+utpMaxPayload, len(b))]
+			c.sendPacket(&utpPacket{typ: utpData, payload: append([]byte(nil), chunk...)}, time.Now())
+			written += len(chunk)
+			c.mu.Unlock()
+			continue
+		}
+		err, changed, deadline := c.err, c.changed, c.writeDeadline
+		if c.closed {
+			err = errUTPClosed
+		}
+		c.mu.Unlock()
+
+		if err != nil {
+			return written, err
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return written, os.ErrDeadlineExceeded
+		}
+		if err := wait(changed, deadline); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Close sends a FIN to the peer, without waiting for its ack, and closes the socket.
+func (c *utpConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	if c.connected && c.err == nil {
+		c.sendPacket(&utpPacket{typ: utpFin}, time.Now())
+	}
+	c.setErr(errUTPClosed)
+	c.mu.Unlock()
+	return c.pc.Close()
+}
+
+func (c *utpConn) LocalAddr() net.Addr {
+	return c.pc.LocalAddr()
+}
+
+func (c *utpConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *utpConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.broadcast()
+	return nil
+}
+
+func (c *utpConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.broadcast()
+	return nil
+}
+
+func (c *utpConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.broadcast()
+	return nil
+}
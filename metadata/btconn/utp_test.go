@@ -0,0 +1,361 @@
+package btconn
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyPacketConn drops the datagrams whose number, counted from one, is in drop.
+type lossyPacketConn struct {
+	net.PacketConn
+	mu     sync.Mutex
+	writes int
+	drop   map[int]bool
+}
+
+func (c *lossyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	c.writes++
+	dropped := c.drop[c.writes]
+	c.mu.Unlock()
+	if dropped {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+// listenUTP returns the socket of an in-process uTP peer.
+func listenUTP(t *testing.T) net.PacketConn {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pc
+}
+
+// acceptUTP accepts the first connection to the in-process peer, whose sequence numbers start
+// close to the wrap around.
+func acceptUTP(pc net.PacketConn) (*utpConn, error) {
+	b := make([]byte, 1500)
+	for {
+		n, addr, err := pc.ReadFrom(b)
+		if err != nil {
+			return nil, err
+		}
+		h, _, err := parseUTPPacket(b[:n])
+		if err != nil || h.typ != utpSyn {
+			continue
+		}
+		c := newUTPConn(pc, addr, h.connID+1, h.connID)
+		c.accept(h, 65530)
+		go c.loop()
+		return c, nil
+	}
+}
+
+func TestParseUTPPacket(t *testing.T) {
+	t.Parallel()
+
+	h := utpHeader{typ: utpData, connID: 7, timestamp: 1, timestampDiff: 2, wndSize: 3, seqNr: 4, ackNr: 5}
+	packet := h.marshal([]byte("payload"))
+	parsed, payload, err := parseUTPPacket(packet)
+	if err != nil || parsed != h || string(payload) != "payload" {
+		t.Errorf("parseUTPPacket() = %v, %q, %v", parsed, payload, err)
+	}
+
+	// The selective ack extension is skipped.
+	withExtension := append([]byte(nil), packet[:utpHeaderSize]...)
+	withExtension[1] = 1
+	withExtension = append(withExtension, 0, 4, 0xff, 0xff, 0xff, 0xff)
+	withExtension = append(withExtension, "payload"...)
+	if _, payload, err := parseUTPPacket(withExtension); err != nil || string(payload) != "payload" {
+		t.Errorf("parseUTPPacket() with an extension = %q, %v", payload, err)
+	}
+
+	for _, malformed := range [][]byte{
+		packet[:utpHeaderSize-1],
+		append([]byte{utpData<<4 | 2}, packet[1:]...),
+		append([]byte{5<<4 | utpVersion}, packet[1:]...),
+		withExtension[:utpHeaderSize+3],
+	} {
+		if _, _, err := parseUTPPacket(malformed); err == nil {
+			t.Errorf("parseUTPPacket(%v) should fail", malformed)
+		}
+	}
+}
+
+func TestSeqLess(t *testing.T) {
+	t.Parallel()
+
+	if !seqLess(1, 2) || seqLess(2, 1) || !seqLess(65535, 0) || seqLess(0, 65535) || seqLess(3, 3) {
+		t.Error("seqLess() does not wrap around")
+	}
+}
+
+// testUTPEcho sends data to the in-process peer, which sends it back, through the sockets.
+func testUTPEcho(t *testing.T, pc net.PacketConn, address string) {
+	t.Helper()
+
+	accepted := make(chan *utpConn, 1)
+	go func() {
+		peer, err := acceptUTP(pc)
+		if err != nil {
+			t.Error(err)
+			close(accepted)
+			return
+		}
+		accepted <- peer
+		_, _ = io.Copy(peer, peer)
+		peer.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := dialUTP(ctx, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.SetDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 100*1024)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		if _, err := conn.Write(data); err != nil {
+			t.Error(err)
+		}
+	}()
+	echoed := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, echoed); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(echoed, data) {
+		t.Error("the data sent back differs")
+	}
+
+	// Closing the connection ends the one of the peer.
+	if err := conn.Close(); err != nil {
+		t.Error(err)
+	}
+	peer := <-accepted
+	if peer == nil {
+		return
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		peer.mu.Lock()
+		eof := peer.eof
+		peer.mu.Unlock()
+		if eof {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the peer to receive the FIN")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUTP_Echo(t *testing.T) {
+	t.Parallel()
+
+	pc := listenUTP(t)
+	defer pc.Close()
+	testUTPEcho(t, pc, pc.LocalAddr().String())
+}
+
+func TestUTP_Loss(t *testing.T) {
+	t.Parallel()
+
+	// The STATE of the handshake is lost, and then some of the data.
+	pc := listenUTP(t)
+	defer pc.Close()
+	lossy := &lossyPacketConn{PacketConn: pc, drop: map[int]bool{1: true, 5: true, 20: true, 21: true}}
+	testUTPEcho(t, lossy, pc.LocalAddr().String())
+}
+
+func TestUTP_Deadline(t *testing.T) {
+	t.Parallel()
+
+	pc := listenUTP(t)
+	defer pc.Close()
+	go func() {
+		if _, err := acceptUTP(pc); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	conn, err := dialUTP(context.Background(), pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// A deadline set meanwhile interrupts the blocked Read.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = conn.SetDeadline(time.Now())
+	}()
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read() error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+}
+
+func TestUTP_DialTimeout(t *testing.T) {
+	t.Parallel()
+
+	// The peer never answers.
+	pc := listenUTP(t)
+	defer pc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := dialUTP(ctx, pc.LocalAddr().String()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("dialUTP() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestUTP_Reset(t *testing.T) {
+	t.Parallel()
+
+	pc := listenUTP(t)
+	defer pc.Close()
+	accepted := make(chan *utpConn, 1)
+	go func() {
+		peer, err := acceptUTP(pc)
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- peer
+	}()
+
+	conn, err := dialUTP(context.Background(), pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer := <-accepted
+	peer.mu.Lock()
+	peer.writePacket(&utpPacket{typ: utpReset}, time.Now())
+	peer.mu.Unlock()
+
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, errUTPReset) {
+		t.Errorf("Read() error = %v, want %v", err, errUTPReset)
+	}
+}
+
+// TestDial_UTP does the encrypted BitTorrent handshake with the in-process uTP peer.
+func TestDial_UTP(t *testing.T) {
+	t.Parallel()
+
+	pc := listenUTP(t)
+	defer pc.Close()
+	done := make(chan error, 1)
+	go func() {
+		peer, err := acceptUTP(pc)
+		if err != nil {
+			done <- err
+			return
+		}
+		defer peer.Close()
+		_, _, _, _, _, err = Accept(peer, 10*time.Second, func([20]byte) []byte { return infoHash[:] },
+			func(ih [20]byte) bool { return ih == infoHash }, ext2, id2)
+		done <- err
+	}()
+
+	// Nothing listens on the TCP port.
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: pc.LocalAddr().(*net.UDPAddr).Port}
+	conn, cipher, ext, id, err := Dial(NewDialer(UTPFirst), addr, time.Now().Add(10*time.Second), ext1, infoHash, id1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if cipher != RC4 || ext != ext2 || id != id2 {
+		t.Errorf("unexpected handshake: cipher %d, extensions %v, id %v", cipher, ext, id)
+	}
+}
+
+func TestPolicyDialer(t *testing.T) {
+	t.Parallel()
+
+	tcpConn, utpConn := net.Pipe()
+	working := func(conn net.Conn, delay time.Duration) func(context.Context, string) (net.Conn, error) {
+		return func(context.Context, string) (net.Conn, error) {
+			time.Sleep(delay)
+			return conn, nil
+		}
+	}
+	failing := func(context.Context, string) (net.Conn, error) {
+		return nil, errors.New("unreachable")
+	}
+
+	tests := []struct {
+		name             string
+		policy           DialPolicy
+		dialTCP, dialUTP func(context.Context, string) (net.Conn, error)
+		expected         net.Conn
+	}{
+		{"TCP first", TCPFirst, working(tcpConn, 0), working(utpConn, 0), tcpConn},
+		{"TCP first, fallback", TCPFirst, failing, working(utpConn, 0), utpConn},
+		{"uTP first", UTPFirst, working(tcpConn, 0), working(utpConn, 0), utpConn},
+		{"uTP first, fallback", UTPFirst, working(tcpConn, 0), failing, tcpConn},
+		{"Race, TCP faster", Race, working(tcpConn, 0), working(utpConn, 100*time.Millisecond), tcpConn},
+		{"Race, uTP faster", Race, working(tcpConn, 100*time.Millisecond), working(utpConn, 0), utpConn},
+		{"Race, TCP fails", Race, failing, working(utpConn, 100*time.Millisecond), utpConn},
+		{"Both fail", Race, failing, failing, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDialer(tt.policy).(*policyDialer)
+			d.dialTCP, d.dialUTP = tt.dialTCP, tt.dialUTP
+			conn, err := d.DialContext(context.Background(), "tcp", "127.0.0.1:6881")
+			if conn != tt.expected || (err != nil) != (tt.expected == nil) {
+				t.Errorf("DialContext() = %v, %v, want %v", conn, err, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDialSockets(t *testing.T) {
+	t.Parallel()
+
+	for policy, expected := range map[DialPolicy]int{TCPFirst: 1, UTPFirst: 1, Race: 2} {
+		if got := DialSockets(NewDialer(policy)); got != expected {
+			t.Errorf("DialSockets() with the policy %v = %d, want %d", policy, got, expected)
+		}
+	}
+	if got := DialSockets(&net.Dialer{}); got != 1 {
+		t.Errorf("DialSockets() of a net.Dialer = %d, want 1", got)
+	}
+}
+
+func TestParseDialPolicy(t *testing.T) {
+	t.Parallel()
+
+	for policy, expected := range map[string]DialPolicy{"tcp-first": TCPFirst, "utp-first": UTPFirst, "race": Race} {
+		if got, err := ParseDialPolicy(policy); err != nil || got != expected {
+			t.Errorf("ParseDialPolicy(%q) = %v, %v, want %v", policy, got, err, expected)
+		}
+	}
+	if _, err := ParseDialPolicy("udp"); err == nil {
+		t.Error("ParseDialPolicy() of an unknown policy should fail")
+	}
+}
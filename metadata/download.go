@@ -0,0 +1,230 @@
+package metadata
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// pieceSize is the size of the pieces of metadata, the last one excepted (BEP 9).
+	pieceSize = 16 * 1024
+	// piecesPerLeech is the number of pieces that a leech requests from its peer at once.
+	piecesPerLeech = 4
+)
+
+var (
+	// errFetched is the error of the leeches whose torrent has been fetched by another leech.
+	errFetched = errors.New("metadata fetched from another peer")
+	// errDiscarded is the error of the leeches whose pieces have been discarded, as the metadata
+	// that they were assembling failed the verification.
+	errDiscarded = errors.New("metadata discarded after a failed verification")
+)
+
+// download assembles the metadata of a torrent from the pieces sent by the peers of several
+// leeches, each one requesting the pieces that the others have not. The pieces received from a
+// peer that fails are kept, and the metadata is verified against the infohash once complete.
+//
+// As any of the peers may lie about the size of the metadata, the pieces are assembled into a
+// candidate for each size announced, so that a lying peer does not turn the honest ones away. A
+// candidate that fails the verification is discarded together with its leeches, as any of their
+// peers may have sent a bogus piece, and so is a candidate once all of its leeches have left.
+type download struct {
+	sync.Mutex
+	infoHash [20]byte
+
+	// candidates are the metadata being assembled, by the size announced by their peers.
+	candidates map[uint]*candidate
+	// conns are the connections of the leeches, interrupted once the metadata is fetched, and the
+	// candidate that each one is assembling.
+	conns   map[net.Conn]*candidate
+	fetched bool
+}
+
+// candidate is the metadata of the size announced by the peers of some of the leeches.
+type candidate struct {
+	size     uint
+	metadata []byte
+	received []bool
+	// requests counts the leeches that requested each piece, and have not received it yet.
+	requests  []int
+	nReceived int
+	// leeches counts the leeches assembling the candidate.
+	leeches int
+}
+
+func newDownload(infoHash [20]byte) *download {
+	return &download{
+		infoHash:   infoHash,
+		candidates: make(map[uint]*candidate),
+		conns:      make(map[net.Conn]*candidate),
+	}
+}
+
+// join adds the connection of a leech to the download, with the size of the metadata as announced
+// by its peer, which selects the candidate that the leech assembles.
+func (d *download) join(conn net.Conn, size uint) error {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.fetched {
+		return errFetched
+	}
+	c, ok := d.candidates[size]
+	if !ok {
+		nPieces := (size + pieceSize - 1) / pieceSize
+		c = &candidate{
+			size:     size,
+			metadata: make([]byte, size),
+			received: make([]bool, nPieces),
+			requests: make([]int, nPieces),
+		}
+		d.candidates[size] = c
+	}
+	c.leeches++
+	d.conns[conn] = c
+	return nil
+}
+
+// leave removes the connection of a leech from the download, and withdraws the requests of the
+// pieces that it has not received. The last leech of a candidate to leave discards it, so that the
+// size announced by its peers does not outlive them.
+func (d *download) leave(conn net.Conn, pending map[int]bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	c, ok := d.conns[conn]
+	if !ok {
+		return
+	}
+	delete(d.conns, conn)
+	for piece := range pending {
+		c.requests[piece]--
+	}
+	if c.leeches--; c.leeches == 0 {
+		delete(d.candidates, c.size)
+	}
+}
+
+// claim returns up to n pieces for a leech to request, besides its pending ones. The pieces
+// requested by the fewest other leeches come first, so that the same piece is requested twice
+// only when all the missing ones have been requested already.
+func (d *download) claim(conn net.Conn, n int, pending map[int]bool) ([]int, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	c, err := d.candidate(conn)
+	if err != nil {
+		return nil, err
+	}
+	var pieces []int
+	for ; n > 0; n-- {
+		best := -1
+		for piece := range c.received {
+			if c.received[piece] || pending[piece] || slices.Contains(pieces, piece) {
+				continue
+			}
+			if best < 0 || c.requests[piece] < c.requests[best] {
+				best = piece
+			}
+		}
+		if best < 0 {
+			break
+		}
+		c.requests[best]++
+		pieces = append(pieces, best)
+	}
+	return pieces, nil
+}
+
+// put stores a piece requested by a leech, which must have claimed it. The piece that completes
+// the metadata returns it verified and extracted, and interrupts the other leeches; if the
+// verification fails, the candidate is discarded and its other leeches are interrupted as well.
+func (d *download) put(conn net.Conn, piece int, data []byte) (*Metadata, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	c, err := d.candidate(conn)
+	if err != nil {
+		return nil, err
+	}
+	c.requests[piece]--
+	if uint(len(data)) != c.pieceLength(piece) {
+		return nil, errors.New("metadata piece of the wrong size")
+	}
+	if c.received[piece] {
+		return nil, nil
+	}
+	copy(c.metadata[piece*pieceSize:], data)
+	c.received[piece] = true
+	c.nReceived++
+	if c.nReceived < len(c.received) {
+		return nil, nil
+	}
+
+	metadata, err := extractMetadata(c.metadata, d.infoHash, time.Now())
+	if err != nil {
+		d.discard(c)
+		return nil, err
+	}
+	d.setFetched()
+	return metadata, nil
+}
+
+// settle marks the download as fetched, when the metadata of its torrent has been fetched under
+// another of its infohashes, and interrupts its leeches.
+func (d *download) settle() {
+	d.Lock()
+	defer d.Unlock()
+	d.setFetched()
+}
+
+// setFetched marks the download as fetched, and ends the reads of its leeches for them to find out.
+func (d *download) setFetched() {
+	d.fetched = true
+	for conn := range d.conns {
+		_ = conn.SetDeadline(time.Now())
+	}
+}
+
+// candidate returns the candidate of a leech, or the error of a leech that can no longer take part
+// in the download: its torrent has been fetched, or its candidate has been discarded.
+func (d *download) candidate(conn net.Conn) (*candidate, error) {
+	if d.fetched {
+		return nil, errFetched
+	}
+	c, ok := d.conns[conn]
+	if !ok {
+		return nil, errDiscarded
+	}
+	return c, nil
+}
+
+// discard forgets a candidate, and ends the reads of its leeches for them to find out.
+func (d *download) discard(c *candidate) {
+	for conn, other := range d.conns {
+		if other == c {
+			_ = conn.SetDeadline(time.Now())
+			delete(d.conns, conn)
+		}
+	}
+	delete(d.candidates, c.size)
+}
+
+// isFetched reports whether the metadata has been fetched.
+func (d *download) isFetched() bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.fetched
+}
+
+// pieceLength returns the length of a piece: the last one is shorter unless the size of the
+// metadata is a multiple of pieceSize.
+func (c *candidate) pieceLength(piece int) uint {
+	if uint(piece+1)*pieceSize <= c.size {
+		return pieceSize
+	}
+	return c.size - uint(piece)*pieceSize
+}
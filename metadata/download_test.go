@@ -0,0 +1,264 @@
+package metadata
+
+import (
+	"crypto/sha1"
+	"errors"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"tgragnato.it/magnetico/v2/bencode"
+	"tgragnato.it/magnetico/v2/metainfo"
+)
+
+// testMetadata returns the metadata of a torrent spanning several pieces, and its infohash.
+func testMetadata(t *testing.T) ([]byte, [20]byte) {
+	t.Helper()
+	meta, err := bencode.Marshal(&metainfo.Info{
+		PieceLength: 10,
+		Pieces:      []byte{},
+		Name:        "test",
+		Source:      strings.Repeat("s", 2*pieceSize),
+		Files: []metainfo.FileInfo{{
+			Length: 0,
+			Path:   []string{"test"},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return meta, sha1.Sum(meta)
+}
+
+func metadataPiece(meta []byte, i int) []byte {
+	return meta[i*pieceSize : min((i+1)*pieceSize, len(meta))]
+}
+
+// mustClaim claims pieces for the leech of conn, which must be part of the download.
+func mustClaim(t *testing.T, d *download, conn net.Conn, n int, pending map[int]bool) []int {
+	t.Helper()
+	pieces, err := d.claim(conn, n, pending)
+	if err != nil {
+		t.Fatalf("claim() error = %v, want nil", err)
+	}
+	return pieces
+}
+
+func TestDownload_Join(t *testing.T) {
+	t.Parallel()
+
+	d := newDownload([20]byte{1})
+	conn, _ := net.Pipe()
+	if err := d.join(conn, 2*pieceSize+1); err != nil {
+		t.Fatalf("join() error = %v, want nil", err)
+	}
+	c := d.candidates[2*pieceSize+1]
+	if c == nil || len(c.received) != 3 || c.pieceLength(2) != 1 {
+		t.Fatalf("expected 3 pieces, the last one of 1 byte, got %v", c)
+	}
+
+	// A peer announcing another size has its own candidate, which goes with its last leech.
+	other, _ := net.Pipe()
+	if err := d.join(other, 2*pieceSize); err != nil {
+		t.Fatalf("join() with a different size error = %v, want nil", err)
+	}
+	if len(d.candidates) != 2 {
+		t.Errorf("expected 2 candidates, got %d", len(d.candidates))
+	}
+	d.leave(other, nil)
+	if _, ok := d.candidates[2*pieceSize]; ok || len(d.candidates) != 1 {
+		t.Errorf("expected the candidate without leeches to be discarded, got %v", d.candidates)
+	}
+}
+
+func TestDownload_Claim(t *testing.T) {
+	t.Parallel()
+
+	d := newDownload([20]byte{1})
+	conn, _ := net.Pipe()
+	if err := d.join(conn, 3*pieceSize); err != nil {
+		t.Fatal(err)
+	}
+
+	// The leeches are given different pieces, until all of them are requested.
+	first := map[int]bool{0: true, 1: true}
+	for _, piece := range mustClaim(t, d, conn, 2, nil) {
+		delete(first, piece)
+	}
+	if len(first) != 0 {
+		t.Errorf("expected the first leech to claim pieces 0 and 1")
+	}
+	second := make(map[int]bool)
+	for _, piece := range mustClaim(t, d, conn, 2, nil) {
+		second[piece] = true
+	}
+	if len(second) != 2 || !second[2] {
+		t.Errorf("expected the second leech to claim piece 2 first, got %v", second)
+	}
+
+	// A leech never claims twice its pending pieces.
+	if pieces := mustClaim(t, d, conn, 3, second); len(pieces) != 1 || second[pieces[0]] {
+		t.Errorf("expected a single piece besides the pending ones, got %v", pieces)
+	}
+}
+
+func TestDownload_Put(t *testing.T) {
+	t.Parallel()
+
+	meta, infoHash := testMetadata(t)
+	d := newDownload(infoHash)
+	first, _ := net.Pipe()
+	second, _ := net.Pipe()
+	if err := d.join(first, uint(len(meta))); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.join(second, uint(len(meta))); err != nil {
+		t.Fatal(err)
+	}
+
+	// The pieces of a leech that fails are kept.
+	pending := map[int]bool{}
+	for _, p := range mustClaim(t, d, first, 2, pending) {
+		pending[p] = true
+	}
+	if _, err := d.put(first, 0, metadataPiece(meta, 0)); err != nil {
+		t.Fatalf("put() error = %v, want nil", err)
+	}
+	delete(pending, 0)
+	d.leave(first, pending)
+
+	if pieces := mustClaim(t, d, second, piecesPerLeech, nil); !slices.Equal(pieces, []int{1, 2}) {
+		t.Fatalf("expected the second leech to claim the missing pieces, got %v", pieces)
+	}
+	if _, err := d.put(second, 1, metadataPiece(meta, 1)[1:]); err == nil {
+		t.Error("put() of a short piece should fail")
+	}
+	if _, err := d.put(second, 1, metadataPiece(meta, 1)); err != nil {
+		t.Fatalf("put() error = %v, want nil", err)
+	}
+	md, err := d.put(second, 2, metadataPiece(meta, 2))
+	if err != nil || md == nil {
+		t.Fatalf("put() = %v, %v, want the metadata", md, err)
+	}
+	if md.Name != "test" || !d.isFetched() {
+		t.Errorf("unexpected metadata %v", md)
+	}
+	if err := d.join(first, uint(len(meta))); !errors.Is(err, errFetched) {
+		t.Errorf("join() error = %v, want %v", err, errFetched)
+	}
+}
+
+func TestDownload_PutBogus(t *testing.T) {
+	t.Parallel()
+
+	meta, infoHash := testMetadata(t)
+	d := newDownload(infoHash)
+	conn, _ := net.Pipe()
+	other, _ := net.Pipe()
+	for _, c := range []net.Conn{conn, other} {
+		if err := d.join(c, uint(len(meta))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A bogus piece fails the verification, and all the pieces are discarded.
+	bogus := slices.Clone(metadataPiece(meta, 1))
+	bogus[0] ^= 0xff
+	mustClaim(t, d, conn, 3, nil)
+	_, _ = d.put(conn, 0, metadataPiece(meta, 0))
+	_, _ = d.put(conn, 1, bogus)
+	if md, err := d.put(conn, 2, metadataPiece(meta, 2)); err == nil || md != nil {
+		t.Errorf("put() = %v, %v, want an error", md, err)
+	}
+	if d.isFetched() || len(d.candidates) != 0 {
+		t.Errorf("expected the pieces to be discarded, got %v", d.candidates)
+	}
+
+	// The other leech is interrupted, as its peer may be the one that lied.
+	if _, err := other.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read() error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	if _, err := d.claim(other, 3, nil); !errors.Is(err, errDiscarded) {
+		t.Errorf("claim() error = %v, want %v", err, errDiscarded)
+	}
+	d.leave(other, map[int]bool{0: true})
+
+	// The next leech requests all the pieces again.
+	next, _ := net.Pipe()
+	if err := d.join(next, uint(len(meta))); err != nil {
+		t.Fatal(err)
+	}
+	if pieces := mustClaim(t, d, next, 3, nil); len(pieces) != 3 {
+		t.Errorf("expected all the pieces to be claimed again, got %v", pieces)
+	}
+}
+
+func TestDownload_LyingPeer(t *testing.T) {
+	t.Parallel()
+
+	meta, infoHash := testMetadata(t)
+	size := uint(len(meta))
+	lying := append(slices.Clone(meta), 'e')
+
+	tests := []struct {
+		name string
+		// lie has the lying peer, which announced a wrong size, either stall or send its pieces.
+		lie func(d *download, liar net.Conn)
+	}{
+		{
+			name: "Stalling",
+			lie:  func(*download, net.Conn) {},
+		},
+		{
+			name: "Sending its pieces",
+			lie: func(d *download, liar net.Conn) {
+				pieces, _ := d.claim(liar, piecesPerLeech, nil)
+				var err error
+				for _, piece := range pieces {
+					if _, err = d.put(liar, piece, metadataPiece(lying, piece)); err != nil {
+						break
+					}
+				}
+				if err == nil {
+					t.Error("expected the verification to fail")
+				}
+				if _, err := d.claim(liar, 1, nil); !errors.Is(err, errDiscarded) {
+					t.Errorf("claim() of the lying peer error = %v, want %v", err, errDiscarded)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newDownload(infoHash)
+			liar, _ := net.Pipe()
+			honest, _ := net.Pipe()
+			if err := d.join(liar, size+1); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.join(honest, size); err != nil {
+				t.Fatalf("join() error = %v, want nil", err)
+			}
+
+			// The honest peer sends the metadata whatever the lying peer does.
+			pieces := mustClaim(t, d, honest, piecesPerLeech, nil)
+			tt.lie(d, liar)
+			var md *Metadata
+			for _, piece := range pieces {
+				var err error
+				if md, err = d.put(honest, piece, metadataPiece(meta, piece)); err != nil {
+					t.Fatalf("put() error = %v, want nil", err)
+				}
+			}
+			if md == nil || !d.isFetched() {
+				t.Error("expected the honest peer to send the metadata")
+			}
+			if _, err := d.claim(liar, 1, nil); !errors.Is(err, errFetched) {
+				t.Errorf("claim() of the lying peer error = %v, want %v", err, errFetched)
+			}
+		})
+	}
+}
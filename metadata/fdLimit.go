@@ -0,0 +1,15 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package metadata
+
+import "golang.org/x/sys/unix"
+
+// openFilesLimit returns the maximum number of file descriptors that the process can open, or
+// zero if it is unknown. The Go runtime raises the soft limit to the hard one at startup.
+func openFilesLimit() uint64 {
+	var rlimit unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &rlimit); err != nil {
+		return 0
+	}
+	return uint64(rlimit.Cur)
+}
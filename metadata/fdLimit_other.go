@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package metadata
+
+// openFilesLimit returns zero, as the file descriptor limit is unknown on this platform.
+func openFilesLimit() uint64 {
+	return 0
+}
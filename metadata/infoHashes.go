@@ -2,6 +2,7 @@ package metadata
 
 import (
 	"net"
+	"slices"
 	"sync"
 )
 
@@ -77,6 +78,24 @@ func checkDuplicate(peerAddresses []net.TCPAddr, addr net.TCPAddr) bool {
 	return false
 }
 
+// drop removes the peers from the pool of infoHash.
+func (ih *infoHashes) drop(infoHash [20]byte, peerAddresses []net.TCPAddr) {
+	if len(peerAddresses) <= 0 {
+		return
+	}
+
+	ih.Lock()
+	defer ih.Unlock()
+
+	peers, exists := ih.infoHashes[infoHash]
+	if !exists {
+		return
+	}
+	ih.infoHashes[infoHash] = slices.DeleteFunc(peers, func(addr net.TCPAddr) bool {
+		return checkDuplicate(peerAddresses, addr)
+	})
+}
+
 func (ih *infoHashes) pop(infoHash [20]byte) *net.TCPAddr {
 	ih.Lock()
 	defer ih.Unlock()
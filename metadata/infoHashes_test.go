@@ -66,6 +66,35 @@ func TestInfoHashes_Pop(t *testing.T) {
 	}
 }
 
+func TestInfoHashes_Drop(t *testing.T) {
+	t.Parallel()
+
+	ih := &infoHashes{
+		infoHashes:  make(map[[20]byte][]net.TCPAddr),
+		maxNLeeches: 3,
+	}
+
+	infoHash := [20]byte{1, 2, 3, 4, 5, 6}
+	ih.infoHashes[infoHash] = []net.TCPAddr{
+		{IP: net.ParseIP("1.0.0.1"), Port: 443},
+		{IP: net.ParseIP("1.0.0.2"), Port: 1337},
+		{IP: net.ParseIP("1.0.0.3"), Port: 6969},
+	}
+
+	ih.drop(infoHash, []net.TCPAddr{
+		{IP: net.ParseIP("1.0.0.2"), Port: 1337},
+		{IP: net.ParseIP("1.0.0.3"), Port: 6970},
+	})
+
+	expected := []net.TCPAddr{
+		{IP: net.ParseIP("1.0.0.1"), Port: 443},
+		{IP: net.ParseIP("1.0.0.3"), Port: 6969},
+	}
+	if actual := ih.infoHashes[infoHash]; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected infoHashes[%v] to be %v, but got %v", infoHash, expected, actual)
+	}
+}
+
 func TestInfoHashes_Pop_Nil(t *testing.T) {
 	t.Parallel()
 
@@ -6,7 +6,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"math"
 	"net"
 	"time"
 
@@ -34,14 +33,18 @@ type extDict struct {
 type Leech struct {
 	infoHash [20]byte
 	peerAddr *net.TCPAddr
+	dialer   btconn.Dialer
 	ev       LeechEventHandlers
+	// download is shared with the leeches of the same torrent racing with other peers.
+	download *download
 
 	conn     net.Conn
 	clientID [20]byte
 
-	ut_metadata                    uint8
-	metadataReceived, metadataSize uint
-	metadata                       []byte
+	ut_metadata  uint8
+	metadataSize uint
+	// pending are the pieces requested from the peer, and not received yet.
+	pending map[int]bool
 
 	connClosed bool
 }
@@ -49,14 +52,25 @@ type Leech struct {
 type LeechEventHandlers struct {
 	OnSuccess func(Metadata)        // must be supplied. args: metadata
 	OnError   func([20]byte, error) // must be supplied. args: infohash, error
+	// may be nil. args: infohash, peers added and dropped by the remote peer (ut_pex, BEP 11)
+	OnPeers func([20]byte, []net.TCPAddr, []net.TCPAddr)
 }
 
-func NewLeech(infoHash [20]byte, peerAddr *net.TCPAddr, clientID []byte, ev LeechEventHandlers) *Leech {
+func NewLeech(infoHash [20]byte, peerAddr *net.TCPAddr, clientID []byte, dialer btconn.Dialer, ev LeechEventHandlers) *Leech {
+	return newLeech(newDownload(infoHash), peerAddr, clientID, dialer, ev)
+}
+
+// newLeech returns a Leech that fetches the metadata of a download together with the other
+// leeches of the download.
+func newLeech(d *download, peerAddr *net.TCPAddr, clientID []byte, dialer btconn.Dialer, ev LeechEventHandlers) *Leech {
 	l := new(Leech)
-	l.infoHash = infoHash
+	l.infoHash = d.infoHash
 	l.peerAddr = peerAddr
+	l.dialer = dialer
+	l.download = d
 	copy(l.clientID[:], clientID)
 	l.ev = ev
+	l.pending = make(map[int]bool)
 
 	return l
 }
@@ -95,7 +109,8 @@ func (l *Leech) OnError(err error) {
 }
 
 func (l *Leech) doExHandshake() error {
-	err := l.writeAll([]byte("\x00\x00\x00\x1a\x14\x00d1:md11:ut_metadatai1eee"))
+	// The remote peer sends ut_metadata messages with ID utMetadataID, and ut_pex with utPexID.
+	err := l.writeAll([]byte("\x00\x00\x00\x25\x14\x00d1:md11:ut_metadatai1e6:ut_pexi2eee"))
 	if err != nil {
 		return errors.New("writeAll lHandshake " + err.Error())
 	}
@@ -126,19 +141,14 @@ func (l *Leech) doExHandshake() error {
 
 	l.ut_metadata = uint8(rRootDict.M.UTMetadata) // Save the ut_metadata code the remote peer uses
 	l.metadataSize = uint(rRootDict.MetadataSize)
-	l.metadata = make([]byte, l.metadataSize)
 
 	return nil
 }
 
-func (l *Leech) requestAllPieces() error {
-	// Request all the pieces of metadata
-	nPieces := int(math.Ceil(float64(l.metadataSize) / math.Pow(2, 14)))
-	if nPieces == 0 {
-		return errors.New("metadataSize is zero")
-	}
-
-	for piece := range nPieces {
+// requestPieces requests pieces of metadata, and adds them to the pending ones.
+func (l *Leech) requestPieces(pieces []int) error {
+	for _, piece := range pieces {
+		l.pending[piece] = true
 		// __request_metadata_piece(piece)
 		// ...............................
 		extDictDump, err := bencode.Marshal(extDict{
@@ -213,7 +223,8 @@ func (l *Leech) readExMessage() ([]byte, error) {
 // readUmMessage returns an ut_metadata extension message, sans the first 4 bytes indicating its
 // length.
 //
-// It will IGNORE all non-"ut_metadata extension" messages!
+// It will IGNORE all non-"ut_metadata extension" messages, but the ut_pex ones whose peers are
+// passed to OnPeers!
 func (l *Leech) readUmMessage() ([]byte, error) {
 	for {
 		rExMessage, err := l.readExMessage()
@@ -221,14 +232,31 @@ func (l *Leech) readUmMessage() ([]byte, error) {
 			return nil, errors.New("readExMessage " + err.Error())
 		}
 
-		if rExMessage[1] == 0x01 {
+		switch rExMessage[1] {
+		case utMetadataID:
 			return rExMessage, nil
+		case utPexID:
+			l.onPex(rExMessage[2:])
 		}
 	}
 }
 
+// onPex passes the peers of a ut_pex message to OnPeers. The malformed messages are ignored, as
+// the peer exchange is incidental to the fetching of the metadata.
+func (l *Leech) onPex(b []byte) {
+	if l.ev.OnPeers == nil {
+		return
+	}
+	added, dropped, err := parsePex(b)
+	if err != nil || len(added)+len(dropped) == 0 {
+		return
+	}
+	l.ev.OnPeers(l.infoHash, added, dropped)
+}
+
 func (l *Leech) Do(deadline time.Time) {
 	conn, _, peerExtensions, _, err := btconn.Dial(
+		l.dialer,
 		l.peerAddr,
 		deadline,
 		[8]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x01},
@@ -250,15 +278,34 @@ func (l *Leech) Do(deadline time.Time) {
 		return
 	}
 
-	err = l.requestAllPieces()
-	if err != nil {
-		l.OnError(errors.New("requestAllPieces " + err.Error()))
+	if err = l.download.join(l.conn, l.metadataSize); err != nil {
+		l.OnError(errors.New("join " + err.Error()))
 		return
 	}
+	defer func() { l.download.leave(l.conn, l.pending) }()
+
+	for {
+		// Keep piecesPerLeech pieces requested, the ones that the other leeches lack first.
+		pieces, err := l.download.claim(l.conn, piecesPerLeech-len(l.pending), l.pending)
+		if err != nil {
+			l.OnError(err)
+			return
+		}
+		err = l.requestPieces(pieces)
+		if err != nil {
+			l.OnError(errors.New("requestPieces " + err.Error()))
+			return
+		}
+		if len(l.pending) == 0 {
+			l.OnError(errFetched)
+			return
+		}
 
-	for l.metadataReceived < l.metadataSize {
 		rUmMessage, err := l.readUmMessage()
 		if err != nil {
+			if l.download.isFetched() {
+				err = errFetched
+			}
 			l.OnError(errors.New("readUmMessage " + err.Error()))
 			return
 		}
@@ -277,49 +324,22 @@ func (l *Leech) Do(deadline time.Time) {
 			return
 		}
 
-		if rExtDict.MsgType == 1 { // data
-			// Get the unread bytes!
-			metadataPiece := rMessageBuf.Bytes()
-
-			// BEP 9 explicitly states:
-			//   > If the piece is the last piece of the metadata, it may be less than 16kiB. If
-			//   > it is not the last piece of the metadata, it MUST be 16kiB.
-			//
-			// Hence...
-			//   ... if the length of @metadataPiece is more than 16kiB, we err.
-			if len(metadataPiece) > 16*1024 {
-				l.OnError(fmt.Errorf("metadataPiece > 16kiB"))
-				return
-			}
-
-			piece := rExtDict.Piece
-			// metadata[piece * 2**14: piece * 2**14 + len(metadataPiece)] = metadataPiece is how it'd be done in Python
-			copy(l.metadata[piece*int(math.Pow(2, 14)):piece*int(math.Pow(2, 14))+len(metadataPiece)], metadataPiece)
-			l.metadataReceived += uint(len(metadataPiece))
-
-			// ... if the length of @metadataPiece is less than 16kiB AND metadata is NOT
-			// complete then we err.
-			if len(metadataPiece) < 16*1024 && l.metadataReceived != l.metadataSize {
-				l.OnError(fmt.Errorf("metadataPiece < 16 kiB but incomplete"))
+		// Only the pieces requested from the peer are stored, whose size the download checks:
+		// BEP 9 states that every piece but the last one MUST be 16kiB.
+		if rExtDict.MsgType == 1 && l.pending[rExtDict.Piece] { // data
+			delete(l.pending, rExtDict.Piece)
+			extracted, err := l.download.put(l.conn, rExtDict.Piece, rMessageBuf.Bytes())
+			if err != nil {
+				l.OnError(err)
 				return
 			}
-
-			if l.metadataReceived > l.metadataSize {
-				l.OnError(fmt.Errorf("metadataReceived > metadataSize"))
+			if extracted != nil {
+				// We are done with the transfer, close socket as soon as possible (i.e. NOW)
+				// Avoid hitting "too many open files" error
+				l.closeConn()
+				l.ev.OnSuccess(*extracted)
 				return
 			}
 		}
 	}
-
-	// We are done with the transfer, close socket as soon as possible (i.e. NOW)
-	// Avoid hitting "too many open files" error
-	l.closeConn()
-
-	extracted, err := extractMetadata(l.metadata, l.infoHash, time.Now())
-	if err != nil {
-		l.OnError(err)
-		return
-	}
-
-	l.ev.OnSuccess(*extracted)
 }
@@ -6,6 +6,7 @@ import (
 	"io"
 	"net"
 	"reflect"
+	"slices"
 	"sync"
 	"testing"
 
@@ -110,45 +111,31 @@ func TestReadExactly(t *testing.T) {
 	wg.Wait()
 }
 
-func TestRequestAllPieces(t *testing.T) {
+func TestRequestPieces(t *testing.T) {
 	t.Parallel()
 
 	tests := []struct {
-		name          string
-		metadataSize  uint
-		expectedCalls int
-		expectedError bool
+		name   string
+		pieces []int
 	}{
 		{
-			name:          "Single piece",
-			metadataSize:  16 * 1024,
-			expectedCalls: 1,
-			expectedError: false,
+			name:   "Single piece",
+			pieces: []int{0},
 		},
 		{
-			name:          "Multiple pieces",
-			metadataSize:  32 * 1024,
-			expectedCalls: 2,
-			expectedError: false,
-		},
-		{
-			name:          "Exact multiple pieces",
-			metadataSize:  48 * 1024,
-			expectedCalls: 3,
-			expectedError: false,
+			name:   "Multiple pieces",
+			pieces: []int{1, 3, 2},
 		},
 		{
-			name:          "Zero size",
-			metadataSize:  0,
-			expectedCalls: 0,
-			expectedError: true,
+			name:   "No pieces",
+			pieces: nil,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			peer1, peer2 := net.Pipe()
-			leech := &Leech{conn: peer1, metadataSize: tt.metadataSize}
+			leech := &Leech{conn: peer1, pending: make(map[int]bool)}
 
 			var wg sync.WaitGroup
 			wg.Add(1)
@@ -161,22 +148,31 @@ func TestRequestAllPieces(t *testing.T) {
 					t.Error(err)
 				}
 
-				// Check the number of requests sent
-				requests := 0
+				// Check the pieces requested
+				var requested []int
 				for buffer.Len() > 0 {
 					length := binary.BigEndian.Uint32(buffer.Next(4))
-					buffer.Next(int(length))
-					requests++
+					message := buffer.Next(int(length))
+					rExtDict := new(extDict)
+					if err := bencode.Unmarshal(message[2:], rExtDict); err != nil {
+						t.Error(err)
+						return
+					}
+					requested = append(requested, rExtDict.Piece)
 				}
 
-				if requests != tt.expectedCalls {
-					t.Errorf("Expected %d requests, but got %d", tt.expectedCalls, requests)
+				if !slices.Equal(requested, tt.pieces) {
+					t.Errorf("Expected requests of %v, but got %v", tt.pieces, requested)
 				}
 			}()
 
-			err := leech.requestAllPieces()
-			if (err != nil) != tt.expectedError {
-				t.Errorf("Expected error: %v, got: %v", tt.expectedError, err)
+			if err := leech.requestPieces(tt.pieces); err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			for _, piece := range tt.pieces {
+				if !leech.pending[piece] {
+					t.Errorf("Expected piece %d to be pending", piece)
+				}
 			}
 
 			leech.closeConn()
@@ -341,6 +337,39 @@ func TestReadUmMessage(t *testing.T) {
 	}
 }
 
+func TestReadUmMessage_Pex(t *testing.T) {
+	t.Parallel()
+
+	peer1, peer2 := net.Pipe()
+	var added, dropped []net.TCPAddr
+	leech := &Leech{conn: peer1, ev: LeechEventHandlers{
+		OnPeers: func(_ [20]byte, a []net.TCPAddr, d []net.TCPAddr) {
+			added, dropped = a, d
+		},
+	}}
+
+	pex := "d5:added6:\x01\x00\x00\x01\x1a\xe17:dropped6:\x01\x00\x00\x02\x1a\xe1e"
+	go func() {
+		input := append([]byte{0, 0, 0, byte(2 + len(pex)), 20, utPexID}, pex...)
+		input = append(input, 0, 0, 0, 7, 20, utMetadataID, 'h', 'e', 'l', 'l', 'o')
+		if _, err := peer2.Write(input); err != nil {
+			t.Error(err)
+		}
+		peer2.Close()
+	}()
+
+	result, err := leech.readUmMessage()
+	if err != nil || !reflect.DeepEqual(result, []byte{20, utMetadataID, 'h', 'e', 'l', 'l', 'o'}) {
+		t.Errorf("Expected the ut_metadata message after the ut_pex one, got: %v, %v", result, err)
+	}
+	if len(added) != 1 || !added[0].IP.Equal(net.IPv4(1, 0, 0, 1)) || added[0].Port != 6881 {
+		t.Errorf("Unexpected added peers: %v", added)
+	}
+	if len(dropped) != 1 || !dropped[0].IP.Equal(net.IPv4(1, 0, 0, 2)) {
+		t.Errorf("Unexpected dropped peers: %v", dropped)
+	}
+}
+
 func TestDoExHandshake(t *testing.T) {
 	t.Parallel()
 
@@ -353,25 +382,25 @@ func TestDoExHandshake(t *testing.T) {
 		{
 			name:           "Valid handshake",
 			input:          append([]byte{0, 0, 0, 49}, []byte{20, 0, 'd', '1', ':', 'm', 'd', '1', '1', ':', 'u', 't', '_', 'm', 'e', 't', 'a', 'd', 'a', 't', 'a', 'i', '1', 'e', 'e', '1', '3', ':', 'm', 'e', 't', 'a', 'd', 'a', 't', 'a', '_', 's', 'i', 'z', 'e', 'i', '2', '2', '5', '2', '8', 'e', 'e'}...),
-			expectedOutput: []byte{0, 0, 0, 26, 20, 0, 100, 49, 58, 109, 100, 49, 49, 58, 117, 116, 95, 109, 101, 116, 97, 100, 97, 116, 97, 105, 49, 101, 101, 101},
+			expectedOutput: append([]byte{0, 0, 0, 37, 20, 0}, "d1:md11:ut_metadatai1e6:ut_pexi2eee"...),
 			expectedError:  false,
 		},
 		{
 			name:           "Invalid extension message ID",
 			input:          append([]byte{0, 0, 0, 50}, []byte{20, 1, 'd', '1', ':', 'm', 'd', '1', '1', ':', 'u', 't', '_', 'm', 'e', 't', 'a', 'd', 'a', 't', 'a', 'i', '1', 'e', 'e', 'e', '1', '3', ':', 'm', 'e', 't', 'a', 'd', 'a', 't', 'a', '_', 's', 'i', 'z', 'e', 'i', '2', '2', '5', '2', '8', 'e', 'e'}...),
-			expectedOutput: []byte{0, 0, 0, 26, 20, 0, 100, 49, 58, 109, 100, 49, 49, 58, 117, 116, 95, 109, 101, 116, 97, 100, 97, 116, 97, 105, 49, 101, 101, 101},
+			expectedOutput: append([]byte{0, 0, 0, 37, 20, 0}, "d1:md11:ut_metadatai1e6:ut_pexi2eee"...),
 			expectedError:  true,
 		},
 		{
 			name:           "Invalid metadata size",
 			input:          append([]byte{0, 0, 0, 45}, []byte{20, 0, 'd', '1', ':', 'm', 'd', '1', '1', ':', 'u', 't', '_', 'm', 'e', 't', 'a', 'd', 'a', 't', 'a', 'i', '1', 'e', 'e', '1', '3', ':', 'm', 'e', 't', 'a', 'd', 'a', 't', 'a', '_', 's', 'i', 'z', 'e', 'i', '0', 'e', 'e'}...),
-			expectedOutput: []byte{0, 0, 0, 26, 20, 0, 100, 49, 58, 109, 100, 49, 49, 58, 117, 116, 95, 109, 101, 116, 97, 100, 97, 116, 97, 105, 49, 101, 101, 101},
+			expectedOutput: append([]byte{0, 0, 0, 37, 20, 0}, "d1:md11:ut_metadatai1e6:ut_pexi2eee"...),
 			expectedError:  true,
 		},
 		{
 			name:           "Invalid ut_metadata",
 			input:          append([]byte{0, 0, 0, 50}, []byte{20, 0, 'd', '1', ':', 'm', 'd', '1', '1', ':', 'u', 't', '_', 'm', 'e', 't', 'a', 'd', 'a', 't', 'a', 'i', '0', 'e', 'e', 'e', '1', '3', ':', 'm', 'e', 't', 'a', 'd', 'a', 't', 'a', '_', 's', 'i', 'z', 'e', 'i', '2', '2', '5', '2', '8', 'e', 'e'}...),
-			expectedOutput: []byte{0, 0, 0, 26, 20, 0, 100, 49, 58, 109, 100, 49, 49, 58, 117, 116, 95, 109, 101, 116, 97, 100, 97, 116, 97, 105, 49, 101, 101, 101},
+			expectedOutput: append([]byte{0, 0, 0, 37, 20, 0}, "d1:md11:ut_metadatai1e6:ut_pexi2eee"...),
 			expectedError:  true,
 		},
 	}
@@ -0,0 +1,68 @@
+package metadata
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"tgragnato.it/magnetico/v2/bencode"
+)
+
+const (
+	// utMetadataID and utPexID are the extension message IDs that the leeches advertise in their
+	// extension handshake, for the peers to send ut_metadata and ut_pex messages.
+	utMetadataID = 1
+	utPexID      = 2
+)
+
+// pexDict is a ut_pex message (BEP 11): the peers that the remote peer has connected to, and
+// disconnected from, since its last message.
+type pexDict struct {
+	Added    string `bencode:"added"`
+	Added6   string `bencode:"added6"`
+	Dropped  string `bencode:"dropped"`
+	Dropped6 string `bencode:"dropped6"`
+}
+
+// parsePex returns the peers added and dropped by a ut_pex message.
+func parsePex(b []byte) (added []net.TCPAddr, dropped []net.TCPAddr, err error) {
+	pex := new(pexDict)
+	if err = bencode.Unmarshal(b, pex); err != nil {
+		return nil, nil, errors.New("unmarshal ut_pex " + err.Error())
+	}
+
+	for _, peers := range []struct {
+		compact string
+		ipLen   int
+		into    *[]net.TCPAddr
+	}{
+		{pex.Added, net.IPv4len, &added},
+		{pex.Added6, net.IPv6len, &added},
+		{pex.Dropped, net.IPv4len, &dropped},
+		{pex.Dropped6, net.IPv6len, &dropped},
+	} {
+		parsed, err := parseCompactPeers([]byte(peers.compact), peers.ipLen)
+		if err != nil {
+			return nil, nil, err
+		}
+		*peers.into = append(*peers.into, parsed...)
+	}
+	return added, dropped, nil
+}
+
+// parseCompactPeers parses the compact peer info of IPv4 or IPv6 peers: their address followed by
+// their port, in network byte order.
+func parseCompactPeers(b []byte, ipLen int) ([]net.TCPAddr, error) {
+	if len(b)%(ipLen+2) != 0 {
+		return nil, errors.New("compact peers of the wrong length")
+	}
+
+	peers := make([]net.TCPAddr, 0, len(b)/(ipLen+2))
+	for ; len(b) > 0; b = b[ipLen+2:] {
+		peers = append(peers, net.TCPAddr{
+			IP:   net.IP(append([]byte(nil), b[:ipLen]...)),
+			Port: int(binary.BigEndian.Uint16(b[ipLen:])),
+		})
+	}
+	return peers, nil
+}
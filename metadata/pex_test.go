@@ -0,0 +1,67 @@
+package metadata
+
+import (
+	"net"
+	"slices"
+	"testing"
+)
+
+func equalPeers(a []net.TCPAddr, b []net.TCPAddr) bool {
+	return slices.EqualFunc(a, b, func(a net.TCPAddr, b net.TCPAddr) bool {
+		return a.IP.Equal(b.IP) && a.Port == b.Port
+	})
+}
+
+func TestParsePex(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name            string
+		input           string
+		expectedAdded   []net.TCPAddr
+		expectedDropped []net.TCPAddr
+		expectedError   bool
+	}{
+		{
+			name:  "IPv4 and IPv6 peers",
+			input: "d5:added12:\x01\x00\x00\x01\x1a\xe1\x01\x00\x00\x02\x00\x507:added.f2:\x00\x006:added618:\x26\x06\x47\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x11\x11\x1a\xe17:dropped6:\x01\x00\x00\x03\x1a\xe1e",
+			expectedAdded: []net.TCPAddr{
+				{IP: net.IP{1, 0, 0, 1}, Port: 6881},
+				{IP: net.IP{1, 0, 0, 2}, Port: 80},
+				{IP: net.ParseIP("2606:4700::1111"), Port: 6881},
+			},
+			expectedDropped: []net.TCPAddr{
+				{IP: net.IP{1, 0, 0, 3}, Port: 6881},
+			},
+		},
+		{
+			name:  "Empty message",
+			input: "de",
+		},
+		{
+			name:          "Truncated peer",
+			input:         "d5:added5:\x01\x00\x00\x01\x1ae",
+			expectedError: true,
+		},
+		{
+			name:          "Not a dictionary",
+			input:         "i42e",
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			added, dropped, err := parsePex([]byte(tt.input))
+			if (err != nil) != tt.expectedError {
+				t.Fatalf("Expected error: %v, got: %v", tt.expectedError, err)
+			}
+			if !equalPeers(added, tt.expectedAdded) {
+				t.Errorf("Expected added: %v, got: %v", tt.expectedAdded, added)
+			}
+			if !equalPeers(dropped, tt.expectedDropped) {
+				t.Errorf("Expected dropped: %v, got: %v", tt.expectedDropped, dropped)
+			}
+		})
+	}
+}
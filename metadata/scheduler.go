@@ -0,0 +1,346 @@
+package metadata
+
+import (
+	"container/heap"
+	"net"
+	"sync"
+	"time"
+
+	"tgragnato.it/magnetico/v2/stats"
+)
+
+const (
+	// fdReserve is the number of file descriptors left to the database, the sockets of the
+	// indexers and the web interface, when the number of leeches is sized to the limit.
+	fdReserve = 256
+	// maxFdLeeches caps the number of leeches sized to the file descriptor limit, which can be in
+	// the millions.
+	maxFdLeeches = 4096
+	// defaultLeeches is the number of leeches when the file descriptor limit is unknown.
+	defaultLeeches = 768
+	// queuedPerLeech is the number of torrents that can wait for every leech: the torrents seen
+	// beyond are dropped, as they would not be leeched before their peers are gone.
+	queuedPerLeech = 16
+	// leechesPerTorrent is the number of peers that the metadata of a torrent is fetched from at
+	// once, each one sending different pieces.
+	leechesPerTorrent = 3
+)
+
+// fdLeeches returns the number of concurrent leeches that fit in the file descriptor limit,
+// keeping fdReserve descriptors for the rest of the process, when each leech may hold up to
+// socketsPerLeech sockets at once.
+func fdLeeches(openFiles uint64, socketsPerLeech int) int {
+	if openFiles == 0 {
+		return max(defaultLeeches/socketsPerLeech, 1)
+	}
+	if openFiles < 2*fdReserve {
+		return max(int(openFiles/2)/socketsPerLeech, 1)
+	}
+	return min(int(openFiles-fdReserve)/socketsPerLeech, maxFdLeeches)
+}
+
+// leechJob is a torrent waiting for a leech, or being leeched from some of its peers.
+type leechJob struct {
+	infoHash [20]byte
+	// peer is the peer of the next leech, and tried the addresses of the peers leeched or queued
+	// so far, which are not tried again when they are seen or exchanged.
+	peer     net.TCPAddr
+	tried    map[string]struct{}
+	download *download
+	// running is the number of leeches of the torrent, and fetched whether one of them succeeded.
+	running int
+	fetched bool
+	// sightings is the number of times that the torrent has been seen by the indexers.
+	sightings uint
+	// queuedOn orders the jobs seen as many times, while waitingSince is when the job was last
+	// queued, for the wait times.
+	queuedOn     time.Time
+	waitingSince time.Time
+	// index is the position of the job in the queue, -1 while it is not queued, and waiting
+	// whether it waits aside for a connection to the IP address of its peer to be freed.
+	index   int
+	waiting bool
+}
+
+// queued reports whether the job waits for a leech, in the queue or aside.
+func (job *leechJob) queued() bool {
+	return job.index >= 0 || job.waiting
+}
+
+// leechQueue orders the waiting jobs by the number of times their torrent has been seen, and then
+// by the time that they were first queued. It implements heap.Interface.
+type leechQueue []*leechJob
+
+func (q leechQueue) Len() int {
+	return len(q)
+}
+
+func (q leechQueue) Less(i, j int) bool {
+	if q[i].sightings != q[j].sightings {
+		return q[i].sightings > q[j].sightings
+	}
+	return q[i].queuedOn.Before(q[j].queuedOn)
+}
+
+func (q leechQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *leechQueue) Push(x any) {
+	job := x.(*leechJob)
+	job.index = len(*q)
+	*q = append(*q, job)
+}
+
+func (q *leechQueue) Pop() any {
+	old := *q
+	job := old[len(old)-1]
+	old[len(old)-1] = nil
+	job.index = -1
+	*q = old[:len(old)-1]
+	return job
+}
+
+// scheduler runs the leeches of a Sink: at most maxLeeches at once, of which at most maxPerIP
+// connected to the same IP address, and up to leechesPerTorrent per torrent however many times it
+// is seen. The torrents seen most often are leeched first. The peers of a torrent wait in the
+// peers pool, and replace the ones that fail until the metadata is fetched. The torrents whose
+// peer has all the connections to its IP address wait aside, in the order in which they were
+// blocked, and one of them is queued again whenever a connection is freed.
+type scheduler struct {
+	sync.Mutex
+	maxLeeches int
+	// maxPerIP is zero when the leeches connected to the same IP address are unlimited.
+	maxPerIP  int
+	maxQueued int
+	peers     *infoHashes
+	// start leeches the torrent of the download from the peer. It must call finish when done.
+	start func(d *download, peer net.TCPAddr)
+
+	running int
+	perIP   map[string]int
+	jobs    map[[20]byte]*leechJob
+	queue   leechQueue
+	// waiting are the jobs blocked on each IP address. The jobs that stopped waiting meanwhile are
+	// skipped when the list is released, while nWaiting counts the ones still waiting.
+	waiting  map[string][]*leechJob
+	nWaiting int
+	closed   bool
+}
+
+func newScheduler(maxLeeches int, maxPerIP int, peers *infoHashes, start func(d *download, peer net.TCPAddr)) *scheduler {
+	return &scheduler{
+		maxLeeches: maxLeeches,
+		maxPerIP:   maxPerIP,
+		maxQueued:  maxLeeches * queuedPerLeech,
+		peers:      peers,
+		start:      start,
+		perIP:      make(map[string]int),
+		jobs:       make(map[[20]byte]*leechJob),
+		waiting:    make(map[string][]*leechJob),
+	}
+}
+
+// submit queues a torrent seen with its peers, to be leeched from the first one. A torrent that is
+// already queued or leeched moves ahead in the queue instead, and its peers join the others, to
+// race with the running leeches.
+func (s *scheduler) submit(infoHash [20]byte, peerAddrs []net.TCPAddr, now time.Time) {
+	if len(peerAddrs) == 0 {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if job, ok := s.jobs[infoHash]; ok {
+		job.sightings++
+		if job.index >= 0 {
+			heap.Fix(&s.queue, job.index)
+		}
+		s.push(job, peerAddrs)
+		s.enqueue(job, now)
+		s.dispatch(now)
+		return
+	}
+	if s.closed || len(s.queue)+s.nWaiting >= s.maxQueued {
+		return
+	}
+
+	job := &leechJob{
+		infoHash:     infoHash,
+		peer:         peerAddrs[0],
+		tried:        map[string]struct{}{peerAddrs[0].String(): {}},
+		download:     newDownload(infoHash),
+		sightings:    1,
+		queuedOn:     now,
+		waitingSince: now,
+	}
+	s.jobs[infoHash] = job
+	heap.Push(&s.queue, job)
+	s.push(job, peerAddrs[1:])
+	s.dispatch(now)
+}
+
+// finish frees the connection of a leech. Unless the torrent has been fetched, another leech is
+// queued with the next of its peers, if any: finish returns whether the torrent has been fetched or
+// is still being leeched.
+func (s *scheduler) finish(infoHash [20]byte, peer net.TCPAddr, fetched bool, now time.Time) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	job, ok := s.jobs[infoHash]
+	if !ok {
+		return false
+	}
+	s.running--
+	job.running--
+	ip := peer.IP.String()
+	if s.perIP[ip] <= 1 {
+		delete(s.perIP, ip)
+	} else {
+		s.perIP[ip]--
+	}
+	s.release(ip)
+
+	if fetched {
+		s.unqueue(job)
+	}
+	job.fetched = job.fetched || fetched
+	s.enqueue(job, now)
+	pending := job.fetched || job.running > 0 || job.queued()
+	if job.running == 0 && !job.queued() {
+		delete(s.jobs, infoHash)
+	}
+	s.dispatch(now)
+	return pending
+}
+
+// settle ends the jobs of the other infohashes of a torrent whose metadata has been fetched, like
+// the v1 and v2 infohashes of a hybrid torrent, so that it is not fetched twice: they are unqueued
+// and their leeches are interrupted.
+func (s *scheduler) settle(infoHashes [][20]byte, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, infoHash := range infoHashes {
+		job, ok := s.jobs[infoHash]
+		if !ok || job.fetched {
+			continue
+		}
+		job.fetched = true
+		s.unqueue(job)
+		job.download.settle()
+		if job.running == 0 {
+			delete(s.jobs, infoHash)
+		}
+	}
+	s.dispatch(now)
+}
+
+// unqueue removes a fetched job from the queue, or from the jobs waiting aside, and forgets the
+// peers learned meanwhile, which are not needed anymore.
+func (s *scheduler) unqueue(job *leechJob) {
+	if job.index >= 0 {
+		heap.Remove(&s.queue, job.index)
+	}
+	if job.waiting {
+		job.waiting = false
+		s.nWaiting--
+	}
+	s.peers.flush(job.infoHash)
+}
+
+// exchange adds the peers learned through the peer exchange to the pool of a torrent being
+// leeched, and removes the ones gone, so that more leeches can race for it or replace the failed
+// ones.
+func (s *scheduler) exchange(infoHash [20]byte, added []net.TCPAddr, dropped []net.TCPAddr, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	job, ok := s.jobs[infoHash]
+	if !ok || job.fetched {
+		return
+	}
+	s.peers.drop(infoHash, dropped)
+	s.push(job, added)
+	s.enqueue(job, now)
+	s.dispatch(now)
+}
+
+// close stops the scheduler from starting more leeches.
+func (s *scheduler) close() {
+	s.Lock()
+	defer s.Unlock()
+	s.closed = true
+}
+
+// dispatch starts the leeches of the queued torrents, as long as there are free connections. The
+// torrents whose peer has all the connections to its IP address wait aside for one to be freed.
+func (s *scheduler) dispatch(now time.Time) {
+	for !s.closed && s.running < s.maxLeeches && len(s.queue) > 0 {
+		job := heap.Pop(&s.queue).(*leechJob)
+		ip := job.peer.IP.String()
+		if s.maxPerIP > 0 && s.perIP[ip] >= s.maxPerIP {
+			job.waiting = true
+			s.waiting[ip] = append(s.waiting[ip], job)
+			s.nWaiting++
+			continue
+		}
+
+		s.running++
+		s.perIP[ip]++
+		job.running++
+		stats.GetInstance().ObserveLeechWait(now.Sub(job.waitingSince))
+		go s.start(job.download, job.peer)
+		s.enqueue(job, now)
+	}
+	stats.GetInstance().SetLeeches(len(s.queue)+s.nWaiting, s.running)
+}
+
+// release queues again the first job still waiting for a connection to ip, once one is freed.
+func (s *scheduler) release(ip string) {
+	waiting := s.waiting[ip]
+	for len(waiting) > 0 {
+		job := waiting[0]
+		waiting[0] = nil
+		waiting = waiting[1:]
+		if job.waiting && job.peer.IP.String() == ip {
+			job.waiting = false
+			s.nWaiting--
+			heap.Push(&s.queue, job)
+			break
+		}
+	}
+	if len(waiting) == 0 {
+		delete(s.waiting, ip)
+	} else {
+		s.waiting[ip] = waiting
+	}
+}
+
+// push adds the peers to the pool of a torrent, but the ones already tried for it.
+func (s *scheduler) push(job *leechJob, peerAddrs []net.TCPAddr) {
+	untried := make([]net.TCPAddr, 0, len(peerAddrs))
+	for _, addr := range peerAddrs {
+		if _, ok := job.tried[addr.String()]; !ok {
+			untried = append(untried, addr)
+		}
+	}
+	s.peers.push(job.infoHash, untried)
+}
+
+// enqueue queues a torrent that is not queued again with the next of its peers, as long as it has
+// fewer than leechesPerTorrent leeches and its metadata has not been fetched.
+func (s *scheduler) enqueue(job *leechJob, now time.Time) {
+	if s.closed || job.fetched || job.queued() || job.running >= leechesPerTorrent {
+		return
+	}
+	if next := s.peers.pop(job.infoHash); next != nil {
+		job.peer = *next
+		job.tried[next.String()] = struct{}{}
+		job.waitingSince = now
+		heap.Push(&s.queue, job)
+	}
+}
@@ -0,0 +1,320 @@
+package metadata
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+type started struct {
+	infoHash [20]byte
+	peer     net.TCPAddr
+}
+
+func newTestScheduler(maxLeeches int, maxPerIP int) (*scheduler, chan started) {
+	leeches := make(chan started, 100)
+	s := newScheduler(maxLeeches, maxPerIP, newInfoHashes(10, nil), func(d *download, peer net.TCPAddr) {
+		leeches <- started{d.infoHash, peer}
+	})
+	return s, leeches
+}
+
+func expectLeech(t *testing.T, leeches chan started, infoHash [20]byte, peer net.TCPAddr) {
+	t.Helper()
+	select {
+	case leech := <-leeches:
+		if leech.infoHash != infoHash || !leech.peer.IP.Equal(peer.IP) {
+			t.Errorf("expected a leech of %x from %v, got %x from %v", infoHash, peer.IP, leech.infoHash, leech.peer.IP)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected a leech of %x from %v", infoHash, peer.IP)
+	}
+}
+
+// expectLeeches expects the leeches of a torrent from the peers, started in any order.
+func expectLeeches(t *testing.T, leeches chan started, infoHash [20]byte, peers []net.TCPAddr) {
+	t.Helper()
+	want := make(map[string]bool)
+	for _, peer := range peers {
+		want[peer.IP.String()] = true
+	}
+	for range peers {
+		select {
+		case leech := <-leeches:
+			if leech.infoHash != infoHash || !want[leech.peer.IP.String()] {
+				t.Errorf("unexpected leech of %x from %v", leech.infoHash, leech.peer.IP)
+			}
+			delete(want, leech.peer.IP.String())
+		case <-time.After(time.Second):
+			t.Fatalf("expected leeches of %x from %v", infoHash, want)
+		}
+	}
+}
+
+func expectNoLeech(t *testing.T, leeches chan started) {
+	t.Helper()
+	select {
+	case leech := <-leeches:
+		t.Errorf("unexpected leech of %x from %v", leech.infoHash, leech.peer.IP)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestFdLeeches(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		openFiles uint64
+		sockets   int
+		want      int
+	}{
+		{0, 1, defaultLeeches},
+		{0, 2, defaultLeeches / 2},
+		{1, 1, 1},
+		{1, 2, 1},
+		{256, 1, 128},
+		{256, 2, 64},
+		{1024, 1, 1024 - fdReserve},
+		{1024, 2, (1024 - fdReserve) / 2},
+		{1 << 20, 1, maxFdLeeches},
+		{1 << 20, 2, maxFdLeeches},
+	}
+	for _, tt := range tests {
+		if got := fdLeeches(tt.openFiles, tt.sockets); got != tt.want {
+			t.Errorf("fdLeeches(%d, %d) = %d, want %d", tt.openFiles, tt.sockets, got, tt.want)
+		}
+	}
+}
+
+func TestScheduler_Priority(t *testing.T) {
+	t.Parallel()
+
+	s, leeches := newTestScheduler(1, 0)
+	now := time.Now()
+	peer := func(i byte) net.TCPAddr { return net.TCPAddr{IP: net.IPv4(1, 0, 0, i), Port: 6881} }
+
+	s.submit([20]byte{1}, []net.TCPAddr{peer(1)}, now)
+	expectLeech(t, leeches, [20]byte{1}, peer(1))
+
+	// The torrent seen twice goes ahead of the one seen first.
+	s.submit([20]byte{2}, []net.TCPAddr{peer(2)}, now.Add(time.Second))
+	s.submit([20]byte{3}, []net.TCPAddr{peer(3)}, now.Add(2*time.Second))
+	s.submit([20]byte{3}, []net.TCPAddr{peer(4)}, now.Add(3*time.Second))
+	expectNoLeech(t, leeches)
+
+	s.finish([20]byte{1}, peer(1), true, now.Add(4*time.Second))
+	expectLeech(t, leeches, [20]byte{3}, peer(3))
+	s.finish([20]byte{3}, peer(3), true, now.Add(5*time.Second))
+	expectLeech(t, leeches, [20]byte{2}, peer(2))
+}
+
+func TestScheduler_Race(t *testing.T) {
+	t.Parallel()
+
+	s, leeches := newTestScheduler(10, 0)
+	now := time.Now()
+	var peers []net.TCPAddr
+	for i := range leechesPerTorrent + 1 {
+		peers = append(peers, net.TCPAddr{IP: net.IPv4(1, 0, 0, byte(i)), Port: 6881})
+	}
+
+	// The torrent is leeched from leechesPerTorrent peers at once, the others wait.
+	s.submit([20]byte{1}, peers[:1], now)
+	s.submit([20]byte{1}, peers[1:], now)
+	expectLeeches(t, leeches, [20]byte{1}, peers[:leechesPerTorrent])
+	expectNoLeech(t, leeches)
+
+	// The peer waiting replaces the first one that fails.
+	if !s.finish([20]byte{1}, peers[0], false, now) {
+		t.Fatal("expected the torrent to be still leeched")
+	}
+	expectLeech(t, leeches, [20]byte{1}, peers[leechesPerTorrent])
+	for _, peer := range peers[1 : len(peers)-1] {
+		if !s.finish([20]byte{1}, peer, false, now) {
+			t.Fatal("expected the torrent to be still leeched")
+		}
+	}
+	if s.finish([20]byte{1}, peers[len(peers)-1], false, now) {
+		t.Error("expected the torrent to be dropped without peers")
+	}
+	if len(s.jobs) != 0 || s.running != 0 || len(s.perIP) != 0 {
+		t.Errorf("expected the scheduler to be idle, got %d jobs and %d leeches", len(s.jobs), s.running)
+	}
+}
+
+func TestScheduler_Fetched(t *testing.T) {
+	t.Parallel()
+
+	s, leeches := newTestScheduler(10, 0)
+	now := time.Now()
+	var peers []net.TCPAddr
+	for i := range leechesPerTorrent + 1 {
+		peers = append(peers, net.TCPAddr{IP: net.IPv4(1, 0, 0, byte(i)), Port: 6881})
+	}
+
+	s.submit([20]byte{1}, peers, now)
+	expectLeeches(t, leeches, [20]byte{1}, peers[:leechesPerTorrent])
+
+	// Once fetched, the leeches that fail are not replaced, nor trigger lookups.
+	s.finish([20]byte{1}, peers[0], true, now)
+	for _, peer := range peers[1:leechesPerTorrent] {
+		if !s.finish([20]byte{1}, peer, false, now) {
+			t.Error("expected the torrent to be fetched")
+		}
+	}
+	expectNoLeech(t, leeches)
+	if len(s.jobs) != 0 || s.running != 0 || len(s.queue) != 0 {
+		t.Errorf("expected the scheduler to be idle, got %d jobs and %d leeches", len(s.jobs), s.running)
+	}
+}
+
+func TestScheduler_Exchange(t *testing.T) {
+	t.Parallel()
+
+	s, leeches := newTestScheduler(1, 0)
+	now := time.Now()
+	first := net.TCPAddr{IP: net.IPv4(1, 0, 0, 1), Port: 6881}
+	exchanged := net.TCPAddr{IP: net.IPv4(1, 0, 0, 2), Port: 6881}
+	dropped := net.TCPAddr{IP: net.IPv4(1, 0, 0, 3), Port: 6881}
+
+	s.submit([20]byte{1}, []net.TCPAddr{first}, now)
+	expectLeech(t, leeches, [20]byte{1}, first)
+	s.exchange([20]byte{1}, []net.TCPAddr{exchanged, dropped}, nil, now)
+	s.exchange([20]byte{1}, nil, []net.TCPAddr{dropped}, now)
+
+	// The peers learned from the peer exchange replace the failed one, but the dropped ones.
+	if !s.finish([20]byte{1}, first, false, now) {
+		t.Fatal("expected the torrent to be queued again with the exchanged peer")
+	}
+	expectLeech(t, leeches, [20]byte{1}, exchanged)
+	if s.finish([20]byte{1}, exchanged, false, now) {
+		t.Error("expected the torrent to be dropped without peers")
+	}
+	expectNoLeech(t, leeches)
+
+	// The torrents that are not leeched are left alone.
+	s.exchange([20]byte{2}, []net.TCPAddr{exchanged}, nil, now)
+	if len(s.jobs) != 0 || s.peers.pop([20]byte{2}) != nil {
+		t.Errorf("expected the peers of a torrent not leeched to be ignored")
+	}
+}
+
+func TestScheduler_Tried(t *testing.T) {
+	t.Parallel()
+
+	s, leeches := newTestScheduler(1, 0)
+	now := time.Now()
+	first := net.TCPAddr{IP: net.IPv4(1, 0, 0, 1), Port: 6881}
+	second := net.TCPAddr{IP: net.IPv4(1, 0, 0, 2), Port: 6881}
+
+	s.submit([20]byte{1}, []net.TCPAddr{first, second}, now)
+	expectLeech(t, leeches, [20]byte{1}, first)
+	if !s.finish([20]byte{1}, first, false, now) {
+		t.Fatal("expected the torrent to be queued again with the second peer")
+	}
+	expectLeech(t, leeches, [20]byte{1}, second)
+
+	// The peers that failed are not tried again, whether they are exchanged or seen again.
+	s.exchange([20]byte{1}, []net.TCPAddr{first, second}, nil, now)
+	s.submit([20]byte{1}, []net.TCPAddr{first}, now)
+	if s.finish([20]byte{1}, second, false, now) {
+		t.Error("expected the torrent to be dropped without untried peers")
+	}
+	expectNoLeech(t, leeches)
+}
+
+func TestScheduler_PerIP(t *testing.T) {
+	t.Parallel()
+
+	s, leeches := newTestScheduler(10, 1)
+	now := time.Now()
+	busy := net.TCPAddr{IP: net.IPv4(1, 0, 0, 1), Port: 6881}
+	sameIP := net.TCPAddr{IP: net.IPv4(1, 0, 0, 1), Port: 6882}
+	other := net.TCPAddr{IP: net.IPv4(1, 0, 0, 2), Port: 6881}
+
+	s.submit([20]byte{1}, []net.TCPAddr{busy}, now)
+	expectLeech(t, leeches, [20]byte{1}, busy)
+
+	// The torrents waiting for the IP address do not hold up the others, and wait aside.
+	s.submit([20]byte{2}, []net.TCPAddr{sameIP}, now)
+	s.submit([20]byte{3}, []net.TCPAddr{other}, now)
+	s.submit([20]byte{4}, []net.TCPAddr{sameIP}, now)
+	expectLeech(t, leeches, [20]byte{3}, other)
+	expectNoLeech(t, leeches)
+	s.Lock()
+	if len(s.queue) != 0 || s.nWaiting != 2 {
+		t.Errorf("expected 2 torrents waiting aside, got %d queued and %d waiting", len(s.queue), s.nWaiting)
+	}
+	s.Unlock()
+
+	// They are released one at a time, in the order in which they were blocked.
+	s.finish([20]byte{1}, busy, true, now)
+	expectLeech(t, leeches, [20]byte{2}, sameIP)
+	expectNoLeech(t, leeches)
+	s.finish([20]byte{2}, sameIP, true, now)
+	expectLeech(t, leeches, [20]byte{4}, sameIP)
+}
+
+func TestScheduler_Settle(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		// maxLeeches is 1 for the other infohash to wait in the queue, 2 for it to be leeched.
+		maxLeeches int
+	}{
+		{"Queued", 1},
+		{"Leeched", 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s, leeches := newTestScheduler(tt.maxLeeches, 0)
+			now := time.Now()
+			v1 := net.TCPAddr{IP: net.IPv4(1, 0, 0, 1), Port: 6881}
+			v2 := net.TCPAddr{IP: net.IPv4(1, 0, 0, 2), Port: 6881}
+
+			// The v1 and the v2 infohashes of a hybrid torrent are seen at once.
+			s.submit([20]byte{1}, []net.TCPAddr{v1}, now)
+			expectLeech(t, leeches, [20]byte{1}, v1)
+			s.submit([20]byte{2}, []net.TCPAddr{v2}, now)
+			leeched := tt.maxLeeches > 1
+			if leeched {
+				expectLeech(t, leeches, [20]byte{2}, v2)
+			}
+			download := s.jobs[[20]byte{2}].download
+
+			// Once the metadata is fetched under the v1 infohash, the v2 one is not leeched.
+			s.settle([][20]byte{{1}, {2}}, now)
+			s.finish([20]byte{1}, v1, true, now)
+			expectNoLeech(t, leeches)
+			if !download.isFetched() {
+				t.Error("expected the download of the v2 infohash to be settled")
+			}
+			if leeched && !s.finish([20]byte{2}, v2, false, now) {
+				t.Error("expected the interrupted leech of the v2 infohash not to look for more peers")
+			}
+			if len(s.jobs) != 0 || s.running != 0 || len(s.queue) != 0 {
+				t.Errorf("expected the scheduler to be idle, got %d jobs and %d leeches", len(s.jobs), s.running)
+			}
+		})
+	}
+}
+
+func TestScheduler_MaxQueued(t *testing.T) {
+	t.Parallel()
+
+	s, _ := newTestScheduler(1, 0)
+	now := time.Now()
+	for i := range queuedPerLeech + 2 {
+		s.submit([20]byte{byte(i)}, []net.TCPAddr{{IP: net.IPv4(1, 0, 0, byte(i)), Port: 6881}}, now)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.running != 1 || len(s.queue) != queuedPerLeech || len(s.jobs) != queuedPerLeech+1 {
+		t.Errorf("expected 1 leech and %d queued torrents, got %d and %d", queuedPerLeech, s.running, len(s.queue))
+	}
+}
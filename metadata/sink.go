@@ -2,9 +2,11 @@ package metadata
 
 import (
 	"net"
+	"sync"
 	"time"
 
 	"tgragnato.it/magnetico/v2/dht"
+	"tgragnato.it/magnetico/v2/metadata/btconn"
 	"tgragnato.it/magnetico/v2/persistence"
 )
 
@@ -14,10 +16,17 @@ const (
 	PeerIDLength = 20
 	// PeerPrefix Azureus-style
 	PeerPrefix = "-UT3600-"
+	// lookupInterval is the minimum time between two DHT lookups of the peers of the same torrent,
+	// so that a torrent whose peers all fail does not keep the DHT busy.
+	lookupInterval = 10 * time.Minute
 )
 
 type Metadata struct {
+	// InfoHash is the SHA-1 of the info dictionary of v1 and hybrid torrents, and the full SHA-256
+	// of the info dictionary of v2-only torrents.
 	InfoHash []byte
+	// InfoHashV2 is the SHA-256 of the info dictionary of v2 and hybrid torrents, nil otherwise.
+	InfoHashV2 []byte
 	// Name should be thought of "Title" of the torrent. For single-file torrents, it is the name
 	// of the file, and for multi-file torrents, it is the name of the root directory.
 	Name         string
@@ -27,24 +36,60 @@ type Metadata struct {
 	Files []persistence.File
 }
 
+// DHTInfoHashes returns the infohashes of the torrent in the DHT: the v1 one, and the v2 one
+// truncated to 20 bytes.
+func (md *Metadata) DHTInfoHashes() (infoHashes [][20]byte) {
+	if len(md.InfoHash) == 20 {
+		infoHashes = append(infoHashes, [20]byte(md.InfoHash))
+	}
+	if len(md.InfoHashV2) == 32 {
+		infoHashes = append(infoHashes, [20]byte(md.InfoHashV2[:20]))
+	}
+	return
+}
+
 type Sink struct {
 	PeerID   []byte
 	deadline time.Duration
 	drain    chan Metadata
+	// dialer connects the leeches to the peers.
+	dialer btconn.Dialer
 
 	incomingInfoHashes *infoHashes
+	scheduler          *scheduler
+
+	// lookup, when set, searches the DHT for more peers of a torrent; they come back through Sink.
+	// The times of the lookups are kept for the current lookupInterval in lastLookup, and for the
+	// one before in previousLookup, which are forgotten together.
+	lookup         func(infoHash [20]byte)
+	lookupsMu      sync.Mutex
+	lastLookup     map[[20]byte]time.Time
+	previousLookup map[[20]byte]time.Time
+	lookupsRotated time.Time
 
 	terminated  bool
 	termination chan any
 }
 
-func NewSink(deadline time.Duration, maxNLeeches int, filterNodes []net.IPNet) *Sink {
+// NewSink returns a Sink that leeches the torrents from at most maxNLeeches peers each, one after
+// the other. At most maxLeeches leeches run at once, and zero sizes them to the file descriptor
+// limit. At most maxLeechesPerIP of them connect to the same IP address, and zero does not limit
+// them.
+func NewSink(deadline time.Duration, maxNLeeches int, maxLeeches int, maxLeechesPerIP int, filterNodes []net.IPNet, lookup func(infoHash [20]byte), dialer btconn.Dialer) *Sink {
 	ms := new(Sink)
 
 	ms.PeerID = randomID()
 	ms.deadline = deadline
 	ms.drain = make(chan Metadata, 10)
 	ms.incomingInfoHashes = newInfoHashes(maxNLeeches, filterNodes)
+	if maxLeeches <= 0 {
+		maxLeeches = fdLeeches(openFilesLimit(), btconn.DialSockets(dialer))
+	}
+	ms.scheduler = newScheduler(maxLeeches, maxLeechesPerIP, ms.incomingInfoHashes, ms.leech)
+	ms.lookup = lookup
+	ms.dialer = dialer
+	ms.lastLookup = make(map[[20]byte]time.Time)
+	ms.lookupsRotated = time.Now()
 	ms.termination = make(chan any)
 
 	return ms
@@ -55,20 +100,24 @@ func (ms *Sink) Sink(res dht.Result) {
 		panic("Trying to Sink() an already closed Sink!")
 	}
 
-	infoHash := res.InfoHash()
-	peerAddrs := res.PeerAddrs()
-	if len(peerAddrs) <= 0 {
-		return
-	}
-
-	go ms.leech(infoHash, peerAddrs[1:], peerAddrs[0])
+	ms.scheduler.submit(res.InfoHash(), res.PeerAddrs(), time.Now())
 }
 
-func (ms *Sink) leech(infoHash [20]byte, peerAddrs []net.TCPAddr, firstPeer net.TCPAddr) {
-	ms.incomingInfoHashes.push(infoHash, peerAddrs)
-	NewLeech(infoHash, &firstPeer, ms.PeerID, LeechEventHandlers{
-		OnSuccess: ms.flush,
-		OnError:   ms.onLeechError,
+// leech fetches the metadata of a torrent from a peer, as started by the scheduler.
+func (ms *Sink) leech(d *download, peer net.TCPAddr) {
+	infoHash := d.infoHash
+	newLeech(d, &peer, ms.PeerID, ms.dialer, LeechEventHandlers{
+		OnSuccess: func(result Metadata) {
+			ms.flush(result)
+			ms.scheduler.settle(result.DHTInfoHashes(), time.Now())
+			ms.scheduler.finish(infoHash, peer, true, time.Now())
+		},
+		OnError: func(infoHash [20]byte, err error) {
+			ms.onLeechError(infoHash, peer, err)
+		},
+		OnPeers: func(infoHash [20]byte, added []net.TCPAddr, dropped []net.TCPAddr) {
+			ms.scheduler.exchange(infoHash, added, dropped, time.Now())
+		},
 	}).Do(time.Now().Add(ms.deadline))
 }
 
@@ -81,6 +130,7 @@ func (ms *Sink) Drain() <-chan Metadata {
 
 func (ms *Sink) Terminate() {
 	ms.terminated = true
+	ms.scheduler.close()
 	close(ms.termination)
 	close(ms.drain)
 }
@@ -92,16 +142,46 @@ func (ms *Sink) flush(result Metadata) {
 
 	ms.drain <- result
 
-	var infoHash [20]byte
-	copy(infoHash[:], result.InfoHash)
-	go ms.incomingInfoHashes.flush(infoHash)
+	for _, infoHash := range result.DHTInfoHashes() {
+		go ms.incomingInfoHashes.flush(infoHash)
+	}
+}
+
+// onLeechError replaces the peer with the next one of the torrent, unless other leeches still race
+// for its metadata.
+func (ms *Sink) onLeechError(infoHash [20]byte, peer net.TCPAddr, err error) {
+	if ms.scheduler.finish(infoHash, peer, false, time.Now()) {
+		return
+	}
+
+	// The peer pool has run empty, and the last leech failed: look for more peers in the DHT.
+	if ms.shouldLookup(infoHash, time.Now()) {
+		ms.lookup(infoHash)
+	}
 }
 
-func (ms *Sink) onLeechError(infoHash [20]byte, err error) {
-	if peer := ms.incomingInfoHashes.pop(infoHash); peer != nil {
-		go NewLeech(infoHash, peer, ms.PeerID, LeechEventHandlers{
-			OnSuccess: ms.flush,
-			OnError:   ms.onLeechError,
-		}).Do(time.Now().Add(ms.deadline))
+// shouldLookup reports whether the peers of infoHash can be looked up, and records the lookup.
+func (ms *Sink) shouldLookup(infoHash [20]byte, now time.Time) bool {
+	if ms.lookup == nil || ms.terminated {
+		return false
+	}
+
+	ms.lookupsMu.Lock()
+	defer ms.lookupsMu.Unlock()
+
+	if now.Sub(ms.lookupsRotated) >= lookupInterval {
+		ms.previousLookup = nil
+		if now.Sub(ms.lookupsRotated) < 2*lookupInterval {
+			ms.previousLookup = ms.lastLookup
+		}
+		ms.lastLookup = make(map[[20]byte]time.Time)
+		ms.lookupsRotated = now
+	}
+	for _, lookups := range []map[[20]byte]time.Time{ms.lastLookup, ms.previousLookup} {
+		if last, ok := lookups[infoHash]; ok && now.Sub(last) < lookupInterval {
+			return false
+		}
 	}
+	ms.lastLookup[infoHash] = now
+	return true
 }
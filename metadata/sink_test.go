@@ -5,17 +5,21 @@ import (
 	"reflect"
 	"testing"
 	"time"
+
+	"tgragnato.it/magnetico/v2/metadata/btconn"
 )
 
 func TestSink_NewSink(t *testing.T) {
 	t.Parallel()
 
-	sink := NewSink(time.Second, 10, []net.IPNet{})
+	sink := NewSink(time.Second, 10, 0, 0, []net.IPNet{}, nil, btconn.NewDialer(btconn.TCPFirst))
 	if sink == nil ||
 		len(sink.PeerID) != 20 ||
 		sink.deadline != time.Second ||
 		sink.drain == nil ||
 		sink.incomingInfoHashes == nil ||
+		sink.scheduler == nil ||
+		sink.scheduler.maxLeeches <= 0 ||
 		sink.termination == nil {
 		t.Error("One or more fields of Sink were not initialized correctly")
 	}
@@ -37,7 +41,7 @@ func (tr *TestResult) PeerAddrs() []net.TCPAddr {
 func TestSink_Sink(t *testing.T) {
 	t.Parallel()
 
-	sink := NewSink(time.Minute, 2, []net.IPNet{})
+	sink := NewSink(time.Minute, 2, 0, 0, []net.IPNet{}, nil, btconn.NewDialer(btconn.TCPFirst))
 	testResult := &TestResult{
 		infoHash:  [20]byte{255},
 		peerAddrs: []net.TCPAddr{{IP: net.ParseIP("1.0.0.1"), Port: 443}},
@@ -51,7 +55,7 @@ func TestSink_Sink(t *testing.T) {
 func TestSink_Terminate(t *testing.T) {
 	t.Parallel()
 
-	sink := NewSink(time.Minute, 1, []net.IPNet{})
+	sink := NewSink(time.Minute, 1, 0, 0, []net.IPNet{}, nil, btconn.NewDialer(btconn.TCPFirst))
 	sink.Terminate()
 
 	if !sink.terminated {
@@ -68,7 +72,7 @@ func TestSink_Drain(t *testing.T) {
 		}
 	}()
 
-	sink := NewSink(time.Minute, 1, []net.IPNet{})
+	sink := NewSink(time.Minute, 1, 0, 0, []net.IPNet{}, nil, btconn.NewDialer(btconn.TCPFirst))
 	sink.Terminate()
 	sink.Drain()
 }
@@ -76,7 +80,7 @@ func TestSink_Drain(t *testing.T) {
 func TestFlush(t *testing.T) {
 	t.Parallel()
 
-	sink := NewSink(time.Minute, 1, []net.IPNet{})
+	sink := NewSink(time.Minute, 1, 0, 0, []net.IPNet{}, nil, btconn.NewDialer(btconn.TCPFirst))
 	testMetadata := Metadata{
 		InfoHash: []byte{1, 2, 3, 4, 5, 6},
 	}
@@ -106,3 +110,35 @@ func TestFlush(t *testing.T) {
 		t.Error("InfoHash was not deleted after flush")
 	}
 }
+
+func TestSink_onLeechError(t *testing.T) {
+	t.Parallel()
+
+	lookups := make(chan [20]byte, 2)
+	sink := NewSink(time.Minute, 1, 0, 0, []net.IPNet{}, func(infoHash [20]byte) {
+		lookups <- infoHash
+	}, btconn.NewDialer(btconn.TCPFirst))
+
+	// An empty peer pool triggers a single lookup within lookupInterval.
+	sink.onLeechError([20]byte{1}, net.TCPAddr{}, nil)
+	sink.onLeechError([20]byte{1}, net.TCPAddr{}, nil)
+
+	if infoHash := <-lookups; infoHash != [20]byte{1} {
+		t.Errorf("unexpected lookup of %v", infoHash)
+	}
+	select {
+	case infoHash := <-lookups:
+		t.Errorf("unexpected second lookup of %v", infoHash)
+	default:
+	}
+
+	if !sink.shouldLookup([20]byte{1}, time.Now().Add(lookupInterval)) {
+		t.Error("expected a new lookup after lookupInterval")
+	}
+
+	// The old lookups are forgotten, without sweeping them at every lookup.
+	sink.shouldLookup([20]byte{2}, time.Now().Add(3*lookupInterval))
+	if len(sink.lastLookup) != 1 || len(sink.previousLookup) != 0 {
+		t.Errorf("expected the old lookups to be forgotten, got %d and %d", len(sink.lastLookup), len(sink.previousLookup))
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	mrand "math/rand/v2"
@@ -12,6 +13,7 @@ import (
 	"tgragnato.it/magnetico/v2/bencode"
 	"tgragnato.it/magnetico/v2/metainfo"
 	"tgragnato.it/magnetico/v2/persistence"
+	infohash_v2 "tgragnato.it/magnetico/v2/types/infohash-v2"
 )
 
 func totalSize(files []persistence.File) (uint64, error) {
@@ -54,14 +56,53 @@ func validateInfo(info *metainfo.Info) error {
 	if info.PieceLength == 0 {
 		return errors.New("zero piece length")
 	}
-	if int((info.TotalLength()+info.PieceLength-1)/info.PieceLength) != info.NumPieces() {
-		return errors.New("piece count and file lengths are at odds")
+	if info.HasV1() {
+		var totalLength int64
+		for file := range info.UpvertedV1Files() {
+			totalLength += file.Length
+		}
+		if int((totalLength+info.PieceLength-1)/info.PieceLength) != len(info.Pieces)/20 {
+			return errors.New("piece count and file lengths are at odds")
+		}
+	}
+	if info.HasV2() {
+		return validateFileTree(info)
+	}
+	return nil
+}
+
+// Check the file tree of a v2 info dictionary, as required by BEP 52
+func validateFileTree(info *metainfo.Info) error {
+	if info.PieceLength < 1<<14 || info.PieceLength&(info.PieceLength-1) != 0 {
+		return errors.New("piece length is not a power of two of at least 16 KiB")
+	}
+	if !info.FileTree.IsDir() {
+		return errors.New("empty file tree")
+	}
+	for file := range info.UpvertedFilesIter() {
+		if file.Length < 0 {
+			return errors.New("file size less than zero")
+		}
+		if file.Length > 0 && file.PiecesRoot == (infohash_v2.T{}) {
+			return errors.New("missing pieces root")
+		}
 	}
 	return nil
 }
 
 // Extract the files from the metainfo
 func extractFiles(info *metainfo.Info) (files []persistence.File) {
+	if info.HasV2() {
+		// The file tree lists the files of hybrid torrents too, without the padding files of v1.
+		for file := range info.UpvertedFilesIter() {
+			files = append(files, persistence.File{
+				Size: file.Length,
+				Path: file.DisplayPath(info),
+			})
+		}
+		return
+	}
+
 	if len(info.Files) == 0 {
 		// Single file
 		files = append(files, persistence.File{
@@ -86,7 +127,9 @@ func extractFiles(info *metainfo.Info) (files []persistence.File) {
 //
 // Parameters:
 // - meta: a byte array containing the metadata to be extracted.
-// - infohash: a 20-byte array representing the infohash for verification.
+// - infohash: a 20-byte array representing the infohash for verification, either the SHA-1 of the
+// metadata of a v1 torrent or the SHA-256 of the metadata of a v2 torrent, truncated to 20 bytes
+// as BEP 52 announces it in the DHT. Hybrid torrents are announced under both.
 // - discovery: a timestamp representing the discovery time of the metadata.
 //
 // Returns:
@@ -94,7 +137,10 @@ func extractFiles(info *metainfo.Info) (files []persistence.File) {
 // - An error if any validation or check does not complete with success.
 func extractMetadata(meta []byte, infohash [20]byte, discovery time.Time) (*Metadata, error) {
 	sha1Sum := sha1.Sum(meta)
-	if !bytes.Equal(sha1Sum[:], infohash[:]) {
+	sha256Sum := sha256.Sum256(meta)
+	v1 := bytes.Equal(sha1Sum[:], infohash[:])
+	v2 := bytes.Equal(sha256Sum[:20], infohash[:])
+	if !v1 && !v2 {
 		return nil, errors.New("infohash mismatch")
 	}
 
@@ -102,6 +148,9 @@ func extractMetadata(meta []byte, infohash [20]byte, discovery time.Time) (*Meta
 	if err != nil {
 		return nil, err
 	}
+	if !(v1 && info.HasV1()) && !(v2 && info.HasV2()) {
+		return nil, errors.New("infohash of a version that the torrent does not have")
+	}
 
 	files := extractFiles(info)
 	totalSize, err := totalSize(files)
@@ -109,13 +158,20 @@ func extractMetadata(meta []byte, infohash [20]byte, discovery time.Time) (*Meta
 		return nil, err
 	}
 
-	return &Metadata{
-		InfoHash:     infohash[:],
+	metadata := &Metadata{
+		InfoHash:     sha1Sum[:],
 		Name:         info.Name,
 		TotalSize:    totalSize,
 		DiscoveredOn: discovery.Unix(),
 		Files:        files,
-	}, nil
+	}
+	if info.HasV2() {
+		metadata.InfoHashV2 = sha256Sum[:]
+		if !info.HasV1() {
+			metadata.InfoHash = sha256Sum[:]
+		}
+	}
+	return metadata, nil
 }
 
 // randomID generates a random peer ID with a predefined prefix.
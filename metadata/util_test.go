@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
 	"math"
 	mrand "math/rand/v2"
 	"reflect"
@@ -387,3 +388,143 @@ func TestExtractMetadata(t *testing.T) {
 		t.Errorf("extractMetadata() = %v, want %v", actualMetadata, expectedMetadata)
 	}
 }
+
+// v2Info returns the info dictionary of a v2 torrent with a file and an empty file in a directory.
+func v2Info() *metainfo.Info {
+	return &metainfo.Info{
+		PieceLength: 1 << 14,
+		Name:        "test",
+		MetaVersion: 2,
+		FileTree: metainfo.FileTree{Dir: map[string]metainfo.FileTree{
+			"a.txt": {File: metainfo.FileTreeFile{Length: 10, PiecesRoot: string(make([]byte, 31)) + "\x01"}},
+			"sub": {Dir: map[string]metainfo.FileTree{
+				"b.txt": {File: metainfo.FileTreeFile{Length: 0}},
+			}},
+		}},
+	}
+}
+
+func TestValidateInfo_V2(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		modify  func(info *metainfo.Info)
+		wantErr bool
+	}{
+		{
+			name:    "valid info",
+			modify:  func(info *metainfo.Info) {},
+			wantErr: false,
+		},
+		{
+			name:    "piece length not a power of two",
+			modify:  func(info *metainfo.Info) { info.PieceLength = 3 << 13 },
+			wantErr: true,
+		},
+		{
+			name:    "piece length below 16 KiB",
+			modify:  func(info *metainfo.Info) { info.PieceLength = 1 << 13 },
+			wantErr: true,
+		},
+		{
+			name:    "empty file tree",
+			modify:  func(info *metainfo.Info) { info.FileTree = metainfo.FileTree{} },
+			wantErr: true,
+		},
+		{
+			name: "missing pieces root",
+			modify: func(info *metainfo.Info) {
+				info.FileTree.Dir["a.txt"] = metainfo.FileTree{File: metainfo.FileTreeFile{Length: 10}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "hybrid with v1 pieces at odds",
+			modify: func(info *metainfo.Info) {
+				info.Pieces = make([]byte, 40)
+				info.Length = 10
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := v2Info()
+			tt.modify(info)
+			if err := validateInfo(info); (err != nil) != tt.wantErr {
+				t.Errorf("validateInfo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExtractMetadata_V2(t *testing.T) {
+	t.Parallel()
+
+	meta, err := bencode.Marshal(v2Info())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha256Sum := sha256.Sum256(meta)
+	injectedTime := time.Now()
+
+	actualMetadata, err := extractMetadata(meta, [20]byte(sha256Sum[:20]), injectedTime)
+	if err != nil {
+		t.Fatalf("extractMetadata() error = %v, want nil", err)
+	}
+	expectedMetadata := &Metadata{
+		InfoHash:     sha256Sum[:],
+		InfoHashV2:   sha256Sum[:],
+		Name:         "test",
+		TotalSize:    10,
+		DiscoveredOn: injectedTime.Unix(),
+		Files:        []persistence.File{{Size: 10, Path: "a.txt"}, {Size: 0, Path: "sub/b.txt"}},
+	}
+	if !reflect.DeepEqual(actualMetadata, expectedMetadata) {
+		t.Errorf("extractMetadata() = %v, want %v", actualMetadata, expectedMetadata)
+	}
+	if got := actualMetadata.DHTInfoHashes(); !reflect.DeepEqual(got, [][20]byte{[20]byte(sha256Sum[:20])}) {
+		t.Errorf("DHTInfoHashes() = %x, want the truncated v2 infohash", got)
+	}
+
+	// A v2-only torrent has no v1 infohash.
+	if _, err := extractMetadata(meta, sha1.Sum(meta), injectedTime); err == nil {
+		t.Error("extractMetadata() accepted the SHA-1 of a v2-only torrent")
+	}
+}
+
+func TestExtractMetadata_Hybrid(t *testing.T) {
+	t.Parallel()
+
+	info := v2Info()
+	info.Pieces = make([]byte, 20)
+	info.Files = []metainfo.FileInfo{
+		{Length: 10, Path: []string{"a.txt"}},
+		{Length: 1<<14 - 10, Path: []string{".pad", "16374"}, ExtendedFileAttrs: metainfo.ExtendedFileAttrs{Attr: "p"}},
+		{Length: 0, Path: []string{"sub", "b.txt"}},
+	}
+	meta, err := bencode.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha1Sum := sha1.Sum(meta)
+	sha256Sum := sha256.Sum256(meta)
+
+	for _, infohash := range [][20]byte{sha1Sum, [20]byte(sha256Sum[:20])} {
+		actualMetadata, err := extractMetadata(meta, infohash, time.Now())
+		if err != nil {
+			t.Fatalf("extractMetadata(%x) error = %v, want nil", infohash, err)
+		}
+		if !bytes.Equal(actualMetadata.InfoHash, sha1Sum[:]) || !bytes.Equal(actualMetadata.InfoHashV2, sha256Sum[:]) {
+			t.Errorf("extractMetadata(%x) = %x and %x, want both infohashes", infohash, actualMetadata.InfoHash, actualMetadata.InfoHashV2)
+		}
+		// The files come from the file tree, without the padding files of v1.
+		if len(actualMetadata.Files) != 2 || actualMetadata.TotalSize != 10 {
+			t.Errorf("extractMetadata(%x) files = %v, want the files of the file tree", infohash, actualMetadata.Files)
+		}
+		if got := actualMetadata.DHTInfoHashes(); !reflect.DeepEqual(got, [][20]byte{sha1Sum, [20]byte(sha256Sum[:20])}) {
+			t.Errorf("DHTInfoHashes() = %x, want the v1 and the truncated v2 infohashes", got)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package opflags
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+)
+
+// IndexerOpFlags configure an indexer of the indexers list of the YAML config. The settings that
+// are not set default to the global flags.
+type IndexerOpFlags struct {
+	Addr               string      `yaml:"addr"`
+	MaxNeighbors       *uint       `yaml:"maxNeighbors"`
+	MaxRPS             *uint       `yaml:"maxRPS"`
+	MaxResponseRPS     *uint       `yaml:"maxResponseRPS"`
+	MaxNodeRPS         *uint       `yaml:"maxNodeRPS"`
+	RateBurst          *uint       `yaml:"rateBurst"`
+	BootstrappingNodes []string    `yaml:"bootstrappingNodes"`
+	FilterNodesCIDRs   []string    `yaml:"filterNodesCIDRs"`
+	FilterNodesIpNets  []net.IPNet `yaml:"-"`
+	// NodeID is the fixed node ID of the indexer, as 40 hexadecimal digits. Empty lets the indexer
+	// pick one.
+	NodeID      string `yaml:"nodeID"`
+	NodeIDBytes []byte `yaml:"-"`
+}
+
+// checkIndexers parses the global filter, and completes the indexers with the global settings that
+// they do not override. Without indexers in the YAML config, one is run on every address of
+// IndexerAddrs.
+func (o *OpFlags) checkIndexers() error {
+	var err error
+	if o.FilterNodesIpNets, err = parseCIDRs(o.FilterNodesCIDRs); err != nil {
+		return err
+	}
+
+	if len(o.Indexers) == 0 {
+		if err := o.checkAddrs(); err != nil {
+			return err
+		}
+		for _, addr := range o.IndexerAddrs {
+			o.Indexers = append(o.Indexers, IndexerOpFlags{Addr: addr})
+		}
+	}
+
+	for i := range o.Indexers {
+		indexer := &o.Indexers[i]
+		if _, err := net.ResolveUDPAddr("udp", indexer.Addr); err != nil || indexer.Addr == "" {
+			return fmt.Errorf("invalid address %q of the indexer %d", indexer.Addr, i)
+		}
+
+		for _, setting := range []struct {
+			value  **uint
+			global uint
+		}{
+			{&indexer.MaxNeighbors, o.IndexerMaxNeighbors},
+			{&indexer.MaxRPS, o.MaxRPS},
+			{&indexer.MaxResponseRPS, o.MaxResponseRPS},
+			{&indexer.MaxNodeRPS, o.MaxNodeRPS},
+			{&indexer.RateBurst, o.RateBurst},
+		} {
+			if *setting.value == nil {
+				global := setting.global
+				*setting.value = &global
+			}
+		}
+		if indexer.BootstrappingNodes == nil {
+			indexer.BootstrappingNodes = o.BootstrappingNodes
+		}
+		if indexer.FilterNodesCIDRs == nil {
+			indexer.FilterNodesCIDRs = o.FilterNodesCIDRs
+		}
+		if indexer.FilterNodesIpNets, err = parseCIDRs(indexer.FilterNodesCIDRs); err != nil {
+			return err
+		}
+
+		if indexer.NodeID != "" {
+			nodeID, err := hex.DecodeString(indexer.NodeID)
+			if err != nil || len(nodeID) != 20 {
+				return fmt.Errorf("the node ID of the indexer %s should be 40 hexadecimal digits", indexer.Addr)
+			}
+			indexer.NodeIDBytes = nodeID
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package opflags
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckIndexers(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		indexers    []IndexerOpFlags
+		expectError bool
+	}{
+		{
+			name:        "ValidIndexers",
+			indexers:    []IndexerOpFlags{{Addr: "0.0.0.0:6881"}, {Addr: "10.0.0.1:6882", FilterNodesCIDRs: []string{"10.0.0.0/8"}}},
+			expectError: false,
+		},
+		{
+			name:        "EmptyAddr",
+			indexers:    []IndexerOpFlags{{}},
+			expectError: true,
+		},
+		{
+			name:        "InvalidCIDR",
+			indexers:    []IndexerOpFlags{{Addr: "0.0.0.0:6881", FilterNodesCIDRs: []string{"invalid-cidr"}}},
+			expectError: true,
+		},
+		{
+			name:        "ValidNodeID",
+			indexers:    []IndexerOpFlags{{Addr: "0.0.0.0:6881", NodeID: "5fbfbff10c5d6a4ec8a88e4c6ab4c28b95eee401"}},
+			expectError: false,
+		},
+		{
+			name:        "ShortNodeID",
+			indexers:    []IndexerOpFlags{{Addr: "0.0.0.0:6881", NodeID: "5fbfbff10c5d6a4e"}},
+			expectError: true,
+		},
+		{
+			name:        "InvalidNodeID",
+			indexers:    []IndexerOpFlags{{Addr: "0.0.0.0:6881", NodeID: "not hexadecimal"}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &OpFlags{Indexers: tt.indexers}
+			if err := o.checkIndexers(); (err != nil) != tt.expectError {
+				t.Errorf("checkIndexers() error = %v, expectError %v", err, tt.expectError)
+			}
+		})
+	}
+}
+
+func TestCheckIndexers_Defaults(t *testing.T) {
+	t.Parallel()
+
+	config := `
+maxRPS: 500
+indexers:
+  - addr: "0.0.0.0:6881"
+    maxRPS: 5000
+  - addr: "10.0.0.1:6882"
+    maxRPS: 0
+    bootstrappingNodes: ["10.0.0.2:6881"]
+    filterNodesCIDRs: ["10.0.0.0/8"]
+    nodeID: "5fbfbff10c5d6a4ec8a88e4c6ab4c28b95eee401"
+`
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	o := &OpFlags{
+		ConfigFilePath:      path,
+		IndexerAddrs:        []string{"0.0.0.0:0"},
+		IndexerMaxNeighbors: 5000,
+		BootstrappingNodes:  []string{"router.example:6881"},
+	}
+	if err := o.parseYaml(); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.checkIndexers(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(o.Indexers) != 2 {
+		t.Fatalf("expected the 2 indexers of the config instead of the addresses, got %+v", o.Indexers)
+	}
+	public, private := o.Indexers[0], o.Indexers[1]
+	if *public.MaxRPS != 5000 || *private.MaxRPS != 0 {
+		t.Errorf("expected the rates of the indexers, got %d and %d", *public.MaxRPS, *private.MaxRPS)
+	}
+	if *public.MaxNeighbors != 5000 || *private.MaxNeighbors != 5000 {
+		t.Error("expected the global number of neighbours")
+	}
+	if len(public.BootstrappingNodes) != 1 || public.BootstrappingNodes[0] != "router.example:6881" {
+		t.Errorf("expected the global bootstrap nodes, got %v", public.BootstrappingNodes)
+	}
+	if len(public.FilterNodesIpNets) != 0 || len(private.FilterNodesIpNets) != 1 {
+		t.Errorf("expected only the second indexer to be filtered, got %v and %v", public.FilterNodesIpNets, private.FilterNodesIpNets)
+	}
+	if public.NodeIDBytes != nil || len(private.NodeIDBytes) != 20 {
+		t.Errorf("expected only the second indexer to have a fixed node ID, got %x and %x", public.NodeIDBytes, private.NodeIDBytes)
+	}
+}
@@ -3,6 +3,7 @@ package opflags
 import (
 	"errors"
 	"fmt"
+	"log"
 	"net"
 	"os"
 	"path/filepath"
@@ -15,14 +16,31 @@ type OpFlags struct {
 
 	IndexerAddrs        []string `long:"indexer-addr" description:"Address(es) to be used by indexing DHT nodes." default:"0.0.0.0:0" yaml:"indexerAddrs"`
 	IndexerMaxNeighbors uint     `long:"indexer-max-neighbors" description:"Maximum number of neighbors of an indexer." default:"5000" yaml:"indexerMaxNeighbors"`
-
-	LeechDeadline uint `long:"leech-deadline" description:"Deadline for leeches in seconds." default:"600" yaml:"leechDeadline"`
-	LeechMaxN     uint `long:"leech-max-n" description:"Maximum number of leeches." default:"1000" yaml:"leechMaxN"`
-	MaxRPS        uint `long:"max-rps" description:"Maximum requests per second." default:"500" yaml:"maxRPS"`
-
-	BootstrappingNodes []string `long:"bootstrap-node" description:"Host(s) to be used for bootstrapping." default:"dht.tgragnato.it:80" default:"dht.tgragnato.it:443" default:"dht.tgragnato.it:1337" default:"dht.tgragnato.it:6969" default:"dht.tgragnato.it:6881" default:"dht.tgragnato.it:25401" yaml:"bootstrappingNodes"`
+	IndexerGoodCitizen  bool     `long:"indexer-good-citizen" description:"Answer find_node and get_peers queries with the closest known nodes, instead of random ones." yaml:"indexerGoodCitizen"`
+	IndexerSockets      uint     `long:"indexer-sockets" description:"Number of sockets bound to the address of each indexer with SO_REUSEPORT." default:"1" yaml:"indexerSockets"`
+	IndexerWorkers      uint     `long:"indexer-workers" description:"Number of goroutines handling the messages of each indexer. Zero means one per CPU." default:"0" yaml:"indexerWorkers"`
+	// Indexers configure the indexers one by one, in the YAML config only. When there are none,
+	// an indexer is run on every address of IndexerAddrs with the global settings.
+	Indexers []IndexerOpFlags `yaml:"indexers"`
+
+	LeechDeadline  uint   `long:"leech-deadline" description:"Deadline for leeches in seconds." default:"600" yaml:"leechDeadline"`
+	LeechMaxN      uint   `long:"leech-max-n" description:"Maximum number of peers from which a torrent is leeched." default:"1000" yaml:"leechMaxN"`
+	LeechMaxActive uint   `long:"leech-max-active" description:"Maximum number of concurrent leeches. Zero sizes it to the file descriptor limit." default:"0" yaml:"leechMaxActive"`
+	LeechMaxPerIP  uint   `long:"leech-max-per-ip" description:"Maximum number of concurrent leeches connected to the same IP address. Zero means unlimited." default:"4" yaml:"leechMaxPerIP"`
+	LeechTransport string `long:"leech-transport" description:"Transport of the leeches: TCP then uTP, uTP then TCP, or both at once." choice:"tcp-first" choice:"utp-first" choice:"race" default:"tcp-first" yaml:"leechTransport"`
+
+	MaxRPS         uint `long:"max-rps" description:"Maximum queries per second sent by each indexer. Zero means unlimited." default:"500" yaml:"maxRPS"`
+	MaxResponseRPS uint `long:"max-response-rps" description:"Maximum responses per second sent by each indexer to the queries of other nodes. Zero means unlimited." default:"500" yaml:"maxResponseRPS"`
+	MaxNodeRPS     uint `long:"max-node-rps" description:"Maximum messages per second sent by each indexer to the same node. Zero means unlimited." default:"5" yaml:"maxNodeRPS"`
+	RateBurst      uint `long:"rate-burst" description:"Seconds for which the unused rate limits are saved up." default:"1" yaml:"rateBurst"`
+
+	ScrapeInterval uint `long:"scrape-interval" description:"Interval in seconds between two rounds of DHT scrapes of the stored torrents. Zero disables scraping." default:"60" yaml:"scrapeInterval"`
+	ScrapeN        uint `long:"scrape-n" description:"Number of stored torrents scraped at every round." default:"50" yaml:"scrapeN"`
+
+	BootstrappingNodes []string `long:"bootstrap-node" description:"Host(s) to be used for bootstrapping. Their addresses are cached for 30 minutes, whatever the TTL of their DNS records." default:"dht.tgragnato.it:80" default:"dht.tgragnato.it:443" default:"dht.tgragnato.it:1337" default:"dht.tgragnato.it:6969" default:"dht.tgragnato.it:6881" default:"dht.tgragnato.it:25401" yaml:"bootstrappingNodes"`
 	FilterNodesCIDRs   []string `long:"filter-nodes-cidrs" description:"List of CIDRs on which Magnetico can operate. Empty is open mode." default:"" yaml:"filterNodesCIDRs"`
 	FilterNodesIpNets  []net.IPNet
+	StatePath          string `long:"state-path" description:"Path of the file in which the DHT routing table is saved, to be restored at the next start. Empty disables it." default:"" yaml:"statePath"`
 
 	Addr            string `short:"a" long:"addr"        description:"Address (host:port) to serve on" default:"[::1]:8080" yaml:"addr"`
 	CredentialsPath string `short:"c" long:"credentials" description:"Path to the credentials file" default:"" yaml:"cred"`
@@ -31,6 +49,8 @@ type OpFlags struct {
 
 	RunDaemon bool `short:"d" long:"daemon" description:"Run the crawler without the web interface." yaml:"runDaemon"`
 	RunWeb    bool `short:"w" long:"web"    description:"Run the web interface without the crawler." yaml:"runWeb"`
+	// RunBootstrap is also set by the bootstrap command, as in `magnetico bootstrap`.
+	RunBootstrap bool `long:"bootstrap" description:"Run a DHT bootstrap node for the private network of --filter-nodes-cidrs, without the crawler and the web interface." yaml:"runBootstrap"`
 
 	Export string `short:"e" long:"export" description:"Export the database to the path." default:"" yaml:"export"`
 	Import string `short:"i" long:"import" description:"Import the database from the path." default:"" yaml:"import"`
@@ -38,7 +58,18 @@ type OpFlags struct {
 	ConfigFilePath string `long:"config-file-path" description:"Configuration YAML file path. If not filled in, it will default to disabled." default:""`
 }
 
+// defaultBootstrappingNodes are the default hosts of --bootstrap-node, which belong to the public DHT.
+var defaultBootstrappingNodes = []string{"dht.tgragnato.it:80", "dht.tgragnato.it:443", "dht.tgragnato.it:1337", "dht.tgragnato.it:6969", "dht.tgragnato.it:6881", "dht.tgragnato.it:25401"}
+
 func (o *OpFlags) check() error {
+	o.checkSockets()
+
+	if o.RunBootstrap {
+		o.RunDaemon = false
+		o.RunWeb = false
+		return o.checkBootstrap()
+	}
+
 	if !o.RunDaemon && !o.RunWeb {
 		o.RunDaemon = true
 		o.RunWeb = true
@@ -62,36 +93,70 @@ func (o *OpFlags) check() error {
 	}
 
 	if o.RunDaemon {
-		if err := o.checkAddrs(); err != nil {
+		if err := o.checkIndexers(); err != nil {
 			return err
 		}
-
-		if o.LeechMaxN > 1000 {
-			fmt.Println(
-				"Beware that on many systems max # of file descriptors per process is limited to 1024. " +
-					"Setting maximum number of leeches greater than 1k might cause \"too many open files\" errors!",
-			)
+		for _, indexer := range o.Indexers {
+			if len(indexer.FilterNodesIpNets) != 0 && reflect.DeepEqual(indexer.BootstrappingNodes, defaultBootstrappingNodes) {
+				return fmt.Errorf("you should specify your own internal bootstrapping nodes in filter mode")
+			}
 		}
+	}
 
-		o.FilterNodesIpNets = []net.IPNet{}
-		for _, cidr := range o.FilterNodesCIDRs {
-			if cidr == "" {
-				continue
-			}
-			if _, ipnet, err := net.ParseCIDR(cidr); err == nil {
-				o.FilterNodesIpNets = append(o.FilterNodesIpNets, *ipnet)
-			} else {
-				return fmt.Errorf("error while parsing CIDR %s: %s", cidr, err.Error())
-			}
+	return nil
+}
+
+// checkSockets clamps IndexerSockets to a single socket where SO_REUSEPORT is not available, as
+// the sockets could not share the address of the indexers.
+func (o *OpFlags) checkSockets() {
+	if o.IndexerSockets > 1 && !reusePort {
+		log.Printf("SO_REUSEPORT is not supported on this platform: binding a single socket instead of the %d of --indexer-sockets\n", o.IndexerSockets)
+		o.IndexerSockets = 1
+	}
+}
+
+// checkBootstrap checks the flags of the bootstrap mode, in which the indexers are the bootstrap
+// nodes. The other bootstrap nodes of the private network, if any, are given with
+// --bootstrap-node: the default hosts of the public DHT are dropped.
+func (o *OpFlags) checkBootstrap() error {
+	if err := o.checkIndexers(); err != nil {
+		return err
+	}
+	if o.StatePath == "" {
+		return errors.New("the bootstrap mode requires a state path, to keep the routing table across restarts")
+	}
+
+	for i := range o.Indexers {
+		indexer := &o.Indexers[i]
+		if udpAddr, _ := net.ResolveUDPAddr("udp", indexer.Addr); udpAddr.Port == 0 {
+			return fmt.Errorf("the bootstrap node %s should listen on a fixed port", indexer.Addr)
 		}
-		if len(o.FilterNodesIpNets) != 0 && reflect.DeepEqual(o.BootstrappingNodes, []string{"dht.tgragnato.it:80", "dht.tgragnato.it:443", "dht.tgragnato.it:1337", "dht.tgragnato.it:6969", "dht.tgragnato.it:6881", "dht.tgragnato.it:25401"}) {
-			return fmt.Errorf("you should specify your own internal bootstrapping nodes in filter mode")
+		if len(indexer.FilterNodesIpNets) == 0 {
+			return fmt.Errorf("the bootstrap node %s requires the CIDRs of the private network", indexer.Addr)
+		}
+		if reflect.DeepEqual(indexer.BootstrappingNodes, defaultBootstrappingNodes) {
+			indexer.BootstrappingNodes = nil
 		}
 	}
-
 	return nil
 }
 
+// parseCIDRs parses the CIDRs of a filter, skipping the empty ones.
+func parseCIDRs(cidrs []string) ([]net.IPNet, error) {
+	ipNets := []net.IPNet{}
+	for _, cidr := range cidrs {
+		if cidr == "" {
+			continue
+		}
+		if _, ipnet, err := net.ParseCIDR(cidr); err == nil {
+			ipNets = append(ipNets, *ipnet)
+		} else {
+			return nil, fmt.Errorf("error while parsing CIDR %s: %s", cidr, err.Error())
+		}
+	}
+	return ipNets, nil
+}
+
 func (o *OpFlags) checkAddrs() error {
 	if len(o.IndexerAddrs) == 0 || len(o.IndexerAddrs) == 1 && o.IndexerAddrs[0] == "" {
 		return errors.New("IndexerAddrs cannot be empty")
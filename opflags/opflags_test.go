@@ -125,6 +125,45 @@ func TestCheck(t *testing.T) {
 			},
 			expectError: false,
 		},
+		{
+			name: "RunBootstrap",
+			opFlags: OpFlags{
+				RunBootstrap:       true,
+				FilterNodesCIDRs:   []string{"192.168.1.0/24"},
+				BootstrappingNodes: defaultBootstrappingNodes,
+				IndexerAddrs:       []string{"0.0.0.0:6881"},
+				StatePath:          "state.json",
+			},
+			expectError: false,
+		},
+		{
+			name: "RunBootstrapOnRandomPort",
+			opFlags: OpFlags{
+				RunBootstrap:     true,
+				FilterNodesCIDRs: []string{"192.168.1.0/24"},
+				IndexerAddrs:     []string{"0.0.0.0:0"},
+				StatePath:        "state.json",
+			},
+			expectError: true,
+		},
+		{
+			name: "RunBootstrapInOpenMode",
+			opFlags: OpFlags{
+				RunBootstrap: true,
+				IndexerAddrs: []string{"0.0.0.0:6881"},
+				StatePath:    "state.json",
+			},
+			expectError: true,
+		},
+		{
+			name: "RunBootstrapWithoutStatePath",
+			opFlags: OpFlags{
+				RunBootstrap:     true,
+				FilterNodesCIDRs: []string{"192.168.1.0/24"},
+				IndexerAddrs:     []string{"0.0.0.0:6881"},
+			},
+			expectError: true,
+		},
 		{
 			name: "RunWithBothDaemonAndWebStopped",
 			opFlags: OpFlags{
@@ -145,3 +184,58 @@ func TestCheck(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckBootstrap(t *testing.T) {
+	t.Parallel()
+
+	opFlags := OpFlags{
+		RunBootstrap:       true,
+		RunDaemon:          true,
+		RunWeb:             true,
+		FilterNodesCIDRs:   []string{"192.168.1.0/24"},
+		BootstrappingNodes: defaultBootstrappingNodes,
+		IndexerAddrs:       []string{"0.0.0.0:6881"},
+		StatePath:          "state.json",
+	}
+	if err := opFlags.check(); err != nil {
+		t.Fatal(err)
+	}
+	if opFlags.RunDaemon || opFlags.RunWeb {
+		t.Error("expected the bootstrap mode to run neither the crawler nor the web interface")
+	}
+	if len(opFlags.Indexers) != 1 || len(opFlags.Indexers[0].FilterNodesIpNets) != 1 {
+		t.Fatalf("expected an indexer filtering the CIDRs, got %+v", opFlags.Indexers)
+	}
+	if opFlags.Indexers[0].BootstrappingNodes != nil {
+		t.Errorf("expected the public bootstrap hosts to be dropped, got %v", opFlags.Indexers[0].BootstrappingNodes)
+	}
+}
+
+func TestCheckSockets(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		sockets uint
+		want    uint
+	}{
+		{"Single", 1, 1},
+		{"Several", 4, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			opFlags := OpFlags{IndexerSockets: tt.sockets}
+			opFlags.checkSockets()
+			want := tt.want
+			if !reusePort {
+				want = 1
+			}
+			if opFlags.IndexerSockets != want {
+				t.Errorf("checkSockets() = %d sockets, want %d", opFlags.IndexerSockets, want)
+			}
+		})
+	}
+}
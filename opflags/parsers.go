@@ -8,21 +8,32 @@ import (
 )
 
 func (o *OpFlags) Parse() (err error) {
-	parser := flags.NewParser(o, flags.Default)
-	_, err = parser.Parse()
-	if err != nil {
+	if err = o.parse(os.Args[1:]); err != nil {
 		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
 			os.Exit(0)
 		}
 		return err
 	}
 
+	return o.check()
+}
+
+// parse parses the command line arguments, and then the YAML config that they point to, if any.
+func (o *OpFlags) parse(args []string) error {
+	parser := flags.NewParser(o, flags.Default)
+	args, err := parser.ParseArgs(args)
+	if err != nil {
+		return err
+	}
+
 	err = o.parseYaml()
 	if err != nil {
 		return err
 	}
 
-	return o.check()
+	// The command is applied last, as the YAML config sets runBootstrap too.
+	o.parseCommand(args)
+	return nil
 }
 
 func (o *OpFlags) parseYaml() error {
@@ -37,3 +48,10 @@ func (o *OpFlags) parseYaml() error {
 
 	return yaml.Unmarshal(data, o)
 }
+
+// parseCommand sets the mode selected by the command among the positional arguments, if any.
+func (o *OpFlags) parseCommand(args []string) {
+	if len(args) > 0 && args[0] == "bootstrap" {
+		o.RunBootstrap = true
+	}
+}
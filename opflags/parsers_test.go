@@ -37,3 +37,39 @@ func TestParseYaml(t *testing.T) {
 		})
 	}
 }
+
+func TestParseCommand(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		args []string
+		want bool
+	}{
+		{"NoCommand", nil, false},
+		{"Bootstrap", []string{"bootstrap"}, true},
+		{"UnknownCommand", []string{"crawl", "bootstrap"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &OpFlags{}
+			if o.parseCommand(tt.args); o.RunBootstrap != tt.want {
+				t.Errorf("OpFlags.parseCommand(%v) RunBootstrap = %v, want %v", tt.args, o.RunBootstrap, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse_BootstrapWithConfig(t *testing.T) {
+	t.Parallel()
+
+	// The example config sets runBootstrap to false, which the command overrides.
+	o := &OpFlags{}
+	if err := o.parse([]string{"bootstrap", "--config-file-path=../doc/config.example.yml"}); err != nil {
+		t.Fatal(err)
+	}
+	if !o.RunBootstrap {
+		t.Error("expected the bootstrap command to select the bootstrap mode over the config")
+	}
+}
@@ -0,0 +1,6 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package opflags
+
+// reusePort is whether several sockets can share the address of an indexer with SO_REUSEPORT.
+const reusePort = true
@@ -74,13 +74,19 @@ func (b *bitmagnet) DoesTorrentExist(infoHash []byte) (bool, error) {
 	return found, nil
 }
 
-func (b *bitmagnet) AddNewTorrent(infoHash []byte, name string, files []File) error {
+func (b *bitmagnet) AddNewTorrent(infoHash []byte, infoHashV2 []byte, name string, files []File) error {
 	totalSize := int64(0)
 	for _, file := range files {
 		totalSize += file.Size
 	}
+	// bitmagnet identifies torrents by their 20-byte infohash: v2-only torrents by the truncated
+	// one of the DHT.
+	dhtInfoHash := infoHash
+	if len(dhtInfoHash) > 20 {
+		dhtInfoHash = dhtInfoHash[:20]
+	}
 	data, err := json.Marshal(map[string]any{
-		"infoHash":    hex.EncodeToString(infoHash),
+		"infoHash":    hex.EncodeToString(dhtInfoHash),
 		"name":        name,
 		"size":        totalSize,
 		"publishedAt": time.Now().UTC().Format(time.RFC3339),
@@ -113,7 +119,9 @@ func (b *bitmagnet) AddNewTorrent(infoHash []byte, name string, files []File) er
 		log.Printf("Response: %s\n", string(body))
 	}
 
-	b.cache[string(infoHash)] = time.Now().Add(10 * time.Minute)
+	for _, key := range cacheKeys(infoHash, infoHashV2) {
+		b.cache[key] = time.Now().Add(10 * time.Minute)
+	}
 	return nil
 }
 
@@ -145,6 +153,10 @@ func (b *bitmagnet) GetStatistics(from string, n uint) (*Statistics, error) {
 	return nil, errors.New("statistics not supported")
 }
 
+func (b *bitmagnet) UpdateSwarm(infoHash []byte, nSeeders uint, nLeechers uint) error {
+	return errors.New("swarm update not supported")
+}
+
 func (b *bitmagnet) Export() (chan SimpleTorrentSummary, error) {
 	return nil, errors.New("export not supported")
 }
@@ -35,7 +35,7 @@ func Test_bitmagnet_AddNewTorrent(t *testing.T) {
 		{Size: 200},
 	}
 
-	err := b.AddNewTorrent(infoHash, name, files)
+	err := b.AddNewTorrent(infoHash, nil, name, files)
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
@@ -47,7 +47,7 @@ func Test_bitmagnet_AddNewTorrent(t *testing.T) {
 		t.Fatalf("expected torrent to be in cache")
 	}
 
-	err = b.AddNewTorrent(infoHash, name, files)
+	err = b.AddNewTorrent(infoHash, nil, name, files)
 	if err == nil || err.Error() != "torrent already exists" {
 		t.Fatalf("expected 'torrent already exists' error, got %v", err)
 	}
@@ -157,6 +157,21 @@ func Test_bitmagnet_GetStatistics(t *testing.T) {
 	}
 }
 
+func Test_bitmagnet_UpdateSwarm(t *testing.T) {
+	t.Parallel()
+
+	b := &bitmagnet{
+		url:        "",
+		debug:      true,
+		sourceName: "testsource",
+		cache:      map[string]time.Time{},
+		Mutex:      sync.Mutex{},
+	}
+	if err := b.UpdateSwarm([]byte("infoHash"), 1, 1); err == nil {
+		t.Error("bitmagnet.UpdateSwarm() error = nil, wanted error")
+	}
+}
+
 func Test_bitmagnet_Engine(t *testing.T) {
 	t.Parallel()
 
@@ -16,7 +16,11 @@ import (
 type Database interface {
 	Engine() databaseEngine
 	DoesTorrentExist(infoHash []byte) (bool, error)
-	AddNewTorrent(infoHash []byte, name string, files []File) error
+	// AddNewTorrent stores a torrent under its infoHash, the SHA-1 of the info dictionary of v1 and
+	// hybrid torrents or the SHA-256 of v2-only ones, and under the SHA-256 infoHashV2 of v2 and
+	// hybrid torrents, nil for v1 ones. The lookups by infohash accept either, the truncated
+	// 20-byte v2 infohash of the DHT included.
+	AddNewTorrent(infoHash []byte, infoHashV2 []byte, name string, files []File) error
 	Close() error
 
 	// GetNumberOfTorrents returns the number of torrents saved in the database. Might be an
@@ -45,6 +49,9 @@ type Database interface {
 	GetTorrent(infoHash []byte) (*TorrentMetadata, error)
 	GetFiles(infoHash []byte) ([]File, error)
 	GetStatistics(from string, n uint) (*Statistics, error)
+	// UpdateSwarm stores the number of seeders and leechers of the torrent of the given InfoHash,
+	// as estimated by a DHT scrape. Does nothing if the torrent does not exist in the database.
+	UpdateSwarm(infoHash []byte, nSeeders uint, nLeechers uint) error
 	// Export returns a channel that will be used to dump all the torrents in the database.
 	Export() (chan SimpleTorrentSummary, error)
 }
@@ -86,28 +93,45 @@ type File struct {
 
 type TorrentMetadata struct {
 	ID           uint64  `json:"id"`
-	InfoHash     []byte  `json:"infoHash"` // marshalled differently
+	InfoHash     []byte  `json:"infoHash"`             // marshalled differently
+	InfoHashV2   []byte  `json:"infoHashV2,omitempty"` // marshalled differently, nil for v1 torrents
 	Name         string  `json:"name"`
 	Size         uint64  `json:"size"`
 	DiscoveredOn int64   `json:"discoveredOn"`
 	NFiles       uint    `json:"nFiles"`
+	NSeeders     uint    `json:"nSeeders"`
+	NLeechers    uint    `json:"nLeechers"`
+	UpdatedOn    int64   `json:"updatedOn"`
 	Relevance    float64 `json:"relevance"`
 }
 
 type SimpleTorrentSummary struct {
-	InfoHash string `json:"infoHash"`
-	Name     string `json:"name"`
-	Files    []File `json:"files"`
+	InfoHash   string `json:"infoHash"`
+	InfoHashV2 string `json:"infoHashV2,omitempty"`
+	Name       string `json:"name"`
+	Files      []File `json:"files"`
+}
+
+// cacheKeys returns the keys under which the message queues remember a torrent that they have
+// published, for DoesTorrentExist to find it under any of the infohashes of the DHT.
+func cacheKeys(infoHash []byte, infoHashV2 []byte) []string {
+	keys := []string{string(infoHash)}
+	if len(infoHashV2) == 32 {
+		keys = append(keys, string(infoHashV2[:20]))
+	}
+	return keys
 }
 
 func (tm *TorrentMetadata) MarshalJSON() ([]byte, error) {
 	type Alias TorrentMetadata
 	return json.Marshal(&struct {
-		InfoHash string `json:"infoHash"`
+		InfoHash   string `json:"infoHash"`
+		InfoHashV2 string `json:"infoHashV2,omitempty"`
 		*Alias
 	}{
-		InfoHash: hex.EncodeToString(tm.InfoHash),
-		Alias:    (*Alias)(tm),
+		InfoHash:   hex.EncodeToString(tm.InfoHash),
+		InfoHashV2: hex.EncodeToString(tm.InfoHashV2),
+		Alias:      (*Alias)(tm),
 	})
 }
 
@@ -256,7 +280,14 @@ func MakeImport(db Database, path string, interruptChan chan os.Signal) error {
 				return fmt.Errorf("failed to decode infohash: %v", err)
 			}
 
-			if err := db.AddNewTorrent(infoHash, torrent.Name, torrent.Files); err != nil {
+			var infoHashV2 []byte
+			if torrent.InfoHashV2 != "" {
+				if infoHashV2, err = hex.DecodeString(torrent.InfoHashV2); err != nil {
+					return fmt.Errorf("failed to decode v2 infohash: %v", err)
+				}
+			}
+
+			if err := db.AddNewTorrent(infoHash, infoHashV2, torrent.Name, torrent.Files); err != nil {
 				log.Printf("failed to add torrent: %v\n", err.Error())
 			}
 		}
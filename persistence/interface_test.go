@@ -15,7 +15,7 @@ func TestTorrentMetadata_MarshalJSON(t *testing.T) {
 		InfoHash: []byte{1, 2, 3, 4, 5, 6},
 	}
 
-	expectedJSON := `{"infoHash":"010203040506","id":0,"name":"","size":0,"discoveredOn":0,"nFiles":0,"relevance":0}`
+	expectedJSON := `{"infoHash":"010203040506","id":0,"name":"","size":0,"discoveredOn":0,"nFiles":0,"nSeeders":0,"nLeechers":0,"updatedOn":0,"relevance":0}`
 
 	jsonData, err := tm.MarshalJSON()
 	if err != nil {
@@ -150,7 +150,7 @@ func TestMakeExport_WithContent_JSON(t *testing.T) {
 
 	db := newDb(t)
 	for _, st := range data {
-		if err := db.AddNewTorrent(infoHash, st.Name, st.Files); err != nil {
+		if err := db.AddNewTorrent(infoHash, nil, st.Name, st.Files); err != nil {
 			t.Fatalf("Failed to add torrent to database: %v", err)
 		}
 	}
@@ -20,6 +20,10 @@ import (
 	"tgragnato.it/magnetico/v2/stats"
 )
 
+// postgresInfoHashMatches is the condition on the torrent whose infohash, v2 infohash or v2
+// infohash truncated to 20 bytes is the first parameter of the query.
+const postgresInfoHashMatches = "(info_hash = $1 OR info_hash_v2 = $1 OR substring(info_hash_v2 from 1 for 20) = $1)"
+
 type postgresDatabase struct {
 	conn        *sql.DB
 	isCockroach bool
@@ -59,7 +63,7 @@ func (db *postgresDatabase) Engine() databaseEngine {
 }
 
 func (db *postgresDatabase) DoesTorrentExist(infoHash []byte) (bool, error) {
-	rows, err := db.conn.Query("SELECT 1 FROM torrents WHERE info_hash = $1;", infoHash)
+	rows, err := db.conn.Query("SELECT 1 FROM torrents WHERE "+postgresInfoHashMatches+";", infoHash)
 	if err != nil {
 		return false, err
 	}
@@ -73,7 +77,7 @@ func (db *postgresDatabase) DoesTorrentExist(infoHash []byte) (bool, error) {
 	return exists, nil
 }
 
-func (db *postgresDatabase) AddNewTorrent(infoHash []byte, name string, files []File) error {
+func (db *postgresDatabase) AddNewTorrent(infoHash []byte, infoHashV2 []byte, name string, files []File) error {
 	if !utf8.ValidString(name) {
 		go stats.GetInstance().IncNonUTF8()
 		// Returning nil so deferred tx.Rollback() will be called and transaction will be canceled.
@@ -110,12 +114,13 @@ func (db *postgresDatabase) AddNewTorrent(infoHash []byte, name string, files []
 	err = tx.QueryRow(`
 		INSERT INTO torrents (
 			info_hash,
+			info_hash_v2,
 			name,
 			total_size,
 			discovered_on
-		) VALUES ($1, $2, $3, $4)
+		) VALUES ($1, $2, $3, $4, $5)
 		RETURNING id;
-	`, infoHash, name, totalSize, time.Now().Unix()).Scan(&lastInsertId)
+	`, infoHash, infoHashV2, name, totalSize, time.Now().Unix()).Scan(&lastInsertId)
 	if err != nil {
 		return errors.New("tx.QueryRow (INSERT INTO torrents) " + err.Error())
 	}
@@ -256,10 +261,14 @@ func (db *postgresDatabase) QueryTorrents(
 		SELECT
 			id,
 			info_hash,
+			info_hash_v2,
 			name,
 			total_size,
 			discovered_on,
 			(SELECT COUNT(*) FROM files WHERE torrents.id = files.torrent_id) AS n_files,
+			COALESCE(n_seeders, 0),
+			COALESCE(n_leechers, 0),
+			COALESCE(updated_on, 0),
 			0
 		FROM torrents
 		WHERE
@@ -335,10 +344,14 @@ func (db *postgresDatabase) QueryTorrents(
 		err = rows.Scan(
 			&torrent.ID,
 			&torrent.InfoHash,
+			&torrent.InfoHashV2,
 			&torrent.Name,
 			&torrent.Size,
 			&torrent.DiscoveredOn,
 			&torrent.NFiles,
+			&torrent.NSeeders,
+			&torrent.NLeechers,
+			&torrent.UpdatedOn,
 			&torrent.Relevance,
 		)
 		if err != nil {
@@ -354,12 +367,13 @@ func (db *postgresDatabase) GetTorrent(infoHash []byte) (*TorrentMetadata, error
 	rows, err := db.conn.Query(`
 		SELECT
 			t.info_hash,
+			t.info_hash_v2,
 			t.name,
 			t.total_size,
 			t.discovered_on,
 			(SELECT COUNT(*) FROM files f WHERE f.torrent_id = t.id) AS n_files
 		FROM torrents t
-		WHERE t.info_hash = $1;`,
+		WHERE `+postgresInfoHashMatches+`;`,
 		infoHash,
 	)
 	if err != nil {
@@ -372,13 +386,27 @@ func (db *postgresDatabase) GetTorrent(infoHash []byte) (*TorrentMetadata, error
 	}
 
 	var tm TorrentMetadata
-	if err = rows.Scan(&tm.InfoHash, &tm.Name, &tm.Size, &tm.DiscoveredOn, &tm.NFiles); err != nil {
+	if err = rows.Scan(&tm.InfoHash, &tm.InfoHashV2, &tm.Name, &tm.Size, &tm.DiscoveredOn, &tm.NFiles); err != nil {
 		return nil, err
 	}
 
 	return &tm, nil
 }
 
+func (db *postgresDatabase) UpdateSwarm(infoHash []byte, nSeeders uint, nLeechers uint) error {
+	_, err := db.conn.Exec(`
+		UPDATE torrents
+		SET n_seeders = $2, n_leechers = $3, updated_on = $4
+		WHERE `+postgresInfoHashMatches+`;`,
+		infoHash, nSeeders, nLeechers, time.Now().Unix(),
+	)
+	if err != nil {
+		return errors.New("conn.Exec (UPDATE torrents) " + err.Error())
+	}
+
+	return nil
+}
+
 func (db *postgresDatabase) GetFiles(infoHash []byte) ([]File, error) {
 	rows, err := db.conn.Query(`
 		SELECT
@@ -389,7 +417,7 @@ func (db *postgresDatabase) GetFiles(infoHash []byte) ([]File, error) {
 			torrents t
 		WHERE
 			f.torrent_id = t.id AND
-			t.info_hash = $1;`,
+			`+postgresInfoHashMatches+`;`,
 		infoHash,
 	)
 	if err != nil {
@@ -615,14 +643,49 @@ func (db *postgresDatabase) setupDatabase() error {
 		if _, err := tx.Exec(migrationStmt); err != nil {
 			return errors.New("sql.Tx.Exec (v0 -> v1) " + err.Error())
 		}
+		fallthrough
+
+	case 1:
+		// Add the swarm columns filled in by DHT scrapes, and the indexes to sort by them.
+		log.Println("Updating database schema from 1 to 2... (this might take a while)")
+		_, err = tx.Exec(`
+				ALTER TABLE torrents ADD COLUMN IF NOT EXISTS updated_on INTEGER CHECK (updated_on > 0) DEFAULT NULL;
+				ALTER TABLE torrents ADD COLUMN IF NOT EXISTS n_seeders  INTEGER CHECK (n_seeders >= 0) DEFAULT NULL;
+				ALTER TABLE torrents ADD COLUMN IF NOT EXISTS n_leechers INTEGER CHECK (n_leechers >= 0) DEFAULT NULL;
+
+				CREATE INDEX IF NOT EXISTS idx_torrents_updated_on ON torrents ((COALESCE(updated_on, 0)));
+				CREATE INDEX IF NOT EXISTS idx_torrents_n_seeders  ON torrents ((COALESCE(n_seeders, 0)));
+				CREATE INDEX IF NOT EXISTS idx_torrents_n_leechers ON torrents ((COALESCE(n_leechers, 0)));
+
+				INSERT INTO migrations (schema_version) VALUES (2);
+			`)
+		if err != nil {
+			return errors.New("sql.Tx.Exec (v1 -> v2) " + err.Error())
+		}
+		fallthrough
+
+	case 2:
+		// Add the SHA-256 infohash of the v2 and hybrid torrents (BEP 52), indexed in full and
+		// truncated to the 20 bytes under which the DHT announces it.
+		log.Println("Updating database schema from 2 to 3... (this might take a while)")
+		_, err = tx.Exec(`
+				ALTER TABLE torrents ADD COLUMN IF NOT EXISTS info_hash_v2 bytea UNIQUE CHECK (info_hash_v2 IS NULL OR length(info_hash_v2) = 32) DEFAULT NULL;
+
+				CREATE INDEX IF NOT EXISTS idx_torrents_info_hash_v2_dht ON torrents ((substring(info_hash_v2 from 1 for 20)));
+
+				INSERT INTO migrations (schema_version) VALUES (3);
+			`)
+		if err != nil {
+			return errors.New("sql.Tx.Exec (v2 -> v3) " + err.Error())
+		}
 
 		// Uncomment for future migrations:
 		//	fallthrough
-		//case 2: // FROZEN.
-		//	log.Println("Updating database schema from 1 to 2... (this might take a while)")
-		//	_, err = tx.Exec(`INSERT INTO migrations (schema_version) VALUES (2);`)
+		//case 3: // FROZEN.
+		//	log.Println("Updating database schema from 3 to 4... (this might take a while)")
+		//	_, err = tx.Exec(`INSERT INTO migrations (schema_version) VALUES (4);`)
 		//	if err != nil {
-		//		return errors.New("sql.Tx.Exec (v1 -> v2) " + err.Error())
+		//		return errors.New("sql.Tx.Exec (v3 -> v4) " + err.Error())
 		//	}
 	}
 
@@ -660,6 +723,15 @@ func (db *postgresDatabase) orderOn(orderBy OrderingCriteria) string {
 	case ByNFiles:
 		return "n_files"
 
+	case ByNSeeders:
+		return "COALESCE(n_seeders, 0)"
+
+	case ByNLeechers:
+		return "COALESCE(n_leechers, 0)"
+
+	case ByUpdatedOn:
+		return "COALESCE(updated_on, 0)"
+
 	default:
 		panic(fmt.Sprintf("unknown orderBy: %v", orderBy))
 	}
@@ -678,7 +750,7 @@ func (db *postgresDatabase) executeTemplate(text string, data any, funcs templat
 
 func (db *postgresDatabase) Export() (chan SimpleTorrentSummary, error) {
 	out := make(chan SimpleTorrentSummary)
-	rows, err := db.conn.Query("SELECT info_hash, name, id FROM torrents;")
+	rows, err := db.conn.Query("SELECT info_hash, info_hash_v2, name, id FROM torrents;")
 	if err != nil {
 		return nil, err
 	}
@@ -687,11 +759,11 @@ func (db *postgresDatabase) Export() (chan SimpleTorrentSummary, error) {
 		defer close(out)
 		defer rows.Close()
 		for rows.Next() {
-			var infoHash []byte
+			var infoHash, infoHashV2 []byte
 			var name string
 			var id int64
 
-			err = rows.Scan(&infoHash, &name, &id)
+			err = rows.Scan(&infoHash, &infoHashV2, &name, &id)
 			if err != nil {
 				log.Fatalln("Error scanning row:", err.Error())
 			}
@@ -702,9 +774,10 @@ func (db *postgresDatabase) Export() (chan SimpleTorrentSummary, error) {
 			}
 
 			out <- SimpleTorrentSummary{
-				InfoHash: hex.EncodeToString(infoHash),
-				Name:     name,
-				Files:    files,
+				InfoHash:   hex.EncodeToString(infoHash),
+				InfoHashV2: hex.EncodeToString(infoHashV2),
+				Name:       name,
+				Files:      files,
 			}
 		}
 	}(out, rows)
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	mrand "math/rand/v2"
 	"reflect"
+	"regexp"
 	"testing"
 	"text/template"
 	"time"
@@ -14,6 +15,9 @@ import (
 	"github.com/DATA-DOG/go-sqlmock"
 )
 
+// infoHashMatches matches postgresInfoHashMatches in the expected queries.
+var infoHashMatches = regexp.QuoteMeta(postgresInfoHashMatches)
+
 func TestPostgresDatabase_ExecuteTemplate(t *testing.T) {
 	t.Parallel()
 
@@ -47,6 +51,9 @@ func TestPostgresDatabase_OrderOn(t *testing.T) {
 		{ByTotalSize, "total_size"},
 		{ByDiscoveredOn, "discovered_on"},
 		{ByNFiles, "n_files"},
+		{ByNSeeders, "COALESCE(n_seeders, 0)"},
+		{ByNLeechers, "COALESCE(n_leechers, 0)"},
+		{ByUpdatedOn, "COALESCE(updated_on, 0)"},
 	}
 
 	for _, tc := range testCases {
@@ -75,7 +82,7 @@ func TestDoesTorrentExist(t *testing.T) {
 	infohash := sha1.Sum(random[:])
 
 	rows := sqlmock.NewRows([]string{"1"}).AddRow("1")
-	mock.ExpectQuery("SELECT 1 FROM torrents WHERE info_hash = \\$1;").WithArgs(infohash[:]).WillReturnRows(rows)
+	mock.ExpectQuery("SELECT 1 FROM torrents WHERE " + infoHashMatches + ";").WithArgs(infohash[:]).WillReturnRows(rows)
 
 	db := &postgresDatabase{conn: conn}
 	found, err := db.DoesTorrentExist(infohash[:])
@@ -90,7 +97,7 @@ func TestDoesTorrentExist(t *testing.T) {
 	}
 
 	rows = sqlmock.NewRows([]string{"1"})
-	mock.ExpectQuery("SELECT 1 FROM torrents WHERE info_hash = \\$1;").WithArgs(infohash[:]).WillReturnRows(rows)
+	mock.ExpectQuery("SELECT 1 FROM torrents WHERE " + infoHashMatches + ";").WithArgs(infohash[:]).WillReturnRows(rows)
 	found, err = db.DoesTorrentExist(infohash[:])
 	if err != nil {
 		t.Error(err)
@@ -382,9 +389,9 @@ func TestPostgresDatabase_GetTorrent(t *testing.T) {
 	size := uint64(1024)
 	discoveredOn := time.Now().Unix()
 
-	rows := sqlmock.NewRows([]string{"info_hash", "name", "total_size", "discovered_on", "n_files"}).
-		AddRow(infohash[:], name, size, discoveredOn, 5)
-	mock.ExpectQuery("SELECT t.info_hash, t.name, t.total_size, t.discovered_on, \\(SELECT COUNT\\(\\*\\) FROM files f WHERE f.torrent_id = t.id\\) AS n_files FROM torrents t WHERE t.info_hash = \\$1;").
+	rows := sqlmock.NewRows([]string{"info_hash", "info_hash_v2", "name", "total_size", "discovered_on", "n_files"}).
+		AddRow(infohash[:], nil, name, size, discoveredOn, 5)
+	mock.ExpectQuery("SELECT t.info_hash, t.info_hash_v2, t.name, t.total_size, t.discovered_on, \\(SELECT COUNT\\(\\*\\) FROM files f WHERE f.torrent_id = t.id\\) AS n_files FROM torrents t WHERE " + infoHashMatches + ";").
 		WithArgs(infohash[:]).
 		WillReturnRows(rows)
 
@@ -418,8 +425,8 @@ func TestPostgresDatabase_GetTorrent(t *testing.T) {
 		t.Error(err)
 	}
 
-	rows = sqlmock.NewRows([]string{"info_hash", "name", "total_size", "discovered_on", "n_files"})
-	mock.ExpectQuery("SELECT t.info_hash, t.name, t.total_size, t.discovered_on, \\(SELECT COUNT\\(\\*\\) FROM files f WHERE f.torrent_id = t.id\\) AS n_files FROM torrents t WHERE t.info_hash = \\$1;").
+	rows = sqlmock.NewRows([]string{"info_hash", "info_hash_v2", "name", "total_size", "discovered_on", "n_files"})
+	mock.ExpectQuery("SELECT t.info_hash, t.info_hash_v2, t.name, t.total_size, t.discovered_on, \\(SELECT COUNT\\(\\*\\) FROM files f WHERE f.torrent_id = t.id\\) AS n_files FROM torrents t WHERE " + infoHashMatches + ";").
 		WithArgs(infohash[:]).
 		WillReturnRows(rows)
 
@@ -456,7 +463,7 @@ func TestPostgresDatabase_GetFiles(t *testing.T) {
 	rows := sqlmock.NewRows([]string{"size", "path"}).
 		AddRow(1024, "/path/to/file1").
 		AddRow(2048, "/path/to/file2")
-	mock.ExpectQuery("SELECT f.size, f.path FROM files f, torrents t WHERE f.torrent_id = t.id AND t.info_hash = \\$1;").
+	mock.ExpectQuery("SELECT f.size, f.path FROM files f, torrents t WHERE f.torrent_id = t.id AND " + infoHashMatches + ";").
 		WithArgs(infohash[:]).
 		WillReturnRows(rows)
 
@@ -487,7 +494,7 @@ func TestPostgresDatabase_GetFiles(t *testing.T) {
 	}
 
 	rows = sqlmock.NewRows([]string{"size", "path"})
-	mock.ExpectQuery("SELECT f.size, f.path FROM files f, torrents t WHERE f.torrent_id = t.id AND t.info_hash = \\$1;").
+	mock.ExpectQuery("SELECT f.size, f.path FROM files f, torrents t WHERE f.torrent_id = t.id AND " + infoHashMatches + ";").
 		WithArgs(infohash[:]).
 		WillReturnRows(rows)
 
@@ -592,17 +599,21 @@ func TestPostgresDatabase_QueryTorrents(t *testing.T) {
 	lastOrderedValue := float64(100)
 	lastID := uint64(5)
 
-	rows := sqlmock.NewRows([]string{"id", "info_hash", "name", "total_size", "discovered_on", "n_files", "relevance"}).
-		AddRow(1, []byte("infohash1"), "Torrent 1", uint64(1024), int64(1640995200), uint64(5), float64(0.5)).
-		AddRow(2, []byte("infohash2"), "Torrent 2", uint64(2048), int64(1641081600), uint64(10), float64(0.8))
+	rows := sqlmock.NewRows([]string{"id", "info_hash", "info_hash_v2", "name", "total_size", "discovered_on", "n_files", "n_seeders", "n_leechers", "updated_on", "relevance"}).
+		AddRow(1, []byte("infohash1"), nil, "Torrent 1", uint64(1024), int64(1640995200), uint64(5), uint64(0), uint64(0), int64(0), float64(0.5)).
+		AddRow(2, []byte("infohash2"), []byte("infohashv2"), "Torrent 2", uint64(2048), int64(1641081600), uint64(10), uint64(12), uint64(3), int64(1641168000), float64(0.8))
 	mock.ExpectQuery(`
 			SELECT
 				id,
 				info_hash,
+				info_hash_v2,
 				name,
 				total_size,
 				discovered_on,
 				\(SELECT COUNT\(\*\) FROM files WHERE torrents.id = files.torrent_id\) AS n_files,
+				COALESCE\(n_seeders, 0\),
+				COALESCE\(n_leechers, 0\),
+				COALESCE\(updated_on, 0\),
 				0
 			FROM torrents
 			WHERE
@@ -645,10 +656,14 @@ func TestPostgresDatabase_QueryTorrents(t *testing.T) {
 		{
 			ID:           2,
 			InfoHash:     []byte("infohash2"),
+			InfoHashV2:   []byte("infohashv2"),
 			Name:         "Torrent 2",
 			Size:         2048,
 			DiscoveredOn: 1641081600,
 			NFiles:       10,
+			NSeeders:     12,
+			NLeechers:    3,
+			UpdatedOn:    1641168000,
 			Relevance:    0.8,
 		},
 	}
@@ -662,15 +677,19 @@ func TestPostgresDatabase_QueryTorrents(t *testing.T) {
 		t.Error(err)
 	}
 
-	rows = sqlmock.NewRows([]string{"id", "info_hash", "name", "total_size", "discovered_on", "n_files", "relevance"})
+	rows = sqlmock.NewRows([]string{"id", "info_hash", "info_hash_v2", "name", "total_size", "discovered_on", "n_files", "n_seeders", "n_leechers", "updated_on", "relevance"})
 	mock.ExpectQuery(`
 			SELECT
 				id,
 				info_hash,
+				info_hash_v2,
 				name,
 				total_size,
 				discovered_on,
 				\(SELECT COUNT\(\*\) FROM files WHERE torrents.id = files.torrent_id\) AS n_files,
+				COALESCE\(n_seeders, 0\),
+				COALESCE\(n_leechers, 0\),
+				COALESCE\(updated_on, 0\),
 				0
 			FROM torrents
 			WHERE
@@ -705,6 +724,37 @@ func TestPostgresDatabase_QueryTorrents(t *testing.T) {
 	}
 }
 
+func TestPostgresDatabase_UpdateSwarm(t *testing.T) {
+	t.Parallel()
+
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	db := &postgresDatabase{conn: conn}
+	infoHash := []byte("infohash")
+
+	mock.ExpectExec("UPDATE torrents SET n_seeders = \\$2, n_leechers = \\$3, updated_on = \\$4 WHERE "+infoHashMatches+";").
+		WithArgs(infoHash, uint(10), uint(5), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := db.UpdateSwarm(infoHash, 10, 5); err != nil {
+		t.Error(err)
+	}
+
+	mock.ExpectExec("UPDATE torrents SET n_seeders = \\$2, n_leechers = \\$3, updated_on = \\$4 WHERE "+infoHashMatches+";").
+		WithArgs(infoHash, uint(10), uint(5), sqlmock.AnyArg()).
+		WillReturnError(fmt.Errorf("some error"))
+	if err := db.UpdateSwarm(infoHash, 10, 5); err == nil {
+		t.Error("Expected an error, but got nil")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestPostgresDatabase_AddNewTorrent(t *testing.T) {
 	t.Parallel()
 
@@ -717,6 +767,7 @@ func TestPostgresDatabase_AddNewTorrent(t *testing.T) {
 	db := &postgresDatabase{conn: conn}
 
 	infoHash := []byte("infohash")
+	infoHashV2 := []byte("infohash v2")
 	name := "Test Torrent"
 	files := []File{
 		{Size: 1024, Path: "/path/to/file1"},
@@ -724,19 +775,20 @@ func TestPostgresDatabase_AddNewTorrent(t *testing.T) {
 	}
 
 	mock.ExpectBegin()
-	mock.ExpectQuery("SELECT 1 FROM torrents WHERE info_hash = \\$1;").
+	mock.ExpectQuery("SELECT 1 FROM torrents WHERE " + infoHashMatches + ";").
 		WithArgs(infoHash).
 		WillReturnRows(sqlmock.NewRows([]string{"1"}))
 	mock.ExpectQuery(`
 		INSERT INTO torrents \(
 			info_hash,
+			info_hash_v2,
 			name,
 			total_size,
 			discovered_on
-		\) VALUES \(\$1, \$2, \$3, \$4\)
+		\) VALUES \(\$1, \$2, \$3, \$4, \$5\)
 		RETURNING id;
 	`).
-		WithArgs(infoHash, name, uint64(3072), sqlmock.AnyArg()).
+		WithArgs(infoHash, infoHashV2, name, uint64(3072), sqlmock.AnyArg()).
 		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
 	mock.ExpectExec("INSERT INTO files \\(torrent_id, size, path\\) VALUES \\(\\$1, \\$2, \\$3\\);").
 		WithArgs(1, 1024, "/path/to/file1").
@@ -746,7 +798,7 @@ func TestPostgresDatabase_AddNewTorrent(t *testing.T) {
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
-	err = db.AddNewTorrent(infoHash, name, files)
+	err = db.AddNewTorrent(infoHash, infoHashV2, name, files)
 	if err != nil {
 		t.Error(err)
 	}
@@ -863,6 +915,26 @@ func TestPostgresDatabase_SetupDatabase(t *testing.T) {
 			INSERT INTO migrations \(schema_version\) VALUES \(1\);
 	`).WillReturnResult(sqlmock.NewResult(0, 0))
 
+	mock.ExpectExec(`
+			ALTER TABLE torrents ADD COLUMN IF NOT EXISTS updated_on INTEGER CHECK \(updated_on > 0\) DEFAULT NULL;
+			ALTER TABLE torrents ADD COLUMN IF NOT EXISTS n_seeders  INTEGER CHECK \(n_seeders >= 0\) DEFAULT NULL;
+			ALTER TABLE torrents ADD COLUMN IF NOT EXISTS n_leechers INTEGER CHECK \(n_leechers >= 0\) DEFAULT NULL;
+
+			CREATE INDEX IF NOT EXISTS idx_torrents_updated_on ON torrents \(\(COALESCE\(updated_on, 0\)\)\);
+			CREATE INDEX IF NOT EXISTS idx_torrents_n_seeders  ON torrents \(\(COALESCE\(n_seeders, 0\)\)\);
+			CREATE INDEX IF NOT EXISTS idx_torrents_n_leechers ON torrents \(\(COALESCE\(n_leechers, 0\)\)\);
+
+			INSERT INTO migrations \(schema_version\) VALUES \(2\);
+	`).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	mock.ExpectExec(`
+			ALTER TABLE torrents ADD COLUMN IF NOT EXISTS info_hash_v2 bytea UNIQUE CHECK \(info_hash_v2 IS NULL OR length\(info_hash_v2\) = 32\) DEFAULT NULL;
+
+			CREATE INDEX IF NOT EXISTS idx_torrents_info_hash_v2_dht ON torrents \(\(substring\(info_hash_v2 from 1 for 20\)\)\);
+
+			INSERT INTO migrations \(schema_version\) VALUES \(3\);
+	`).WillReturnResult(sqlmock.NewResult(0, 0))
+
 	mock.ExpectCommit()
 
 	err = db.setupDatabase()
@@ -886,21 +958,21 @@ func TestPostgresDatabase_Export(t *testing.T) {
 
 	db := &postgresDatabase{conn: conn}
 
-	rows := sqlmock.NewRows([]string{"info_hash", "name", "id"}).
-		AddRow([]byte("infohash1"), "Torrent 1", 1).
-		AddRow([]byte("infohash2"), "Torrent 2", 2)
-	mock.ExpectQuery("SELECT info_hash, name, id FROM torrents;").WillReturnRows(rows)
+	rows := sqlmock.NewRows([]string{"info_hash", "info_hash_v2", "name", "id"}).
+		AddRow([]byte("infohash1"), nil, "Torrent 1", 1).
+		AddRow([]byte("infohash2"), []byte("infohash2 v2"), "Torrent 2", 2)
+	mock.ExpectQuery("SELECT info_hash, info_hash_v2, name, id FROM torrents;").WillReturnRows(rows)
 
 	filesRows1 := sqlmock.NewRows([]string{"size", "path"}).
 		AddRow(1024, "/path/to/file1").
 		AddRow(2048, "/path/to/file2")
-	mock.ExpectQuery("SELECT f.size, f.path FROM files f, torrents t WHERE f.torrent_id = t.id AND t.info_hash = \\$1;").
+	mock.ExpectQuery("SELECT f.size, f.path FROM files f, torrents t WHERE f.torrent_id = t.id AND " + infoHashMatches + ";").
 		WithArgs([]byte("infohash1")).
 		WillReturnRows(filesRows1)
 
 	filesRows2 := sqlmock.NewRows([]string{"size", "path"}).
 		AddRow(512, "/path/to/file3")
-	mock.ExpectQuery("SELECT f.size, f.path FROM files f, torrents t WHERE f.torrent_id = t.id AND t.info_hash = \\$1;").
+	mock.ExpectQuery("SELECT f.size, f.path FROM files f, torrents t WHERE f.torrent_id = t.id AND " + infoHashMatches + ";").
 		WithArgs([]byte("infohash2")).
 		WillReturnRows(filesRows2)
 
@@ -924,8 +996,9 @@ func TestPostgresDatabase_Export(t *testing.T) {
 			},
 		},
 		{
-			InfoHash: "696e666f6861736832",
-			Name:     "Torrent 2",
+			InfoHash:   "696e666f6861736832",
+			InfoHashV2: "696e666f6861736832207632",
+			Name:       "Torrent 2",
 			Files: []File{
 				{Size: 512, Path: "/path/to/file3"},
 			},
@@ -86,11 +86,12 @@ func (r *rabbitMQ) DoesTorrentExist(infoHash []byte) (bool, error) {
 	return found, nil
 }
 
-func (r *rabbitMQ) AddNewTorrent(infoHash []byte, name string, files []File) error {
+func (r *rabbitMQ) AddNewTorrent(infoHash []byte, infoHashV2 []byte, name string, files []File) error {
 	data, err := json.Marshal(SimpleTorrentSummary{
-		InfoHash: hex.EncodeToString(infoHash),
-		Name:     name,
-		Files:    files,
+		InfoHash:   hex.EncodeToString(infoHash),
+		InfoHashV2: hex.EncodeToString(infoHashV2),
+		Name:       name,
+		Files:      files,
 	})
 	if err != nil {
 		return errors.New("failed to encode metadata " + err.Error())
@@ -119,7 +120,9 @@ func (r *rabbitMQ) AddNewTorrent(infoHash []byte, name string, files []File) err
 		}),
 	)
 	if err == nil {
-		r.cache[string(infoHash)] = time.Now().Add(10 * time.Minute)
+		for _, key := range cacheKeys(infoHash, infoHashV2) {
+			r.cache[key] = time.Now().Add(10 * time.Minute)
+		}
 	}
 
 	return err
@@ -156,6 +159,10 @@ func (r *rabbitMQ) GetStatistics(from string, n uint) (*Statistics, error) {
 	return nil, errors.New("statistics not supported")
 }
 
+func (r *rabbitMQ) UpdateSwarm(infoHash []byte, nSeeders uint, nLeechers uint) error {
+	return errors.New("swarm update not supported")
+}
+
 func (r *rabbitMQ) Export() (chan SimpleTorrentSummary, error) {
 	return nil, errors.New("export not supported")
 }
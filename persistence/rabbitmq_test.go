@@ -117,6 +117,22 @@ func Test_rabbitmq_GetStatistics(t *testing.T) {
 	}
 }
 
+func Test_rabbitmq_UpdateSwarm(t *testing.T) {
+	t.Parallel()
+
+	r := &rabbitMQ{
+		url:       "",
+		conn:      nil,
+		ch:        nil,
+		dataQueue: nil,
+		cache:     map[string]time.Time{},
+		Mutex:     sync.Mutex{},
+	}
+	if err := r.UpdateSwarm([]byte("infoHash"), 1, 1); err == nil {
+		t.Error("rabbitmq.UpdateSwarm() error = nil, wanted error")
+	}
+}
+
 func Test_rabbitmq_Engine(t *testing.T) {
 	t.Parallel()
 
@@ -229,7 +245,7 @@ func Test_rabbitmq_AddNewTorrent(t *testing.T) {
 		cache:     map[string]time.Time{},
 		Mutex:     sync.Mutex{},
 	}
-	err := r.AddNewTorrent([]byte("exampleInfoHash"), "exampleName", []File{})
+	err := r.AddNewTorrent([]byte("exampleInfoHash"), nil, "exampleName", []File{})
 	if err == nil {
 		t.Error("rabbitmq.AddNewTorrent() error = nil, want error")
 	}
@@ -18,6 +18,10 @@ import (
 // Close your rows lest you get "database table is locked" error(s)!
 // See https://github.com/mattn/go-sqlite3/issues/2741
 
+// sqliteInfoHashMatches is the condition on the torrent whose infohash, v2 infohash or v2 infohash
+// truncated to 20 bytes is the first parameter of the query.
+const sqliteInfoHashMatches = "(info_hash = ?1 OR info_hash_v2 = ?1 OR substr(info_hash_v2, 1, 20) = ?1)"
+
 type sqlite3Database struct {
 	conn *sql.DB
 }
@@ -76,7 +80,7 @@ func (db *sqlite3Database) Engine() databaseEngine {
 }
 
 func (db *sqlite3Database) DoesTorrentExist(infoHash []byte) (bool, error) {
-	rows, err := db.conn.Query("SELECT 1 FROM torrents WHERE info_hash = ?;", infoHash)
+	rows, err := db.conn.Query("SELECT 1 FROM torrents WHERE "+sqliteInfoHashMatches+";", infoHash)
 	if err != nil {
 		return false, err
 	}
@@ -92,7 +96,7 @@ func (db *sqlite3Database) DoesTorrentExist(infoHash []byte) (bool, error) {
 	return exists, nil
 }
 
-func (db *sqlite3Database) AddNewTorrent(infoHash []byte, name string, files []File) error {
+func (db *sqlite3Database) AddNewTorrent(infoHash []byte, infoHashV2 []byte, name string, files []File) error {
 	tx, err := db.conn.Begin()
 	if err != nil {
 		return errors.New("conn.Begin " + err.Error())
@@ -153,12 +157,13 @@ func (db *sqlite3Database) AddNewTorrent(infoHash []byte, name string, files []F
 	res, err := tx.Exec(`
 		INSERT INTO torrents (
 			info_hash,
+			info_hash_v2,
 			name,
 			total_size,
 			discovered_on,
 			modified_on
-		) VALUES (?, ?, ?, ?, ?);
-	`, infoHash, name, totalSize, time.Now().Unix(), time.Now().Unix())
+		) VALUES (?, ?, ?, ?, ?, ?);
+	`, infoHash, infoHashV2, name, totalSize, time.Now().Unix(), time.Now().Unix())
 	if err != nil {
 		return errors.New("tx.Exec (INSERT OR REPLACE INTO torrents) " + err.Error())
 	}
@@ -282,10 +287,14 @@ func (db *sqlite3Database) QueryTorrents(
 	sqlQuery := executeTemplate(`
 		SELECT id 
              , info_hash
+             , info_hash_v2
 			 , name
 			 , total_size
 			 , discovered_on
 			 , (SELECT COUNT(*) FROM files WHERE torrents.id = files.torrent_id) AS n_files
+			 , COALESCE(n_seeders, 0)
+			 , COALESCE(n_leechers, 0)
+			 , COALESCE(updated_on, 0)
 	{{ if .DoJoin }}
 			 , idx.rank
 	{{ else }}
@@ -357,10 +366,14 @@ func (db *sqlite3Database) QueryTorrents(
 		err = rows.Scan(
 			&torrent.ID,
 			&torrent.InfoHash,
+			&torrent.InfoHashV2,
 			&torrent.Name,
 			&torrent.Size,
 			&torrent.DiscoveredOn,
 			&torrent.NFiles,
+			&torrent.NSeeders,
+			&torrent.NLeechers,
+			&torrent.UpdatedOn,
 			&torrent.Relevance,
 		)
 		if err != nil {
@@ -386,6 +399,17 @@ func orderOn(orderBy OrderingCriteria) string {
 	case ByNFiles:
 		return "n_files"
 
+	// Torrents that have never been scraped have NULL swarm columns, which would break the row
+	// value comparisons used for pagination.
+	case ByNSeeders:
+		return "COALESCE(n_seeders, 0)"
+
+	case ByNLeechers:
+		return "COALESCE(n_leechers, 0)"
+
+	case ByUpdatedOn:
+		return "COALESCE(updated_on, 0)"
+
 	default:
 		panic(fmt.Sprintf("unknown orderBy: %v", orderBy))
 	}
@@ -395,12 +419,13 @@ func (db *sqlite3Database) GetTorrent(infoHash []byte) (*TorrentMetadata, error)
 	rows, err := db.conn.Query(`
 		SELECT
 			info_hash,
+			info_hash_v2,
 			name,
 			total_size,
 			discovered_on,
 			(SELECT COUNT(*) FROM files WHERE torrent_id = torrents.id) AS n_files
 		FROM torrents
-		WHERE info_hash = ?`,
+		WHERE `+sqliteInfoHashMatches,
 		infoHash,
 	)
 	defer closeRows(rows)
@@ -413,16 +438,34 @@ func (db *sqlite3Database) GetTorrent(infoHash []byte) (*TorrentMetadata, error)
 	}
 
 	var tm TorrentMetadata
-	if err = rows.Scan(&tm.InfoHash, &tm.Name, &tm.Size, &tm.DiscoveredOn, &tm.NFiles); err != nil {
+	if err = rows.Scan(&tm.InfoHash, &tm.InfoHashV2, &tm.Name, &tm.Size, &tm.DiscoveredOn, &tm.NFiles); err != nil {
 		return nil, err
 	}
 
 	return &tm, nil
 }
 
+func (db *sqlite3Database) UpdateSwarm(infoHash []byte, nSeeders uint, nLeechers uint) error {
+	now := time.Now().Unix()
+	_, err := db.conn.Exec(`
+		UPDATE torrents
+		SET n_seeders   = ?2
+		  , n_leechers  = ?3
+		  , updated_on  = ?4
+		  , modified_on = MAX(modified_on, ?4)
+		WHERE `+sqliteInfoHashMatches+`;`,
+		infoHash, nSeeders, nLeechers, now,
+	)
+	if err != nil {
+		return errors.New("conn.Exec (UPDATE torrents) " + err.Error())
+	}
+
+	return nil
+}
+
 func (db *sqlite3Database) GetFiles(infoHash []byte) ([]File, error) {
 	rows, err := db.conn.Query(
-		"SELECT size, path FROM files, torrents WHERE files.torrent_id = torrents.id AND torrents.info_hash = ?;",
+		"SELECT size, path FROM files, torrents WHERE files.torrent_id = torrents.id AND "+sqliteInfoHashMatches+";",
 		infoHash)
 	defer closeRows(rows)
 	if err != nil {
@@ -686,6 +729,43 @@ func (db *sqlite3Database) setupDatabase() error {
 		if err != nil {
 			return errors.New("sql.Tx.Exec (v2 -> v3) " + err.Error())
 		}
+		fallthrough
+
+	case 3:
+		// Upgrade from user_version 3 to 4
+		// Changes:
+		//   * Added indices on `updated_on`, `n_seeders` and `n_leechers`, now filled in by DHT
+		//     scrapes, so that torrents can be ordered by them.
+		log.Println("Updating database schema from 3 to 4... (this might take a while)")
+		_, err = tx.Exec(`
+			CREATE INDEX updated_on_index ON torrents (COALESCE(updated_on, 0));
+			CREATE INDEX n_seeders_index  ON torrents (COALESCE(n_seeders, 0));
+			CREATE INDEX n_leechers_index ON torrents (COALESCE(n_leechers, 0));
+
+			PRAGMA user_version = 4;
+		`)
+		if err != nil {
+			return errors.New("sql.Tx.Exec (v3 -> v4) " + err.Error())
+		}
+		fallthrough
+
+	case 4:
+		// Upgrade from user_version 4 to 5
+		// Changes:
+		//   * Added `info_hash_v2`, the SHA-256 infohash of the v2 and hybrid torrents (BEP 52),
+		//     indexed in full and truncated to the 20 bytes under which the DHT announces it.
+		log.Println("Updating database schema from 4 to 5... (this might take a while)")
+		_, err = tx.Exec(`
+			ALTER TABLE torrents ADD COLUMN info_hash_v2 BLOB DEFAULT NULL CHECK (info_hash_v2 IS NULL OR length(info_hash_v2) = 32);
+
+			CREATE UNIQUE INDEX info_hash_v2_index ON torrents (info_hash_v2);
+			CREATE INDEX info_hash_v2_dht_index    ON torrents (substr(info_hash_v2, 1, 20));
+
+			PRAGMA user_version = 5;
+		`)
+		if err != nil {
+			return errors.New("sql.Tx.Exec (v4 -> v5) " + err.Error())
+		}
 	}
 
 	if err = tx.Commit(); err != nil {
@@ -721,7 +801,7 @@ func closeRows(rows *sql.Rows) {
 
 func (db *sqlite3Database) Export() (chan SimpleTorrentSummary, error) {
 	out := make(chan SimpleTorrentSummary)
-	rows, err := db.conn.Query("SELECT info_hash, name, id FROM torrents;")
+	rows, err := db.conn.Query("SELECT info_hash, info_hash_v2, name, id FROM torrents;")
 	if err != nil {
 		return nil, err
 	}
@@ -731,11 +811,11 @@ func (db *sqlite3Database) Export() (chan SimpleTorrentSummary, error) {
 		defer rows.Close()
 
 		for rows.Next() {
-			var infoHash []byte
+			var infoHash, infoHashV2 []byte
 			var name string
 			var id int64
 
-			if err := rows.Scan(&infoHash, &name, &id); err != nil {
+			if err := rows.Scan(&infoHash, &infoHashV2, &name, &id); err != nil {
 				return
 			}
 
@@ -745,9 +825,10 @@ func (db *sqlite3Database) Export() (chan SimpleTorrentSummary, error) {
 			}
 
 			out <- SimpleTorrentSummary{
-				InfoHash: hex.EncodeToString(infoHash),
-				Name:     name,
-				Files:    files,
+				InfoHash:   hex.EncodeToString(infoHash),
+				InfoHashV2: hex.EncodeToString(infoHashV2),
+				Name:       name,
+				Files:      files,
 			}
 		}
 	}(out, rows)
@@ -6,6 +6,7 @@ import (
 	"net/url"
 	"reflect"
 	"testing"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -172,7 +173,7 @@ func Test_sqlite3Database_AddNewTorrent(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if err := db.AddNewTorrent(tt.infoHash, tt.name, tt.files); (err != nil) != tt.wantErr {
+			if err := db.AddNewTorrent(tt.infoHash, nil, tt.name, tt.files); (err != nil) != tt.wantErr {
 				t.Errorf("sqlite3Database.AddNewTorrent() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -327,6 +328,76 @@ func Test_sqlite3Database_GetFiles(t *testing.T) {
 	}
 }
 
+func Test_sqlite3Database_UpdateSwarm(t *testing.T) {
+	t.Parallel()
+	db := newDb(t)
+
+	infoHash := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	if err := db.AddNewTorrent(infoHash, nil, "swarm", []File{{Size: 1, Path: "swarm"}}); err != nil {
+		t.Fatalf("sqlite3Database.AddNewTorrent() error = %v", err)
+	}
+
+	if err := db.UpdateSwarm(infoHash, 12, 3); err != nil {
+		t.Fatalf("sqlite3Database.UpdateSwarm() error = %v", err)
+	}
+	if err := db.UpdateSwarm([]byte{0}, 1, 1); err != nil {
+		t.Errorf("sqlite3Database.UpdateSwarm() on a missing torrent error = %v", err)
+	}
+
+	got, err := db.QueryTorrents("", time.Now().Unix()+1, ByNSeeders, false, 10, nil, nil)
+	if err != nil {
+		t.Fatalf("sqlite3Database.QueryTorrents() error = %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("sqlite3Database.QueryTorrents() returned %d torrents, want 1", len(got))
+	}
+	if got[0].NSeeders != 12 || got[0].NLeechers != 3 || got[0].UpdatedOn == 0 {
+		t.Errorf("sqlite3Database.QueryTorrents() = %+v, want 12 seeders and 3 leechers", got[0])
+	}
+}
+
+func Test_sqlite3Database_InfoHashV2(t *testing.T) {
+	t.Parallel()
+	db := newDb(t)
+
+	infoHash := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	infoHashV2 := make([]byte, 32)
+	for i := range infoHashV2 {
+		infoHashV2[i] = byte(100 + i)
+	}
+	if err := db.AddNewTorrent(infoHash, infoHashV2, "hybrid", []File{{Size: 1, Path: "hybrid"}}); err != nil {
+		t.Fatalf("sqlite3Database.AddNewTorrent() error = %v", err)
+	}
+
+	for _, lookup := range [][]byte{infoHash, infoHashV2, infoHashV2[:20]} {
+		if exists, err := db.DoesTorrentExist(lookup); !exists || err != nil {
+			t.Errorf("sqlite3Database.DoesTorrentExist(%x) = %v, %v, want true", lookup, exists, err)
+		}
+		if torrent, err := db.GetTorrent(lookup); torrent == nil || err != nil || !reflect.DeepEqual(torrent.InfoHash, infoHash) ||
+			!reflect.DeepEqual(torrent.InfoHashV2, infoHashV2) {
+			t.Errorf("sqlite3Database.GetTorrent(%x) = %+v, %v, want the hybrid torrent", lookup, torrent, err)
+		}
+		if files, err := db.GetFiles(lookup); len(files) != 1 || err != nil {
+			t.Errorf("sqlite3Database.GetFiles(%x) = %v, %v, want the file of the hybrid torrent", lookup, files, err)
+		}
+	}
+	if exists, _ := db.DoesTorrentExist(infoHashV2[:16]); exists {
+		t.Error("sqlite3Database.DoesTorrentExist() found a torrent by a prefix of its v2 infohash")
+	}
+
+	if err := db.UpdateSwarm(infoHashV2[:20], 7, 2); err != nil {
+		t.Fatalf("sqlite3Database.UpdateSwarm() error = %v", err)
+	}
+	got, err := db.QueryTorrents("", time.Now().Unix()+1, ByNSeeders, false, 10, nil, nil)
+	if err != nil || len(got) != 1 || got[0].NSeeders != 7 || got[0].NLeechers != 2 || !reflect.DeepEqual(got[0].InfoHashV2, infoHashV2) {
+		t.Errorf("sqlite3Database.QueryTorrents() = %+v, %v, want 7 seeders, 2 leechers and the v2 infohash", got, err)
+	}
+
+	if err := db.AddNewTorrent(infoHash[:19], make([]byte, 31), "invalid", []File{{Size: 1, Path: "invalid"}}); err == nil {
+		t.Error("sqlite3Database.AddNewTorrent() accepted a v2 infohash that is not 32 bytes long")
+	}
+}
+
 func Test_sqlite3Database_GetStatistics(t *testing.T) {
 	t.Parallel()
 	db := newDb(t)
@@ -425,7 +496,7 @@ func Test_sqlite3Database_Export(t *testing.T) {
 	infoHash1 := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
 	name1 := "Test Torrent 1"
 	files1 := []File{{Size: 100, Path: "file1.txt"}, {Size: 200, Path: "file2.txt"}}
-	err := db.AddNewTorrent(infoHash1, name1, files1)
+	err := db.AddNewTorrent(infoHash1, nil, name1, files1)
 	if err != nil {
 		t.Fatalf("Failed to add torrent: %v", err)
 	}
@@ -433,7 +504,7 @@ func Test_sqlite3Database_Export(t *testing.T) {
 	infoHash2 := []byte{21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34, 35, 36, 37, 38, 39, 40}
 	name2 := "Test Torrent 2"
 	files2 := []File{{Size: 300, Path: "file3.txt"}}
-	err = db.AddNewTorrent(infoHash2, name2, files2)
+	err = db.AddNewTorrent(infoHash2, nil, name2, files2)
 	if err != nil {
 		t.Fatalf("Failed to add torrent: %v", err)
 	}
@@ -63,11 +63,12 @@ func (instance *zeromq) DoesTorrentExist(infoHash []byte) (bool, error) {
 	return found, nil
 }
 
-func (instance *zeromq) AddNewTorrent(infoHash []byte, name string, files []File) error {
+func (instance *zeromq) AddNewTorrent(infoHash []byte, infoHashV2 []byte, name string, files []File) error {
 	data, err := json.Marshal(SimpleTorrentSummary{
-		InfoHash: hex.EncodeToString(infoHash),
-		Name:     name,
-		Files:    files,
+		InfoHash:   hex.EncodeToString(infoHash),
+		InfoHashV2: hex.EncodeToString(infoHashV2),
+		Name:       name,
+		Files:      files,
 	})
 	if err != nil {
 		return errors.New("failed to encode metadata " + err.Error())
@@ -79,7 +80,9 @@ func (instance *zeromq) AddNewTorrent(infoHash []byte, name string, files []File
 	if _, found := instance.cache[string(infoHash)]; found {
 		return errors.New("torrent already exists")
 	}
-	instance.cache[string(infoHash)] = time.Now().Add(10 * time.Minute)
+	for _, key := range cacheKeys(infoHash, infoHashV2) {
+		instance.cache[key] = time.Now().Add(10 * time.Minute)
+	}
 
 	_, err = instance.socket.SendMessage(data)
 	return err
@@ -121,6 +124,10 @@ func (instance *zeromq) GetStatistics(from string, n uint) (*Statistics, error)
 	return nil, errors.New("statistics not supported")
 }
 
+func (instance *zeromq) UpdateSwarm(infoHash []byte, nSeeders uint, nLeechers uint) error {
+	return errors.New("swarm update not supported")
+}
+
 func (instance *zeromq) Export() (chan SimpleTorrentSummary, error) {
 	return nil, errors.New("export not supported")
 }
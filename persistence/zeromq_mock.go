@@ -21,7 +21,7 @@ func (instance *zeromq) DoesTorrentExist(infoHash []byte) (bool, error) {
 	return false, nil
 }
 
-func (instance *zeromq) AddNewTorrent(infoHash []byte, name string, files []File) error {
+func (instance *zeromq) AddNewTorrent(infoHash []byte, infoHashV2 []byte, name string, files []File) error {
 	return errors.New("add not supported")
 }
 
@@ -61,6 +61,10 @@ func (instance *zeromq) GetStatistics(from string, n uint) (*Statistics, error)
 	return nil, errors.New("statistics not supported")
 }
 
+func (instance *zeromq) UpdateSwarm(infoHash []byte, nSeeders uint, nLeechers uint) error {
+	return errors.New("swarm update not supported")
+}
+
 func (instance *zeromq) Export() (chan SimpleTorrentSummary, error) {
 	return nil, errors.New("export not supported")
 }
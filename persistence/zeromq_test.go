@@ -24,7 +24,7 @@ func Test_zeromq_DoesTorrentExist(t *testing.T) {
 	}
 
 	infoHash := []byte("exampleInfoHash")
-	err = instance.AddNewTorrent(infoHash, "exampleName", []File{})
+	err = instance.AddNewTorrent(infoHash, nil, "exampleName", []File{})
 	if err != nil {
 		t.Errorf("zeromq.AddNewTorrent() error = %v, want nil", err)
 	}
@@ -161,6 +161,15 @@ func Test_zeromq_GetStatistics(t *testing.T) {
 	}
 }
 
+func Test_zeromq_UpdateSwarm(t *testing.T) {
+	t.Parallel()
+
+	instance := &zeromq{}
+	if err := instance.UpdateSwarm([]byte("infoHash"), 1, 1); err == nil {
+		t.Error("zeromq.UpdateSwarm() error = nil, wanted error")
+	}
+}
+
 func Test_zeromq_Engine(t *testing.T) {
 	t.Parallel()
 
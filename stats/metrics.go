@@ -25,6 +25,21 @@ func GetInstance() *Stats {
 				Name:      "bootstrap",
 				Help:      "Number of times the bootstrap process has been triggered",
 			}),
+			bootstrapQueries: prometheus.NewCounterVec(prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "bootstrap_queries",
+				Help:      "Number of queries sent by an indexer to bootstrap, by the source of the node",
+			}, []string{"indexer", "source"}),
+			bootstrapNodes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "bootstrap_nodes",
+				Help:      "Number of bootstrap nodes known to an indexer, by whether they ever answered",
+			}, []string{"indexer", "state"}),
+			bootstrapBackoff: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "bootstrap_backoff_seconds",
+				Help:      "Delay between the bootstrap rounds of an indexer while its routing table is empty",
+			}, []string{"indexer"}),
 			writeError: prometheus.NewCounter(prometheus.CounterOpts{
 				Namespace: namespace,
 				Name:      "write_error",
@@ -35,11 +50,21 @@ func GetInstance() *Stats {
 				Name:      "read_error",
 				Help:      "Number of times there was an error reading a message from the UDP socket",
 			}),
-			rtClearing: prometheus.NewCounter(prometheus.CounterOpts{
+			rtEviction: prometheus.NewCounter(prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "rt_eviction",
+				Help:      "Number of stale nodes that have been evicted from the routing table",
+			}),
+			rtQuarantine: prometheus.NewCounter(prometheus.CounterOpts{
 				Namespace: namespace,
-				Name:      "rt_clearing",
-				Help:      "Number of times the routing table has been cleared",
+				Name:      "rt_quarantine",
+				Help:      "Number of nodes that have been quarantined for their poor reputation",
 			}),
+			krpcErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "krpc_errors",
+				Help:      "Number of KRPC error messages received, by error code",
+			}, []string{"code"}),
 			nonUTF8: prometheus.NewCounter(prometheus.CounterOpts{
 				Namespace: namespace,
 				Name:      "non_utf8",
@@ -60,7 +85,50 @@ func GetInstance() *Stats {
 				Name:      "mse_encryption",
 				Help:      "Number of times a peer connection has been obfuscated with MSE",
 			}),
-			extensions: map[string]prometheus.Counter{},
+			coverage: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "keyspace_coverage",
+				Help:      "Fraction of the DHT keyspace sampled by an indexer in the last hour",
+			}, []string{"indexer"}),
+			dhtClients: prometheus.NewCounterVec(prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "dht_clients",
+				Help:      "Number of DHT nodes met, by client implementation",
+			}, []string{"client"}),
+			rateTokens: prometheus.NewCounterVec(prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "rate_tokens",
+				Help:      "Number of messages sent by an indexer, by the rate limit budget that they spent",
+			}, []string{"indexer", "budget"}),
+			rateDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "rate_dropped",
+				Help:      "Number of messages dropped by an indexer for exceeding the rate limits, by reason",
+			}, []string{"indexer", "reason"}),
+			externalAddr: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "external_address",
+				Help:      "External address of an indexer, as reported by the other DHT nodes",
+			}, []string{"indexer", "address"}),
+			leechQueue: prometheus.NewGauge(prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "leech_queue_depth",
+				Help:      "Number of torrents waiting for a leech",
+			}),
+			leechActive: prometheus.NewGauge(prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "leech_active",
+				Help:      "Number of leeches connected to a peer",
+			}),
+			leechWait: prometheus.NewHistogram(prometheus.HistogramOpts{
+				Namespace: namespace,
+				Name:      "leech_wait_seconds",
+				Help:      "Time that the torrents waited for a leech",
+				Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+			}),
+			extensions:    map[string]prometheus.Counter{},
+			clients:       map[string]uint64{},
+			externalAddrs: map[string]string{},
 		}
 	})
 	return instance
@@ -3,7 +3,9 @@ package stats
 import (
 	"fmt"
 	"regexp"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -12,12 +14,22 @@ import (
 type Stats struct {
 	// bootstrap represents the number of times the DHT has been bootstrapped.
 	bootstrap prometheus.Counter
+	// bootstrapQueries represents the number of queries sent by each indexer to bootstrap, by the source of the node.
+	bootstrapQueries *prometheus.CounterVec
+	// bootstrapNodes represents the number of bootstrap nodes known to each indexer, by whether they ever answered.
+	bootstrapNodes *prometheus.GaugeVec
+	// bootstrapBackoff represents the delay between the bootstrap rounds of each indexer, in seconds.
+	bootstrapBackoff *prometheus.GaugeVec
 	// writeError represents the number of times there was an error writing a message to the UDP socket.
 	writeError prometheus.Counter
 	// readError represents the number of times there was an error reading a message from the UDP socket.
 	readError prometheus.Counter
-	// rtClearing represents the number of times the routing table has been cleared.
-	rtClearing prometheus.Counter
+	// rtEviction represents the number of stale nodes that have been evicted from the routing table.
+	rtEviction prometheus.Counter
+	// rtQuarantine represents the number of nodes that have been quarantined for their poor reputation.
+	rtQuarantine prometheus.Counter
+	// krpcErrors represents the number of KRPC error messages received, by error code.
+	krpcErrors *prometheus.CounterVec
 	// nonUTF8 represents the number of times a torrent has been ignored due to its name not being UTF-8 compliant.
 	nonUTF8 prometheus.Counter
 	// checkError represents the number of times there was an error checking whether a torrent exists.
@@ -26,21 +38,61 @@ type Stats struct {
 	addError prometheus.Counter
 	// mseEncryption represents the number of times a peer connection has been obfuscated with mse.
 	mseEncryption prometheus.Counter
+	// coverage represents the fraction of the DHT keyspace sampled recently by each indexer.
+	coverage *prometheus.GaugeVec
+	// dhtClients represents the number of DHT nodes met, by the client implementation they run.
+	dhtClients *prometheus.CounterVec
+	// rateTokens represents the number of messages sent by each indexer, by the budget that they spent.
+	rateTokens *prometheus.CounterVec
+	// rateDropped represents the number of messages dropped by each indexer for exceeding the rate limits.
+	rateDropped *prometheus.CounterVec
+	// externalAddr reports the external address of each indexer, as agreed on by the other nodes.
+	externalAddr *prometheus.GaugeVec
+	// leechQueue represents the number of torrents waiting for a leech.
+	leechQueue prometheus.Gauge
+	// leechActive represents the number of leeches connected to a peer.
+	leechActive prometheus.Gauge
+	// leechWait represents the time that the torrents waited for a leech, in seconds.
+	leechWait prometheus.Histogram
 	// extensions represents the number of times a peer connection has been negotiated with a given extension set.
 	extensions map[string]prometheus.Counter
 
+	// clients and externalAddrs mirror dhtClients and externalAddr for DHTSummary.
+	clients       map[string]uint64
+	externalAddrs map[string]string
+
 	sync.Mutex
 }
 
+// DHTSummary describes the DHT as seen by the indexers: the client implementations of the nodes
+// that they met, and their external addresses.
+type DHTSummary struct {
+	Clients           map[string]uint64 `json:"clients"`
+	ExternalAddresses map[string]string `json:"externalAddresses"`
+}
+
 func (s *Stats) Collect(ch chan<- prometheus.Metric) {
 	s.bootstrap.Collect(ch)
+	s.bootstrapQueries.Collect(ch)
+	s.bootstrapNodes.Collect(ch)
+	s.bootstrapBackoff.Collect(ch)
 	s.writeError.Collect(ch)
 	s.readError.Collect(ch)
-	s.rtClearing.Collect(ch)
+	s.rtEviction.Collect(ch)
+	s.rtQuarantine.Collect(ch)
+	s.krpcErrors.Collect(ch)
 	s.nonUTF8.Collect(ch)
 	s.checkError.Collect(ch)
 	s.addError.Collect(ch)
 	s.mseEncryption.Collect(ch)
+	s.coverage.Collect(ch)
+	s.dhtClients.Collect(ch)
+	s.rateTokens.Collect(ch)
+	s.rateDropped.Collect(ch)
+	s.externalAddr.Collect(ch)
+	s.leechQueue.Collect(ch)
+	s.leechActive.Collect(ch)
+	s.leechWait.Collect(ch)
 
 	s.Lock()
 	defer s.Unlock()
@@ -58,6 +110,22 @@ func (s *Stats) IncBootstrap() {
 	s.bootstrap.Inc()
 }
 
+// IncBootstrapQuery counts a query sent by the indexer to bootstrap, to a node of the source.
+func (s *Stats) IncBootstrapQuery(indexer string, source string) {
+	s.bootstrapQueries.WithLabelValues(indexer, source).Inc()
+}
+
+// SetBootstrapNodes sets the number of bootstrap nodes of the indexer in the state: "answered" or
+// "silent".
+func (s *Stats) SetBootstrapNodes(indexer string, state string, count int) {
+	s.bootstrapNodes.WithLabelValues(indexer, state).Set(float64(count))
+}
+
+// SetBootstrapBackoff sets the delay between the bootstrap rounds of the indexer.
+func (s *Stats) SetBootstrapBackoff(indexer string, seconds float64) {
+	s.bootstrapBackoff.WithLabelValues(indexer).Set(seconds)
+}
+
 // IncUDPError increments the UDP error count in the Stats struct.
 // If the 'write' parameter is true, it increments the writeError count.
 // Otherwise, it increments the readError count.
@@ -69,9 +137,84 @@ func (s *Stats) IncUDPError(write bool) {
 	}
 }
 
-// IncRtClearing increments the rtClearing field of the Stats struct.
-func (s *Stats) IncRtClearing() {
-	s.rtClearing.Inc()
+// IncRtEviction increments the rtEviction field of the Stats struct.
+func (s *Stats) IncRtEviction() {
+	s.rtEviction.Inc()
+}
+
+// IncRtQuarantine increments the rtQuarantine field of the Stats struct.
+func (s *Stats) IncRtQuarantine() {
+	s.rtQuarantine.Inc()
+}
+
+// IncKRPCError counts a KRPC error message with the given code. The codes other than the ones of
+// BEP 5, which the remote nodes choose, are counted together, to bound the number of series.
+func (s *Stats) IncKRPCError(code int) {
+	s.krpcErrors.WithLabelValues(krpcErrorLabel(code)).Inc()
+}
+
+// krpcErrorLabel returns the label of a KRPC error code: the code itself for the ones of BEP 5,
+// from 201 to 204, and "other" for the rest.
+func krpcErrorLabel(code int) string {
+	if code < 201 || code > 204 {
+		return "other"
+	}
+	return strconv.Itoa(code)
+}
+
+// SetCoverage sets the fraction of the DHT keyspace sampled recently by the indexer.
+func (s *Stats) SetCoverage(indexer string, coverage float64) {
+	s.coverage.WithLabelValues(indexer).Set(coverage)
+}
+
+// IncDHTClient counts a DHT node running the client implementation.
+func (s *Stats) IncDHTClient(client string) {
+	s.dhtClients.WithLabelValues(client).Inc()
+
+	s.Lock()
+	defer s.Unlock()
+	s.clients[client]++
+}
+
+// IncRateToken counts a message sent by the indexer that spent a token of the budget.
+func (s *Stats) IncRateToken(indexer string, budget string) {
+	s.rateTokens.WithLabelValues(indexer, budget).Inc()
+}
+
+// IncRateDropped counts a message dropped by the indexer, with the reason: the budget that it
+// exceeded.
+func (s *Stats) IncRateDropped(indexer string, reason string) {
+	s.rateDropped.WithLabelValues(indexer, reason).Inc()
+}
+
+// SetExternalAddr records the external address of the indexer.
+func (s *Stats) SetExternalAddr(indexer string, addr string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if previous, ok := s.externalAddrs[indexer]; ok {
+		s.externalAddr.DeleteLabelValues(indexer, previous)
+	}
+	s.externalAddrs[indexer] = addr
+	s.externalAddr.WithLabelValues(indexer, addr).Set(1)
+}
+
+// DHTSummary returns a copy of the DHT clients and external addresses recorded so far.
+func (s *Stats) DHTSummary() DHTSummary {
+	s.Lock()
+	defer s.Unlock()
+
+	summary := DHTSummary{
+		Clients:           make(map[string]uint64, len(s.clients)),
+		ExternalAddresses: make(map[string]string, len(s.externalAddrs)),
+	}
+	for client, n := range s.clients {
+		summary.Clients[client] = n
+	}
+	for indexer, addr := range s.externalAddrs {
+		summary.ExternalAddresses[indexer] = addr
+	}
+	return summary
 }
 
 // IncNonUTF8 increments the nonUTF8 counter in the Stats struct.
@@ -90,6 +233,17 @@ func (s *Stats) IncDBError(add bool) {
 	}
 }
 
+// SetLeeches sets the number of torrents waiting for a leech, and the number of leeches running.
+func (s *Stats) SetLeeches(queued int, active int) {
+	s.leechQueue.Set(float64(queued))
+	s.leechActive.Set(float64(active))
+}
+
+// ObserveLeechWait records the time that a torrent waited for a leech.
+func (s *Stats) ObserveLeechWait(wait time.Duration) {
+	s.leechWait.Observe(wait.Seconds())
+}
+
 // IncLeech increments the leech statistics based on the provided 'peerExtensions'.
 func (s *Stats) IncLeech(peerExtensions [8]byte) {
 	s.mseEncryption.Inc()
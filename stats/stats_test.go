@@ -2,6 +2,7 @@ package stats
 
 import (
 	"testing"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -12,13 +13,25 @@ func TestCollect(t *testing.T) {
 	stats := GetInstance()
 
 	stats.IncBootstrap()
+	stats.IncBootstrapQuery("0.0.0.0:0", "dns")
+	stats.SetBootstrapNodes("0.0.0.0:0", "answered", 1)
+	stats.SetBootstrapBackoff("0.0.0.0:0", 2)
 	stats.IncUDPError(true)
 	stats.IncUDPError(false)
-	stats.IncRtClearing()
+	stats.IncRtEviction()
+	stats.IncRtQuarantine()
+	stats.IncKRPCError(202)
 	stats.IncNonUTF8()
 	stats.IncDBError(false)
 	stats.IncDBError(true)
 	stats.IncLeech([8]byte{})
+	stats.SetCoverage("0.0.0.0:0", 0.5)
+	stats.IncDHTClient("libtorrent")
+	stats.SetExternalAddr("0.0.0.0:0", "1.2.3.4")
+	stats.IncRateToken("0.0.0.0:0", "queries")
+	stats.IncRateDropped("0.0.0.0:0", "responses")
+	stats.SetLeeches(3, 2)
+	stats.ObserveLeechWait(time.Second)
 
 	ch := make(chan prometheus.Metric)
 	go func() {
@@ -31,8 +44,43 @@ func TestCollect(t *testing.T) {
 		count++
 	}
 
-	expectedCount := 9 // 8 counters + 1 extension counter
+	expectedCount := 22 // 9 counters + 3 bootstrap metrics + 1 KRPC error counter + 1 coverage gauge + 1 client counter + 2 rate limit counters + 1 address gauge + 3 leech metrics + 1 extension counter
 	if count != expectedCount {
 		t.Errorf("Expected %d metrics, but got %d", expectedCount, count)
 	}
 }
+
+func TestDHTSummary(t *testing.T) {
+	t.Parallel()
+
+	stats := GetInstance()
+	// The labels are the ones of TestCollect, which counts the metrics of the same singleton.
+	stats.IncDHTClient("libtorrent")
+	stats.IncDHTClient("libtorrent")
+	stats.SetExternalAddr("0.0.0.0:0", "1.2.3.4")
+
+	summary := stats.DHTSummary()
+	if summary.Clients["libtorrent"] < 2 {
+		t.Errorf("expected at least 2 libtorrent nodes, got %d", summary.Clients["libtorrent"])
+	}
+	if summary.ExternalAddresses["0.0.0.0:0"] != "1.2.3.4" {
+		t.Errorf("unexpected external addresses %v", summary.ExternalAddresses)
+	}
+
+	// The summary is a copy.
+	summary.Clients["libtorrent"] = 0
+	if stats.DHTSummary().Clients["libtorrent"] == 0 {
+		t.Error("expected the summary not to share its maps")
+	}
+}
+
+func TestKRPCErrorLabel(t *testing.T) {
+	t.Parallel()
+
+	tests := map[int]string{201: "201", 202: "202", 203: "203", 204: "204", 0: "other", 200: "other", 205: "other", -1: "other", 1 << 30: "other"}
+	for code, want := range tests {
+		if got := krpcErrorLabel(code); got != want {
+			t.Errorf("krpcErrorLabel(%d) = %q, want %q", code, got, want)
+		}
+	}
+}
@@ -1,11 +1,13 @@
 package web
 
 import (
+	"bytes"
 	"encoding/hex"
 	"encoding/xml"
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"tgragnato.it/magnetico/v2/persistence"
@@ -88,11 +90,7 @@ func feedHandler(w http.ResponseWriter, r *http.Request) {
 				URL  string `xml:"url,attr"`
 				Type string `xml:"type,attr"`
 			}{
-				URL: fmt.Sprintf(
-					"magnet:?xt=urn:btih:%s&dn=%s",
-					infohash,
-					torrent.Name,
-				),
+				URL:  magnetLink(torrent.InfoHash, torrent.InfoHashV2, torrent.Name),
 				Type: "application/x-bittorrent",
 			},
 		})
@@ -115,3 +113,18 @@ func feedHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// magnetLink returns the magnet link of a torrent: v1 torrents are identified by their btih, v2-only
+// torrents by the multihash of their SHA-256 infohash (BEP 9), and hybrid torrents by both.
+func magnetLink(infoHash []byte, infoHashV2 []byte, name string) string {
+	var xt []string
+	if len(infoHash) == 32 {
+		xt = append(xt, "urn:btmh:1220"+hex.EncodeToString(infoHash))
+	} else {
+		xt = append(xt, "urn:btih:"+hex.EncodeToString(infoHash))
+	}
+	if len(infoHashV2) == 32 && !bytes.Equal(infoHashV2, infoHash) {
+		xt = append(xt, "urn:btmh:1220"+hex.EncodeToString(infoHashV2))
+	}
+	return fmt.Sprintf("magnet:?xt=%s&dn=%s", strings.Join(xt, "&xt="), name)
+}
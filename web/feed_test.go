@@ -1,6 +1,8 @@
 package web
 
 import (
+	"bytes"
+	"encoding/hex"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -67,3 +69,43 @@ func TestFeedHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestMagnetLink(t *testing.T) {
+	t.Parallel()
+
+	v1 := bytes.Repeat([]byte{0xab}, 20)
+	v2 := bytes.Repeat([]byte{0xcd}, 32)
+	tests := []struct {
+		name       string
+		infoHash   []byte
+		infoHashV2 []byte
+		expected   string
+	}{
+		{
+			name:     "v1",
+			infoHash: v1,
+			expected: "magnet:?xt=urn:btih:" + hex.EncodeToString(v1) + "&dn=test",
+		},
+		{
+			name:       "Hybrid",
+			infoHash:   v1,
+			infoHashV2: v2,
+			expected: "magnet:?xt=urn:btih:" + hex.EncodeToString(v1) +
+				"&xt=urn:btmh:1220" + hex.EncodeToString(v2) + "&dn=test",
+		},
+		{
+			name:       "v2-only",
+			infoHash:   v2,
+			infoHashV2: v2,
+			expected:   "magnet:?xt=urn:btmh:1220" + hex.EncodeToString(v2) + "&dn=test",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := magnetLink(tt.infoHash, tt.infoHashV2, "test"); got != tt.expected {
+				t.Errorf("magnetLink() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
@@ -63,6 +63,7 @@ func makeRouter() *http.ServeMux {
 	router.HandleFunc("/metrics", middlewares(stats.MakePrometheusHandler()))
 
 	router.HandleFunc("GET /api/v0.1/statistics", middlewares(apiStatistics))
+	router.HandleFunc("GET /api/v0.1/dht", middlewares(apiDHT))
 	router.HandleFunc("GET /api/v0.1/torrents", middlewares(apiTorrents))
 	router.HandleFunc("GET /api/v0.1/torrentstotal", middlewares(apiTorrentsTotal))
 	router.HandleFunc("GET /api/v0.1/torrents/{infohash}", middlewares(infohashMiddleware(apiTorrent)))
@@ -24,6 +24,15 @@ function fileSize(fileSizeInBytes) {
     return Math.max(fileSizeInBytes, 0.1).toFixed(1) + byteUnits[i];
 }
 
+// magnetLink mirrors magnetLink in feed.go: v1 torrents are identified by their btih, v2-only
+// torrents by the multihash of their SHA-256 infohash (BEP 9), and hybrid torrents by both.
+function magnetLink(infoHash, infoHashV2, name) {
+    let xt = [infoHash.length === 64 ? "urn:btmh:1220" + infoHash : "urn:btih:" + infoHash];
+    if (infoHashV2 && infoHashV2 !== infoHash)
+        xt.push("urn:btmh:1220" + infoHashV2);
+    return "magnet:?xt=" + xt.join("&xt=") + "&dn=" + name;
+}
+
 function humaniseDate(unixTime) {
     return (new Date(unixTime * 1000)).toLocaleDateString("en-GB", {
         day: "2-digit",
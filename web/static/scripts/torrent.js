@@ -18,6 +18,7 @@ window.onload = function () {
         document.querySelector("main").innerHTML = Mustache.render(template, {
             name: x.name,
             infoHash: x.infoHash,
+            magnet: magnetLink(x.infoHash, x.infoHashV2, x.name),
             sizeHumanised: fileSize(x.size),
             discoveredOn: humaniseDate(x.discoveredOn),
             nFiles: x.nFiles,
@@ -54,10 +54,10 @@ function setOrderBy(x) {
 function orderedValue(torrent) {
     if      (orderBy === "TOTAL_SIZE")    return torrent.size;
     else if (orderBy === "DISCOVERED_ON") return torrent.discoveredOn;
-    else if (orderBy === "UPDATED_ON")    alert("implement it server side first!");
+    else if (orderBy === "UPDATED_ON")    return torrent.updatedOn;
     else if (orderBy === "N_FILES")       return torrent.nFiles;
-    else if (orderBy === "N_SEEDERS")     alert("implement it server side first!");
-    else if (orderBy === "N_LEECHERS")    alert("implement it server side first!");
+    else if (orderBy === "N_SEEDERS")     return torrent.nSeeders;
+    else if (orderBy === "N_LEECHERS")    return torrent.nLeechers;
     else if (orderBy === "RELEVANCE")     return torrent.relevance;
 }
 
@@ -105,6 +105,7 @@ function load() {
         for (let t of torrents) {
             t.size = fileSize(t.size);
             t.discoveredOn = humaniseDate(t.discoveredOn);
+            t.magnet = magnetLink(t.infoHash, t.infoHashV2, t.name);
 
             ul.innerHTML += Mustache.render(template, t);
         }
@@ -8,6 +8,7 @@ import (
 	g "maragu.dev/gomponents"
 	c "maragu.dev/gomponents/components"
 	. "maragu.dev/gomponents/html"
+	"tgragnato.it/magnetico/v2/stats"
 )
 
 func statistics() g.Node {
@@ -131,3 +132,12 @@ func apiStatistics(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 	}
 }
+
+// apiDHT summarises the DHT client implementations met by the indexers, and their external
+// addresses as reported by the other nodes.
+func apiDHT(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(ContentType, ContentTypeJson)
+	if err := json.NewEncoder(w).Encode(stats.GetInstance().DHTSummary()); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
@@ -2,9 +2,12 @@ package web
 
 import (
 	"bytes"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	"tgragnato.it/magnetico/v2/stats"
 )
 
 func TestStatistics(t *testing.T) {
@@ -108,3 +111,35 @@ func TestAPIStatistics(t *testing.T) {
 		})
 	}
 }
+
+func TestAPIDHT(t *testing.T) {
+	t.Parallel()
+
+	stats.GetInstance().IncDHTClient("libtorrent")
+
+	req, err := http.NewRequest("GET", "/api/v0.1/dht", nil)
+	if err != nil {
+		t.Fatalf("could not create request: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	http.HandlerFunc(apiDHT).ServeHTTP(rec, req)
+
+	res := rec.Result()
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("expected status OK; got %v", res.Status)
+	}
+	if contentType := res.Header.Get("Content-Type"); contentType != ContentTypeJson {
+		t.Errorf("expected Content-Type application/json; got %v", contentType)
+	}
+
+	var summary stats.DHTSummary
+	if err := json.NewDecoder(res.Body).Decode(&summary); err != nil {
+		t.Fatalf("could not decode the summary: %v", err)
+	}
+	if summary.Clients["libtorrent"] == 0 {
+		t.Errorf("expected libtorrent among the clients, got %v", summary.Clients)
+	}
+}
@@ -34,7 +34,7 @@ func torrents() g.Node {
 					Div(
 						H3(A(Href("/torrents/{{ infoHash }}"), g.Text("{{ name }}"))),
 						A(
-							Href("magnet:?xt=urn:btih:{{ infoHash }}&dn={{ name }}"),
+							Href("{{ magnet }}"),
 							Img(
 								Src("/static/assets/magnet.gif"),
 								Alt("Magnet link")),